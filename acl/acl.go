@@ -0,0 +1,133 @@
+// The acl package implements access control lists that grant a
+// permission to a principal on a set of resources, such as
+// "user alice may edit document 42".
+// A principal is a username, a role in the form @rolename, or "*" for
+// any authenticated user. A resource is a slash-separated name chosen by
+// the application, such as "doc/42", and a grant applies to the resources
+// matching its pattern, as described for MatchResource.
+package acl
+
+import (
+  "fmt"
+  "path"
+  "strings"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+// AnyPrincipal is the principal that matches every user.
+const AnyPrincipal = "*"
+
+// A Grant gives a permission to a principal on the matching resources.
+type Grant struct {
+  Principal string
+  Permission permissions.Permission
+  Resource string        // A resource pattern.
+}
+
+// The Store interface is used to load and save our grants.
+type Store interface {
+  Load() error           // Load our data before other operations
+  Save() error           // Save our data after other operations
+  Grants() ([]*Grant, error)    // Retrieve all grants
+  AddGrant(g *Grant) error      // Add a grant, if not already present
+  RemoveGrant(g *Grant) error   // Remove a grant
+}
+
+// A Subject is the user whose access is being checked. It is
+// satisfied by *users.User.
+type Subject interface {
+  Id() string
+  HasPermission(perm permissions.Permission) bool
+}
+
+func (g *Grant) String() string {
+  return fmt.Sprintf("%s:%s:%s", g.Principal, g.Permission, g.Resource)
+}
+
+// AppliesTo returns true if the grant's principal matches the subject.
+func (g *Grant) AppliesTo(subject Subject) bool {
+  if g.Principal == AnyPrincipal || g.Principal == subject.Id() {
+    return true
+  }
+  if _, isRole := permissions.RoleName(permissions.Permission(g.Principal)); isRole {
+    return subject.HasPermission(permissions.Permission(g.Principal))
+  }
+  return false
+}
+
+// Gives returns true if the grant gives perm on resource, without
+// looking at the principal. The grant's permission may use wildcards
+// and implications in the same way as for permissions.Permissions.
+func (g *Grant) Gives(perm permissions.Permission, resource string) bool {
+  if !MatchResource(g.Resource, resource) {
+    return false
+  }
+  return permissions.FromString(string(g.Permission)).HasPermission(perm)
+}
+
+// MatchResource returns true if the resource matches the pattern.
+// A pattern of "*" matches every resource, a pattern ending in "/**"
+// matches every resource below that point, and otherwise the pattern
+// is matched as by path.Match, so "doc/*" matches "doc/42" but not
+// "doc/42/draft".
+// Both are cleaned as by path.Clean first, so that a resource taken
+// from a request path such as "/admin/../secret" or "//secret" is
+// matched as "/secret".
+func MatchResource(pattern, resource string) bool {
+  if pattern == "*" || pattern == "**" {
+    return true
+  }
+  pattern = path.Clean(pattern)
+  resource = path.Clean(resource)
+  if strings.HasSuffix(pattern, "/**") {
+    // Match if any proper ancestor of the resource matches the base.
+    base := strings.TrimSuffix(pattern, "/**")
+    for i := range resource {
+      if resource[i] == '/' {
+        if ok, err := path.Match(base, resource[:i]); err == nil && ok {
+          return true
+        }
+      }
+    }
+    return false
+  }
+  ok, err := path.Match(pattern, resource)
+  return err == nil && ok
+}
+
+// Allowed returns true if some grant in the store gives the subject
+// perm on resource.
+func Allowed(s Store, subject Subject, perm permissions.Permission, resource string) (bool, error) {
+  grants, err := s.Grants()
+  if err != nil {
+    return false, err
+  }
+  for _, g := range grants {
+    if g.AppliesTo(subject) && g.Gives(perm, resource) {
+      return true, nil
+    }
+  }
+  return false, nil
+}
+
+// canonicalGrant returns g with its principal in canonical form under
+// the username policy p, or g itself if that is unchanged.
+func canonicalGrant(p *users.UsernamePolicy, g *Grant) *Grant {
+  principal := p.CanonicalPrincipal(g.Principal)
+  if principal == g.Principal {
+    return g
+  }
+  cg := *g
+  cg.Principal = principal
+  return &cg
+}
+
+// checkGrant returns an error if any field of the grant is empty.
+func checkGrant(g *Grant) error {
+  if g.Principal == "" || g.Permission == permissions.NoPermission || g.Resource == "" {
+    return fmt.Errorf("grant %v must have a principal, permission and resource", g)
+  }
+  return nil
+}
@@ -0,0 +1,147 @@
+package acl
+
+import (
+  "errors"
+  "testing"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+func TestMatchResource(t *testing.T) {
+  tests := []struct{
+    pattern, resource string
+    match bool
+  }{
+    {"*", "doc/42", true},
+    {"**", "doc/42/x", true},
+    {"doc/42", "doc/42", true},
+    {"doc/42", "doc/43", false},
+    {"doc/*", "doc/42", true},
+    {"doc/*", "doc/42/draft", false},
+    {"doc/*", "img/42", false},
+    {"doc/**", "doc/42", true},
+    {"doc/**", "doc/42/draft", true},
+    {"doc/**", "doc", false},
+    {"doc/**", "docs/42", false},
+    {"proj/*/files/**", "proj/a/files/x/y", true},
+    {"proj/*/files/**", "proj/a/other/x", false},
+    {"doc/[", "doc/[", false},
+    {"/secret/*", "/admin/../secret/x", true},
+    {"/secret/*", "//secret/x", true},
+    {"/secret/**", "/public/../secret/a/b", true},
+    {"/secret/x", "/secret/./x/", true},
+    {"//secret/*", "/secret/x", true},
+    {"/public/*", "/public/../secret", false},
+  }
+  for _, tt := range tests {
+    if got := MatchResource(tt.pattern, tt.resource); got != tt.match {
+      t.Errorf("MatchResource(%q, %q): got %v, want %v", tt.pattern, tt.resource, got, tt.match)
+    }
+  }
+}
+
+func TestAllowed(t *testing.T) {
+  f := NewFile("testdata/acl1.txt")
+  if err := f.Load(); err != nil {
+    t.Fatalf("error loading acl file: %v", err)
+  }
+  roles := permissions.NewRoles()
+  roles.SetRole("editor", permissions.FromString("something"))
+  editorPerms := permissions.FromString("@editor")
+  editorPerms.SetRoles(roles)
+  alice := users.NewUser("alice", "", nil)
+  bob := users.NewUser("bob", "", nil)
+  carol := users.NewUser("carol", "", editorPerms)
+  tests := []struct{
+    user *users.User
+    perm permissions.Permission
+    resource string
+    allowed bool
+  }{
+    {alice, "edit", "doc/42", true},
+    {alice, "edit", "doc/43", false},
+    {alice, "read", "doc/43", true},
+    {alice, "read", "doc/43/draft", false},
+    {bob, "edit", "doc/42", false},
+    {bob, "docs:edit", "proj/p1/files/a", true},
+    {bob, "docs:edit", "proj/p1/a", false},
+    {carol, "edit", "doc/7/draft", true},
+    {carol, "delete", "doc/7", false},
+  }
+  for _, tt := range tests {
+    got, err := Allowed(f, tt.user, tt.perm, tt.resource)
+    if err != nil {
+      t.Errorf("Allowed(%s, %s, %s): unexpected error %v", tt.user.Id(), tt.perm, tt.resource, err)
+    }
+    if got != tt.allowed {
+      t.Errorf("Allowed(%s, %s, %s): got %v, want %v", tt.user.Id(), tt.perm, tt.resource, got, tt.allowed)
+    }
+  }
+}
+
+func TestUsernamePolicy(t *testing.T) {
+  f := NewFile("testdata/acl1.txt")
+  if err := f.Load(); err != nil {
+    t.Fatalf("error loading acl file: %v", err)
+  }
+  if err := f.AddGrant(&Grant{"Carol", "edit", "doc/1"}); err != nil {
+    t.Fatalf("error adding grant: %v", err)
+  }
+  f.SetUsernamePolicy(users.NewUsernamePolicy())
+  if err := f.AddGrant(&Grant{"DAVE", "edit", "doc/2"}); err != nil {
+    t.Fatalf("error adding grant: %v", err)
+  }
+  carol := users.NewUser("carol", "", nil)
+  dave := users.NewUser("dave", "", nil)
+  if allowed, _ := Allowed(f, carol, "edit", "doc/1"); !allowed {
+    t.Errorf("grant for Carol should apply to carol")
+  }
+  if allowed, _ := Allowed(f, dave, "edit", "doc/2"); !allowed {
+    t.Errorf("grant for DAVE should apply to dave")
+  }
+  if err := f.RemoveGrant(&Grant{"Dave", "edit", "doc/2"}); err != nil {
+    t.Errorf("error removing grant by non-canonical principal: %v", err)
+  }
+  grants, _ := f.Grants()
+  if got, want := grants[1].Principal, "@editor"; got != want {
+    t.Errorf("role principal: got %q, want %q", got, want)
+  }
+}
+
+// testStore runs the Store operations against an empty store.
+// It is shared by the tests for each of our Store implementations.
+func testStore(t *testing.T, s Store) {
+  t.Helper()
+  g1 := &Grant{"alice", "edit", "doc/42"}
+  g2 := &Grant{"@editor", "edit", "doc/**"}
+  for _, g := range []*Grant{g1, g2, g1} {
+    if err := s.AddGrant(g); err != nil {
+      t.Errorf("error adding grant %v: %v", g, err)
+    }
+  }
+  if err := s.AddGrant(&Grant{"alice", "", "doc/42"}); err == nil {
+    t.Errorf("expected error adding grant with no permission")
+  }
+  grants, err := s.Grants()
+  if err != nil {
+    t.Fatalf("error reading grants: %v", err)
+  }
+  if got, want := len(grants), 2; got != want {
+    t.Fatalf("number of grants: got %d, want %d", got, want)
+  }
+  alice := users.NewUser("alice", "", nil)
+  if allowed, _ := Allowed(s, alice, "edit", "doc/42"); !allowed {
+    t.Errorf("alice should be allowed to edit doc/42")
+  }
+  if err := s.RemoveGrant(&Grant{"alice", "edit", "doc/42"}); err != nil {
+    t.Errorf("error removing grant: %v", err)
+  }
+  if allowed, _ := Allowed(s, alice, "edit", "doc/42"); allowed {
+    t.Errorf("alice should not be allowed to edit doc/42 after removing grant")
+  }
+  err = s.RemoveGrant(g1)
+  if !errors.Is(err, ErrNoSuchGrant) {
+    t.Errorf("removing missing grant: got %v, want %v", err, ErrNoSuchGrant)
+  }
+}
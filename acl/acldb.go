@@ -0,0 +1,143 @@
+package acl
+
+import (
+  "database/sql"
+  "fmt"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/store"
+  "github.com/jimmc/auth/users"
+)
+
+// DB implements the Store interface to load and store grants in an SQL
+// database, in the same style as store.PwDB.
+// Grants are stored in a table called "acl" with three string columns,
+// principal, permission, and resource.
+// SQL is written for SQLite unless another dialect is set by SetDialect.
+// If a username policy is set by SetUsernamePolicy, principals are
+// canonicalized when read and before they are used in queries.
+type DB struct {
+  db *sql.DB
+  dialect store.Dialect
+  usernamePolicy *users.UsernamePolicy
+}
+
+func NewDB(db *sql.DB) *DB {
+  return &DB{
+    db: db,
+    dialect: store.SQLite,
+  }
+}
+
+// SetDialect sets the dialect of SQL to use for our database.
+func (adb *DB) SetDialect(d store.Dialect) {
+  adb.dialect = d
+}
+
+func (adb *DB) queries() dbQueries {
+  return dbQueries{d: adb.dialect}
+}
+
+// SetUsernamePolicy sets the policy for the usernames in principals.
+// It should be the same policy as is set on the user store.
+func (adb *DB) SetUsernamePolicy(p *users.UsernamePolicy) {
+  adb.usernamePolicy = p
+}
+
+func (adb *DB) CreateACLTable() error {
+  _, err := adb.db.Exec(adb.queries().createTable())
+  return err
+}
+
+// Load does nothing when we are using a database.
+func (adb *DB) Load() error {
+  return nil
+}
+
+// Save does nothing when we are using a database.
+func (adb *DB) Save() error {
+  return nil
+}
+
+func (adb *DB) Grants() ([]*Grant, error) {
+  rows, err := adb.db.Query(adb.queries().selectGrants())
+  if err != nil {
+    return nil, fmt.Errorf("error reading grants: %v", err)
+  }
+  defer rows.Close()
+  grants := make([]*Grant, 0)
+  for rows.Next() {
+    var principal, perm, resource string
+    if err := rows.Scan(&principal, &perm, &resource); err != nil {
+      return nil, fmt.Errorf("error scanning grant row: %v", err)
+    }
+    grants = append(grants, &Grant{
+      Principal: adb.usernamePolicy.CanonicalPrincipal(principal),
+      Permission: permissions.Permission(perm),
+      Resource: resource,
+    })
+  }
+  if err := rows.Err(); err != nil {
+    return nil, fmt.Errorf("error reading grants: %v", err)
+  }
+  return grants, nil
+}
+
+func (adb *DB) AddGrant(g *Grant) error {
+  if err := checkGrant(g); err != nil {
+    return err
+  }
+  g = canonicalGrant(adb.usernamePolicy, g)
+  _, err := adb.db.Exec(adb.queries().insertGrant(), g.Principal, string(g.Permission), g.Resource)
+  if err != nil {
+    return fmt.Errorf("error adding grant %v: %v", g, err)
+  }
+  return nil
+}
+
+func (adb *DB) RemoveGrant(g *Grant) error {
+  g = canonicalGrant(adb.usernamePolicy, g)
+  result, err := adb.db.Exec(adb.queries().deleteGrant(), g.Principal, string(g.Permission), g.Resource)
+  if err != nil {
+    return fmt.Errorf("error removing grant %v: %v", g, err)
+  }
+  n, err := result.RowsAffected()
+  if err != nil {
+    return fmt.Errorf("error checking rows affected removing grant %v: %v", g, err)
+  }
+  if n == 0 {
+    return fmt.Errorf("can't remove %v: %w", g, ErrNoSuchGrant)
+  }
+  return nil
+}
+
+// aclTable is the name of the table in which DB stores grants.
+const aclTable = "acl"
+
+// dbQueries generates the SQL statements used by DB.
+type dbQueries struct {
+  d store.Dialect
+}
+
+func (q dbQueries) createTable() string {
+  return "CREATE TABLE " + q.d.Quote(aclTable) + "(principal " + q.d.KeyType() + " NOT NULL, permission " +
+      q.d.KeyType() + " NOT NULL, resource " + q.d.KeyType() + " NOT NULL, primary key(principal, permission, resource));"
+}
+
+func (q dbQueries) selectGrants() string {
+  return "SELECT principal, permission, resource FROM " + q.d.Quote(aclTable) + ";"
+}
+
+// insertGrant takes the principal, permission and resource. Adding a
+// grant that is already there leaves it unchanged, since all of the
+// columns are in the key.
+func (q dbQueries) insertGrant() string {
+  return q.d.Upsert(aclTable, "principal, permission, resource",
+      []string{"principal", "permission", "resource"}, []string{"resource"})
+}
+
+// deleteGrant takes the principal, permission and resource.
+func (q dbQueries) deleteGrant() string {
+  return "DELETE FROM " + q.d.Quote(aclTable) + " WHERE principal = " + q.d.Placeholder(1) +
+      " AND permission = " + q.d.Placeholder(2) + " AND resource = " + q.d.Placeholder(3) + ";"
+}
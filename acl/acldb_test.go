@@ -0,0 +1,54 @@
+package acl
+
+import (
+  "database/sql"
+  "io/ioutil"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  _ "github.com/mattn/go-sqlite3"
+
+  "github.com/jimmc/auth/store"
+)
+
+func TestDBStore(t *testing.T) {
+  db, err := sql.Open("sqlite3", t.TempDir() + "/acl.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  defer db.Close()
+  adb := NewDB(db)
+  if err := adb.CreateACLTable(); err != nil {
+    t.Fatalf("error creating acl table: %v", err)
+  }
+  adb.Load()    // No-op, just for coverage.
+  testStore(t, adb)
+  adb.Save()    // No-op, just for coverage.
+}
+
+// dbStatements returns all of the SQL that DB uses with dialect d.
+func dbStatements(d store.Dialect) string {
+  q := dbQueries{d: d}
+  statements := []string{
+    q.createTable(),
+    q.selectGrants(),
+    q.insertGrant(),
+    q.deleteGrant(),
+  }
+  return strings.Join(statements, "\n") + "\n"
+}
+
+func TestDBDialectStatements(t *testing.T) {
+  for _, d := range []store.Dialect{store.SQLite, store.Postgres, store.MySQL} {
+    got := dbStatements(d)
+    wantFile := filepath.Join("testdata", "sql-" + d.Name() + ".txt")
+    want, err := ioutil.ReadFile(wantFile)
+    if err != nil {
+      t.Fatalf("failed to read reference file %s: %v", wantFile, err)
+    }
+    if got != string(want) {
+      t.Errorf("%s statements don't match %s, got:\n%s", d.Name(), wantFile, got)
+    }
+  }
+}
@@ -0,0 +1,152 @@
+package acl
+
+import (
+  "bufio"
+  "encoding/csv"
+  "errors"
+  "fmt"
+  "os"
+  "sync"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+var ErrNoSuchGrant = errors.New("no such grant")
+
+// File implements the Store interface to load and store grants in a
+// CSV file in the same style as store.PwFile.
+// Each line has one grant with the format
+//   principal,permission,resource
+// If a username policy is set by SetUsernamePolicy, principals are
+// canonicalized when loaded or added, and written in canonical form by Save.
+type File struct {
+  filename string
+  mu sync.RWMutex     // Protects the fields below.
+  usernamePolicy *users.UsernamePolicy
+  grants []*Grant
+}
+
+func NewFile(filename string) *File {
+  return &File{
+    filename: filename,
+    grants: make([]*Grant, 0),
+  }
+}
+
+// SetUsernamePolicy sets the policy for the usernames in principals,
+// and applies it to the grants already loaded. It should be the same
+// policy as is set on the user store.
+func (f *File) SetUsernamePolicy(p *users.UsernamePolicy) {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  f.usernamePolicy = p
+  for n, g := range f.grants {
+    f.grants[n] = canonicalGrant(p, g)
+  }
+}
+
+func (f *File) Load() error {
+  file, err := os.Open(f.filename)
+  if err != nil {
+    return fmt.Errorf("error opening acl file %s: %v", f.filename, err)
+  }
+  defer file.Close()
+  r := csv.NewReader(bufio.NewReader(file))
+  r.FieldsPerRecord = 3         // principal, permission, resource
+
+  records, err := r.ReadAll()
+  if err != nil {
+    return fmt.Errorf("error loading acl file %s: %v", f.filename, err)
+  }
+  f.mu.RLock()
+  policy := f.usernamePolicy
+  f.mu.RUnlock()
+  grants := make([]*Grant, len(records))
+  for n, record := range records {
+    grants[n] = &Grant{
+      Principal: record[0],
+      Permission: permissions.Permission(record[1]),
+      Resource: record[2],
+    }
+    if err := checkGrant(grants[n]); err != nil {
+      return fmt.Errorf("error in acl file %s line %d: %v", f.filename, n+1, err)
+    }
+    grants[n] = canonicalGrant(policy, grants[n])
+  }
+  f.mu.Lock()
+  f.grants = grants
+  f.mu.Unlock()
+  return nil
+}
+
+func (f *File) Save() error {
+  newFilePath := f.filename + ".new"
+  file, err := os.Create(newFilePath)
+  if err != nil {
+    return fmt.Errorf("error creating new acl file %s: %v", newFilePath, err)
+  }
+  w := csv.NewWriter(file)
+  f.mu.RLock()
+  for _, g := range f.grants {
+    w.Write([]string{ g.Principal, string(g.Permission), g.Resource })
+  }
+  f.mu.RUnlock()
+  w.Flush()
+  if err := w.Error(); err != nil {
+    file.Close()
+    return fmt.Errorf("error writing new acl file %s: %v", newFilePath, err)
+  }
+  if err := file.Close(); err != nil {
+    return fmt.Errorf("error closing new acl file %s: %v", newFilePath, err)
+  }
+  if err := os.Rename(newFilePath, f.filename); err != nil {
+    return fmt.Errorf("error moving new file %s to become active file: %v", newFilePath, err)
+  }
+  return nil
+}
+
+// Grants returns a copy of the list of grants, so that it is not
+// changed by a later Load, AddGrant or RemoveGrant.
+func (f *File) Grants() ([]*Grant, error) {
+  f.mu.RLock()
+  defer f.mu.RUnlock()
+  return append([]*Grant(nil), f.grants...), nil
+}
+
+func (f *File) AddGrant(g *Grant) error {
+  if err := checkGrant(g); err != nil {
+    return err
+  }
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  g = canonicalGrant(f.usernamePolicy, g)
+  if f.index(g) >= 0 {
+    return nil
+  }
+  f.grants = append(f.grants, g)
+  return nil
+}
+
+func (f *File) RemoveGrant(g *Grant) error {
+  f.mu.Lock()
+  defer f.mu.Unlock()
+  g = canonicalGrant(f.usernamePolicy, g)
+  n := f.index(g)
+  if n < 0 {
+    return fmt.Errorf("can't remove %v: %w", g, ErrNoSuchGrant)
+  }
+  f.grants = append(f.grants[:n], f.grants[n+1:]...)
+  return nil
+}
+
+// index returns the index of the grant equal to g, or -1 if none.
+// The caller must hold mu.
+func (f *File) index(g *Grant) int {
+  for n, fg := range f.grants {
+    if *fg == *g {
+      return n
+    }
+  }
+  return -1
+}
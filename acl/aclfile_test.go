@@ -0,0 +1,78 @@
+package acl
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "sync"
+  "testing"
+
+  "github.com/jimmc/auth/users"
+)
+
+func TestFileStore(t *testing.T) {
+  testStore(t, NewFile("/no/such/file/acl.txt"))
+}
+
+func TestFileLoadSave(t *testing.T) {
+  if err := NewFile("/no/such/file/acl.txt").Load(); err == nil {
+    t.Errorf("expected error loading missing acl file")
+  }
+  bad := filepath.Join(t.TempDir(), "bad.txt")
+  if err := ioutil.WriteFile(bad, []byte("alice,,doc/1\n"), 0644); err != nil {
+    t.Fatalf("error writing bad acl file: %v", err)
+  }
+  if err := NewFile(bad).Load(); err == nil {
+    t.Errorf("expected error loading acl file with empty permission")
+  }
+
+  f := NewFile("testdata/acl1.txt")
+  if err := f.Load(); err != nil {
+    t.Fatalf("error loading acl file: %v", err)
+  }
+  saved := filepath.Join(t.TempDir(), "acl.txt")
+  f2 := NewFile(saved)
+  f2.grants = f.grants
+  if err := f2.Save(); err != nil {
+    t.Fatalf("error saving acl file: %v", err)
+  }
+  got, err := ioutil.ReadFile(saved)
+  if err != nil {
+    t.Fatalf("error reading saved acl file: %v", err)
+  }
+  want, err := ioutil.ReadFile("testdata/acl1.txt")
+  if err != nil {
+    t.Fatalf("error reading acl file: %v", err)
+  }
+  if string(got) != string(want) {
+    t.Errorf("saved acl file: got %q, want %q", got, want)
+  }
+}
+
+func TestFileConcurrentLoad(t *testing.T) {
+  f := NewFile("testdata/acl1.txt")
+  if err := f.Load(); err != nil {
+    t.Fatalf("error loading acl file: %v", err)
+  }
+  alice := users.NewUser("alice", "", nil)
+  var wg sync.WaitGroup
+  for i := 0; i < 4; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for j := 0; j < 50; j++ {
+        if allowed, _ := Allowed(f, alice, "edit", "doc/42"); !allowed {
+          t.Errorf("alice should be allowed to edit doc/42")
+          return
+        }
+      }
+    }()
+  }
+  for j := 0; j < 20; j++ {
+    if err := f.Load(); err != nil {
+      t.Errorf("error reloading acl file: %v", err)
+    }
+    f.AddGrant(&Grant{"bob", "edit", "doc/1"})
+    f.RemoveGrant(&Grant{"bob", "edit", "doc/1"})
+  }
+  wg.Wait()
+}
@@ -0,0 +1,559 @@
+package auth
+
+import (
+  "crypto/rand"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "math/big"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/golang/glog"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/policy"
+  "github.com/jimmc/auth/store"
+  "github.com/jimmc/auth/users"
+)
+
+// AdminUser is the information about one user returned by the admin API.
+type AdminUser struct {
+  Username string
+  Permissions string
+  Disabled bool
+  HasPassword bool
+}
+
+// AdminUserList is the result of the admin users call.
+type AdminUserList struct {
+  Users []*AdminUser
+  Offset int
+  Total int
+}
+
+// AdminSession is the information about one active session returned by the
+// admin sessions call. The Id can be passed to the admin revoke call.
+type AdminSession struct {
+  Id string
+  ClientId string
+  Timeout time.Time
+  Expiry time.Time
+}
+
+// AdminGrant is the information about one permission of a user returned
+// by the admin grants call. NotBefore and NotAfter are omitted if the
+// permission is not limited in that direction.
+type AdminGrant struct {
+  Permission permissions.Permission
+  NotBefore *time.Time `json:",omitempty"`
+  NotAfter *time.Time `json:",omitempty"`
+  Active bool
+  RemainingSeconds int64 `json:",omitempty"`    // Time until NotAfter, if set.
+}
+
+// AdminResult is returned by the admin calls that modify data.
+type AdminResult struct {
+  Status string
+  Password string `json:",omitempty"`    // Set only by resetpassword.
+  Revoked int `json:",omitempty"`        // Number of sessions revoked.
+}
+
+const resetPasswordLength = 16
+const resetPasswordChars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// initAdminHandler sets up AdminHandler. All of the admin calls require
+// the user to be logged in with the admin permission. Calls that modify
+// data must use POST, and are applied to the Store by loading it,
+// making the change, and saving it again.
+func (h *Handler) initAdminHandler() {
+  if h.config.AdminPermission == permissions.NoPermission {
+    h.config.AdminPermission = DefaultAdminPermission
+  }
+  mux := http.NewServeMux()
+  mux.HandleFunc(h.apiPrefix("admin/users"), h.adminUsers)
+  mux.HandleFunc(h.apiPrefix("admin/create"), h.adminPost(h.adminCreate))
+  mux.HandleFunc(h.apiPrefix("admin/delete"), h.adminPost(h.adminDelete))
+  mux.HandleFunc(h.apiPrefix("admin/setpassword"), h.adminPost(h.adminSetPassword))
+  mux.HandleFunc(h.apiPrefix("admin/resetpassword"), h.adminPost(h.adminResetPassword))
+  mux.HandleFunc(h.apiPrefix("admin/permissions"), h.adminPost(h.adminPermissions))
+  mux.HandleFunc(h.apiPrefix("admin/disable"), h.adminPost(h.adminDisable))
+  mux.HandleFunc(h.apiPrefix("admin/grants"), h.adminGrants)
+  mux.HandleFunc(h.apiPrefix("admin/sessions"), h.adminSessions)
+  mux.HandleFunc(h.apiPrefix("admin/revoke"), h.adminPost(h.adminRevoke))
+  mux.HandleFunc(h.apiPrefix("admin/explain"), h.adminExplain)
+  mux.HandleFunc(h.apiPrefix("admin/catalog"), h.adminCatalog)
+  // AdminPermission does not need to be in the permissions catalog.
+  h.AdminHandler = h.RequireAuth(h.requireCurrentUserPermission(mux, h.config.AdminPermission))
+}
+
+// requireCurrentUserPermission checks that the user set into the request
+// by RequireAuth has perm, without authenticating the request again.
+func (h *Handler) requireCurrentUserPermission(httpHandler http.Handler, perm permissions.Permission) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+    user := CurrentUser(r)
+    if user == nil {
+      http.Error(w, "Not authenticated", http.StatusUnauthorized)
+      return
+    }
+    if h.config.Policy != nil {
+      d := h.config.Policy.Evaluate(policy.NewRequest(r, user, perm))
+      if !d.Allowed {
+        glog.V(2).Infof("Not authorized: user %q permission %q: %s", user.Id(), perm, d.Reason)
+        http.Error(w, "Not authorized: " + d.Reason, http.StatusUnauthorized)
+        return
+      }
+    } else if !user.HasPermission(perm) {
+      glog.V(2).Infof("Not authorized: user %q does not have permission %q", user.Id(), perm)
+      http.Error(w, "Not authorized", http.StatusUnauthorized)
+      return
+    }
+    httpHandler.ServeHTTP(w, r)
+  })
+}
+
+// errDisabled is returned when setting the password of a disabled
+// account, which would enable it again.
+func errDisabled(username string) error {
+  return &adminError{http.StatusConflict, fmt.Sprintf("account %q is disabled, enable it before setting its password", username)}
+}
+
+// adminPost wraps an admin call that modifies data. It rejects methods
+// other than POST and reports errors returned by the call.
+func (h *Handler) adminPost(f func(*http.Request) (*AdminResult, error)) func(http.ResponseWriter, *http.Request) {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+      http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+      return
+    }
+    result, err := f(r)
+    if err != nil {
+      glog.Errorf("Admin call %s by %q failed: %v", r.URL.Path, CurrentUsername(r), err)
+      http.Error(w, err.Error(), adminErrorStatus(err))
+      return
+    }
+    glog.Infof("Admin call %s by %q for user %q", r.URL.Path, CurrentUsername(r), r.FormValue("username"))
+    result.Status = "ok"
+    marshalAndWrite(w, result)
+  }
+}
+
+// adminError is an error with an associated http status code.
+type adminError struct {
+  status int
+  msg string
+}
+
+func (e *adminError) Error() string {
+  return e.msg
+}
+
+func adminErrorStatus(err error) int {
+  var ae *adminError
+  switch {
+  case errors.As(err, &ae):
+    return ae.status
+  case errors.Is(err, users.ErrNoSuchUser):
+    return http.StatusNotFound
+  case errors.Is(err, users.ErrUserExists):
+    return http.StatusConflict
+  case errors.Is(err, users.ErrInvalidUsername):
+    return http.StatusBadRequest
+  case errors.Is(err, store.ErrNotSupported):
+    return http.StatusNotImplemented
+  }
+  return http.StatusInternalServerError
+}
+
+func (h *Handler) adminStore() (store.AdminStore, error) {
+  as, ok := h.config.Store.(store.AdminStore)
+  if !ok {
+    return nil, &adminError{http.StatusNotImplemented, "Store does not support admin operations"}
+  }
+  return as, nil
+}
+
+// updateStore loads the store, calls f to modify it, then saves it,
+// holding the lock on the store throughout if it supports locking.
+func (h *Handler) updateStore(f func(store.AdminStore) error) error {
+  as, err := h.adminStore()
+  if err != nil {
+    return err
+  }
+  unlock, err := h.lockUsers()
+  if err != nil {
+    return err
+  }
+  defer unlock()
+  if err := h.loadUsers(); err != nil {
+    return err
+  }
+  if err := f(as); err != nil {
+    return err
+  }
+  return h.saveUsers()
+}
+
+// requiredUser returns the canonical username form value, or an error
+// if it is missing.
+func (h *Handler) requiredUser(r *http.Request) (string, error) {
+  username := h.canonicalUsername(r.FormValue("username"))
+  if username == "" {
+    return "", &adminError{http.StatusBadRequest, "username is required"}
+  }
+  return username, nil
+}
+
+// permissionsValue parses the permissions form value, returning an error
+// if it is not well-formed, so that a typo is not stored as a different
+// permission than the one that was meant.
+func permissionsValue(r *http.Request) (*permissions.Permissions, error) {
+  perms, err := permissions.Parse(r.FormValue("permissions"))
+  if err != nil {
+    return nil, &adminError{http.StatusBadRequest, fmt.Sprintf("bad permissions: %v", err)}
+  }
+  return perms, nil
+}
+
+func (h *Handler) adminUsers(w http.ResponseWriter, r *http.Request) {
+  as, err := h.adminStore()
+  if err != nil {
+    http.Error(w, err.Error(), adminErrorStatus(err))
+    return
+  }
+  offset, _ := strconv.Atoi(r.FormValue("offset"))
+  limit, _ := strconv.Atoi(r.FormValue("limit"))
+  uu, err := as.ListUsers(offset, limit)
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to list users: %v", err), http.StatusInternalServerError)
+    return
+  }
+  result := &AdminUserList{
+    Users: make([]*AdminUser, len(uu)),
+    Offset: offset,
+    Total: as.UserCount(),
+  }
+  for n, u := range uu {
+    result.Users[n] = &AdminUser{
+      Username: u.Id(),
+      Permissions: u.PermissionsString(),
+      Disabled: u.Disabled(),
+      HasPassword: u.Saltword() != "" && !u.Disabled(),
+    }
+  }
+  marshalAndWrite(w, result)
+}
+
+func (h *Handler) adminCreate(r *http.Request) (*AdminResult, error) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    return nil, err
+  }
+  if err := h.config.UsernamePolicy.Check(username); err != nil {
+    return nil, err
+  }
+  hashword := r.FormValue("hashword")
+  password := r.FormValue("password")
+  perms, err := permissionsValue(r)
+  if err != nil {
+    return nil, err
+  }
+  err = h.updateStore(func(as store.AdminStore) error {
+    if as.User(username) != nil {
+      return fmt.Errorf("can't create %q: %w", username, users.ErrUserExists)
+    }
+    if hashword == "" && password != "" {
+      if err := h.storePassword(r.Context(), as, username, password); err != nil {
+        return err
+      }
+    } else {
+      saltword := ""
+      if hashword != "" {
+        var err error
+        saltword, err = h.generateSaltword(hashword)
+        if err != nil {
+          return err
+        }
+      }
+      if err := store.WithContext(as).SetSaltwordContext(r.Context(), username, saltword); err != nil {
+        return err
+      }
+    }
+    return as.SetPermissions(username, perms)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return &AdminResult{}, nil
+}
+
+func (h *Handler) adminDelete(r *http.Request) (*AdminResult, error) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    return nil, err
+  }
+  err = h.updateStore(func(as store.AdminStore) error {
+    return as.DeleteUser(username)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return &AdminResult{Revoked: revokeUserTokens(h.realm, username, "")}, nil
+}
+
+// adminSetPassword sets the password for a user to the hashword
+// calculated by the client, in the same way as for login, or to the
+// plain password, which the Store may hash in its own format.
+// All of the user's sessions are revoked.
+func (h *Handler) adminSetPassword(r *http.Request) (*AdminResult, error) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    return nil, err
+  }
+  hashword := r.FormValue("hashword")
+  password := r.FormValue("password")
+  if hashword == "" && password == "" {
+    return nil, &adminError{http.StatusBadRequest, "hashword or password is required"}
+  }
+  saltword := ""
+  if hashword != "" {
+    saltword, err = h.generateSaltword(hashword)
+    if err != nil {
+      return nil, err
+    }
+  }
+  err = h.updateStore(func(as store.AdminStore) error {
+    user := as.User(username)
+    if user == nil {
+      return fmt.Errorf("can't set password for %q: %w", username, users.ErrNoSuchUser)
+    }
+    if user.Disabled() {
+      return errDisabled(username)
+    }
+    if saltword == "" {
+      return h.storePassword(r.Context(), as, username, password)
+    }
+    return store.WithContext(as).SetSaltwordContext(r.Context(), username, saltword)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return &AdminResult{Revoked: revokeUserTokens(h.realm, username, "")}, nil
+}
+
+// adminResetPassword sets the password for a user to a new random
+// password, which is returned so that it can be given to the user.
+// All of the user's sessions are revoked.
+func (h *Handler) adminResetPassword(r *http.Request) (*AdminResult, error) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    return nil, err
+  }
+  password, err := randomPassword()
+  if err != nil {
+    return nil, err
+  }
+  err = h.updateStore(func(as store.AdminStore) error {
+    user := as.User(username)
+    if user == nil {
+      return fmt.Errorf("can't reset password for %q: %w", username, users.ErrNoSuchUser)
+    }
+    if user.Disabled() {
+      return errDisabled(username)
+    }
+    return h.storePassword(r.Context(), as, username, password)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return &AdminResult{Password: password, Revoked: revokeUserTokens(h.realm, username, "")}, nil
+}
+
+func (h *Handler) adminPermissions(r *http.Request) (*AdminResult, error) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    return nil, err
+  }
+  perms, err := permissionsValue(r)
+  if err != nil {
+    return nil, err
+  }
+  err = h.updateStore(func(as store.AdminStore) error {
+    return as.SetPermissions(username, perms)
+  })
+  if err != nil {
+    return nil, err
+  }
+  return &AdminResult{}, nil
+}
+
+// adminDisable disables the account for a user, or enables it again
+// if the disabled form value is "false". Disabling an account revokes
+// all of its sessions.
+func (h *Handler) adminDisable(r *http.Request) (*AdminResult, error) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    return nil, err
+  }
+  disable := r.FormValue("disabled") != "false"
+  err = h.updateStore(func(as store.AdminStore) error {
+    user := as.User(username)
+    if user == nil {
+      return fmt.Errorf("can't disable %q: %w", username, users.ErrNoSuchUser)
+    }
+    saltword := strings.TrimPrefix(user.Saltword(), users.DisabledPrefix)
+    if disable {
+      saltword = users.DisabledPrefix + saltword
+    }
+    return store.WithContext(as).SetSaltwordContext(r.Context(), username, saltword)
+  })
+  if err != nil {
+    return nil, err
+  }
+  result := &AdminResult{}
+  if disable {
+    result.Revoked = revokeUserTokens(h.realm, username, "")
+  }
+  return result, nil
+}
+
+// adminGrants lists the permissions of a user, including time-limited
+// permissions that are not yet valid, with the remaining lifetime of each.
+// The bounds are checked with permissions.Now, the same clock that
+// HasPermission uses.
+func (h *Handler) adminGrants(w http.ResponseWriter, r *http.Request) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    http.Error(w, err.Error(), adminErrorStatus(err))
+    return
+  }
+  user, err := h.contextStore().UserContext(r.Context(), username)
+  if err != nil {
+    storeUnavailable(w, err)
+    return
+  }
+  if user == nil {
+    http.Error(w, fmt.Sprintf("no such user %q", username), http.StatusNotFound)
+    return
+  }
+  result := make([]*AdminGrant, 0)
+  if user.Permissions() != nil {
+    now := permissions.Now()
+    for _, g := range user.Permissions().Grants() {
+      if g.Expired(now) {
+        continue
+      }
+      ag := &AdminGrant{
+        Permission: g.Permission,
+        Active: g.Active(now),
+        RemainingSeconds: int64(g.Remaining(now).Seconds()),
+      }
+      if !g.NotBefore.IsZero() {
+        ag.NotBefore = &g.NotBefore
+      }
+      if !g.NotAfter.IsZero() {
+        ag.NotAfter = &g.NotAfter
+      }
+      result = append(result, ag)
+    }
+  }
+  marshalAndWrite(w, result)
+}
+
+func (h *Handler) adminSessions(w http.ResponseWriter, r *http.Request) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    http.Error(w, err.Error(), adminErrorStatus(err))
+    return
+  }
+  tt := userTokens(h.realm, username)
+  sessions := make([]*AdminSession, len(tt))
+  for n, t := range tt {
+    sessions[n] = &AdminSession{
+      Id: t.sessionId(),
+      ClientId: t.idstr,
+      Timeout: t.timeout,
+      Expiry: t.expiry,
+    }
+  }
+  marshalAndWrite(w, sessions)
+}
+
+// adminRevoke revokes the session with the given id, or all sessions for
+// the user if no session id is given.
+func (h *Handler) adminRevoke(r *http.Request) (*AdminResult, error) {
+  username, err := h.requiredUser(r)
+  if err != nil {
+    return nil, err
+  }
+  sessionId := r.FormValue("session")
+  count := revokeUserTokens(h.realm, username, sessionId)
+  if sessionId != "" && count == 0 {
+    return nil, &adminError{http.StatusNotFound, fmt.Sprintf("no session %q for user %q", sessionId, username)}
+  }
+  return &AdminResult{Revoked: count}, nil
+}
+
+// adminExplain is a dry run of Config.Policy. It reports whether the user
+// would be allowed the permission, and how each policy rule was evaluated.
+// The method and remoteaddr form values may be given to test conditions;
+// they default to the values for the explain request itself.
+func (h *Handler) adminExplain(w http.ResponseWriter, r *http.Request) {
+  if h.config.Policy == nil {
+    http.Error(w, "No policy configured", http.StatusNotImplemented)
+    return
+  }
+  username, err := h.requiredUser(r)
+  if err != nil {
+    http.Error(w, err.Error(), adminErrorStatus(err))
+    return
+  }
+  user, err := h.contextStore().UserContext(r.Context(), username)
+  if err != nil {
+    storeUnavailable(w, err)
+    return
+  }
+  if user == nil {
+    http.Error(w, fmt.Sprintf("no such user %q", username), http.StatusNotFound)
+    return
+  }
+  req := policy.NewRequest(r, user, permissions.Permission(r.FormValue("permission")))
+  if method := r.FormValue("method"); method != "" {
+    req.Method = method
+  }
+  if addr := r.FormValue("remoteaddr"); addr != "" {
+    req.RemoteAddr = addr
+  }
+  marshalAndWrite(w, h.config.Policy.Explain(req))
+}
+
+// adminCatalog lists the permissions registered with permissions.Register,
+// for use by admin UIs when editing permissions.
+func (h *Handler) adminCatalog(w http.ResponseWriter, r *http.Request) {
+  marshalAndWrite(w, permissions.Catalog())
+}
+
+func randomPassword() (string, error) {
+  max := big.NewInt(int64(len(resetPasswordChars)))
+  b := make([]byte, resetPasswordLength)
+  for n := range b {
+    i, err := rand.Int(rand.Reader, max)
+    if err != nil {
+      return "", fmt.Errorf("error generating random password: %v", err)
+    }
+    b[n] = resetPasswordChars[i.Int64()]
+  }
+  return string(b), nil
+}
+
+func marshalAndWrite(w http.ResponseWriter, result interface{}) {
+  b, err := json.MarshalIndent(result, "", "  ")
+  if err != nil {
+    http.Error(w, fmt.Sprintf("Failed to marshall result: %v", err), http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusOK)
+  w.Write(b)
+}
@@ -0,0 +1,485 @@
+package auth
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "path/filepath"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/policy"
+  "github.com/jimmc/auth/store"
+  "github.com/jimmc/auth/users"
+)
+
+// makeAdminTestHandler returns a handler using a temporary copy of testdata/pw1.txt.
+func makeAdminTestHandler(t *testing.T) *Handler {
+  t.Helper()
+  b, err := ioutil.ReadFile("testdata/pw1.txt")
+  if err != nil {
+    t.Fatalf("error reading test password file: %v", err)
+  }
+  pwfile := filepath.Join(t.TempDir(), "pw.txt")
+  if err := ioutil.WriteFile(pwfile, b, 0600); err != nil {
+    t.Fatalf("error writing temp password file: %v", err)
+  }
+  return NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: store.NewPwFile(pwfile),
+    TokenCookieName: "test_cookie",
+  })
+}
+
+// adminRequest sends an admin call as the given user and returns the recorded response.
+func adminRequest(t *testing.T, h *Handler, user *users.User, method, call string, form url.Values) *httptest.ResponseRecorder {
+  t.Helper()
+  var req *http.Request
+  var err error
+  if method == http.MethodPost {
+    req, err = http.NewRequest(method, "/auth/admin/"+call+"/", strings.NewReader(form.Encode()))
+    if err == nil {
+      req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    }
+  } else {
+    req, err = http.NewRequest(method, "/auth/admin/"+call+"/?"+form.Encode(), nil)
+  }
+  if err != nil {
+    t.Fatalf("error creating admin %s request: %v", call, err)
+  }
+  if user != nil {
+    token := newToken("", user, clientIdString(req), h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+    req.AddCookie(token.cookie(h.config.TokenCookieName))
+  }
+  rr := httptest.NewRecorder()
+  h.AdminHandler.ServeHTTP(rr, req)
+  return rr
+}
+
+func TestAdminRequiresPermission(t *testing.T) {
+  h := makeAdminTestHandler(t)
+  rr := adminRequest(t, h, nil, http.MethodGet, "users", url.Values{})
+  if got, want := rr.Code, http.StatusUnauthorized; got != want {
+    t.Errorf("admin call with no user: got status %d, want %d", got, want)
+  }
+  user := users.NewUser("user1", "", permissions.FromString("something"))
+  rr = adminRequest(t, h, user, http.MethodGet, "users", url.Values{})
+  if got, want := rr.Code, http.StatusUnauthorized; got != want {
+    t.Errorf("admin call with non-admin user: got status %d, want %d", got, want)
+  }
+}
+
+func TestAdminAuthenticatesOnce(t *testing.T) {
+  pwfile := filepath.Join(t.TempDir(), "pw.txt")
+  if err := ioutil.WriteFile(pwfile, []byte("admin,,admin\n"), 0600); err != nil {
+    t.Fatalf("error writing temp password file: %v", err)
+  }
+  as := &authenticatorStore{
+    PwFile: store.NewPwFile(pwfile),
+    passwords: map[string]string{"admin": "secret"},
+  }
+  h := NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: as,
+    TokenCookieName: "test_cookie",
+    BasicAuth: true,
+  })
+  req, err := http.NewRequest(http.MethodGet, "/auth/admin/users/", nil)
+  if err != nil {
+    t.Fatalf("error creating admin request: %v", err)
+  }
+  req.SetBasicAuth("admin", "secret")
+  rr := httptest.NewRecorder()
+  h.AdminHandler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("admin call with basic auth: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  if got, want := as.calls, 1; got != want {
+    t.Errorf("password checks for admin call: got %d, want %d", got, want)
+  }
+}
+
+func TestAdminUsers(t *testing.T) {
+  h := makeAdminTestHandler(t)
+  admin := users.NewUser("admin", "", permissions.FromString("admin"))
+
+  rr := adminRequest(t, h, admin, http.MethodGet, "users", url.Values{})
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("admin users: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  list := &AdminUserList{}
+  if err := json.Unmarshal(rr.Body.Bytes(), list); err != nil {
+    t.Fatalf("error unmarshalling user list: %v", err)
+  }
+  if got, want := len(list.Users), 2; got != want {
+    t.Fatalf("number of users: got %d, want %d", got, want)
+  }
+  if got, want := list.Users[1].Username, "user3"; got != want {
+    t.Errorf("second user: got %q, want %q", got, want)
+  }
+  if got, want := list.Users[1].HasPassword, true; got != want {
+    t.Errorf("user3 has password: got %v, want %v", got, want)
+  }
+
+  rr = adminRequest(t, h, admin, http.MethodGet, "create", url.Values{"username": {"user4"}})
+  if got, want := rr.Code, http.StatusMethodNotAllowed; got != want {
+    t.Errorf("create with GET: got status %d, want %d", got, want)
+  }
+  rr = adminRequest(t, h, admin, http.MethodPost, "create", url.Values{})
+  if got, want := rr.Code, http.StatusBadRequest; got != want {
+    t.Errorf("create with no username: got status %d, want %d", got, want)
+  }
+  form := url.Values{
+    "username": {"user4"},
+    "hashword": {h.generateHashword("user4", "pw4")},
+    "permissions": {"something"},
+  }
+  rr = adminRequest(t, h, admin, http.MethodPost, "create", form)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("create user4: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  if !h.hashwordIsValid("user4", h.generateHashword("user4", "pw4")) {
+    t.Errorf("user4 password should be valid after create")
+  }
+  if got, want := h.config.Store.User("user4").HasPermission(CanDoSomething), true; got != want {
+    t.Errorf("user4 permission after create: got %v, want %v", got, want)
+  }
+  rr = adminRequest(t, h, admin, http.MethodPost, "create", form)
+  if got, want := rr.Code, http.StatusConflict; got != want {
+    t.Errorf("create existing user: got status %d, want %d", got, want)
+  }
+
+  // Reload from the file to make sure the change was saved.
+  if err := h.loadUsers(); err != nil {
+    t.Fatalf("error reloading password file: %v", err)
+  }
+  if h.config.Store.User("user4") == nil {
+    t.Errorf("user4 should exist after reloading")
+  }
+
+  form = url.Values{"username": {"user5"}, "permissions": {"deploy[oops"}}
+  rr = adminRequest(t, h, admin, http.MethodPost, "create", form)
+  if got, want := rr.Code, http.StatusBadRequest; got != want {
+    t.Errorf("create with bad permissions: got status %d, want %d", got, want)
+  }
+  if h.config.Store.User("user5") != nil {
+    t.Errorf("user5 should not be created with bad permissions")
+  }
+
+  user4 := h.config.Store.User("user4")
+  newToken("", user4, "id1", 0, 0)
+  form = url.Values{
+    "username": {"user4"},
+    "hashword": {h.generateHashword("user4", "pw4b")},
+  }
+  rr = adminRequest(t, h, admin, http.MethodPost, "setpassword", form)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("setpassword user4: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  if got, want := len(userTokens("", "user4")), 0; got != want {
+    t.Errorf("sessions after setpassword: got %d, want %d", got, want)
+  }
+  if !h.hashwordIsValid("user4", h.generateHashword("user4", "pw4b")) {
+    t.Errorf("user4 new password should be valid after setpassword")
+  }
+  form.Set("username", "user9")
+  rr = adminRequest(t, h, admin, http.MethodPost, "setpassword", form)
+  if got, want := rr.Code, http.StatusNotFound; got != want {
+    t.Errorf("setpassword for missing user: got status %d, want %d", got, want)
+  }
+
+  newToken("", user4, "id2", 0, 0)
+  rr = adminRequest(t, h, admin, http.MethodPost, "resetpassword", url.Values{"username": {"user4"}})
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("resetpassword user4: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  result := &AdminResult{}
+  if err := json.Unmarshal(rr.Body.Bytes(), result); err != nil {
+    t.Fatalf("error unmarshalling resetpassword result: %v", err)
+  }
+  if got, want := len(result.Password), resetPasswordLength; got != want {
+    t.Errorf("reset password length: got %d, want %d", got, want)
+  }
+  if got, want := result.Revoked, 1; got != want {
+    t.Errorf("sessions revoked by resetpassword: got %d, want %d", got, want)
+  }
+  if !h.hashwordIsValid("user4", h.generateHashword("user4", result.Password)) {
+    t.Errorf("user4 reset password should be valid")
+  }
+
+  form = url.Values{"username": {"user1"}, "permissions": {"something"}}
+  rr = adminRequest(t, h, admin, http.MethodPost, "permissions", form)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Errorf("permissions for user1: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  if got, want := h.config.Store.User("user1").HasPermission(CanDoSomething), true; got != want {
+    t.Errorf("user1 permission after update: got %v, want %v", got, want)
+  }
+  form = url.Values{"username": {"user1"}, "permissions": {"deploy[oops"}}
+  rr = adminRequest(t, h, admin, http.MethodPost, "permissions", form)
+  if got, want := rr.Code, http.StatusBadRequest; got != want {
+    t.Errorf("bad permissions for user1: got status %d, want %d", got, want)
+  }
+  if got, want := h.config.Store.User("user1").PermissionsString(), "something"; got != want {
+    t.Errorf("user1 permissions after bad update: got %q, want %q", got, want)
+  }
+
+  rr = adminRequest(t, h, admin, http.MethodPost, "delete", url.Values{"username": {"user1"}})
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Errorf("delete user1: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  rr = adminRequest(t, h, admin, http.MethodPost, "delete", url.Values{"username": {"user1"}})
+  if got, want := rr.Code, http.StatusNotFound; got != want {
+    t.Errorf("delete user1 again: got status %d, want %d", got, want)
+  }
+  if got, want := h.config.Store.UserCount(), 2; got != want {
+    t.Errorf("user count after delete: got %d, want %d", got, want)
+  }
+}
+
+// TestLoginAndRevoke is meant to be run with -race.
+func TestLoginAndRevoke(t *testing.T) {
+  h := makeAdminTestHandler(t)
+  admin := users.NewUser("admin", "", permissions.FromString("admin"))
+  hashword := sha256sum("user3/pw3")
+  const logins = 3
+  done := make(chan bool)
+  var wg sync.WaitGroup
+  wg.Add(2)
+  go func() {
+    defer wg.Done()
+    defer close(done)
+    for i := 0; i < logins; i++ {
+      req, err := http.NewRequest("GET", "/auth/login?username=user3&hashword="+hashword, nil)
+      if err != nil {
+        t.Errorf("error creating auth login request: %v", err)
+        return
+      }
+      rr := httptest.NewRecorder()
+      h.login(rr, req)
+      if got, want := rr.Code, http.StatusOK; got != want {
+        t.Errorf("login failed: got status %d, want %d; response is %q", got, want, rr.Body.String())
+      }
+    }
+  }()
+  go func() {
+    defer wg.Done()
+    // Revoke until all of the logins are done.
+    for {
+      adminRequest(t, h, admin, http.MethodGet, "sessions", url.Values{"username": {"user3"}})
+      adminRequest(t, h, admin, http.MethodPost, "revoke", url.Values{"username": {"user3"}})
+      select {
+      case <-done:
+        return
+      default:
+      }
+    }
+  }()
+  wg.Wait()
+  rr := adminRequest(t, h, admin, http.MethodPost, "revoke", url.Values{"username": {"user3"}})
+  if rr.Code != http.StatusOK && rr.Code != http.StatusNotFound {
+    t.Errorf("final revoke: got status %d; response is %q", rr.Code, rr.Body.String())
+  }
+  if got, want := len(userTokens("", "user3")), 0; got != want {
+    t.Errorf("sessions after revoke: got %d, want %d", got, want)
+  }
+}
+
+func TestAdminDisableAndSessions(t *testing.T) {
+  h := makeAdminTestHandler(t)
+  admin := users.NewUser("admin", "", permissions.FromString("admin"))
+  hashword := h.generateHashword("user3", "pw3")
+  if !h.hashwordIsValid("user3", hashword) {
+    t.Fatalf("user3 password should be valid before disabling")
+  }
+
+  user3 := h.config.Store.User("user3")
+  newToken("", user3, "id1", 0, 0)
+  newToken("", user3, "id2", 0, 0)
+  rr := adminRequest(t, h, admin, http.MethodGet, "sessions", url.Values{"username": {"user3"}})
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("sessions for user3: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  var sessions []*AdminSession
+  if err := json.Unmarshal(rr.Body.Bytes(), &sessions); err != nil {
+    t.Fatalf("error unmarshalling sessions: %v", err)
+  }
+  if got, want := len(sessions), 2; got != want {
+    t.Fatalf("number of sessions for user3: got %d, want %d", got, want)
+  }
+
+  form := url.Values{"username": {"user3"}, "session": {sessions[0].Id}}
+  rr = adminRequest(t, h, admin, http.MethodPost, "revoke", form)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Errorf("revoke session: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  if got, want := len(userTokens("", "user3")), 1; got != want {
+    t.Errorf("sessions after revoke: got %d, want %d", got, want)
+  }
+  rr = adminRequest(t, h, admin, http.MethodPost, "revoke", form)
+  if got, want := rr.Code, http.StatusNotFound; got != want {
+    t.Errorf("revoke revoked session: got status %d, want %d", got, want)
+  }
+
+  rr = adminRequest(t, h, admin, http.MethodPost, "disable", url.Values{"username": {"user3"}})
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("disable user3: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  if h.hashwordIsValid("user3", hashword) {
+    t.Errorf("user3 password should not be valid after disabling")
+  }
+  if got, want := len(userTokens("", "user3")), 0; got != want {
+    t.Errorf("sessions after disable: got %d, want %d", got, want)
+  }
+  // Setting the password does not enable the account again.
+  for _, call := range []string{"setpassword", "resetpassword"} {
+    form := url.Values{"username": {"user3"}, "password": {"newpw"}}
+    rr = adminRequest(t, h, admin, http.MethodPost, call, form)
+    if got, want := rr.Code, http.StatusConflict; got != want {
+      t.Errorf("%s for disabled user3: got status %d, want %d", call, got, want)
+    }
+  }
+  if !h.config.Store.User("user3").Disabled() {
+    t.Errorf("user3 should still be disabled after setting the password")
+  }
+
+  form = url.Values{"username": {"user3"}, "disabled": {"false"}}
+  rr = adminRequest(t, h, admin, http.MethodPost, "disable", form)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("enable user3: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  if !h.hashwordIsValid("user3", hashword) {
+    t.Errorf("user3 password should be valid after enabling")
+  }
+}
+
+func TestAdminExplain(t *testing.T) {
+  h := makeAdminTestHandler(t)
+  admin := users.NewUser("admin", "", permissions.FromString("admin"))
+  rr := adminRequest(t, h, admin, http.MethodGet, "explain", url.Values{"username": {"user1"}})
+  if got, want := rr.Code, http.StatusNotImplemented; got != want {
+    t.Errorf("explain with no policy: got status %d, want %d", got, want)
+  }
+
+  p, err := policy.Parse([]byte(`{"rules": [
+    {"id": "posts", "effect": "allow", "principals": ["user1"], "permissions": ["something"],
+     "conditions": {"methods": ["POST"]}}
+  ]}`))
+  if err != nil {
+    t.Fatalf("error parsing policy: %v", err)
+  }
+  if h.config.Policy, err = policy.NewEngineFromPolicy(p); err != nil {
+    t.Fatalf("error creating policy engine: %v", err)
+  }
+  form := url.Values{"username": {"user1"}, "permission": {"something"}}
+  rr = adminRequest(t, h, admin, http.MethodGet, "explain", form)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("explain: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  d := &policy.Decision{}
+  if err := json.Unmarshal(rr.Body.Bytes(), d); err != nil {
+    t.Fatalf("error unmarshalling decision: %v", err)
+  }
+  if got, want := d.Allowed, false; got != want {
+    t.Errorf("explain for GET: got allowed %v, want %v", got, want)
+  }
+  if got, want := len(d.Trace), 1; got != want {
+    t.Fatalf("explain trace length: got %d, want %d", got, want)
+  }
+
+  form.Set("method", "POST")
+  rr = adminRequest(t, h, admin, http.MethodGet, "explain", form)
+  d = &policy.Decision{}
+  if err := json.Unmarshal(rr.Body.Bytes(), d); err != nil {
+    t.Fatalf("error unmarshalling decision: %v", err)
+  }
+  if got, want := d.Rule, "posts"; got != want {
+    t.Errorf("explain for POST: got rule %q, want %q", got, want)
+  }
+
+  form.Set("username", "nobody")
+  rr = adminRequest(t, h, admin, http.MethodGet, "explain", form)
+  if got, want := rr.Code, http.StatusNotFound; got != want {
+    t.Errorf("explain for missing user: got status %d, want %d", got, want)
+  }
+}
+
+func TestAdminGrants(t *testing.T) {
+  h := makeAdminTestHandler(t)
+  admin := users.NewUser("admin", "", permissions.FromString("admin"))
+  now := permissions.Now()
+  perms := fmt.Sprintf("something deploy[/%s] audit[%s/] old[/%s]",
+      now.Add(2 * time.Hour).UTC().Format(time.RFC3339),
+      now.Add(24 * time.Hour).UTC().Format(time.RFC3339),
+      now.Add(-time.Hour).UTC().Format(time.RFC3339))
+  form := url.Values{"username": {"user1"}, "permissions": {perms}}
+  rr := adminRequest(t, h, admin, http.MethodPost, "permissions", form)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("permissions for user1: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+
+  rr = adminRequest(t, h, admin, http.MethodGet, "grants", url.Values{"username": {"user1"}})
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("grants for user1: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  var grants []*AdminGrant
+  if err := json.Unmarshal(rr.Body.Bytes(), &grants); err != nil {
+    t.Fatalf("error unmarshalling grants: %v", err)
+  }
+  if got, want := len(grants), 3; got != want {
+    t.Fatalf("number of grants: got %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  // Sorted: audit, deploy, something
+  if got, want := grants[0].Active, false; got != want {
+    t.Errorf("audit active: got %v, want %v", got, want)
+  }
+  if grants[0].NotBefore == nil || grants[0].NotAfter != nil {
+    t.Errorf("audit should have only NotBefore, got %v, %v", grants[0].NotBefore, grants[0].NotAfter)
+  }
+  if got := grants[1].RemainingSeconds; got < 7000 || got > 7200 {
+    t.Errorf("deploy remaining seconds: got %d, want about 7200", got)
+  }
+  if got, want := grants[2].Permission, CanDoSomething; got != want {
+    t.Errorf("third grant: got %q, want %q", got, want)
+  }
+  if grants[2].NotBefore != nil || grants[2].NotAfter != nil || grants[2].RemainingSeconds != 0 {
+    t.Errorf("permanent grant should have no limits, got %+v", grants[2])
+  }
+
+  rr = adminRequest(t, h, admin, http.MethodGet, "grants", url.Values{"username": {"nobody"}})
+  if got, want := rr.Code, http.StatusNotFound; got != want {
+    t.Errorf("grants for missing user: got status %d, want %d", got, want)
+  }
+}
+
+func TestAdminCatalog(t *testing.T) {
+  defer permissions.ClearCatalog()
+  permissions.Register("edit", "Edit documents")
+  permissions.Register("read", "Read documents")
+  // The admin permission need not be registered.
+  h := makeAdminTestHandler(t)
+  admin := users.NewUser("admin", "", permissions.FromString("admin"))
+  rr := adminRequest(t, h, admin, http.MethodGet, "catalog", url.Values{})
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("catalog: got status %d, want %d; response is %q", got, want, rr.Body.String())
+  }
+  var entries []*permissions.CatalogEntry
+  if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+    t.Fatalf("error unmarshalling catalog: %v", err)
+  }
+  if got, want := len(entries), 2; got != want {
+    t.Fatalf("catalog size: got %d, want %d", got, want)
+  }
+  if got, want := entries[0].Permission, permissions.Permission("edit"); got != want {
+    t.Errorf("first catalog entry: got %q, want %q", got, want)
+  }
+  if got, want := entries[1].Description, "Read documents"; got != want {
+    t.Errorf("second catalog description: got %q, want %q", got, want)
+  }
+}
@@ -13,14 +13,21 @@
 // with the username. The server looks up the username in its database
 // and retrieves the saltword. The saltword and the hashword are passed
 // to bcrypt's comparison function. If they match, the user is authenticated.
+// If Config.UsernamePolicy is set, the username is put into canonical
+// form, such as by folding case, before the hashword is generated, so
+// the client must do the same.
 
 package auth
 
 import (
+  "context"
   "crypto/sha256"
   "encoding/hex"
+  "errors"
   "fmt"
+  "net"
   "net/http"
+  "strings"
   "syscall"
   "time"
 
@@ -28,7 +35,11 @@ import (
   "golang.org/x/crypto/bcrypt"
   "golang.org/x/crypto/ssh/terminal"
 
+  "github.com/jimmc/auth/acl"
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/policy"
   "github.com/jimmc/auth/store"
+  "github.com/jimmc/auth/users"
 )
 
 type Config struct {
@@ -37,11 +48,25 @@ type Config struct {
   TokenCookieName string        // The name of the cookie we use to store our auth data.
   TokenTimeoutDuration time.Duration   // Amount of idle time until token times out.
   TokenExpiryDuration time.Duration    // Amount of time until hard expire of the token.
+  AdminPermission permissions.Permission  // Permission required to use AdminHandler.
+  ACLStore acl.Store            // Optional resource grants, see RequireResourcePermission.
+  Policy *policy.Engine         // Optional allow and deny rules, see RequirePermission.
+  BasicAuth bool                // Accept HTTP Basic authentication with a plain password.
+  ReloadUser bool               // Read the user from the Store on each request, so changes take effect at once.
+  UsernamePolicy *users.UsernamePolicy  // Optional canonicalization of usernames and rule principals; set the same policy on the Store.
+  Realms []*Realm               // Optional applications with their own users and tokens, see Realm.
+  RealmHeader string            // Optional request header that names the realm, see Realm.
+  RealmHeaderProxies []string   // Addresses or CIDR blocks of the proxies trusted to set RealmHeader.
 }
 
 type Handler struct {
   ApiHandler http.Handler
+  AdminHandler http.Handler
   config *Config
+  realm string                  // The name of our realm, or empty if we don't use realms.
+  realms map[string]*Handler    // The Handlers for Config.Realms, by name.
+  realmList []*Realm            // The realms of Config.Realms that are valid, in order.
+  realmProxies []*net.IPNet     // The parsed Config.RealmHeaderProxies.
 }
 
 const (
@@ -49,10 +74,21 @@ const (
   defaultTokenExpiryDuration = time.Duration(10) * time.Hour
 )
 
+// DefaultAdminPermission is used for Config.AdminPermission if none is specified.
+const DefaultAdminPermission = permissions.Permission("admin")
+
 const bcryptCost = 12   // The cost factor we pass to bcrypt.GenerateFromPassword.
 
 func NewHandler(c *Config) *Handler {
-  h := &Handler{config: c}
+  initTokens()
+  if len(c.Realms) > 0 {
+    return newRealmsHandler(c)
+  }
+  return newHandler(c, "")
+}
+
+func newHandler(c *Config, realm string) *Handler {
+  h := &Handler{config: c, realm: realm}
   if c.Store==nil {
     glog.Errorf("Error: no Store provided")
     return h
@@ -61,14 +97,31 @@ func NewHandler(c *Config) *Handler {
   if err != nil {
     glog.Errorf("Error loading password file: %v", err)
   }
+  if c.UsernamePolicy != nil {
+    // Rules written for "Alice" should apply to the user "alice".
+    if ps, ok := c.ACLStore.(interface{ SetUsernamePolicy(*users.UsernamePolicy) }); ok {
+      ps.SetUsernamePolicy(c.UsernamePolicy)
+    }
+    if c.Policy != nil {
+      c.Policy.SetUsernamePolicy(c.UsernamePolicy)
+    }
+  }
+  if c.ACLStore != nil {
+    if err := c.ACLStore.Load(); err != nil {
+      glog.Errorf("Error loading acl store: %v", err)
+    }
+  }
   h.initApiHandler()
-  initTokens()
+  h.initAdminHandler()
   return h
 }
 
 // Read a password from the terminal and pass it to UpdatePassword.
 // This function is difficult to test automatically. It should be tested manually.
 func (h *Handler) UpdateUserPassword(username string) error {
+  if err := h.checkStore(); err != nil {
+    return err
+  }
   if !terminal.IsTerminal(syscall.Stdin) {
     return fmt.Errorf("updatePassword option requires terminal for input")
   }
@@ -93,16 +146,28 @@ func (h *Handler) UpdateUserPassword(username string) error {
 // Set the saltword for a user into our database based on the username
 // and the given password, with a randomly generated salt.
 func (h *Handler) UpdatePassword(username, password string) error {
-  err := h.loadUsers()
+  if err := h.checkStore(); err != nil {
+    return err
+  }
+  username = h.canonicalUsername(username)
+  unlock, err := h.lockUsers()
   if err != nil {
     return err
   }
-  hashword := h.generateHashword(username, password)
-  saltword, err := h.generateSaltword(hashword)
+  defer unlock()
+  err = h.loadUsers()
   if err != nil {
     return err
   }
-  h.setSaltword(username, saltword)
+  if h.config.Store.User(username) == nil {
+    // Adding a new user.
+    if err := h.config.UsernamePolicy.Check(username); err != nil {
+      return err
+    }
+  }
+  if err := h.storePassword(context.Background(), h.config.Store, username, password); err != nil {
+    return err
+  }
   err = h.saveUsers()
   if err != nil {
     return err
@@ -110,6 +175,48 @@ func (h *Handler) UpdatePassword(username, password string) error {
   return nil
 }
 
+// checkStore returns an error if we have no Store, such as when we
+// pass requests to the Handlers of our realms.
+func (h *Handler) checkStore() error {
+  if h.realms != nil {
+    return fmt.Errorf("auth handler has realms, use Realm(name) to update a realm's users")
+  }
+  if h.config.Store == nil {
+    return fmt.Errorf("no Store provided")
+  }
+  return nil
+}
+
+// lockUsers locks the Store against changes by other processes, if it
+// supports locking, and returns a function to release the lock.
+func (h *Handler) lockUsers() (func(), error) {
+  l, ok := h.config.Store.(store.Locker)
+  if !ok {
+    return func() {}, nil
+  }
+  if err := l.Lock(); err != nil {
+    return nil, err
+  }
+  return func() {
+    if err := l.Unlock(); err != nil {
+      glog.Errorf("Error unlocking password store: %v", err)
+    }
+  }, nil
+}
+
+// contextStore returns our Store as a store.ContextStore.
+func (h *Handler) contextStore() store.ContextStore {
+  return store.WithContext(h.config.Store)
+}
+
+// storeUnavailable writes a StatusServiceUnavailable response for an
+// error reading the Store, so that a failing database is not reported
+// as invalid credentials.
+func storeUnavailable(w http.ResponseWriter, err error) {
+  glog.Errorf("Error reading user store: %v", err)
+  http.Error(w, "Authentication service unavailable", http.StatusServiceUnavailable)
+}
+
 func (h *Handler) loadUsers() error {
   return h.config.Store.Load()
 }
@@ -131,12 +238,53 @@ func (h *Handler) getSaltword(username string) string {
   return user.Saltword()
 }
 
+// passwordSaltword returns the saltword to store for the given username
+// and password.
+func (h *Handler) passwordSaltword(username, password string) (string, error) {
+  hashword := h.generateHashword(username, password)
+  return h.generateSaltword(hashword)
+}
+
+// storePassword sets the password for a user in s. If s is a
+// store.PasswordSetter, it hashes the password in its own format,
+// otherwise we store our saltword. Errors from s, such as a database
+// failure or a store that can't be changed, are returned.
+func (h *Handler) storePassword(ctx context.Context, s store.Store, username, password string) error {
+  if ps, ok := s.(store.PasswordSetter); ok {
+    err := ps.SetPassword(username, password)
+    if !errors.Is(err, store.ErrNotSupported) {
+      return err
+    }
+    // A wrapper store around a store that uses our saltwords.
+  }
+  saltword, err := h.passwordSaltword(username, password)
+  if err != nil {
+    return err
+  }
+  return store.WithContext(s).SetSaltwordContext(ctx, username, saltword)
+}
+
 func (h *Handler) generateHashword(username, password string) string {
-  return sha256sum(username + "/" + password)
+  return sha256sum(h.canonicalUsername(username) + "/" + password)
+}
+
+// canonicalUsername applies our username policy. Clients that calculate
+// the hashword must use the canonical username.
+func (h *Handler) canonicalUsername(username string) string {
+  return h.config.UsernamePolicy.Canonical(username)
 }
 
 func (h *Handler) hashwordIsValid(username, hashword string) bool {
-  saltword := h.getSaltword(username)
+  return saltwordMatchesHashword(username, h.getSaltword(username), hashword)
+}
+
+// saltwordMatchesHashword checks a hashword against the saltword stored
+// for the user.
+func saltwordMatchesHashword(username, saltword, hashword string) bool {
+  if strings.HasPrefix(saltword, users.DisabledPrefix) {
+    glog.V(4).Infof("account %q is disabled", username)
+    return false
+  }
   saltwordBytes, err := hex.DecodeString(saltword)
   if err != nil {
     glog.V(4).Infof("error converting saltword to bytes: %v", err)
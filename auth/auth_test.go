@@ -1,11 +1,24 @@
 package auth
 
 import (
+  "database/sql"
+  "errors"
   "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
   "os"
+  "path/filepath"
   "testing"
+  "time"
 
+  _ "github.com/mattn/go-sqlite3"
+
+  "github.com/jimmc/auth/acl"
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/policy"
   "github.com/jimmc/auth/store"
+  "github.com/jimmc/auth/users"
 )
 
 // Returns a config and the temp file used in the config
@@ -98,24 +111,60 @@ func TestPasswordFile(t *testing.T) {
 
   // Saving the password file after a change is done by creating a new temp
   // file and moving it onto the old file. To make this fail, we create a
-  // file of that new name and make it read-only.
-  // Now make the password file protected so a write on save fails
+  // directory of that new name, which can't be replaced by a file even
+  // when running as root.
   tfName := pf.Name()+".new"
-  tf, err := os.Create(tfName)
-  if err != nil {
-    t.Fatalf("failed to create temp password file")
-  }
-  defer os.Remove(tf.Name())    // clean up
-  err = os.Chmod(tf.Name(), 0400)       // read-only
-  if err!=nil {
-    t.Fatalf("error setting temp password file (~) to read-only: %v", err)
+  if err := os.Mkdir(tfName, 0700); err != nil {
+    t.Fatalf("failed to create directory in place of temp password file: %v", err)
   }
+  defer os.Remove(tfName)    // clean up
   err = h.UpdatePassword("user1", "xyz")
   if err == nil {
     t.Errorf("expected error updating password, did not get error")
   }
 }
 
+// A Cached store around a PwFile is a PasswordSetter, but the PwFile
+// needs our saltword.
+func TestUpdatePasswordCached(t *testing.T) {
+  testConfig, pf := makeTestConfig(t)
+  defer os.Remove(pf.Name())    // clean up
+  testConfig.Store = store.NewCached(testConfig.Store, 10, time.Minute)
+  h := NewHandler(testConfig)
+  if err := h.UpdatePassword("user1", "abcd"); err != nil {
+    t.Fatalf("failed to update password: %v", err)
+  }
+  if !h.hashwordIsValid("user1", h.generateHashword("user1", "abcd")) {
+    t.Errorf("hashword should be valid after updating password through cache")
+  }
+}
+
+// Errors from the Store, such as a Chain refusing to change a user who
+// is not in its writer, are returned.
+func TestUpdatePasswordStoreError(t *testing.T) {
+  writerFile := filepath.Join(t.TempDir(), "writer.txt")
+  if err := ioutil.WriteFile(writerFile, []byte(""), 0600); err != nil {
+    t.Fatalf("error writing password file: %v", err)
+  }
+  chain, err := store.NewChain(store.NewPwFile(writerFile), store.NewPwFile("testdata/pw1.txt"))
+  if err != nil {
+    t.Fatalf("error creating chain: %v", err)
+  }
+  h := NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: chain,
+    TokenCookieName: "test_cookie",
+  })
+  if err := h.UpdatePassword("user3", "abcd"); err == nil {
+    t.Errorf("expected error updating password of user who is not in the writer")
+  }
+  admin := users.NewUser("admin", "", permissions.FromString("admin"))
+  rr := adminRequest(t, h, admin, http.MethodPost, "setpassword", url.Values{"username": {"user3"}, "hashword": {"abc"}})
+  if got, want := rr.Code, http.StatusInternalServerError; got != want {
+    t.Errorf("admin setpassword of user who is not in the writer: got status %d, want %d", got, want)
+  }
+}
+
 func TestMissingPasswordFile(t *testing.T) {
   noSuchFile := "/no/such/file/foo.txt"
   pwStore := store.NewPwFile(noSuchFile)
@@ -161,3 +210,88 @@ func TestSha256sum(t *testing.T) {
     t.Errorf("sha256sum got %s want %s", got, want)
   }
 }
+
+func TestUsernamePolicy(t *testing.T) {
+  testConfig, pf := makeTestConfig(t)
+  defer os.Remove(pf.Name())    // clean up
+  up := users.NewUsernamePolicy()
+  testConfig.UsernamePolicy = up
+  testConfig.Store.(*store.PwFile).SetUsernamePolicy(up)
+  aclFilename := filepath.Join(t.TempDir(), "acl.txt")
+  if err := ioutil.WriteFile(aclFilename, []byte("Alice,edit,doc/1\n"), 0600); err != nil {
+    t.Fatalf("error writing acl file: %v", err)
+  }
+  testConfig.ACLStore = acl.NewFile(aclFilename)
+  engine, err := policy.NewEngineFromPolicy(&policy.Policy{Rules: []*policy.Rule{
+    {Id: "alice-deploy", Effect: policy.Allow, Principals: []string{"ALICE"}, Permissions: []permissions.Permission{"deploy"}},
+  }})
+  if err != nil {
+    t.Fatalf("error creating policy engine: %v", err)
+  }
+  testConfig.Policy = engine
+  h := NewHandler(testConfig)
+  // Rules are matched against the canonical username.
+  alice := users.NewUser("alice", "", nil)
+  if allowed, _ := acl.Allowed(testConfig.ACLStore, alice, "edit", "doc/1"); !allowed {
+    t.Errorf("acl grant for Alice should apply to alice")
+  }
+  if !engine.Evaluate(&policy.Request{Subject: alice, Permission: "deploy", Time: time.Now()}).Allowed {
+    t.Errorf("policy rule for ALICE should apply to alice")
+  }
+  if err := h.UpdatePassword(" Alice", "abcd"); err != nil {
+    t.Fatalf("failed to update password: %v", err)
+  }
+  if testConfig.Store.User("alice") == nil {
+    t.Fatalf("expected user to be stored as alice")
+  }
+  // The client calculates the hashword with the canonical username.
+  hashword := sha256sum("alice/abcd")
+  req, err := http.NewRequest("GET", "/auth/login?username=ALICE&hashword=" + hashword, nil)
+  if err != nil {
+    t.Fatalf("error creating auth login request: %v", err)
+  }
+  rr := httptest.NewRecorder()
+  h.login(rr, req)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Errorf("login as ALICE: got status %d, want %d", got, want)
+  }
+  if err := h.UpdatePassword("bad name", "abcd"); !errors.Is(err, users.ErrInvalidUsername) {
+    t.Errorf("update password for bad name: got %v, want %v", err, users.ErrInvalidUsername)
+  }
+}
+
+// A user table created before PwDB had migrations is updated by Load,
+// so that users can still log in.
+func TestLoginWithOldPwDB(t *testing.T) {
+  db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "old.db"))
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  defer db.Close()
+  if _, err := db.Exec("CREATE TABLE user(id string, cryptword string, permissions string, primary key(id));"); err != nil {
+    t.Fatalf("error creating old user table: %v", err)
+  }
+  h := &Handler{config: &Config{}}
+  saltword, err := h.passwordSaltword("user1", "abcd")
+  if err != nil {
+    t.Fatalf("error generating saltword: %v", err)
+  }
+  if _, err := db.Exec("INSERT INTO user(id, cryptword, permissions) VALUES(?, ?, '');", "user1", saltword); err != nil {
+    t.Fatalf("error inserting user: %v", err)
+  }
+
+  h = NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: store.NewPwDB(db),
+    TokenCookieName: "test_cookie",
+  })
+  req, err := http.NewRequest("GET", "/auth/login?username=user1&hashword=" + sha256sum("user1/abcd"), nil)
+  if err != nil {
+    t.Fatalf("error creating auth login request: %v", err)
+  }
+  rr := httptest.NewRecorder()
+  h.login(rr, req)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Errorf("login with old user table: got status %d, want %d", got, want)
+  }
+}
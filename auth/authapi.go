@@ -3,23 +3,32 @@ package auth
 import (
   "context"
   "encoding/json"
+  "errors"
   "fmt"
   "net/http"
   "time"
 
   "github.com/golang/glog"
 
+  "github.com/jimmc/auth/acl"
   "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/policy"
+  "github.com/jimmc/auth/store"
   "github.com/jimmc/auth/users"
 )
 
 type LoginStatus struct {
   LoggedIn bool
-  Permissions string
+  Permissions string                              // Space-separated, for older clients.
+  PermissionList *permissions.Permissions         // Encoded as a JSON array.
+  Realm string `json:",omitempty"`                // The name of the realm, if Config.Realms is used.
 }
 
 const (
   ctxUserKey = "AuthUser"       // Make it a string that the caller can access. Useful for testing.
+  ctxACLKey = "AuthACL"
+  ctxPolicyKey = "AuthPolicy"
+  ctxRealmKey = "AuthRealm"
 )
 
 func (h *Handler) initApiHandler() {
@@ -37,7 +46,7 @@ func (h *Handler) initApiHandler() {
 // with the message "not authenticated".
 // See also RequirePermission and RequireAuthFunc.
 func (h *Handler) RequireAuth(httpHandler http.Handler) http.Handler {
-  return h.RequirePermission(httpHandler, permissions.NoPermission)
+  return h.requirePermission(httpHandler, permissions.NoPermission)
 }
 
 // RequirePermission enforces Authentication and having one permission.
@@ -47,42 +56,249 @@ func (h *Handler) RequireAuth(httpHandler http.Handler) http.Handler {
 // with the message "not authenticated".
 // If the user does not have the specified permission, it returns
 // StatusUnauthorized with a the message "not authorized".
+// If Config.Policy is set, the permission is checked by evaluating the
+// policy, so its deny rules can refuse a permission the user holds and its
+// allow rules can grant one they don't.
 // If both checks pass, the specified handler is called.
 // For more control, you can use RequireAuth instead of RequirePermission,
 // then call CurrentUserHasPermission to check that condition.
+// If any permissions have been registered with permissions.Register,
+// RequirePermission panics if perm is not one of them, so that a typo
+// is caught when the handlers are set up.
 // See also RequirePermissionFunc.
 func (h *Handler) RequirePermission(httpHandler http.Handler, perm permissions.Permission) http.Handler {
-  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
-    currentUser := CurrentUser(r)
-    username := "(no current user)"
-    if currentUser != nil {
-      username = currentUser.Id()
-    }
-    tokenKey := cookieValue(r, h.config.TokenCookieName)
-    idstr := clientIdString(r)
-    token, valid := currentToken(tokenKey, idstr);
-    if !valid {
-      // No token, or token is not valid
-      glog.V(2).Infof("No token or token is not valid for user %q", username)
-      http.Error(w, "Not authenticated", http.StatusUnauthorized)
+  mustBeRegistered(perm)
+  return h.requirePermission(httpHandler, perm)
+}
+
+// mustBeRegistered panics if there is a permissions catalog and perm is not in it.
+func mustBeRegistered(perm permissions.Permission) {
+  if perm != permissions.NoPermission && len(permissions.Catalog()) > 0 && !permissions.Registered(perm) {
+    panic(fmt.Sprintf("permission %q is not registered", perm))
+  }
+}
+
+func (h *Handler) requirePermission(httpHandler http.Handler, perm permissions.Permission) http.Handler {
+  return h.forRealm(func(h *Handler, w http.ResponseWriter, r *http.Request){
+    token, ok := h.authenticate(w, r)
+    if !ok {
       return
     }
-    if perm != permissions.NoPermission {
+    if perm != permissions.NoPermission && h.config.Policy != nil {
+      d := h.config.Policy.Evaluate(policy.NewRequest(r, token.User(), perm))
+      if !d.Allowed {
+        glog.V(2).Infof("Not authorized: user %q permission %q: %s", token.User().Id(), perm, d.Reason)
+        http.Error(w, "Not authorized: " + d.Reason, http.StatusUnauthorized)
+        return
+      }
+    } else if perm != permissions.NoPermission {
       if !CurrentUserHasPermission(r, perm) {
-        glog.V(2).Infof("Not authorized: user %q does not have permission %q", username, perm)
+        glog.V(2).Infof("Not authorized: user %q does not have permission %q", CurrentUsername(r), perm)
         http.Error(w, "Not authorized", http.StatusUnauthorized)
         return
       }
     }
+    h.serveWithToken(w, r, token, httpHandler)
+  })
+}
+
+// Require enforces Authentication and that the user satisfies
+// a permissions.Requirement, such as
+//   permissions.AnyOf(CanEdit, HasRoot)
+// or a requirement parsed by permissions.ParseRequirement.
+// Use this function to wrap the call to your handler when you
+// call http.NewServeMux().Handle().
+// If the user is not authenticated, it returns StatusUnauthorized
+// with the message "not authenticated".
+// If the user does not satisfy the requirement, it returns
+// StatusUnauthorized with a message saying what was missing.
+// If Config.Policy is set, each permission in the requirement is checked
+// by evaluating the policy, as for RequirePermission, so a permission
+// refused by a deny rule counts as not held: AnyOf(a, b) is still met by
+// a user with b when a is denied.
+// Like RequirePermission, it panics if any of the permissions in the
+// requirement is not registered.
+// See also RequireFunc and CurrentUserSatisfies.
+func (h *Handler) Require(httpHandler http.Handler, req permissions.Requirement) http.Handler {
+  for _, perm := range permissions.RequiredPermissions(req) {
+    mustBeRegistered(perm)
+  }
+  return h.forRealm(func(h *Handler, w http.ResponseWriter, r *http.Request){
+    token, ok := h.authenticate(w, r)
+    if !ok {
+      return
+    }
+    user := token.User()
+    var checker permissions.Checker = user
+    if h.config.Policy != nil {
+      checker = &policyChecker{engine: h.config.Policy, r: r, user: user}
+    }
+    if missing := req.Missing(checker); missing != "" {
+      glog.V(2).Infof("Not authorized: user %q does not satisfy %q: %s", user.Id(), req, missing)
+      http.Error(w, "Not authorized: " + missing, http.StatusUnauthorized)
+      return
+    }
+    h.serveWithToken(w, r, token, httpHandler)
+  })
+}
+
+// policyChecker is a permissions.Checker that has a permission if the
+// policy allows it for the user and request. A permission that a deny
+// rule refuses is one the checker does not have, so a requirement is
+// evaluated with each denied permission treated as false.
+type policyChecker struct {
+  engine *policy.Engine
+  r *http.Request
+  user *users.User
+}
+
+func (pc *policyChecker) HasPermission(perm permissions.Permission) bool {
+  d := pc.engine.Evaluate(policy.NewRequest(pc.r, pc.user, perm))
+  if !d.Allowed {
+    glog.V(2).Infof("Policy does not allow user %q permission %q: %s", pc.user.Id(), perm, d.Reason)
+  }
+  return d.Allowed
+}
+
+// authenticate returns the valid token for the request. If there is none,
+// it writes a StatusUnauthorized response and returns false. If the
+// Store fails, it writes a StatusServiceUnavailable response.
+// If Config.ReloadUser is set, the token's user is read again from the
+// Store, and a user who has been deleted or disabled is not authenticated.
+func (h *Handler) authenticate(w http.ResponseWriter, r *http.Request) (*Token, bool) {
+  tokenKey := cookieValue(r, h.config.TokenCookieName)
+  idstr := clientIdString(r)
+  token, valid := currentToken(h.realm, tokenKey, idstr);
+  if !valid && h.config.BasicAuth {
+    var err error
+    token, valid, err = h.basicAuthToken(r, idstr)
+    if err != nil {
+      storeUnavailable(w, err)
+      return nil, false
+    }
+  } else if valid && h.config.ReloadUser {
+    user, err := h.contextStore().UserContext(r.Context(), token.User().Id())
+    if err != nil {
+      storeUnavailable(w, err)
+      return nil, false
+    }
+    if user == nil || user.Disabled() {
+      valid = false
+    } else {
+      token.setUser(user)
+    }
+  }
+  if !valid {
+    // No token, or token is not valid
+    glog.V(2).Infof("No token or token is not valid for user %q", CurrentUsername(r))
+    http.Error(w, "Not authenticated", http.StatusUnauthorized)
+    return nil, false
+  }
+  return token, true
+}
+
+// basicAuthToken checks the HTTP Basic credentials of the request, if any.
+// If they are valid, it returns a token for the user that is used only
+// for this request, so no cookie is set for it.
+func (h *Handler) basicAuthToken(r *http.Request, idstr string) (*Token, bool, error) {
+  username, password, ok := r.BasicAuth()
+  if !ok {
+    return nil, false, nil
+  }
+  username = h.canonicalUsername(username)
+  user, err := h.checkCredentials(r.Context(), username, "", password)
+  if err != nil {
+    return nil, false, err
+  }
+  if user == nil {
+    glog.V(2).Infof("Invalid basic auth credentials for user %q", username)
+    return nil, false, nil
+  }
+  return requestToken(h.realm, user, idstr), true, nil
+}
+
+// serveWithToken renews the token, then calls httpHandler with the
+// token's user in the request context.
+func (h *Handler) serveWithToken(w http.ResponseWriter, r *http.Request, token *Token, httpHandler http.Handler) {
+  if token.Key != "" {
     token.updateTimeout(h.config.TokenTimeoutDuration)
     http.SetCookie(w, token.cookie(h.config.TokenCookieName)) // Set the renewed cookie
     http.SetCookie(w, token.timeoutCookie(h.config.TokenCookieName)) // Set the timeout cookie
+  }
+  user := token.User()
+  rwcu := requestWithContextUser(r, user)
+  if h.realm != "" {
+    rwcu = rwcu.WithContext(context.WithValue(rwcu.Context(), ctxRealmKey, h.realm))
+  }
+  if h.config.ACLStore != nil {
+    rwcu = rwcu.WithContext(context.WithValue(rwcu.Context(), ctxACLKey, h.config.ACLStore))
+  }
+  if h.config.Policy != nil {
+    rwcu = rwcu.WithContext(context.WithValue(rwcu.Context(), ctxPolicyKey, h.config.Policy))
+  }
+  httpHandler.ServeHTTP(w, rwcu)
+}
+
+// RequireResourcePermission enforces Authentication and having a permission
+// on the resource named by calling resourceFromRequest. The user has the
+// permission on the resource if they hold the permission itself, or if
+// a grant in Config.ACLStore gives it to them for that resource.
+// If the user is not authenticated, it returns StatusUnauthorized
+// with the message "not authenticated".
+// If the user does not have the permission on the resource, it returns
+// StatusUnauthorized with a message naming the permission and resource.
+// If Config.Policy is set, a deny rule for the permission refuses it
+// even if there is a grant, and an allow rule grants it on all resources.
+// Like RequirePermission, it panics if perm is not registered.
+// See also CurrentUserCan.
+func (h *Handler) RequireResourcePermission(httpHandler http.Handler, perm permissions.Permission, resourceFromRequest func(*http.Request) string) http.Handler {
+  mustBeRegistered(perm)
+  return h.forRealm(func(h *Handler, w http.ResponseWriter, r *http.Request){
+    token, ok := h.authenticate(w, r)
+    if !ok {
+      return
+    }
     user := token.User()
-    rwcu := requestWithContextUser(r, user)
-    httpHandler.ServeHTTP(w, rwcu)
+    resource := resourceFromRequest(r)
+    allowed, err := userCan(h.config.Policy, h.config.ACLStore, r, user, perm, resource)
+    if err != nil {
+      glog.Errorf("Error checking permission %q on %q for user %q: %v", perm, resource, user.Id(), err)
+      http.Error(w, "Error checking authorization", http.StatusInternalServerError)
+      return
+    }
+    if !allowed {
+      glog.V(2).Infof("Not authorized: user %q does not have permission %q on %q", user.Id(), perm, resource)
+      http.Error(w, fmt.Sprintf("Not authorized: missing permission %s on %s", perm, resource), http.StatusUnauthorized)
+      return
+    }
+    h.serveWithToken(w, r, token, httpHandler)
   })
 }
 
+// RequireResourcePermissionFunc is like RequireResourcePermission, except that
+// it is for use to wrap a handler func rather than a Handler.
+func (h *Handler) RequireResourcePermissionFunc(handleFunc func(http.ResponseWriter, *http.Request), perm permissions.Permission, resourceFromRequest func(*http.Request) string) func(http.ResponseWriter, *http.Request) {
+  return h.RequireResourcePermission(http.HandlerFunc(handleFunc), perm, resourceFromRequest).ServeHTTP
+}
+
+// userCan returns true if the user has perm, or if acls gives the user
+// perm on resource. If there is a policy, it decides whether the user
+// has perm, and its deny rules also override acls.
+func userCan(engine *policy.Engine, acls acl.Store, r *http.Request, user *users.User, perm permissions.Permission, resource string) (bool, error) {
+  if engine != nil {
+    d := engine.Evaluate(policy.NewRequest(r, user, perm))
+    if d.Allowed || d.Denied() {
+      return d.Allowed, nil
+    }
+  } else if user.HasPermission(perm) {
+    return true, nil
+  }
+  if acls == nil {
+    return false, nil
+  }
+  return acl.Allowed(acls, user, perm, resource)
+}
+
 // RequireAuthFunc is like RequireAuth, except that it is for use to wrap
 // a handler func rather than a Handler.
 func (h *Handler) RequireAuthFunc(handleFunc func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -95,6 +311,12 @@ func (h *Handler) RequirePermissionFunc(handleFunc func(http.ResponseWriter, *ht
   return h.RequirePermission(http.HandlerFunc(handleFunc), perm).ServeHTTP
 }
 
+// RequireFunc is like Require, except that it is for use to wrap
+// a handler func rather than a Handler.
+func (h *Handler) RequireFunc(handleFunc func(http.ResponseWriter, *http.Request), req permissions.Requirement) func(http.ResponseWriter, *http.Request) {
+  return h.Require(http.HandlerFunc(handleFunc), req).ServeHTTP
+}
+
 func requestWithContextUser(r *http.Request, user *users.User) *http.Request {
   cwv := context.WithValue(r.Context(), ctxUserKey, user)
   return r.WithContext(cwv)
@@ -109,6 +331,14 @@ func CurrentUser(r *http.Request) *users.User {
   return v.(*users.User)
 }
 
+// CurrentRealm returns the name of the realm in which the user from the
+// request context was authenticated, or an empty string if there is no
+// user found or the Handler does not use realms.
+func CurrentRealm(r *http.Request) string {
+  realm, _ := r.Context().Value(ctxRealmKey).(string)
+  return realm
+}
+
 // CurrentUsername returns the current username, or a placeholder string if
 // there is no current user.
 func CurrentUsername(r *http.Request) string {
@@ -119,14 +349,60 @@ func CurrentUsername(r *http.Request) string {
   return user.Id()
 }
 
+// currentChecker returns the permissions.Checker for the user from the
+// request context, which evaluates Config.Policy if it is set, or nil if
+// there is no user found.
+func currentChecker(r *http.Request) permissions.Checker {
+  user := CurrentUser(r)
+  if user == nil {
+    return nil
+  }
+  if engine, ok := r.Context().Value(ctxPolicyKey).(*policy.Engine); ok {
+    return &policyChecker{engine: engine, r: r, user: user}
+  }
+  return user
+}
+
 // CurrentUserHasPermissions returns true if the user from the request context has
 // the specified permission, or false if they do not, or if there is no user found.
+// If Config.Policy is set, the permission is checked by evaluating the policy.
 func CurrentUserHasPermission(r *http.Request, perm permissions.Permission) bool {
+  checker := currentChecker(r)
+  if checker == nil {
+    return false
+  }
+  return checker.HasPermission(perm)
+}
+
+// CurrentUserSatisfies returns true if the user from the request context
+// satisfies the requirement, or false if they do not, or if there is no
+// user found. If Config.Policy is set, it is applied as for Require.
+func CurrentUserSatisfies(r *http.Request, req permissions.Requirement) bool {
+  checker := currentChecker(r)
+  if checker == nil {
+    return false
+  }
+  return req.Satisfied(checker)
+}
+
+// CurrentUserCan returns true if the user from the request context has
+// the permission on the resource, either from their own permissions or
+// from a grant in Config.ACLStore, subject to Config.Policy as for
+// RequireResourcePermission. It returns false if there is no user
+// found, or if there is an error reading the grants.
+func CurrentUserCan(r *http.Request, perm permissions.Permission, resource string) bool {
   user := CurrentUser(r)
   if user == nil {
     return false
   }
-  return user.HasPermission(perm)
+  acls, _ := r.Context().Value(ctxACLKey).(acl.Store)
+  engine, _ := r.Context().Value(ctxPolicyKey).(*policy.Engine)
+  allowed, err := userCan(engine, acls, r, user, perm, resource)
+  if err != nil {
+    glog.Errorf("Error checking permission %q on %q for user %q: %v", perm, resource, user.Id(), err)
+    return false
+  }
+  return allowed
 }
 
 // CurrentPermissions returns the set of permissions for the user from the
@@ -144,29 +420,34 @@ func (h *Handler) apiPrefix(s string) string {
 }
 
 func (h *Handler) login(w http.ResponseWriter, r *http.Request) {
-  username := r.FormValue("username")
+  username := h.canonicalUsername(r.FormValue("username"))
   glog.V(4).Infof("login username=%s", username)
   hashword := r.FormValue("hashword")
   glog.V(4).Infof("login hashword=%s", hashword)
+  password := r.FormValue("password")
 
-  user := h.config.Store.User(username)
-  if user != nil && h.hashwordIsValid(username, hashword) {
+  user, err := h.checkCredentials(r.Context(), username, hashword, password)
+  if err != nil {
+    storeUnavailable(w, err)
+    return
+  }
+  if user != nil {
     // OK to log in; generate a bearer token and put in a cookie
     idstr := clientIdString(r)
-    token := newToken(user, idstr, h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+    token := newToken(h.realm, user, idstr, h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
     http.SetCookie(w, token.cookie(h.config.TokenCookieName))
     http.SetCookie(w, token.timeoutCookie(h.config.TokenCookieName))
   } else {
-    if user==nil {
-      glog.Errorf("user is nil in login")
-    }
+    glog.V(2).Infof("Invalid login credentials for user %q", username)
     http.Error(w, "Invalid username or password", http.StatusUnauthorized)
     return
   }
 
   result := &LoginStatus{
     LoggedIn: true,
+    Realm: h.realm,
     Permissions: user.PermissionsString(),
+    PermissionList: user.Permissions(),
   }
   b, err := json.MarshalIndent(result, "", "  ")
   if err != nil {
@@ -177,6 +458,42 @@ func (h *Handler) login(w http.ResponseWriter, r *http.Request) {
   w.Write(b)
 }
 
+// checkCredentials returns the user if the credentials are valid, nil if
+// they are not, or an error if the Store fails. If the Store is a
+// store.Authenticator, such as store.LDAP, it checks the plain password
+// itself, and the hashword is not used.
+func (h *Handler) checkCredentials(ctx context.Context, username, hashword, password string) (*users.User, error) {
+  if a, ok := h.config.Store.(store.Authenticator); ok {
+    user, err := a.Authenticate(ctx, username, password)
+    if !errors.Is(err, store.ErrNotSupported) {
+      return user, err
+    }
+    // A wrapper store around a store that uses saltwords.
+  }
+  user, err := h.contextStore().UserContext(ctx, username)
+  if err != nil || user == nil {
+    return nil, err
+  }
+  if !h.credentialsAreValid(user, hashword, password) {
+    return nil, nil
+  }
+  return user, nil
+}
+
+// credentialsAreValid checks the hashword calculated by the client if
+// there is one, and otherwise the plain password. Plain passwords are
+// needed for users whose passwords were set by other servers, such as
+// in an htpasswd file, and should only be sent over https.
+func (h *Handler) credentialsAreValid(user *users.User, hashword, password string) bool {
+  if hashword != "" {
+    return saltwordMatchesHashword(user.Id(), user.Saltword(), hashword)
+  }
+  if password != "" {
+    return h.saltwordMatchesPassword(user.Id(), user.Saltword(), password)
+  }
+  return false
+}
+
 func (h *Handler) logout(w http.ResponseWriter, r *http.Request) {
   // Clear our token cookie
   tokenCookie := &http.Cookie{
@@ -200,15 +517,17 @@ func (h *Handler) logout(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) status(w http.ResponseWriter, r *http.Request) {
   tokenKey := cookieValue(r, h.config.TokenCookieName)
   idstr := clientIdString(r)
-  token, loggedIn := currentToken(tokenKey, idstr)
+  token, loggedIn := currentToken(h.realm, tokenKey, idstr)
   result := &LoginStatus{
     LoggedIn: loggedIn,
+    Realm: h.realm,
   }
   if loggedIn {
     token.updateTimeout(h.config.TokenTimeoutDuration)
     http.SetCookie(w, token.cookie(h.config.TokenCookieName)) // Set the renewed cookie
     http.SetCookie(w, token.timeoutCookie(h.config.TokenCookieName))
     result.Permissions = token.User().PermissionsString()
+    result.PermissionList = token.User().Permissions()
   }
 
   b, err := json.MarshalIndent(result, "", "  ")
@@ -240,7 +559,7 @@ func AddTokenCookieForTesting(r *http.Request, config *Config) error {
     return fmt.Errorf("No user in request")
   }
   idstr := clientIdString(r)
-  token := newToken(user, idstr, config.TokenTimeoutDuration, config.TokenExpiryDuration)
+  token := newToken("", user, idstr, config.TokenTimeoutDuration, config.TokenExpiryDuration)
   c := token.cookie(config.TokenCookieName)
   r.AddCookie(c)
   return nil
@@ -4,9 +4,12 @@ import (
   "encoding/json"
   "net/http"
   "net/http/httptest"
+  "strings"
   "testing"
 
+  "github.com/jimmc/auth/acl"
   "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/policy"
   "github.com/jimmc/auth/store"
   "github.com/jimmc/auth/users"
 )
@@ -69,7 +72,7 @@ func TestRequireAuth(t *testing.T) {
   rr = httptest.NewRecorder()
   user := users.NewUser("user1", "cw1", nil)
   idstr := clientIdString(req)
-  token := newToken(user, idstr, h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+  token := newToken("", user, idstr, h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
   cookie := token.cookie(h.config.TokenCookieName)
   req.AddCookie(cookie)
   reqUser = nil
@@ -102,7 +105,7 @@ func TestRequireAuth(t *testing.T) {
   rr = httptest.NewRecorder()
   user = users.NewUser("user1", "cw1", permissions.FromString("something"))
   idstr = clientIdString(req)
-  token = newToken(user, idstr, h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+  token = newToken("", user, idstr, h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
   cookie = token.cookie(h.config.TokenCookieName)
   req.AddCookie(cookie)
   reqUser = nil
@@ -195,6 +198,11 @@ func TestLogin(t *testing.T) {
   if got, want := result.LoggedIn, true; got != want {
     t.Errorf("wrong login status: got %v, want %v", got, want)
   }
+  if result.PermissionList == nil {
+    t.Errorf("login status should include PermissionList; response is %q", string(body))
+  } else if got, want := result.PermissionList.ToString(), result.Permissions; got != want {
+    t.Errorf("PermissionList: got %q, want %q", got, want)
+  }
 
   logoutUrl := "/auth/logout"
   req, err = http.NewRequest("GET", logoutUrl, nil)
@@ -231,3 +239,382 @@ func TestLogin(t *testing.T) {
     t.Errorf("wrong login status after logout: got %v, want %v", got, want)
   }
 }
+
+func TestCurrentUserHasPermissionWithRoles(t *testing.T) {
+  roles := permissions.NewRoles()
+  roles.SetRole("doer", permissions.FromString("something"))
+  perms := permissions.FromString("@doer")
+  perms.SetRoles(roles)
+  req, err := http.NewRequest("GET", "/api/list/d1", nil)
+  if err != nil {
+    t.Fatalf("error creating request: %v", err)
+  }
+  req = requestWithContextUser(req, users.NewUser("user1", "cw1", perms))
+  if got, want := CurrentUserHasPermission(req, CanDoSomething), true; got != want {
+    t.Errorf("permission through role: got %v, want %v", got, want)
+  }
+}
+
+func TestRequire(t *testing.T) {
+  pf := store.NewPwFile("testdata/pw1.txt")
+  h := NewHandler(&Config{
+    Prefix: "/pre/",
+    Store: pf,
+    TokenCookieName: "test_cookie",
+  })
+  called := false
+  baseFunc := func(w http.ResponseWriter, r *http.Request) {
+    called = true
+    if got, want := CurrentUserSatisfies(r, permissions.AnyOf(permissions.Permission("edit"), permissions.Permission("root"))), true; got != want {
+      t.Errorf("CurrentUserSatisfies in handler: got %v, want %v", got, want)
+    }
+  }
+  req := permissions.MustParseRequirement("edit | (root & !readonly)")
+  wrappedHandler := h.Require(http.HandlerFunc(baseFunc), req)
+  wrappedFunc := h.RequireFunc(baseFunc, req)
+
+  tests := []struct{
+    perms string
+    code int
+    body string
+  }{
+    {"", http.StatusUnauthorized, "Not authorized: requires one of edit, (root & !readonly)\n"},
+    {"edit", http.StatusOK, ""},
+    {"root", http.StatusOK, ""},
+    {"root readonly", http.StatusUnauthorized, "Not authorized: requires one of edit, (root & !readonly)\n"},
+  }
+  for _, tt := range tests {
+    for _, wrapped := range []http.HandlerFunc{wrappedHandler.ServeHTTP, wrappedFunc} {
+      r, err := http.NewRequest("GET", "/api/edit2", nil)
+      if err != nil {
+        t.Fatalf("error creating request: %v", err)
+      }
+      user := users.NewUser("user1", "cw1", permissions.FromString(tt.perms))
+      token := newToken("", user, clientIdString(r), h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+      r.AddCookie(token.cookie(h.config.TokenCookieName))
+      rr := httptest.NewRecorder()
+      called = false
+      wrapped(rr, r)
+      if got, want := rr.Code, tt.code; got != want {
+        t.Errorf("Require with perms %q: got status %d, want %d", tt.perms, got, want)
+      }
+      if got, want := called, tt.code == http.StatusOK; got != want {
+        t.Errorf("Require with perms %q: handler called %v, want %v", tt.perms, got, want)
+      }
+      if tt.body != "" {
+        if got, want := rr.Body.String(), tt.body; got != want {
+          t.Errorf("Require with perms %q: got body %q, want %q", tt.perms, got, want)
+        }
+      }
+    }
+  }
+
+  r, err := http.NewRequest("GET", "/api/edit2", nil)
+  if err != nil {
+    t.Fatalf("error creating request: %v", err)
+  }
+  rr := httptest.NewRecorder()
+  wrappedHandler.ServeHTTP(rr, r)
+  if got, want := rr.Code, http.StatusUnauthorized; got != want {
+    t.Errorf("Require with no token: got status %d, want %d", got, want)
+  }
+  if got, want := CurrentUserSatisfies(r, permissions.Not(permissions.Permission("edit"))), false; got != want {
+    t.Errorf("CurrentUserSatisfies with no user: got %v, want %v", got, want)
+  }
+}
+
+func TestRequireResourcePermission(t *testing.T) {
+  acls := acl.NewFile("/no/such/file/acl.txt")
+  acls.AddGrant(&acl.Grant{Principal: "user1", Permission: "edit", Resource: "doc/42"})
+  h := NewHandler(&Config{
+    Prefix: "/pre/",
+    Store: store.NewPwFile("testdata/pw1.txt"),
+    TokenCookieName: "test_cookie",
+    ACLStore: acls,
+  })
+  called := false
+  baseFunc := func(w http.ResponseWriter, r *http.Request) {
+    called = true
+    if got, want := CurrentUserCan(r, "edit", "doc/42"), true; got != want {
+      t.Errorf("CurrentUserCan edit doc/42: got %v, want %v", got, want)
+    }
+    if got, want := CurrentUserCan(r, "delete", "doc/42"), CurrentUserHasPermission(r, "delete"); got != want {
+      t.Errorf("CurrentUserCan delete doc/42: got %v, want %v", got, want)
+    }
+  }
+  docFromPath := func(r *http.Request) string {
+    return strings.TrimPrefix(r.URL.Path, "/api/")
+  }
+  wrapped := h.RequireResourcePermissionFunc(baseFunc, "edit", docFromPath)
+
+  tests := []struct{
+    username string
+    perms string
+    path string
+    code int
+  }{
+    {"user1", "", "/api/doc/42", http.StatusOK},
+    {"user1", "", "/api/doc/43", http.StatusUnauthorized},
+    {"user2", "", "/api/doc/42", http.StatusUnauthorized},
+    {"user2", "edit", "/api/doc/43", http.StatusOK},
+  }
+  for _, tt := range tests {
+    r, err := http.NewRequest("GET", tt.path, nil)
+    if err != nil {
+      t.Fatalf("error creating request: %v", err)
+    }
+    user := users.NewUser(tt.username, "", permissions.FromString(tt.perms))
+    token := newToken("", user, clientIdString(r), h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+    r.AddCookie(token.cookie(h.config.TokenCookieName))
+    rr := httptest.NewRecorder()
+    called = false
+    wrapped(rr, r)
+    if got, want := rr.Code, tt.code; got != want {
+      t.Errorf("%s with perms %q on %s: got status %d, want %d", tt.username, tt.perms, tt.path, got, want)
+    }
+    if got, want := called, tt.code == http.StatusOK; got != want {
+      t.Errorf("%s with perms %q on %s: handler called %v, want %v", tt.username, tt.perms, tt.path, got, want)
+    }
+  }
+
+  r, err := http.NewRequest("GET", "/api/doc/42", nil)
+  if err != nil {
+    t.Fatalf("error creating request: %v", err)
+  }
+  if got, want := CurrentUserCan(r, "edit", "doc/42"), false; got != want {
+    t.Errorf("CurrentUserCan with no user: got %v, want %v", got, want)
+  }
+}
+
+func TestResourcePermissionWithPolicy(t *testing.T) {
+  p, err := policy.Parse([]byte(`{"rules": [
+    {"id": "no-edit", "effect": "deny", "principals": ["user2"], "permissions": ["edit"]},
+    {"id": "no-delete", "effect": "deny", "principals": ["user3"], "permissions": ["delete"]}
+  ]}`))
+  if err != nil {
+    t.Fatalf("error parsing policy: %v", err)
+  }
+  engine, err := policy.NewEngineFromPolicy(p)
+  if err != nil {
+    t.Fatalf("error creating policy engine: %v", err)
+  }
+  acls := acl.NewFile("/no/such/file/acl.txt")
+  acls.AddGrant(&acl.Grant{Principal: "user1", Permission: "edit", Resource: "doc/42"})
+  acls.AddGrant(&acl.Grant{Principal: "user2", Permission: "edit", Resource: "doc/42"})
+  acls.AddGrant(&acl.Grant{Principal: "user3", Permission: "delete", Resource: "doc/42"})
+  h := NewHandler(&Config{
+    Prefix: "/pre/",
+    Store: store.NewPwFile("testdata/pw1.txt"),
+    TokenCookieName: "test_cookie",
+    ACLStore: acls,
+    Policy: engine,
+  })
+  serve := func(handler http.Handler, username, perms string) int {
+    t.Helper()
+    r, err := http.NewRequest("GET", "/api/doc/42", nil)
+    if err != nil {
+      t.Fatalf("error creating request: %v", err)
+    }
+    user := users.NewUser(username, "", permissions.FromString(perms))
+    token := newToken("", user, clientIdString(r), h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+    r.AddCookie(token.cookie(h.config.TokenCookieName))
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, r)
+    return rr.Code
+  }
+  docFromPath := func(r *http.Request) string {
+    return strings.TrimPrefix(r.URL.Path, "/api/")
+  }
+  edit := h.RequireResourcePermission(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "edit", docFromPath)
+  if got, want := serve(edit, "user1", ""), http.StatusOK; got != want {
+    t.Errorf("user1 with grant: got status %d, want %d", got, want)
+  }
+  if got, want := serve(edit, "user2", ""), http.StatusUnauthorized; got != want {
+    t.Errorf("user2 with grant and deny rule: got status %d, want %d", got, want)
+  }
+
+  // The deny rule for user3 applies to the current user functions.
+  checks := h.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if got, want := CurrentUserHasPermission(r, "edit"), true; got != want {
+      t.Errorf("CurrentUserHasPermission edit: got %v, want %v", got, want)
+    }
+    if got, want := CurrentUserHasPermission(r, "delete"), false; got != want {
+      t.Errorf("CurrentUserHasPermission delete: got %v, want %v", got, want)
+    }
+    if got, want := CurrentUserSatisfies(r, permissions.MustParseRequirement("edit & delete")), false; got != want {
+      t.Errorf("CurrentUserSatisfies edit & delete: got %v, want %v", got, want)
+    }
+    if got, want := CurrentUserSatisfies(r, permissions.MustParseRequirement("edit | delete")), true; got != want {
+      t.Errorf("CurrentUserSatisfies edit | delete: got %v, want %v", got, want)
+    }
+    if got, want := CurrentUserCan(r, "delete", "doc/42"), false; got != want {
+      t.Errorf("CurrentUserCan delete doc/42: got %v, want %v", got, want)
+    }
+  }))
+  if got, want := serve(checks, "user3", "edit delete"), http.StatusOK; got != want {
+    t.Errorf("user3: got status %d, want %d", got, want)
+  }
+}
+
+func TestRequirePermissionWithPolicy(t *testing.T) {
+  p, err := policy.Parse([]byte(`{"rules": [
+    {"id": "no-delete", "effect": "deny", "principals": ["user2"], "permissions": ["something"]},
+    {"id": "grant", "effect": "allow", "principals": ["user3"], "permissions": ["something"]},
+    {"id": "no-readonly", "effect": "deny", "principals": ["user4"], "permissions": ["readonly"]}
+  ]}`))
+  if err != nil {
+    t.Fatalf("error parsing policy: %v", err)
+  }
+  engine, err := policy.NewEngineFromPolicy(p)
+  if err != nil {
+    t.Fatalf("error creating policy engine: %v", err)
+  }
+  h := NewHandler(&Config{
+    Prefix: "/pre/",
+    Store: store.NewPwFile("testdata/pw1.txt"),
+    TokenCookieName: "test_cookie",
+    Policy: engine,
+  })
+  called := false
+  wrapped := h.RequirePermissionFunc(func(w http.ResponseWriter, r *http.Request) {
+    called = true
+  }, CanDoSomething)
+
+  tests := []struct{
+    username string
+    perms string
+    code int
+    body string
+  }{
+    {"user1", "something", http.StatusOK, ""},
+    {"user1", "", http.StatusUnauthorized, "Not authorized: missing permission something\n"},
+    {"user2", "something", http.StatusUnauthorized, "Not authorized: denied by rule no-delete\n"},
+    {"user3", "", http.StatusOK, ""},
+  }
+  for _, tt := range tests {
+    r, err := http.NewRequest("GET", "/api/something", nil)
+    if err != nil {
+      t.Fatalf("error creating request: %v", err)
+    }
+    user := users.NewUser(tt.username, "", permissions.FromString(tt.perms))
+    token := newToken("", user, clientIdString(r), h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+    r.AddCookie(token.cookie(h.config.TokenCookieName))
+    rr := httptest.NewRecorder()
+    called = false
+    wrapped(rr, r)
+    if got, want := rr.Code, tt.code; got != want {
+      t.Errorf("%s with perms %q: got status %d, want %d", tt.username, tt.perms, got, want)
+    }
+    if got, want := called, tt.code == http.StatusOK; got != want {
+      t.Errorf("%s with perms %q: handler called %v, want %v", tt.username, tt.perms, got, want)
+    }
+    if tt.body != "" && rr.Body.String() != tt.body {
+      t.Errorf("%s with perms %q: got body %q, want %q", tt.username, tt.perms, rr.Body.String(), tt.body)
+    }
+  }
+}
+
+func TestRequireWithPolicy(t *testing.T) {
+  p, err := policy.Parse([]byte(`{"rules": [
+    {"id": "no-delete", "effect": "deny", "principals": ["user2"], "permissions": ["something"]},
+    {"id": "grant", "effect": "allow", "principals": ["user3"], "permissions": ["something"]},
+    {"id": "no-readonly", "effect": "deny", "principals": ["user4"], "permissions": ["readonly"]}
+  ]}`))
+  if err != nil {
+    t.Fatalf("error parsing policy: %v", err)
+  }
+  engine, err := policy.NewEngineFromPolicy(p)
+  if err != nil {
+    t.Fatalf("error creating policy engine: %v", err)
+  }
+  h := NewHandler(&Config{
+    Prefix: "/pre/",
+    Store: store.NewPwFile("testdata/pw1.txt"),
+    TokenCookieName: "test_cookie",
+    Policy: engine,
+  })
+  either := h.RequireFunc(func(w http.ResponseWriter, r *http.Request) {},
+      permissions.MustParseRequirement("something | other"))
+  wrapped := h.RequireFunc(func(w http.ResponseWriter, r *http.Request) {},
+      permissions.MustParseRequirement("something & !readonly"))
+
+  tests := []struct{
+    username string
+    perms string
+    code int
+  }{
+    {"user1", "something", http.StatusOK},
+    {"user1", "something readonly", http.StatusUnauthorized},
+    {"user2", "something", http.StatusUnauthorized},
+    {"user3", "", http.StatusOK},
+    // A denied permission counts as not held.
+    {"user4", "something readonly", http.StatusOK},
+  }
+  for _, tt := range tests {
+    r, err := http.NewRequest("GET", "/api/something", nil)
+    if err != nil {
+      t.Fatalf("error creating request: %v", err)
+    }
+    user := users.NewUser(tt.username, "", permissions.FromString(tt.perms))
+    token := newToken("", user, clientIdString(r), h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+    r.AddCookie(token.cookie(h.config.TokenCookieName))
+    rr := httptest.NewRecorder()
+    wrapped(rr, r)
+    if got, want := rr.Code, tt.code; got != want {
+      t.Errorf("%s with perms %q: got status %d, want %d", tt.username, tt.perms, got, want)
+    }
+  }
+
+  // One side of an OR being denied does not refuse the other side.
+  for _, tt := range []struct{
+    username string
+    perms string
+    code int
+  }{
+    {"user2", "something other", http.StatusOK},
+    {"user2", "something", http.StatusUnauthorized},
+  } {
+    r, err := http.NewRequest("GET", "/api/something", nil)
+    if err != nil {
+      t.Fatalf("error creating request: %v", err)
+    }
+    user := users.NewUser(tt.username, "", permissions.FromString(tt.perms))
+    token := newToken("", user, clientIdString(r), h.config.TokenTimeoutDuration, h.config.TokenExpiryDuration)
+    r.AddCookie(token.cookie(h.config.TokenCookieName))
+    rr := httptest.NewRecorder()
+    either(rr, r)
+    if got, want := rr.Code, tt.code; got != want {
+      t.Errorf("AnyOf for %s with perms %q: got status %d, want %d", tt.username, tt.perms, got, want)
+    }
+  }
+}
+
+func TestRequirePermissionUnregistered(t *testing.T) {
+  defer permissions.ClearCatalog()
+  h := NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: store.NewPwFile("testdata/pw1.txt"),
+    TokenCookieName: "test_cookie",
+  })
+  handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+  // With no catalog, any permission is accepted.
+  h.RequirePermission(handler, "edti")
+
+  permissions.Register("edit", "Edit documents")
+  h.RequirePermission(handler, "edit")
+  h.RequireAuth(handler)
+  for _, setup := range []func(){
+    func() { h.RequirePermission(handler, "edti") },
+    func() { h.RequireResourcePermission(handler, "edti", func(r *http.Request) string { return "" }) },
+    func() { h.Require(handler, permissions.MustParseRequirement("edit | !edti")) },
+  } {
+    func() {
+      defer func() {
+        if recover() == nil {
+          t.Errorf("requiring an unregistered permission should panic")
+        }
+      }()
+      setup()
+    }()
+  }
+}
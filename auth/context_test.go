@@ -0,0 +1,132 @@
+package auth
+
+import (
+  "context"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+
+  "github.com/jimmc/auth/store"
+  "github.com/jimmc/auth/users"
+)
+
+var errStoreDown = errors.New("store is down")
+
+// failingStore is a PwFile whose ContextStore methods fail when fail is set.
+type failingStore struct {
+  *store.PwFile
+  fail bool
+}
+
+func (s *failingStore) LoadContext(ctx context.Context) error {
+  if s.fail {
+    return errStoreDown
+  }
+  return s.Load()
+}
+
+func (s *failingStore) SaveContext(ctx context.Context) error {
+  if s.fail {
+    return errStoreDown
+  }
+  return s.Save()
+}
+
+func (s *failingStore) UserContext(ctx context.Context, username string) (*users.User, error) {
+  if s.fail {
+    return nil, errStoreDown
+  }
+  return s.User(username), nil
+}
+
+func (s *failingStore) SetSaltwordContext(ctx context.Context, username, saltword string) error {
+  if s.fail {
+    return errStoreDown
+  }
+  s.SetSaltword(username, saltword)
+  return nil
+}
+
+func (s *failingStore) UserCountContext(ctx context.Context) (int, error) {
+  if s.fail {
+    return 0, errStoreDown
+  }
+  return s.UserCount(), nil
+}
+
+func loginRequest(t *testing.T, h *Handler, username, password string) *httptest.ResponseRecorder {
+  t.Helper()
+  hashword := sha256sum(username + "/" + password)
+  req, err := http.NewRequest("GET", "/auth/login?username=" + username + "&hashword=" + hashword, nil)
+  if err != nil {
+    t.Fatalf("error creating auth login request: %v", err)
+  }
+  rr := httptest.NewRecorder()
+  h.login(rr, req)
+  return rr
+}
+
+func TestStoreUnavailable(t *testing.T) {
+  fs := &failingStore{PwFile: store.NewPwFile("testdata/pw1.txt")}
+  h := NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: fs,
+    TokenCookieName: "test_cookie",
+    BasicAuth: true,
+    ReloadUser: true,
+  })
+  handler := h.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+  fs.fail = true
+  if got, want := loginRequest(t, h, "user3", "pw3").Code, http.StatusServiceUnavailable; got != want {
+    t.Errorf("login with failing store: got status %d, want %d", got, want)
+  }
+  req, err := http.NewRequest("GET", "/api/list", nil)
+  if err != nil {
+    t.Fatalf("error creating request: %v", err)
+  }
+  req.SetBasicAuth("user3", "pw3")
+  rr := httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusServiceUnavailable; got != want {
+    t.Errorf("basic auth with failing store: got status %d, want %d", got, want)
+  }
+
+  fs.fail = false
+  rr = loginRequest(t, h, "user3", "pw3")
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("login: got status %d, want %d", got, want)
+  }
+  req, err = http.NewRequest("GET", "/api/list", nil)
+  if err != nil {
+    t.Fatalf("error creating request: %v", err)
+  }
+  for _, c := range rr.Result().Cookies() {
+    if c.Name == "test_cookie" {
+      req.AddCookie(c)
+    }
+  }
+  rr = httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Errorf("request after login: got status %d, want %d", got, want)
+  }
+
+  // With ReloadUser, the store is read on each request.
+  fs.fail = true
+  rr = httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusServiceUnavailable; got != want {
+    t.Errorf("request with failing store: got status %d, want %d", got, want)
+  }
+
+  // A disabled user is no longer authenticated.
+  fs.fail = false
+  fs.SetSaltword("user3", users.DisabledPrefix + fs.User("user3").Saltword())
+  rr = httptest.NewRecorder()
+  handler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusUnauthorized; got != want {
+    t.Errorf("request for disabled user: got status %d, want %d", got, want)
+  }
+}
@@ -0,0 +1,121 @@
+package auth
+
+import (
+  "crypto/md5"
+  "crypto/sha1"
+  "crypto/subtle"
+  "encoding/base64"
+  "encoding/hex"
+  "strings"
+
+  "github.com/golang/glog"
+  "golang.org/x/crypto/bcrypt"
+
+  "github.com/jimmc/auth/users"
+)
+
+// Prefixes of the password hash formats used in htpasswd files.
+const (
+  htpasswdSHAPrefix = "{SHA}"
+  htpasswdAPR1Prefix = "$apr1$"
+)
+
+// CheckPassword returns true if password matches hash, which is in one of
+// the formats used in Apache htpasswd files: bcrypt ($2y$, $2a$ or $2b$),
+// SHA1 ({SHA}) or APR1-MD5 ($apr1$). Other formats, including crypt,
+// are not supported.
+func CheckPassword(hash, password string) bool {
+  switch {
+  case strings.HasPrefix(hash, "$2"):
+    return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+  case strings.HasPrefix(hash, htpasswdSHAPrefix):
+    sum := sha1.Sum([]byte(password))
+    want := htpasswdSHAPrefix + base64.StdEncoding.EncodeToString(sum[:])
+    return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+  case strings.HasPrefix(hash, htpasswdAPR1Prefix):
+    salt := strings.TrimPrefix(hash, htpasswdAPR1Prefix)
+    if n := strings.Index(salt, "$"); n >= 0 {
+      salt = salt[:n]
+    }
+    want := apr1(password, salt)
+    return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+  }
+  return false
+}
+
+// saltwordMatchesPassword checks a plain password against the saltword
+// stored for the user. The saltword may be in our own format or in any
+// of the formats accepted by CheckPassword.
+func (h *Handler) saltwordMatchesPassword(username, saltword, password string) bool {
+  if strings.HasPrefix(saltword, users.DisabledPrefix) {
+    glog.V(4).Infof("account %q is disabled", username)
+    return false
+  }
+  if _, err := hex.DecodeString(saltword); err == nil && saltword != "" {
+    return saltwordMatchesHashword(username, saltword, h.generateHashword(username, password))
+  }
+  return CheckPassword(saltword, password)
+}
+
+const apr1Chars = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 returns the APR1-MD5 hash of password with the given salt,
+// as calculated by "htpasswd -m".
+func apr1(password, salt string) string {
+  if len(salt) > 8 {
+    salt = salt[:8]
+  }
+  pw := []byte(password)
+  alt := md5.Sum([]byte(password + salt + password))
+  ctx := md5.New()
+  ctx.Write([]byte(password + htpasswdAPR1Prefix + salt))
+  for n := len(pw); n > 0; n -= 16 {
+    if n > 16 {
+      ctx.Write(alt[:])
+    } else {
+      ctx.Write(alt[:n])
+    }
+  }
+  for n := len(pw); n != 0; n >>= 1 {
+    if n & 1 != 0 {
+      ctx.Write([]byte{0})
+    } else {
+      ctx.Write(pw[:1])
+    }
+  }
+  final := ctx.Sum(nil)
+  for i := 0; i < 1000; i++ {
+    c := md5.New()
+    if i & 1 != 0 {
+      c.Write(pw)
+    } else {
+      c.Write(final)
+    }
+    if i % 3 != 0 {
+      c.Write([]byte(salt))
+    }
+    if i % 7 != 0 {
+      c.Write(pw)
+    }
+    if i & 1 != 0 {
+      c.Write(final)
+    } else {
+      c.Write(pw)
+    }
+    final = c.Sum(nil)
+  }
+
+  var sb strings.Builder
+  sb.WriteString(htpasswdAPR1Prefix + salt + "$")
+  encode := func(v uint, n int) {
+    for ; n > 0; n-- {
+      sb.WriteByte(apr1Chars[v & 0x3f])
+      v >>= 6
+    }
+  }
+  for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+    encode(uint(final[g[0]]) << 16 | uint(final[g[1]]) << 8 | uint(final[g[2]]), 4)
+  }
+  encode(uint(final[11]), 2)
+  return sb.String()
+}
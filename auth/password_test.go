@@ -0,0 +1,243 @@
+package auth
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "golang.org/x/crypto/bcrypt"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/store"
+  "github.com/jimmc/auth/users"
+)
+
+func TestCheckPassword(t *testing.T) {
+  bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+  if err != nil {
+    t.Fatalf("error generating bcrypt hash: %v", err)
+  }
+  bcrypt2y := "$2y$" + string(bcryptHash[4:])
+  tests := []struct{
+    hash string
+    password string
+    want bool
+  }{
+    { string(bcryptHash), "secret", true },
+    { bcrypt2y, "secret", true },
+    { bcrypt2y, "wrong", false },
+    { "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret", true },
+    { "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "Secret", false },
+    { "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/", "myPassword", true },
+    { "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "secret", true },
+    { "$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "secret2", false },
+    { "rqXexS6ZhobKA", "secret", false },     // crypt is not supported
+    { "", "", false },
+  }
+  for _, tc := range tests {
+    if got := CheckPassword(tc.hash, tc.password); got != tc.want {
+      t.Errorf("CheckPassword(%q, %q): got %v, want %v", tc.hash, tc.password, got, tc.want)
+    }
+  }
+}
+
+// makeHtpasswdTestHandler returns a handler using a temporary copy of
+// testdata/htpasswd1 and its permission file.
+func makeHtpasswdTestHandler(t *testing.T, basicAuth bool) *Handler {
+  t.Helper()
+  dir := t.TempDir()
+  for _, name := range []string{"htpasswd1", "htpasswd1.perms"} {
+    b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+    if err != nil {
+      t.Fatalf("error reading test file %s: %v", name, err)
+    }
+    if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+      t.Fatalf("error writing temp file %s: %v", name, err)
+    }
+  }
+  return NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: store.NewHtpasswd(filepath.Join(dir, "htpasswd1")),
+    TokenCookieName: "test_cookie",
+    BasicAuth: basicAuth,
+  })
+}
+
+func TestLoginWithPassword(t *testing.T) {
+  h := makeHtpasswdTestHandler(t, false)
+  tests := []struct{
+    username string
+    password string
+    code int
+  }{
+    { "alice", "alicepw", http.StatusOK },
+    { "bob", "bobpw", http.StatusOK },
+    { "carol", "carolpw", http.StatusOK },
+    { "carol", "alicepw", http.StatusUnauthorized },
+    { "nobody", "alicepw", http.StatusUnauthorized },
+  }
+  for _, tc := range tests {
+    form := url.Values{"username": {tc.username}, "password": {tc.password}}
+    req, err := http.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+    if err != nil {
+      t.Fatalf("error creating login request: %v", err)
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    rr := httptest.NewRecorder()
+    h.login(rr, req)
+    if got, want := rr.Code, tc.code; got != want {
+      t.Errorf("login for %s: got status %d, want %d", tc.username, got, want)
+    }
+  }
+}
+
+func TestBasicAuth(t *testing.T) {
+  for _, enabled := range []bool{false, true} {
+    h := makeHtpasswdTestHandler(t, enabled)
+    handler := h.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+      w.Write([]byte(CurrentUsername(r)))
+    }), permissions.Permission("edit"))
+    tests := []struct{
+      username string
+      password string
+      code int
+    }{
+      { "alice", "alicepw", http.StatusOK },
+      { "alice", "wrong", http.StatusUnauthorized },
+      { "bob", "bobpw", http.StatusUnauthorized },      // No edit permission
+    }
+    for _, tc := range tests {
+      req, err := http.NewRequest("GET", "/api/edit", nil)
+      if err != nil {
+        t.Fatalf("error creating request: %v", err)
+      }
+      req.SetBasicAuth(tc.username, tc.password)
+      rr := httptest.NewRecorder()
+      handler.ServeHTTP(rr, req)
+      want := tc.code
+      if !enabled {
+        want = http.StatusUnauthorized
+      }
+      if got := rr.Code; got != want {
+        t.Errorf("basic auth %v for %s: got status %d, want %d", enabled, tc.username, got, want)
+      }
+      if rr.Code == http.StatusOK {
+        if got, want := rr.Body.String(), tc.username; got != want {
+          t.Errorf("current user with basic auth: got %q, want %q", got, want)
+        }
+        if got, want := len(rr.Result().Cookies()), 0; got != want {
+          t.Errorf("basic auth should not set cookies, got %d", got)
+        }
+      }
+    }
+  }
+}
+
+// authenticatorStore is a PwFile that checks plain passwords itself,
+// as does store.LDAP.
+type authenticatorStore struct {
+  *store.PwFile
+  passwords map[string]string
+  err error
+  calls int             // Number of calls to Authenticate.
+}
+
+func (s *authenticatorStore) Authenticate(ctx context.Context, username, password string) (*users.User, error) {
+  s.calls++
+  if s.err != nil {
+    return nil, s.err
+  }
+  if password == "" || s.passwords[username] != password {
+    return nil, nil
+  }
+  return s.User(username), nil
+}
+
+func TestLoginWithAuthenticator(t *testing.T) {
+  as := &authenticatorStore{
+    PwFile: store.NewPwFile("testdata/pw1.txt"),
+    passwords: map[string]string{"user1": "secret"},
+  }
+  if err := as.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+  h := NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: as,
+    TokenCookieName: "test_cookie",
+  })
+  login := func(form url.Values) int {
+    req, err := http.NewRequest("POST", "/auth/login", strings.NewReader(form.Encode()))
+    if err != nil {
+      t.Fatalf("error creating login request: %v", err)
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    rr := httptest.NewRecorder()
+    h.login(rr, req)
+    return rr.Code
+  }
+  if got, want := login(url.Values{"username": {"user1"}, "password": {"secret"}}), http.StatusOK; got != want {
+    t.Errorf("login with password: got status %d, want %d", got, want)
+  }
+  if got, want := login(url.Values{"username": {"user1"}, "password": {"wrong"}}), http.StatusUnauthorized; got != want {
+    t.Errorf("login with wrong password: got status %d, want %d", got, want)
+  }
+  // An Authenticator needs the plain password, not a hashword.
+  if got, want := loginRequest(t, h, "user1", "pw1").Code, http.StatusUnauthorized; got != want {
+    t.Errorf("login with hashword: got status %d, want %d", got, want)
+  }
+  as.err = errors.New("directory is down")
+  if got, want := login(url.Values{"username": {"user1"}, "password": {"secret"}}), http.StatusServiceUnavailable; got != want {
+    t.Errorf("login with directory down: got status %d, want %d", got, want)
+  }
+}
+
+func TestUpdatePasswordHtpasswd(t *testing.T) {
+  h := makeHtpasswdTestHandler(t, false)
+  if err := h.UpdatePassword("bob", "newbobpw"); err != nil {
+    t.Fatalf("error updating password: %v", err)
+  }
+  if err := h.loadUsers(); err != nil {
+    t.Fatalf("error reloading htpasswd file: %v", err)
+  }
+  saltword := h.getSaltword("bob")
+  if !strings.HasPrefix(saltword, "$2y$") {
+    t.Errorf("updated password should use htpasswd bcrypt format, got %q", saltword)
+  }
+  if !plainPasswordIsValid(t, h, "bob", "newbobpw") {
+    t.Errorf("new password should be valid")
+  }
+  if plainPasswordIsValid(t, h, "bob", "bobpw") {
+    t.Errorf("old password should not be valid")
+  }
+}
+
+// plainPasswordIsValid checks a plain password as for a login.
+func plainPasswordIsValid(t *testing.T, h *Handler, username, password string) bool {
+  t.Helper()
+  user, err := h.checkCredentials(context.Background(), username, "", password)
+  if err != nil {
+    t.Fatalf("error checking credentials for %s: %v", username, err)
+  }
+  return user != nil
+}
+
+func TestPlainPasswordNativeFormat(t *testing.T) {
+  h := NewHandler(&Config{
+    Prefix: "/auth/",
+    Store: store.NewPwFile("testdata/pw1.txt"),
+    TokenCookieName: "test_cookie",
+  })
+  if !plainPasswordIsValid(t, h, "user3", "pw3") {
+    t.Errorf("plain password should be valid for our own saltword format")
+  }
+  if plainPasswordIsValid(t, h, "user3", "pw4") {
+    t.Errorf("wrong plain password should not be valid")
+  }
+}
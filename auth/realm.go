@@ -0,0 +1,225 @@
+package auth
+
+import (
+  "fmt"
+  "net"
+  "net/http"
+  "path"
+  "strings"
+
+  "github.com/golang/glog"
+)
+
+// A Realm is a separate set of users for one of several applications
+// served by a single Handler. Each realm has its own Config, with its own
+// Store, cookie name and other settings, and a token issued in one realm
+// is not accepted in any other.
+// A request is in the first realm in Config.Realms whose Host and
+// PathPrefix both match it; a realm with neither matches all requests,
+// so it can be listed last as a default.
+// A request that is in no realm gets StatusNotFound.
+// A realm whose name is empty or not unique, or that has no Store, is
+// logged as an error and skipped, so no requests are in it.
+// If Config.RealmHeader is set, a request may name its realm in that
+// header, but only if the request comes from one of the addresses in
+// Config.RealmHeaderProxies and the named realm matches the host and path
+// of the request, such as to choose between several realms with the same
+// Host. Any other request with the header gets StatusBadRequest, since a
+// client that could choose the realm could have its token and permissions
+// checked in a realm other than the one that owns the route it calls.
+// The RequireAuth and other Require functions of a Handler with realms
+// choose the realm of each request in the same way. To bind a route to
+// one realm regardless of the request, wrap it with the Require functions
+// of the Handler returned by Realm.
+// In the Config of a Realm, Prefix defaults to the Prefix of the main
+// Config under the PathPrefix of the realm, so that the API of a realm
+// with PathPrefix "/b/" is at "/b/auth/" when the main Prefix is "/auth/",
+// where the requests for it are in the realm. TokenCookieName defaults
+// to the main TokenCookieName followed by "_" and the name of the realm.
+// Realms, RealmHeader and RealmHeaderProxies are not used.
+type Realm struct {
+  Name string                   // Identifies the realm, as returned by CurrentRealm. Must be unique.
+  Host string                   // Host name, without port, of the requests in this realm.
+  PathPrefix string             // URL path prefix of the requests in this realm.
+  Config *Config                // Store, cookie name and other settings for the realm.
+}
+
+// newRealmsHandler creates a Handler that passes each request to the
+// Handler for its realm.
+func newRealmsHandler(c *Config) *Handler {
+  h := &Handler{
+    config: c,
+    realms: make(map[string]*Handler),
+  }
+  for _, realm := range c.Realms {
+    if realm.Name == "" || h.realms[realm.Name] != nil {
+      glog.Errorf("Error: realm name %q is empty or not unique", realm.Name)
+      continue
+    }
+    rc := realm.Config
+    if rc == nil || rc.Store == nil {
+      glog.Errorf("Error: no Store provided for realm %q", realm.Name)
+      continue
+    }
+    if rc.Prefix == "" {
+      rc.Prefix = realm.defaultPrefix(c.Prefix)
+    }
+    if rc.TokenCookieName == "" {
+      rc.TokenCookieName = c.TokenCookieName + "_" + realm.Name
+    }
+    h.realms[realm.Name] = newHandler(rc, realm.Name)
+    h.realmList = append(h.realmList, realm)
+  }
+  for _, proxy := range c.RealmHeaderProxies {
+    ipnet, err := parseProxy(proxy)
+    if err != nil {
+      glog.Errorf("Error: %v", err)
+      continue
+    }
+    h.realmProxies = append(h.realmProxies, ipnet)
+  }
+  h.ApiHandler = h.forRealm(func(h *Handler, w http.ResponseWriter, r *http.Request){
+    h.ApiHandler.ServeHTTP(w, r)
+  })
+  h.AdminHandler = h.forRealm(func(h *Handler, w http.ResponseWriter, r *http.Request){
+    h.AdminHandler.ServeHTTP(w, r)
+  })
+  return h
+}
+
+// Realm returns the Handler for the named realm, such as for calling
+// UpdatePassword, or nil if there is no such realm.
+func (h *Handler) Realm(name string) *Handler {
+  return h.realms[name]
+}
+
+// forRealm returns an http.Handler that calls f with the Handler for the
+// realm of the request, which is h itself if we don't use realms.
+func (h *Handler) forRealm(f func(*Handler, http.ResponseWriter, *http.Request)) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+    rh, err := h.realmHandler(r)
+    if err != nil {
+      glog.V(2).Infof("Bad realm header for request from %s to %s%s: %v", r.RemoteAddr, r.Host, r.URL.Path, err)
+      http.Error(w, "Bad realm header", http.StatusBadRequest)
+      return
+    }
+    if rh == nil {
+      glog.V(2).Infof("No realm for request to %s%s", r.Host, r.URL.Path)
+      http.Error(w, "Unknown realm", http.StatusNotFound)
+      return
+    }
+    f(rh, w, r)
+  })
+}
+
+// realmHandler returns the Handler for the realm of the request, or nil
+// if it is in no realm. It returns an error if the request has a realm
+// header that we don't accept.
+func (h *Handler) realmHandler(r *http.Request) (*Handler, error) {
+  if h.realms == nil {
+    return h, nil
+  }
+  if h.config.RealmHeader != "" {
+    if name := r.Header.Get(h.config.RealmHeader); name != "" {
+      return h.headerRealmHandler(r, name)
+    }
+  }
+  for _, realm := range h.realmList {
+    if realm.matches(r) {
+      return h.realms[realm.Name], nil
+    }
+  }
+  return nil, nil
+}
+
+// headerRealmHandler returns the Handler for the realm named in the realm
+// header of the request, or an error if the request is not from a trusted
+// proxy or is not in that realm.
+func (h *Handler) headerRealmHandler(r *http.Request, name string) (*Handler, error) {
+  if !h.fromRealmProxy(r) {
+    return nil, fmt.Errorf("realm header from untrusted address")
+  }
+  for _, realm := range h.realmList {
+    if realm.Name == name {
+      if !realm.matches(r) {
+        return nil, fmt.Errorf("realm %q does not match the request", name)
+      }
+      return h.realms[name], nil
+    }
+  }
+  return nil, fmt.Errorf("no realm %q", name)
+}
+
+// fromRealmProxy returns true if the request comes from one of the
+// addresses in Config.RealmHeaderProxies.
+func (h *Handler) fromRealmProxy(r *http.Request) bool {
+  host, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    host = r.RemoteAddr
+  }
+  ip := net.ParseIP(host)
+  if ip == nil {
+    return false
+  }
+  for _, ipnet := range h.realmProxies {
+    if ipnet.Contains(ip) {
+      return true
+    }
+  }
+  return false
+}
+
+// parseProxy parses an IP address or CIDR block from
+// Config.RealmHeaderProxies.
+func parseProxy(proxy string) (*net.IPNet, error) {
+  if strings.Contains(proxy, "/") {
+    _, ipnet, err := net.ParseCIDR(proxy)
+    if err != nil {
+      return nil, fmt.Errorf("bad realm header proxy %q: %v", proxy, err)
+    }
+    return ipnet, nil
+  }
+  ip := net.ParseIP(proxy)
+  if ip == nil {
+    return nil, fmt.Errorf("bad realm header proxy %q", proxy)
+  }
+  bits := 8 * net.IPv4len
+  if ip.To4() == nil {
+    bits = 8 * net.IPv6len
+  } else {
+    ip = ip.To4()
+  }
+  return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// defaultPrefix returns the API prefix for the realm, given the main
+// Prefix.
+func (realm *Realm) defaultPrefix(prefix string) string {
+  if realm.PathPrefix == "" {
+    return prefix
+  }
+  joined := path.Join(realm.PathPrefix, prefix)
+  if strings.HasSuffix(prefix, "/") && !strings.HasSuffix(joined, "/") {
+    joined += "/"
+  }
+  return joined
+}
+
+func (realm *Realm) matches(r *http.Request) bool {
+  if realm.Host != "" && !strings.EqualFold(requestHost(r), realm.Host) {
+    return false
+  }
+  if realm.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, realm.PathPrefix) {
+    return false
+  }
+  return true
+}
+
+// requestHost returns the host name of the request without the port.
+func requestHost(r *http.Request) string {
+  host, _, err := net.SplitHostPort(r.Host)
+  if err != nil {
+    return r.Host       // No port.
+  }
+  return host
+}
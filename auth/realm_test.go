@@ -0,0 +1,210 @@
+package auth
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "strings"
+  "testing"
+
+  "github.com/jimmc/auth/store"
+)
+
+func makeRealmsTestHandler(t *testing.T) *Handler {
+  t.Helper()
+  return NewHandler(&Config{
+    Prefix: "/auth/",
+    TokenCookieName: "test_cookie",
+    RealmHeader: "X-Auth-Realm",
+    RealmHeaderProxies: []string{"10.0.0.0/8", "::1", "bad"},
+    Realms: []*Realm{
+      { Name: "a", Host: "a.example.com", Config: &Config{
+          Store: store.NewHtpasswd("testdata/htpasswd1"),
+        },
+      },
+      { Name: "b", PathPrefix: "/b/", Config: &Config{
+          Store: store.NewHtpasswd("testdata/htpasswd1"),
+        },
+      },
+    },
+  })
+}
+
+// realmRequest creates a request to the host and path, with the cookie
+// if it is not nil.
+func realmRequest(t *testing.T, host, path string, cookie *http.Cookie) *http.Request {
+  t.Helper()
+  req, err := http.NewRequest("GET", "http://" + host + path, nil)
+  if err != nil {
+    t.Fatalf("error creating request: %v", err)
+  }
+  if cookie != nil {
+    req.AddCookie(cookie)
+  }
+  return req
+}
+
+func realmLogin(t *testing.T, h *Handler, host, path string) *http.Cookie {
+  t.Helper()
+  form := url.Values{"username": {"alice"}, "password": {"alicepw"}}
+  req, err := http.NewRequest("POST", "http://" + host + path, strings.NewReader(form.Encode()))
+  if err != nil {
+    t.Fatalf("error creating login request: %v", err)
+  }
+  req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+  rr := httptest.NewRecorder()
+  h.ApiHandler.ServeHTTP(rr, req)
+  if got, want := rr.Code, http.StatusOK; got != want {
+    t.Fatalf("login at %s%s: got status %d, want %d", host, path, got, want)
+  }
+  status := &LoginStatus{}
+  if err := json.Unmarshal(rr.Body.Bytes(), status); err != nil {
+    t.Fatalf("error decoding login status: %v", err)
+  }
+  cookies := rr.Result().Cookies()
+  if len(cookies) == 0 {
+    t.Fatalf("login at %s%s: no cookie", host, path)
+  }
+  if got, want := cookies[0].Name, "test_cookie_" + status.Realm; got != want {
+    t.Errorf("login at %s%s: got cookie %q, want %q", host, path, got, want)
+  }
+  return cookies[0]
+}
+
+func TestRealms(t *testing.T) {
+  h := makeRealmsTestHandler(t)
+  handler := h.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(CurrentRealm(r) + ":" + CurrentUsername(r)))
+  }))
+  cookieA := realmLogin(t, h, "a.example.com", "/auth/login/")
+  cookieB := realmLogin(t, h, "www.example.com", "/b/auth/login/")
+  // A token from realm a, in the cookie used by realm b.
+  crossA := &http.Cookie{Name: cookieB.Name, Value: cookieA.Value}
+
+  tests := []struct{
+    name string
+    req *http.Request
+    code int
+    body string
+  }{
+    { "realm a", realmRequest(t, "a.example.com:8080", "/api/x", cookieA), http.StatusOK, "a:alice" },
+    { "realm b", realmRequest(t, "www.example.com", "/b/api/x", cookieB), http.StatusOK, "b:alice" },
+    { "no cookie", realmRequest(t, "a.example.com", "/api/x", nil), http.StatusUnauthorized, "" },
+    { "token from a in b", realmRequest(t, "www.example.com", "/b/api/x", crossA), http.StatusUnauthorized, "" },
+    { "no realm", realmRequest(t, "www.example.com", "/api/x", cookieA), http.StatusNotFound, "" },
+  }
+  for _, tc := range tests {
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, tc.req)
+    if got, want := rr.Code, tc.code; got != want {
+      t.Errorf("%s: got status %d, want %d", tc.name, got, want)
+    }
+    if tc.code == http.StatusOK {
+      if got, want := rr.Body.String(), tc.body; got != want {
+        t.Errorf("%s: got body %q, want %q", tc.name, got, want)
+      }
+    }
+  }
+
+  // The header must come from a proxy and agree with the host and path.
+  for _, tc := range []struct{
+    name string
+    remote string
+    host, path string
+    header string
+    code int
+  }{
+    { "header from client", "192.0.2.1:1234", "a.example.com", "/api/x", "a", http.StatusBadRequest },
+    { "header for other realm", "10.1.2.3:1234", "a.example.com", "/api/x", "b", http.StatusBadRequest },
+    { "header for unknown realm", "10.1.2.3:1234", "a.example.com", "/api/x", "c", http.StatusBadRequest },
+    { "header for same realm", "10.1.2.3:1234", "a.example.com", "/api/x", "a", http.StatusOK },
+  }{
+    req := realmRequest(t, tc.host, tc.path, cookieA)
+    req.RemoteAddr = tc.remote
+    req.Header.Set("X-Auth-Realm", tc.header)
+    rr := httptest.NewRecorder()
+    handler.ServeHTTP(rr, req)
+    if got, want := rr.Code, tc.code; got != want {
+      t.Errorf("%s: got status %d, want %d", tc.name, got, want)
+    }
+  }
+
+  // A route bound to realm b checks realm b, whatever the request.
+  bound := h.Realm("b").RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte(CurrentRealm(r)))
+  }))
+  for _, cookie := range []*http.Cookie{cookieA, crossA} {
+    req := realmRequest(t, "a.example.com", "/b/api/x", cookie)
+    req.Header.Set("X-Auth-Realm", "a")
+    rr := httptest.NewRecorder()
+    bound.ServeHTTP(rr, req)
+    if got, want := rr.Code, http.StatusUnauthorized; got != want {
+      t.Errorf("token from a on route bound to b: got status %d, want %d", got, want)
+    }
+  }
+
+  if got, want := len(userTokens("a", "alice")), 1; got != want {
+    t.Errorf("tokens for alice in realm a: got %d, want %d", got, want)
+  }
+  if got, want := h.Realm("b").config.Store.UserCount(), 3; got != want {
+    t.Errorf("users in realm b: got %d, want %d", got, want)
+  }
+}
+
+func TestRealmsInvalid(t *testing.T) {
+  h := NewHandler(&Config{
+    Prefix: "/auth/",
+    TokenCookieName: "test_cookie",
+    Realms: []*Realm{
+      { Name: "a", Host: "a.example.com", Config: &Config{
+          Store: store.NewHtpasswd("testdata/htpasswd1"),
+        },
+      },
+      { Name: "a", Host: "dup.example.com", Config: &Config{
+          Store: store.NewHtpasswd("testdata/htpasswd1"),
+        },
+      },
+      { Name: "nostore", Host: "nostore.example.com", Config: &Config{} },
+      { Name: "default", Config: &Config{
+          Store: store.NewHtpasswd("testdata/htpasswd1"),
+        },
+      },
+    },
+  })
+  // Requests for the rejected realms fall through to the default realm.
+  for host, want := range map[string]string{
+    "a.example.com": "a",
+    "dup.example.com": "default",
+    "nostore.example.com": "default",
+  } {
+    rr := httptest.NewRecorder()
+    h.ApiHandler.ServeHTTP(rr, realmRequest(t, host, "/auth/status/", nil))
+    if got, want := rr.Code, http.StatusOK; got != want {
+      t.Fatalf("status at %s: got status %d, want %d", host, got, want)
+    }
+    status := &LoginStatus{}
+    if err := json.Unmarshal(rr.Body.Bytes(), status); err != nil {
+      t.Fatalf("error decoding login status: %v", err)
+    }
+    if got := status.Realm; got != want {
+      t.Errorf("realm for %s: got %q, want %q", host, got, want)
+    }
+  }
+  if h.Realm("nostore") != nil {
+    t.Errorf("realm with no store should not have a Handler")
+  }
+}
+
+func TestRealmsUpdatePassword(t *testing.T) {
+  h := makeRealmsTestHandler(t)
+  if err := h.UpdatePassword("alice", "newpw"); err == nil || !strings.Contains(err.Error(), "Realm(name)") {
+    t.Errorf("UpdatePassword on realms handler: got %v, want error mentioning Realm(name)", err)
+  }
+  if err := h.UpdateUserPassword("alice"); err == nil || !strings.Contains(err.Error(), "Realm(name)") {
+    t.Errorf("UpdateUserPassword on realms handler: got %v, want error mentioning Realm(name)", err)
+  }
+  if err := NewHandler(&Config{}).UpdatePassword("alice", "newpw"); err == nil {
+    t.Errorf("expected error from UpdatePassword with no Store")
+  }
+}
@@ -1,10 +1,12 @@
 package auth
 
 import (
+  "crypto/sha256"
   "fmt"
   "math/rand"
   "net/http"
   "strconv"
+  "sync"
   "time"
 
   "github.com/jimmc/auth/users"
@@ -15,11 +17,15 @@ var (
 )
 
 var (
+  tokensMu sync.Mutex   // Protects tokens and the user and timeout of each Token.
   tokens map[string]*Token
 )
 
+// Tokens are in the namespace of the realm of the Handler that created
+// them, and are not valid in any other realm.
 type Token struct {
   Key string
+  realm string
   user *users.User
   idstr string
   timeout time.Time     // Time at which token is no longer valid if not refreshed
@@ -27,10 +33,12 @@ type Token struct {
 }
 
 func initTokens() {
+  tokensMu.Lock()
+  defer tokensMu.Unlock()
   tokens = make(map[string]*Token)
 }
 
-func newToken(user *users.User, idstr string, timeoutDuration, expiryDuration time.Duration) *Token {
+func newToken(realm string, user *users.User, idstr string, timeoutDuration, expiryDuration time.Duration) *Token {
   if timeoutDuration == 0 {
     timeoutDuration = defaultTokenTimeoutDuration
   }
@@ -38,6 +46,7 @@ func newToken(user *users.User, idstr string, timeoutDuration, expiryDuration ti
     expiryDuration = defaultTokenExpiryDuration
   }
   token := &Token{
+    realm: realm,
     user: user,
     idstr: idstr,
     timeout: timeNow().Add(timeoutDuration),
@@ -45,18 +54,38 @@ func newToken(user *users.User, idstr string, timeoutDuration, expiryDuration ti
   }
   keynum := rand.Intn(1000000)
   token.Key = fmt.Sprintf("%06d", keynum)
+  tokensMu.Lock()
   tokens[token.Key] = token
+  tokensMu.Unlock()
   return token
 }
 
-func currentToken(tokenKey, idstr string) (*Token, bool) {
+// requestToken returns a token for a user who authenticated with a single
+// request, such as with HTTP Basic authentication. It has no key and is
+// not saved, so it can not be used for later requests.
+func requestToken(realm string, user *users.User, idstr string) *Token {
+  return &Token{
+    realm: realm,
+    user: user,
+    idstr: idstr,
+    timeout: timeNow(),
+    expiry: timeNow(),
+  }
+}
+
+// currentToken returns the token with the given key. A token from
+// another realm is not returned.
+func currentToken(realm, tokenKey, idstr string) (*Token, bool) {
+  tokensMu.Lock()
+  defer tokensMu.Unlock()
   token := tokens[tokenKey]
-  if token == nil {
+  if token == nil || token.realm != realm {
     return nil, false
   }
   return token, token.isValid(idstr)
 }
 
+// isValid must be called with tokensMu held.
 func (t *Token) isValid(idstr string) bool {
   if t.idstr != idstr {
     return false
@@ -74,23 +103,85 @@ func (t *Token) updateTimeout(timeoutDuration time.Duration) {
     timeoutDuration = defaultTokenTimeoutDuration
   }
   timeout := timeNow().Add(timeoutDuration)
+  tokensMu.Lock()
+  defer tokensMu.Unlock()
   if timeout.After(t.expiry) {
     timeout = t.expiry
   }
   t.timeout = timeout
 }
 
+// userTokens returns copies of the tokens belonging to the named user in
+// the realm that have not yet timed out.
+func userTokens(realm, username string) []*Token {
+  tt := make([]*Token, 0)
+  now := timeNow()
+  tokensMu.Lock()
+  defer tokensMu.Unlock()
+  for _, token := range tokens {
+    if token.realm == realm && token.user.Id() == username && !now.After(token.timeout) {
+      tcopy := *token
+      tt = append(tt, &tcopy)
+    }
+  }
+  return tt
+}
+
+// revokeUserTokens removes the tokens for the named user in the realm. If sessionId is
+// not empty, only the token with that session id is removed.
+// It returns the number of tokens removed.
+func revokeUserTokens(realm, username, sessionId string) int {
+  count := 0
+  tokensMu.Lock()
+  defer tokensMu.Unlock()
+  for key, token := range tokens {
+    if token.realm != realm || token.user.Id() != username {
+      continue
+    }
+    if sessionId != "" && token.sessionId() != sessionId {
+      continue
+    }
+    delete(tokens, key)
+    count++
+  }
+  return count
+}
+
+// sessionId returns an identifier for the token that can be shown to
+// an administrator without revealing the key itself.
+func (t *Token) sessionId() string {
+  sum := sha256.Sum256([]byte(t.Key))
+  return fmt.Sprintf("%x", sum[:6])
+}
+
 func (t *Token) User() *users.User {
+  tokensMu.Lock()
+  defer tokensMu.Unlock()
   return t.user
 }
 
+// setUser replaces the user of the token, such as after the user has been
+// read again from the Store.
+func (t *Token) setUser(user *users.User) {
+  tokensMu.Lock()
+  defer tokensMu.Unlock()
+  t.user = user
+}
+
+// timeoutTime returns the time at which the token times out.
+func (t *Token) timeoutTime() time.Time {
+  tokensMu.Lock()
+  defer tokensMu.Unlock()
+  return t.timeout
+}
+
 // cookie creates the HttpOnly cookie that contains our authentication key.
 func (t *Token) cookie(tokenCookieName string) *http.Cookie {
   return &http.Cookie{
     Name: tokenCookieName,
     Path: "/",
     Value: t.Key,
-    Expires: t.timeout,
+    Expires: t.timeoutTime(),
     HttpOnly: true,
   }
 }
@@ -98,10 +189,11 @@ func (t *Token) cookie(tokenCookieName string) *http.Cookie {
 // timeoutCookie creates a cookie, readable by the client javascript code,
 // with a value that is the truncated number of seconds until our cookies expire.
 func (t *Token) timeoutCookie(tokenCookieName string) *http.Cookie {
+  timeout := t.timeoutTime()
   return &http.Cookie{
     Name: tokenCookieName + "_TIMEOUT",
     Path: "/",
-    Value: strconv.Itoa(int(t.timeout.Sub(time.Now()).Seconds())),
-    Expires: t.timeout,
+    Value: strconv.Itoa(int(timeout.Sub(time.Now()).Seconds())),
+    Expires: timeout,
   }
 }
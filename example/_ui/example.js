@@ -10,7 +10,7 @@ class Example {
     const loggedIn = response.LoggedIn
     document.querySelector("#loggedin").style.display = loggedIn?"block":"none";
     document.querySelector("#loggedout").style.display = loggedIn?"none":"block";
-    document.querySelector("#permissions").innerHTML = response.Permissions;
+    document.querySelector("#permissions").innerHTML = (response.PermissionList || []).join(" ");
   }
 
   static async onClickLogin() {
@@ -20,7 +20,7 @@ class Example {
       alert("Please enter a username and a password")
       return
     }
-    const hashword = Example.sha256sum(username + "/" + password);
+    const hashword = Example.sha256sum(Example.canonicalUsername(username) + "/" + password);
     try {
       const loginUrl = "/auth/login/";
       const formData = new FormData();
@@ -32,7 +32,7 @@ class Example {
         encoding: 'direct',
       };
       const response = await Example.xhrJson(loginUrl, options);
-      document.querySelector("#permissions").innerHTML = response.Permissions;
+      document.querySelector("#permissions").innerHTML = (response.PermissionList || []).join(" ");
       console.log("Login succeeded")
     } catch (e) {
       alert("login failed: " + e.response)
@@ -83,6 +83,12 @@ class Example {
     }
   }
 
+  // canonicalUsername matches users.NewUsernamePolicy on the server
+  // for usernames without special case mappings.
+  static canonicalUsername(username/*string*/) {
+    return username.trim().normalize("NFKC").toLowerCase().normalize("NFKC");
+  }
+
   static sha256sum(s/*string*/) {
     const s8a = new TextEncoder().encode(s);
     const r8a = sha256hash(s8a);
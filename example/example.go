@@ -10,20 +10,27 @@ import (
   "net/http"
   "os"
   "strconv"
+  "time"
 
   "github.com/jimmc/auth/auth"
   "github.com/jimmc/auth/permissions"
   "github.com/jimmc/auth/store"
+  "github.com/jimmc/auth/users"
 )
 
 const (
   useAuth = true       // True to use the auth package; false shows code without auth.
   port = 8018           // The port our http server listens on.
   passwordFilePath = "pw.txt"  // Relative to this directory.
+  passwordReloadInterval = 5 * time.Second      // How often to check for changes to pw.txt.
   maxClockSkewSeconds = 5
   uiRoot = "_ui"        // Relative to this directory.
-  CanEdit = permissions.Permission("edit")
-  HasRoot = permissions.Permission("root")
+)
+
+// Registering our permissions lets RequirePermission catch typos.
+var (
+  CanEdit = permissions.Register("edit", "Edit the sample data")
+  HasRoot = permissions.Register("root", "Full access")
 )
 
 func main() {
@@ -33,17 +40,58 @@ func main() {
 // doMain return 0 if the program is exiting with no errors.
 func doMain() int {
   updatePasswordP := flag.String("updatepassword", "", "update password for named user")
+  convertP := flag.String("convertpwfile", "", "convert the password file to the named JSON file")
+  keyFileP := flag.String("keyfile", "", "file with the base64 key used to encrypt saltwords in the password file")
 
   flag.Parse()
 
+  if *convertP != "" && *keyFileP != "" {
+    // The JSON file would hold the decrypted saltwords.
+    fmt.Printf("Can't use -convertpwfile with -keyfile, since JSON files are not encrypted\n")
+    return 1
+  }
+
   authPrefix := "/auth/"
   authStore := store.NewPwFile(passwordFilePath)
+  usernamePolicy := users.NewUsernamePolicy()
+  if err := authStore.SetUsernamePolicy(usernamePolicy); err != nil {
+    fmt.Printf("Error in %s: %v\n", passwordFilePath, err)
+    return 1
+  }
+  if *keyFileP != "" {
+    key, err := store.ReadKeyFile(*keyFileP)
+    if err != nil {
+      fmt.Printf("Error reading key: %v\n", err)
+      return 1
+    }
+    encryption, err := store.NewEncryption(key)
+    if err != nil {
+      fmt.Printf("Error with key: %v\n", err)
+      return 1
+    }
+    authStore.SetEncryption(encryption)
+    // Don't start if the key can't decrypt the password file.
+    if err := authStore.Load(); err != nil {
+      fmt.Printf("Error loading %s: %v\n", passwordFilePath, err)
+      return 1
+    }
+  }
   authHandler := auth.NewHandler(&auth.Config{
     Prefix: authPrefix,
     Store: authStore,
     TokenCookieName: "AUTH_EXAMPLE",
+    UsernamePolicy: usernamePolicy,
   })
 
+  if *convertP != "" {
+    if err := store.ConvertPwFile(authStore, store.NewJSONFile(*convertP)); err != nil {
+      fmt.Printf("Error converting %s: %v\n", passwordFilePath, err)
+      return 1
+    }
+    fmt.Printf("Converted %s to %s\n", passwordFilePath, *convertP)
+    return 0
+  }
+
   if (*updatePasswordP != "") {
     err := authHandler.UpdateUserPassword(*updatePasswordP)
     if err != nil {
@@ -54,6 +102,8 @@ func doMain() int {
     return 0
   }
 
+  authStore.Watch(passwordReloadInterval)      // Pick up changes made by -updatepassword.
+
   apiPrefix := "/api/"
   apiHandler := newApiHandler(apiPrefix, authHandler )  // We will require auth for these calls.
 
@@ -72,6 +122,7 @@ func doMain() int {
   mux.Handle(openPrefix, openHandler)
   if useAuth {
     mux.Handle(authPrefix, authHandler.ApiHandler)        // Wire in login and logout calls.
+    mux.Handle(authPrefix + "admin/", authHandler.AdminHandler)   // User management, requires admin permission.
   }
   mux.HandleFunc("/", redirectToUi)
   fmt.Printf("Starting example server on port %d\n", port)
@@ -94,7 +145,7 @@ func newApiHandler(prefix string, authHandler *auth.Handler) http.Handler {
   mux := http.NewServeMux()
   mux.HandleFunc(prefix + "secret", secret)
   mux.HandleFunc(prefix + "edit", authHandler.RequirePermissionFunc(edit,CanEdit))
-  mux.HandleFunc(prefix + "edit2", edit2)
+  mux.HandleFunc(prefix + "edit2", authHandler.RequireFunc(edit2, permissions.AnyOf(CanEdit, HasRoot)))
   return mux
 }
 
@@ -127,12 +178,11 @@ func edit(w http.ResponseWriter, r *http.Request) {
   marshalAndReply(w, "Success for edit!")
 }
 
+// The edit2 handler is only called if the user has edit or root permission.
 func edit2(w http.ResponseWriter, r *http.Request) {
   if auth.CurrentUserHasPermission(r, CanEdit) {
     marshalAndReply(w, "Success for edit2 with edit permission!")
-  } else if auth.CurrentUserHasPermission(r, HasRoot) {
-    marshalAndReply(w, "Success for edit2 with root permission!")
   } else {
-    http.Error(w, "Not authorized", http.StatusUnauthorized)
+    marshalAndReply(w, "Success for edit2 with root permission!")
   }
 }
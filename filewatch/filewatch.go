@@ -0,0 +1,145 @@
+// The filewatch package reloads a file when it changes on disk. It is
+// used by store.PwFile and policy.Engine, which report its Status.
+package filewatch
+
+import (
+  "os"
+  "sync"
+  "time"
+
+  "github.com/golang/glog"
+)
+
+// Status reports the state of a watched file for monitoring.
+type Status struct {
+  Reloads int             // Number of successful loads.
+  LastError error         // Error from the most recent load, or nil.
+  ModTime time.Time       // Modification time of the loaded file.
+}
+
+// A Watcher checks a file for changes and calls a reload function when
+// it changes. The reload function reports back by calling Loaded and
+// SetError, which it should also do when it is called directly.
+// A change is only reloaded once the file has settled, meaning that two
+// checks in a row have seen the same modification time and size, so that
+// a file that is truncated and then rewritten in place is not loaded
+// while it is empty or partly written.
+type Watcher struct {
+  what string           // Describes the file in log messages, such as "policy file".
+  filename string
+  reload func() error
+  mu sync.Mutex         // Protects the fields below.
+  modTime time.Time     // Modification time of the file when loaded or saved.
+  size int64
+  reloads int
+  lastErr error
+  pendingModTime time.Time  // State of the changed file at the previous check.
+  pendingSize int64
+  pending bool          // True if the previous check saw a change.
+  stop chan struct{}
+}
+
+func New(what, filename string, reload func() error) *Watcher {
+  return &Watcher{
+    what: what,
+    filename: filename,
+    reload: reload,
+  }
+}
+
+// Loaded records a successful load of the file, which was in the state
+// given by info.
+func (w *Watcher) Loaded(info os.FileInfo) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.modTime = info.ModTime()
+  w.size = info.Size()
+  w.reloads++
+}
+
+// Seen records the state of the file without counting it as a load,
+// such as after we have written it ourselves, so that it is not reloaded.
+func (w *Watcher) Seen(info os.FileInfo) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.modTime = info.ModTime()
+  w.size = info.Size()
+}
+
+// SetError records the result of the most recent load.
+func (w *Watcher) SetError(err error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.lastErr = err
+}
+
+// Start starts checking the file every interval, and reloads it when
+// its modification time or size changes. Call Stop to end the checking.
+func (w *Watcher) Start(interval time.Duration) {
+  w.Stop()
+  stop := make(chan struct{})
+  w.mu.Lock()
+  w.stop = stop
+  w.mu.Unlock()
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+      select {
+      case <-stop:
+        return
+      case <-ticker.C:
+        w.ReloadIfChanged()
+      }
+    }
+  }()
+}
+
+// Stop ends the checking started by Start.
+func (w *Watcher) Stop() {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  if w.stop != nil {
+    close(w.stop)
+    w.stop = nil
+  }
+}
+
+// ReloadIfChanged checks the file once, as Start does every interval.
+// If the file has changed since it was loaded, and is the same as at the
+// previous check, it calls the reload function.
+func (w *Watcher) ReloadIfChanged() {
+  info, err := os.Stat(w.filename)
+  if err != nil {
+    glog.Errorf("Error checking %s %s: %v", w.what, w.filename, err)
+    return
+  }
+  w.mu.Lock()
+  changed := !info.ModTime().Equal(w.modTime) || info.Size() != w.size
+  settled := w.pending && info.ModTime().Equal(w.pendingModTime) && info.Size() == w.pendingSize
+  w.pending = changed && !settled
+  w.pendingModTime = info.ModTime()
+  w.pendingSize = info.Size()
+  w.mu.Unlock()
+  if !changed || !settled {
+    return
+  }
+  if err := w.reload(); err != nil {
+    glog.Errorf("Error reloading %s, keeping previous data: %v", w.what, err)
+    // Don't retry until the file changes again.
+    w.Seen(info)
+    return
+  }
+  glog.Infof("Reloaded %s %s", w.what, w.filename)
+}
+
+// Status returns the reload status of the file.
+func (w *Watcher) Status() *Status {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  return &Status{
+    Reloads: w.reloads,
+    LastError: w.lastErr,
+    ModTime: w.modTime,
+  }
+}
@@ -0,0 +1,109 @@
+package filewatch
+
+import (
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func TestWatcher(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "watched.txt")
+  write := func(s string) {
+    if err := ioutil.WriteFile(filename, []byte(s), 0600); err != nil {
+      t.Fatalf("error writing file: %v", err)
+    }
+  }
+  var w *Watcher
+  var contents string
+  reload := func() error {
+    b, err := ioutil.ReadFile(filename)
+    if err == nil && len(b) == 0 {
+      err = errors.New("empty file")
+    }
+    w.SetError(err)
+    if err != nil {
+      return err
+    }
+    info, err := os.Stat(filename)
+    if err != nil {
+      return err
+    }
+    contents = string(b)
+    w.Loaded(info)
+    return nil
+  }
+  w = New("test file", filename, reload)
+
+  write("one")
+  if err := reload(); err != nil {
+    t.Fatalf("error loading file: %v", err)
+  }
+
+  write("two two")
+  w.ReloadIfChanged()
+  if got, want := w.Status().Reloads, 1; got != want {
+    t.Errorf("reloads before the file has settled: got %d, want %d", got, want)
+  }
+  w.ReloadIfChanged()
+  if got, want := w.Status().Reloads, 2; got != want {
+    t.Errorf("reloads after the file has settled: got %d, want %d", got, want)
+  }
+  if got, want := contents, "two two"; got != want {
+    t.Errorf("contents after reload: got %q, want %q", got, want)
+  }
+
+  // A file seen empty while it is rewritten is not loaded.
+  write("")
+  w.ReloadIfChanged()
+  write("three")
+  w.ReloadIfChanged()
+  if got, want := w.Status().LastError, error(nil); got != want {
+    t.Errorf("error while the file is changing: got %v, want %v", got, want)
+  }
+  w.ReloadIfChanged()
+  if got, want := contents, "three"; got != want {
+    t.Errorf("contents after rewrite: got %q, want %q", got, want)
+  }
+
+  write("")
+  w.ReloadIfChanged()
+  w.ReloadIfChanged()
+  if w.Status().LastError == nil {
+    t.Errorf("expected error after the file stays empty")
+  }
+  if got, want := w.Status().Reloads, 3; got != want {
+    t.Errorf("reloads after bad file: got %d, want %d", got, want)
+  }
+  if got, want := contents, "three"; got != want {
+    t.Errorf("contents after bad file: got %q, want %q", got, want)
+  }
+  w.ReloadIfChanged()
+  if got, want := w.Status().Reloads, 3; got != want {
+    t.Errorf("bad file should not be retried: got %d reloads, want %d", got, want)
+  }
+}
+
+func TestWatcherStart(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "watched.txt")
+  if err := ioutil.WriteFile(filename, []byte("one"), 0600); err != nil {
+    t.Fatalf("error writing file: %v", err)
+  }
+  reloaded := make(chan bool, 1)
+  w := New("test file", filename, func() error {
+    select {
+    case reloaded <- true:
+    default:
+    }
+    return nil
+  })
+  w.Start(time.Millisecond)
+  defer w.Stop()
+  select {
+  case <-reloaded:
+  case <-time.After(5 * time.Second):
+    t.Fatalf("timed out waiting for reload")
+  }
+}
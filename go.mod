@@ -3,12 +3,16 @@ module github.com/jimmc/auth
 go 1.18
 
 require (
+	github.com/go-asn1-ber/asn1-ber v1.5.1
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/golang/glog v1.0.0
 	github.com/mattn/go-sqlite3 v1.14.15
 	golang.org/x/crypto v0.0.0-20220926161630-eccd6366d1be
+	golang.org/x/text v0.14.0
 )
 
 require (
-	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
+	github.com/Azure/go-ntlmssp v0.0.0-20200615164410-66371956d46c // indirect
+	golang.org/x/sys v0.7.0 // indirect
 	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1 // indirect
 )
@@ -0,0 +1,173 @@
+package permissions
+
+import (
+  "fmt"
+  "strings"
+  "time"
+)
+
+var (
+  timeNow = time.Now            // Allow overriding for unit testing.
+)
+
+// Now returns the current time as used to decide whether time-limited
+// permissions are valid. Code that checks the bounds of a Grant should
+// pass it the time from Now, so that it agrees with HasPermission.
+func Now() time.Time {
+  return timeNow()
+}
+
+// A permission may be granted for a limited time by following it with
+// the times between which it is valid, in RFC 3339 format, as in
+//   deploy[2026-10-18T08:00:00Z/2026-10-18T16:00:00Z]
+// Either time may be omitted, as in deploy[/2026-10-18T16:00:00Z].
+// The grant is valid from NotBefore up to but not including NotAfter.
+const (
+  boundsStart = "["
+  boundsSep = "/"
+  boundsEnd = "]"
+)
+
+// A Grant is one permission held by a Permissions, with the optional
+// times between which it is valid. A zero time means no limit.
+type Grant struct {
+  Permission Permission
+  NotBefore time.Time
+  NotAfter time.Time
+}
+
+// bounds is the validity period of a time-limited permission.
+type bounds struct {
+  notBefore time.Time
+  notAfter time.Time
+}
+
+// equal returns true if b and other are the same period. A nil bounds
+// means no limit.
+func (b *bounds) equal(other *bounds) bool {
+  if b == nil || other == nil {
+    return b == other
+  }
+  return b.notBefore.Equal(other.notBefore) && b.notAfter.Equal(other.notAfter)
+}
+
+// GrantBetween adds perm valid between notBefore and notAfter,
+// either of which may be the zero time to mean no limit.
+func (p *Permissions) GrantBetween(perm Permission, notBefore, notAfter time.Time) {
+  p.perms[perm] = true
+  if notBefore.IsZero() && notAfter.IsZero() {
+    delete(p.bounds, perm)
+    return
+  }
+  if p.bounds == nil {
+    p.bounds = make(map[Permission]*bounds)
+  }
+  p.bounds[perm] = &bounds{notBefore, notAfter}
+}
+
+// Grants returns all of our permissions, including those that are not
+// currently valid, in sorted order.
+func (p *Permissions) Grants() []*Grant {
+  grants := make([]*Grant, 0, len(p.perms))
+  for _, perm := range p.sorted() {
+    g := &Grant{Permission: perm}
+    if b := p.bounds[perm]; b != nil {
+      g.NotBefore = b.notBefore
+      g.NotAfter = b.notAfter
+    }
+    grants = append(grants, g)
+  }
+  return grants
+}
+
+// Active returns true if the grant is valid at time t.
+func (g *Grant) Active(t time.Time) bool {
+  return (&bounds{g.NotBefore, g.NotAfter}).active(t)
+}
+
+// Expired returns true if the grant is no longer valid at time t,
+// and never will be again.
+func (g *Grant) Expired(t time.Time) bool {
+  return (&bounds{g.NotBefore, g.NotAfter}).expired(t)
+}
+
+// Remaining returns how much longer the grant is valid after time t,
+// or zero if it has no end time or has expired.
+func (g *Grant) Remaining(t time.Time) time.Duration {
+  if g.NotAfter.IsZero() || !t.Before(g.NotAfter) {
+    return 0
+  }
+  return g.NotAfter.Sub(t)
+}
+
+func (b *bounds) active(t time.Time) bool {
+  if !b.notBefore.IsZero() && t.Before(b.notBefore) {
+    return false
+  }
+  return !b.expired(t)
+}
+
+func (b *bounds) expired(t time.Time) bool {
+  return !b.notAfter.IsZero() && !t.Before(b.notAfter)
+}
+
+// active returns the permissions that are valid now.
+func (p *Permissions) active() map[Permission]bool {
+  if len(p.bounds) == 0 {
+    return p.perms
+  }
+  now := timeNow()
+  perms := make(map[Permission]bool, len(p.perms))
+  for perm := range p.perms {
+    if b := p.bounds[perm]; b == nil || b.active(now) {
+      perms[perm] = true
+    }
+  }
+  return perms
+}
+
+// parseGrant splits a permission string into the permission and its
+// bounds, if it has any.
+func parseGrant(s string) (Permission, *bounds, error) {
+  start := strings.Index(s, boundsStart)
+  if start < 0 {
+    return permFromString(s), nil, nil
+  }
+  if !strings.HasSuffix(s, boundsEnd) {
+    return NoPermission, nil, fmt.Errorf("permission %q is missing %q", s, boundsEnd)
+  }
+  times := strings.Split(s[start+1:len(s)-1], boundsSep)
+  if len(times) != 2 {
+    return NoPermission, nil, fmt.Errorf("permission %q must have two times separated by %q", s, boundsSep)
+  }
+  b := &bounds{}
+  var err error
+  if times[0] != "" {
+    if b.notBefore, err = time.Parse(time.RFC3339, times[0]); err != nil {
+      return NoPermission, nil, fmt.Errorf("permission %q: %v", s, err)
+    }
+  }
+  if times[1] != "" {
+    if b.notAfter, err = time.Parse(time.RFC3339, times[1]); err != nil {
+      return NoPermission, nil, fmt.Errorf("permission %q: %v", s, err)
+    }
+  }
+  return permFromString(s[:start]), b, nil
+}
+
+// grantString returns the permission with its bounds, if any.
+func (p *Permissions) grantString(perm Permission) string {
+  b := p.bounds[perm]
+  if b == nil {
+    return permToString(perm)
+  }
+  return permToString(perm) + boundsStart + formatBound(b.notBefore) + boundsSep +
+      formatBound(b.notAfter) + boundsEnd
+}
+
+func formatBound(t time.Time) string {
+  if t.IsZero() {
+    return ""
+  }
+  return t.UTC().Format(time.RFC3339)
+}
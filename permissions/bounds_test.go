@@ -0,0 +1,111 @@
+package permissions
+
+import (
+  "testing"
+  "time"
+)
+
+func TestTimeLimitedPermissions(t *testing.T) {
+  defer func() { timeNow = time.Now }()
+  now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+  timeNow = func() time.Time { return now }
+
+  p := FromString("read deploy[2026-10-18T08:00:00Z/2026-10-18T16:00:00Z] " +
+      "audit[2026-10-19T00:00:00Z/] old[/2026-10-18T00:00:00Z]")
+  tests := []struct{
+    perm Permission
+    offset time.Duration
+    has bool
+  }{
+    {"read", 0, true},
+    {"deploy", 0, true},
+    {"deploy", -5 * time.Hour, false},
+    {"deploy", -4 * time.Hour, true},
+    {"deploy", 4 * time.Hour, false},
+    {"deploy", 4 * time.Hour - time.Second, true},
+    {"audit", 0, false},
+    {"audit", 12 * time.Hour, true},
+    {"audit", 1000 * time.Hour, true},
+    {"old", 0, false},
+    {"old", -13 * time.Hour, true},
+  }
+  for _, tt := range tests {
+    timeNow = func() time.Time { return now.Add(tt.offset) }
+    if got := p.HasPermission(tt.perm); got != tt.has {
+      t.Errorf("HasPermission(%q) at %v: got %v, want %v", tt.perm, now.Add(tt.offset), got, tt.has)
+    }
+  }
+
+  timeNow = func() time.Time { return now }
+  p2 := FromString(p.ToString())
+  if got, want := len(p2.perms), 3; got != want {
+    t.Errorf("permissions after round trip omitting expired: got %d, want %d (%q)", got, want, p.ToString())
+  }
+  if got, want := p2.grantString("deploy"), "deploy[2026-10-18T08:00:00Z/2026-10-18T16:00:00Z]"; got != want {
+    t.Errorf("deploy after round trip: got %q, want %q", got, want)
+  }
+  if got, want := p2.grantString("audit"), "audit[2026-10-19T00:00:00Z/]"; got != want {
+    t.Errorf("audit after round trip: got %q, want %q", got, want)
+  }
+
+  grants := p.Grants()
+  if got, want := len(grants), 4; got != want {
+    t.Fatalf("number of grants: got %d, want %d", got, want)
+  }
+  // Sorted: audit, deploy, old, read
+  if got, want := grants[1].Remaining(now), 4 * time.Hour; got != want {
+    t.Errorf("deploy remaining: got %v, want %v", got, want)
+  }
+  if got, want := grants[0].Active(now), false; got != want {
+    t.Errorf("audit active: got %v, want %v", got, want)
+  }
+  if got, want := grants[2].Expired(now), true; got != want {
+    t.Errorf("old expired: got %v, want %v", got, want)
+  }
+  if got, want := Now(), now; !got.Equal(want) {
+    t.Errorf("Now: got %v, want %v", got, want)
+  }
+  if got, want := grants[3].Remaining(now), time.Duration(0); got != want {
+    t.Errorf("read remaining: got %v, want %v", got, want)
+  }
+
+  p.GrantBetween("deploy", time.Time{}, time.Time{})
+  timeNow = func() time.Time { return now.Add(100 * time.Hour) }
+  if !p.HasPermission("deploy") {
+    t.Errorf("deploy should be permanent after GrantBetween with zero times")
+  }
+}
+
+func TestTimeLimitedRoles(t *testing.T) {
+  defer func() { timeNow = time.Now }()
+  now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+  timeNow = func() time.Time { return now }
+  roles := NewRoles()
+  roles.SetRole("oncall", FromString("deploy"))
+  p := FromString("@oncall[/2026-10-18T20:00:00Z]")
+  p.SetRoles(roles)
+  if !p.HasPermission("deploy") {
+    t.Errorf("deploy should be held through time-limited role")
+  }
+  timeNow = func() time.Time { return now.Add(8 * time.Hour) }
+  if p.HasPermission("deploy") {
+    t.Errorf("deploy should not be held after time-limited role expires")
+  }
+}
+
+func TestParseTimeLimits(t *testing.T) {
+  bad := []string{
+    "deploy[2026-10-18T08:00:00Z]",
+    "deploy[2026-10-18T08:00:00Z/",
+    "deploy[yesterday/]",
+    "deploy[/tomorrow]",
+  }
+  for _, s := range bad {
+    if _, err := Parse(s); err == nil {
+      t.Errorf("Parse(%q): expected error", s)
+    }
+  }
+  if _, err := Parse("deploy[2026-10-18T08:00:00Z/] read[/2026-10-18T08:00:00-07:00]"); err != nil {
+    t.Errorf("unexpected error from Parse: %v", err)
+  }
+}
@@ -0,0 +1,102 @@
+package permissions
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+)
+
+// A CatalogEntry describes one permission known to the application.
+type CatalogEntry struct {
+  Permission Permission
+  Description string
+}
+
+// catalog maps each registered permission to its description.
+var catalog = make(map[Permission]string)
+
+// Register adds perm to the catalog of permissions known to the
+// application, and returns it so it can be used to declare a variable:
+//   var CanEdit = permissions.Register("edit", "Edit documents")
+// Once any permission is registered, the stores can check that the
+// permissions they load are in the catalog. Register panics if perm is
+// not a well-formed permission, or is a role or a wildcard.
+func Register(perm Permission, description string) Permission {
+  if _, err := ParsePermission(permToString(perm)); err != nil {
+    panic(err)
+  }
+  if _, isRole := RoleName(perm); isRole || isWildcard(perm) {
+    panic(fmt.Sprintf("can not register role or wildcard %q", perm))
+  }
+  catalog[perm] = description
+  return perm
+}
+
+// ClearCatalog removes all permissions added by Register.
+func ClearCatalog() {
+  catalog = make(map[Permission]string)
+}
+
+// Registered returns true if perm has been added by Register.
+func Registered(perm Permission) bool {
+  _, ok := catalog[perm]
+  return ok
+}
+
+// Catalog returns the registered permissions sorted by name.
+func Catalog() []*CatalogEntry {
+  entries := make([]*CatalogEntry, 0, len(catalog))
+  for perm, desc := range catalog {
+    entries = append(entries, &CatalogEntry{perm, desc})
+  }
+  sort.Slice(entries, func(i, j int) bool { return entries[i].Permission < entries[j].Permission })
+  return entries
+}
+
+// Unregistered returns the permissions in p that are not in the catalog,
+// in sorted order. Roles are not checked, and a wildcard is accepted if it
+// covers at least one registered permission. If nothing has been
+// registered, every permission is accepted.
+func Unregistered(p *Permissions) []Permission {
+  unknown := make([]Permission, 0)
+  if len(catalog) == 0 || p == nil {
+    return unknown
+  }
+  for _, perm := range p.sorted() {
+    if _, isRole := RoleName(perm); isRole || Registered(perm) || coversRegistered(perm) {
+      continue
+    }
+    unknown = append(unknown, perm)
+  }
+  return unknown
+}
+
+// CheckRegistered returns an error listing the permissions in p that
+// are not in the catalog, or nil if there are none.
+func CheckRegistered(p *Permissions) error {
+  unknown := Unregistered(p)
+  if len(unknown) == 0 {
+    return nil
+  }
+  ss := make([]string, len(unknown))
+  for n, perm := range unknown {
+    ss[n] = permToString(perm)
+  }
+  return fmt.Errorf("unregistered permissions: %s", strings.Join(ss, ", "))
+}
+
+func isWildcard(perm Permission) bool {
+  return perm == Wildcard || strings.HasSuffix(permToString(perm), SegmentSep + string(Wildcard))
+}
+
+func coversRegistered(perm Permission) bool {
+  if !isWildcard(perm) {
+    return false
+  }
+  for registered := range catalog {
+    if Matches(perm, registered) {
+      return true
+    }
+  }
+  return false
+}
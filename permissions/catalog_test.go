@@ -0,0 +1,76 @@
+package permissions
+
+import (
+  "testing"
+)
+
+func TestCatalog(t *testing.T) {
+  defer ClearCatalog()
+  ClearCatalog()
+  if got, want := CheckRegistered(FromString("edti")), error(nil); got != want {
+    t.Errorf("with empty catalog: got %v, want %v", got, want)
+  }
+
+  edit := Register("docs:edit", "Edit documents")
+  if got, want := edit, Permission("docs:edit"); got != want {
+    t.Errorf("Register: got %q, want %q", got, want)
+  }
+  Register("docs:read", "Read documents")
+  Register("deploy", "Deploy the service")
+
+  entries := Catalog()
+  if got, want := len(entries), 3; got != want {
+    t.Fatalf("catalog size: got %d, want %d", got, want)
+  }
+  if got, want := entries[0].Permission, Permission("deploy"); got != want {
+    t.Errorf("first entry: got %q, want %q", got, want)
+  }
+  if got, want := entries[1].Description, "Edit documents"; got != want {
+    t.Errorf("description: got %q, want %q", got, want)
+  }
+
+  if !Registered("deploy") || Registered("deplyo") {
+    t.Errorf("Registered gives wrong answers")
+  }
+
+  tests := []struct{
+    perms string
+    want string
+  }{
+    { "deploy docs:edit", "" },
+    { "docs:* @editor *", "" },
+    { "edti deploy zzz", "edti zzz" },
+    { "other:*", "other:*" },
+  }
+  for _, tc := range tests {
+    unknown := Unregistered(FromString(tc.perms))
+    got := FromString("")
+    for _, perm := range unknown {
+      got.perms[perm] = true
+    }
+    if got.ToString() != tc.want {
+      t.Errorf("Unregistered(%q): got %q, want %q", tc.perms, got.ToString(), tc.want)
+    }
+  }
+  err := CheckRegistered(FromString("edti deploy"))
+  if err == nil {
+    t.Fatalf("CheckRegistered should fail for edti")
+  }
+  if got, want := err.Error(), "unregistered permissions: edti"; got != want {
+    t.Errorf("CheckRegistered: got %q, want %q", got, want)
+  }
+}
+
+func TestRegisterPanics(t *testing.T) {
+  defer ClearCatalog()
+  for _, perm := range []Permission{"bad perm", "@role", "docs:*", "*"} {
+    func() {
+      defer func() {
+        if recover() == nil {
+          t.Errorf("Register(%q) should panic", perm)
+        }
+      }()
+      Register(perm, "")
+    }()
+  }
+}
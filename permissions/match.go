@@ -0,0 +1,160 @@
+package permissions
+
+import (
+  "fmt"
+  "strings"
+  "sync"
+)
+
+// Permissions may be namespaced by separating segments with a colon,
+// such as "docs:edit". A final segment of "*" grants every permission
+// in that namespace, so "docs:*" grants "docs:edit" and "docs:edit:draft",
+// and a grant of "*" by itself grants every permission.
+const (
+  SegmentSep = ":"
+  Wildcard = Permission("*")
+)
+
+var (
+  implicationsMu sync.RWMutex   // Protects implications.
+  implications = make(map[Permission][]Permission)     // The permissions implied by each permission.
+)
+
+// Imply declares that holding perm also grants each of the implied
+// permissions, which may use wildcards. For example,
+//   Imply("admin", "*")
+//   Imply("docs:edit", "docs:read")
+// Implications are followed transitively, and a wildcard grant gets the
+// implications of the permissions it covers, so with the above, holding
+// "docs:*" grants "docs:read" through the implications of "docs:edit".
+// Implications are usually declared during initialization, before
+// permissions are checked.
+func Imply(perm Permission, implied ...Permission) {
+  implicationsMu.Lock()
+  defer implicationsMu.Unlock()
+  implications[perm] = append(implications[perm], implied...)
+}
+
+// ClearImplications removes all implications declared by Imply.
+func ClearImplications() {
+  implicationsMu.Lock()
+  defer implicationsMu.Unlock()
+  implications = make(map[Permission][]Permission)
+}
+
+// ParsePermission checks that s is a well-formed permission: it must
+// contain no spaces, no empty segments, and may only use "*" as its
+// entire final segment.
+func ParsePermission(s string) (Permission, error) {
+  if s == "" {
+    return NoPermission, fmt.Errorf("empty permission")
+  }
+  if strings.ContainsAny(s, " \t\n") {
+    return NoPermission, fmt.Errorf("permission %q contains whitespace", s)
+  }
+  name := strings.TrimPrefix(s, RolePrefix)
+  segments := strings.Split(name, SegmentSep)
+  for n, seg := range segments {
+    if seg == "" {
+      return NoPermission, fmt.Errorf("permission %q has an empty segment", s)
+    }
+    if strings.Contains(seg, string(Wildcard)) {
+      if seg != string(Wildcard) || n != len(segments)-1 {
+        return NoPermission, fmt.Errorf("permission %q may only use %s as its final segment", s, Wildcard)
+      }
+      if name != s {
+        return NoPermission, fmt.Errorf("role %q may not use a wildcard", s)
+      }
+    }
+  }
+  return permFromString(s), nil
+}
+
+// Parse is like FromString, but returns an error if any of the
+// permissions or their time limits is not well-formed.
+func Parse(permstr string) (*Permissions, error) {
+  for _, pstr := range strings.Fields(permstr) {
+    perm, _, err := parseGrant(pstr)
+    if err != nil {
+      return nil, err
+    }
+    if _, err := ParsePermission(permToString(perm)); err != nil {
+      return nil, err
+    }
+  }
+  return FromString(permstr), nil
+}
+
+// Matches returns true if holding grant directly gives want, either
+// because they are the same or because grant is a wildcard that covers
+// want. Roles are never covered by wildcards.
+func Matches(grant, want Permission) bool {
+  if grant == want {
+    return true
+  }
+  if _, isRole := RoleName(want); isRole {
+    return false
+  }
+  if grant == Wildcard {
+    return true
+  }
+  g := permToString(grant)
+  if !strings.HasSuffix(g, SegmentSep + string(Wildcard)) {
+    return false
+  }
+  return strings.HasPrefix(permToString(want), strings.TrimSuffix(g, string(Wildcard)))
+}
+
+// holds returns true if the set of granted permissions gives want,
+// directly, through a wildcard, or through an implication.
+// It does not look at roles.
+func holds(granted map[Permission]bool, want Permission) bool {
+  if granted[want] {
+    return true
+  }
+  if _, isRole := RoleName(want); !isRole {
+    if granted[Wildcard] {
+      return true
+    }
+    // Check the wildcard for each namespace containing want.
+    w := permToString(want)
+    for i := range w {
+      if strings.HasPrefix(w[i:], SegmentSep) && granted[permFromString(w[:i] + SegmentSep + string(Wildcard))] {
+        return true
+      }
+    }
+  }
+  implicationsMu.RLock()
+  defer implicationsMu.RUnlock()
+  if len(implications) == 0 {
+    return false
+  }
+  visited := make(map[Permission]bool)
+  for grant := range granted {
+    if implies(grant, want, visited) {
+      return true
+    }
+  }
+  return false
+}
+
+// implies returns true if an implication of grant, or of a permission
+// that grant matches, followed transitively, gives want.
+// It must be called with implicationsMu held.
+func implies(grant, want Permission, visited map[Permission]bool) bool {
+  if visited[grant] {
+    return false
+  }
+  visited[grant] = true
+  for perm, implied := range implications {
+    if !Matches(grant, perm) {
+      continue
+    }
+    for _, imp := range implied {
+      if Matches(imp, want) || implies(imp, want, visited) {
+        return true
+      }
+    }
+  }
+  return false
+}
@@ -0,0 +1,160 @@
+package permissions
+
+import (
+  "fmt"
+  "sync"
+  "testing"
+)
+
+func TestParsePermission(t *testing.T) {
+  tests := []struct{
+    s string
+    ok bool
+  }{
+    {"edit", true},
+    {"docs:edit", true},
+    {"docs:edit:draft", true},
+    {"docs:*", true},
+    {"*", true},
+    {"@editor", true},
+    {"", false},
+    {"docs:", false},
+    {":edit", false},
+    {"docs::edit", false},
+    {"docs:*:edit", false},
+    {"docs:ed*", false},
+    {"do cs", false},
+    {"@edit:*", false},
+  }
+  for _, tt := range tests {
+    _, err := ParsePermission(tt.s)
+    if got := err == nil; got != tt.ok {
+      t.Errorf("ParsePermission(%q): got ok=%v, want ok=%v (err=%v)", tt.s, got, tt.ok, err)
+    }
+  }
+
+  if _, err := Parse("edit docs:*"); err != nil {
+    t.Errorf("unexpected error from Parse: %v", err)
+  }
+  if _, err := Parse("edit docs::x"); err == nil {
+    t.Errorf("expected error from Parse with bad permission")
+  }
+}
+
+func TestMatches(t *testing.T) {
+  tests := []struct{
+    grant, want Permission
+    match bool
+  }{
+    {"edit", "edit", true},
+    {"edit", "read", false},
+    {"edit", "edit:draft", false},
+    {"*", "edit", true},
+    {"*", "docs:edit", true},
+    {"*", "@editor", false},
+    {"docs:*", "docs:edit", true},
+    {"docs:*", "docs:edit:draft", true},
+    {"docs:*", "docs:*", true},
+    {"docs:*", "docs", false},
+    {"docs:*", "docsx:edit", false},
+    {"docs:*", "images:edit", false},
+    {"docs:edit:*", "docs:edit:draft", true},
+    {"docs:edit:*", "docs:read", false},
+    {"docs:edit", "docs:*", false},
+    {"@editor", "@editor", true},
+  }
+  for _, tt := range tests {
+    if got := Matches(tt.grant, tt.want); got != tt.match {
+      t.Errorf("Matches(%q, %q): got %v, want %v", tt.grant, tt.want, got, tt.match)
+    }
+  }
+}
+
+func TestHasPermissionWildcards(t *testing.T) {
+  tests := []struct{
+    granted string
+    want Permission
+    has bool
+  }{
+    {"", "edit", false},
+    {"edit", "edit", true},
+    {"*", "anything", true},
+    {"*", "a:b:c", true},
+    {"*", "@role", false},
+    {"docs:*", "docs:read", true},
+    {"docs:*", "docs:read:draft", true},
+    {"docs:*", "docs", false},
+    {"docs:*", "images:read", false},
+    {"docs:read:*", "docs:read:draft", true},
+    {"docs:read:*", "docs:edit", false},
+    {"docs:read images:*", "images:x:y", true},
+    {"docs:read images:*", "docs:edit", false},
+  }
+  for _, tt := range tests {
+    p := FromString(tt.granted)
+    if got := p.HasPermission(tt.want); got != tt.has {
+      t.Errorf("FromString(%q).HasPermission(%q): got %v, want %v", tt.granted, tt.want, got, tt.has)
+    }
+  }
+}
+
+func TestImplications(t *testing.T) {
+  defer ClearImplications()
+  Imply("admin", Wildcard)
+  Imply("docs:edit", "docs:read", "comment")
+  Imply("comment", "reply")
+  Imply("loop1", "loop2")
+  Imply("loop2", "loop1")
+  tests := []struct{
+    granted string
+    want Permission
+    has bool
+  }{
+    {"admin", "anything", true},
+    {"admin", "docs:edit", true},
+    {"docs:edit", "docs:read", true},
+    {"docs:edit", "comment", true},
+    {"docs:edit", "reply", true},
+    {"docs:edit", "docs:delete", false},
+    {"docs:read", "docs:edit", false},
+    {"docs:*", "comment", true},
+    {"docs:*", "reply", true},
+    {"*", "reply", true},
+    {"docs:edit:*", "comment", false},
+    {"loop1", "loop2", true},
+    {"loop1", "other", false},
+  }
+  for _, tt := range tests {
+    p := FromString(tt.granted)
+    if got := p.HasPermission(tt.want); got != tt.has {
+      t.Errorf("FromString(%q).HasPermission(%q) with implications: got %v, want %v", tt.granted, tt.want, got, tt.has)
+    }
+  }
+
+  roles := NewRoles()
+  roles.SetRole("editor", FromString("docs:edit"))
+  p := FromString("@editor")
+  p.SetRoles(roles)
+  if got, want := p.HasPermission("reply"), true; got != want {
+    t.Errorf("implied permission through role: got %v, want %v", got, want)
+  }
+
+  // Implications may be declared while permissions are being checked.
+  var wg sync.WaitGroup
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    for i := 0; i < 100; i++ {
+      Imply(Permission(fmt.Sprintf("p%d", i)), "q")
+    }
+  }()
+  for i := 0; i < 100; i++ {
+    FromString("docs:*").HasPermission("reply")
+  }
+  wg.Wait()
+
+  ClearImplications()
+  if got, want := FromString("admin").HasPermission("anything"), false; got != want {
+    t.Errorf("permission after ClearImplications: got %v, want %v", got, want)
+  }
+}
@@ -1,6 +1,7 @@
 package permissions
 
 import (
+  "sort"
   "strings"
 )
 
@@ -8,6 +9,8 @@ type Permission string
 
 type Permissions struct {
   perms map[Permission]bool
+  bounds map[Permission]*bounds  // Validity of time-limited permissions.
+  roles *Roles          // Used to resolve role permissions, may be nil.
 }
 
 const (
@@ -23,26 +26,80 @@ func FromString(permstr string) *Permissions {
   pp := strings.Split(permstr, permSepChar)
   for _, pstr := range pp {
     if pstr != "" {
-      perm := permFromString(pstr)
+      perm, b, err := parseGrant(pstr)
+      if err != nil {
+        perm, b = permFromString(pstr), nil   // Keep it as is, Parse reports the error.
+      }
       p.perms[perm] = true;
+      if b != nil {
+        p.GrantBetween(perm, b.notBefore, b.notAfter)
+      }
     }
   }
   return p
 }
 
+// ToString returns our permissions in sorted order in the format accepted
+// by FromString. Time-limited permissions that have expired are omitted.
 func (p *Permissions) ToString() string {
-  s := ""
-  sep := ""
-  for perm, _ := range p.perms {
-    pstr := permToString(perm)
-    s = s + sep + pstr
-    sep = permSepChar
+  return strings.Join(p.grantStrings(), permSepChar)
+}
+
+// grantStrings returns the sorted strings for our permissions that have
+// not expired, including their time limits.
+func (p *Permissions) grantStrings() []string {
+  ss := make([]string, 0, len(p.perms))
+  now := timeNow()
+  for _, perm := range p.sorted() {
+    if b := p.bounds[perm]; b != nil && b.expired(now) {
+      continue
+    }
+    ss = append(ss, p.grantString(perm))
   }
-  return s
+  return ss
+}
+
+// SetRoles sets the roles used to resolve any role permissions we hold.
+func (p *Permissions) SetRoles(roles *Roles) {
+  p.roles = roles
+}
+
+// WithRoles returns a copy of p that uses roles to resolve role
+// permissions, leaving p unchanged.
+func (p *Permissions) WithRoles(roles *Roles) *Permissions {
+  result := p.copy()
+  result.roles = roles
+  return result
 }
 
+// HasPermission returns true if we hold perm, either directly, through
+// a wildcard or implication, or through one of our roles.
+// Time-limited permissions are only held while they are valid.
 func (p *Permissions) HasPermission(perm Permission) bool {
-  return p.perms[perm]
+  active := p.active()
+  if holds(active, perm) {
+    return true
+  }
+  if p.roles == nil {
+    return false
+  }
+  visited := make(map[string]bool)
+  for rp := range active {
+    if name, ok := RoleName(rp); ok && p.roles.hasPermission(name, perm, visited) {
+      return true
+    }
+  }
+  return false
+}
+
+// sorted returns our permissions in sorted order.
+func (p *Permissions) sorted() []Permission {
+  pp := make([]Permission, 0, len(p.perms))
+  for perm := range p.perms {
+    pp = append(pp, perm)
+  }
+  sort.Slice(pp, func(i, j int) bool { return pp[i] < pp[j] })
+  return pp
 }
 
 func permFromString(s string) Permission {
@@ -0,0 +1,312 @@
+package permissions
+
+import (
+  "fmt"
+  "strings"
+)
+
+// A Checker is anything that can report whether it has a permission,
+// such as *Permissions or *users.User.
+type Checker interface {
+  HasPermission(perm Permission) bool
+}
+
+// A Requirement is a condition on the permissions held by a Checker.
+// A single Permission is a Requirement, and Requirements can be combined
+// using AnyOf, AllOf and Not, or parsed from a string by ParseRequirement.
+type Requirement interface {
+  // Satisfied returns true if c meets the requirement.
+  Satisfied(c Checker) bool
+  // Missing describes why c does not meet the requirement,
+  // or returns the empty string if it does.
+  Missing(c Checker) string
+  // String returns the requirement in the syntax accepted by ParseRequirement.
+  String() string
+}
+
+type anyOf []Requirement
+type allOf []Requirement
+type not struct {
+  req Requirement
+}
+
+// AnyOf returns a Requirement that is satisfied if any of reqs is satisfied.
+// With no reqs it is never satisfied, and its string form is "!()".
+func AnyOf(reqs ...Requirement) Requirement {
+  return anyOf(reqs)
+}
+
+// AllOf returns a Requirement that is satisfied if all of reqs are satisfied.
+// With no reqs it is always satisfied, and its string form is "()".
+func AllOf(reqs ...Requirement) Requirement {
+  return allOf(reqs)
+}
+
+// Not returns a Requirement that is satisfied if req is not satisfied.
+func Not(req Requirement) Requirement {
+  return not{req}
+}
+
+func (p Permission) Satisfied(c Checker) bool {
+  return c.HasPermission(p)
+}
+
+func (p Permission) Missing(c Checker) string {
+  if p.Satisfied(c) {
+    return ""
+  }
+  return "missing permission " + permToString(p)
+}
+
+func (p Permission) String() string {
+  return permToString(p)
+}
+
+func (a anyOf) Satisfied(c Checker) bool {
+  for _, req := range a {
+    if req.Satisfied(c) {
+      return true
+    }
+  }
+  return false
+}
+
+func (a anyOf) Missing(c Checker) string {
+  if a.Satisfied(c) {
+    return ""
+  }
+  switch len(a) {
+  case 0:
+    return "can never be satisfied"
+  case 1:
+    return a[0].Missing(c)
+  }
+  return "requires one of " + joinRequirements(a, ", ")
+}
+
+func (a anyOf) String() string {
+  if len(a) == 0 {
+    return "!" + emptyRequirement
+  }
+  return joinRequirements(a, " | ")
+}
+
+func (a allOf) Satisfied(c Checker) bool {
+  for _, req := range a {
+    if !req.Satisfied(c) {
+      return false
+    }
+  }
+  return true
+}
+
+func (a allOf) Missing(c Checker) string {
+  missing := make([]string, 0)
+  for _, req := range a {
+    if m := req.Missing(c); m != "" {
+      missing = append(missing, m)
+    }
+  }
+  return strings.Join(missing, "; ")
+}
+
+func (a allOf) String() string {
+  if len(a) == 0 {
+    return emptyRequirement
+  }
+  return joinRequirements(a, " & ")
+}
+
+func (n not) Satisfied(c Checker) bool {
+  return !n.req.Satisfied(c)
+}
+
+func (n not) Missing(c Checker) string {
+  if n.Satisfied(c) {
+    return ""
+  }
+  return "must not have " + n.req.String()
+}
+
+func (n not) String() string {
+  return "!" + operandString(n.req)
+}
+
+// joinRequirements returns the strings for reqs separated by sep,
+// with parentheses around any that have more than one part.
+func joinRequirements(reqs []Requirement, sep string) string {
+  ss := make([]string, len(reqs))
+  for n, req := range reqs {
+    ss[n] = operandString(req)
+  }
+  return strings.Join(ss, sep)
+}
+
+func operandString(req Requirement) string {
+  switch r := req.(type) {
+  case anyOf:
+    if len(r) > 1 {
+      return "(" + r.String() + ")"
+    }
+  case allOf:
+    if len(r) > 1 {
+      return "(" + r.String() + ")"
+    }
+  }
+  return req.String()
+}
+
+// RequiredPermissions returns the permissions named in req, in order,
+// for checking them against the permissions catalog.
+func RequiredPermissions(req Requirement) []Permission {
+  switch r := req.(type) {
+  case Permission:
+    return []Permission{r}
+  case anyOf:
+    return requiredPermissions(r)
+  case allOf:
+    return requiredPermissions(r)
+  case not:
+    return RequiredPermissions(r.req)
+  }
+  return nil
+}
+
+func requiredPermissions(reqs []Requirement) []Permission {
+  perms := make([]Permission, 0)
+  for _, req := range reqs {
+    perms = append(perms, RequiredPermissions(req)...)
+  }
+  return perms
+}
+
+// ParseRequirement parses a requirement expression made up of permissions,
+// "!" (not), "&" (and), "|" (or) and parentheses, such as
+//   edit | (root & !readonly)
+// As usual, "!" binds most tightly and "|" least tightly.
+// Empty parentheses, the string form of AllOf(), are always satisfied,
+// so "!()" is never satisfied.
+func ParseRequirement(s string) (Requirement, error) {
+  p := &reqParser{s: s}
+  req, err := p.parseOr()
+  if err != nil {
+    return nil, fmt.Errorf("error parsing requirement %q: %v", s, err)
+  }
+  if tok := p.next(); tok != "" {
+    return nil, fmt.Errorf("error parsing requirement %q: unexpected %q", s, tok)
+  }
+  return req, nil
+}
+
+// MustParseRequirement is like ParseRequirement but panics on error.
+// It is intended for requirements written into the program.
+func MustParseRequirement(s string) Requirement {
+  req, err := ParseRequirement(s)
+  if err != nil {
+    panic(err)
+  }
+  return req
+}
+
+const reqOperators = "!&|()"
+
+// emptyRequirement is the string form of AllOf() with no requirements.
+const emptyRequirement = "()"
+
+type reqParser struct {
+  s string
+  pos int
+}
+
+// peek returns the next token without consuming it, or "" at the end.
+func (p *reqParser) peek() string {
+  s := strings.TrimLeft(p.s[p.pos:], " \t")
+  if s == "" {
+    return ""
+  }
+  if strings.ContainsRune(reqOperators, rune(s[0])) {
+    return s[:1]
+  }
+  end := strings.IndexAny(s, reqOperators + " \t")
+  if end < 0 {
+    end = len(s)
+  }
+  return s[:end]
+}
+
+// next consumes and returns the next token, or "" at the end.
+func (p *reqParser) next() string {
+  tok := p.peek()
+  if tok != "" {
+    p.pos = strings.Index(p.s[p.pos:], tok) + p.pos + len(tok)
+  }
+  return tok
+}
+
+func (p *reqParser) parseOr() (Requirement, error) {
+  reqs := make([]Requirement, 0)
+  for {
+    req, err := p.parseAnd()
+    if err != nil {
+      return nil, err
+    }
+    reqs = append(reqs, req)
+    if p.peek() != "|" {
+      break
+    }
+    p.next()
+  }
+  if len(reqs) == 1 {
+    return reqs[0], nil
+  }
+  return anyOf(reqs), nil
+}
+
+func (p *reqParser) parseAnd() (Requirement, error) {
+  reqs := make([]Requirement, 0)
+  for {
+    req, err := p.parseNot()
+    if err != nil {
+      return nil, err
+    }
+    reqs = append(reqs, req)
+    if p.peek() != "&" {
+      break
+    }
+    p.next()
+  }
+  if len(reqs) == 1 {
+    return reqs[0], nil
+  }
+  return allOf(reqs), nil
+}
+
+func (p *reqParser) parseNot() (Requirement, error) {
+  tok := p.next()
+  switch tok {
+  case "":
+    return nil, fmt.Errorf("unexpected end of expression")
+  case "!":
+    req, err := p.parseNot()
+    if err != nil {
+      return nil, err
+    }
+    return not{req}, nil
+  case "(":
+    if p.peek() == ")" {
+      p.next()
+      return allOf{}, nil
+    }
+    req, err := p.parseOr()
+    if err != nil {
+      return nil, err
+    }
+    if p.next() != ")" {
+      return nil, fmt.Errorf("missing close parenthesis")
+    }
+    return req, nil
+  case "&", "|", ")":
+    return nil, fmt.Errorf("unexpected %q", tok)
+  }
+  return ParsePermission(tok)
+}
@@ -0,0 +1,143 @@
+package permissions
+
+import (
+  "fmt"
+  "testing"
+)
+
+func TestRequirementCombinators(t *testing.T) {
+  edit := Permission("edit")
+  root := Permission("root")
+  readonly := Permission("readonly")
+  req := AnyOf(edit, AllOf(root, Not(readonly)))
+  if got, want := req.String(), "edit | (root & !readonly)"; got != want {
+    t.Errorf("requirement string: got %q, want %q", got, want)
+  }
+  tests := []struct{
+    perms string
+    satisfied bool
+    missing string
+  }{
+    {"edit", true, ""},
+    {"root", true, ""},
+    {"edit readonly", true, ""},
+    {"root readonly", false, "requires one of edit, (root & !readonly)"},
+    {"", false, "requires one of edit, (root & !readonly)"},
+  }
+  for _, tt := range tests {
+    p := FromString(tt.perms)
+    if got := req.Satisfied(p); got != tt.satisfied {
+      t.Errorf("Satisfied(%q): got %v, want %v", tt.perms, got, tt.satisfied)
+    }
+    if got := req.Missing(p); got != tt.missing {
+      t.Errorf("Missing(%q): got %q, want %q", tt.perms, got, tt.missing)
+    }
+  }
+
+  all := AllOf(edit, root, Not(readonly))
+  if got, want := all.Missing(FromString("root readonly")), "missing permission edit; must not have readonly"; got != want {
+    t.Errorf("AllOf missing: got %q, want %q", got, want)
+  }
+  if got, want := AnyOf(edit).Missing(FromString("")), "missing permission edit"; got != want {
+    t.Errorf("single AnyOf missing: got %q, want %q", got, want)
+  }
+  if got, want := fmt.Sprint(RequiredPermissions(req)), "[edit root readonly]"; got != want {
+    t.Errorf("required permissions: got %s, want %s", got, want)
+  }
+}
+
+func TestEmptyRequirements(t *testing.T) {
+  p := FromString("edit")
+  tests := []struct{
+    req Requirement
+    str string
+    satisfied bool
+  }{
+    {AllOf(), "()", true},
+    {AnyOf(), "!()", false},
+    {Not(AllOf()), "!()", false},
+    {Not(AnyOf()), "!!()", true},
+    {AllOf(Permission("edit"), AnyOf()), "edit & !()", false},
+    {AnyOf(Permission("root"), AllOf()), "root | ()", true},
+  }
+  for _, tt := range tests {
+    if got := tt.req.String(); got != tt.str {
+      t.Errorf("String: got %q, want %q", got, tt.str)
+    }
+    if got := tt.req.Satisfied(p); got != tt.satisfied {
+      t.Errorf("%s Satisfied: got %v, want %v", tt.str, got, tt.satisfied)
+    }
+    if got := tt.req.Missing(p) == ""; got != tt.satisfied {
+      t.Errorf("%s Missing: got %q", tt.str, tt.req.Missing(p))
+    }
+    // The string form parses back to a requirement with the same meaning.
+    req2, err := ParseRequirement(tt.str)
+    if err != nil {
+      t.Errorf("ParseRequirement(%q): unexpected error %v", tt.str, err)
+      continue
+    }
+    if got := req2.String(); got != tt.str {
+      t.Errorf("round trip of %q: got %q", tt.str, got)
+    }
+    if got := req2.Satisfied(p); got != tt.satisfied {
+      t.Errorf("parsed %s Satisfied: got %v, want %v", tt.str, got, tt.satisfied)
+    }
+  }
+}
+
+func TestParseRequirement(t *testing.T) {
+  tests := []struct{
+    s string
+    str string
+  }{
+    {"edit", "edit"},
+    {" edit ", "edit"},
+    {"edit|root", "edit | root"},
+    {"edit | root & !readonly", "edit | (root & !readonly)"},
+    {"edit | (root & !readonly)", "edit | (root & !readonly)"},
+    {"(edit | root) & !readonly", "(edit | root) & !readonly"},
+    {"!!edit", "!!edit"},
+    {"!(edit | root)", "!(edit | root)"},
+    {"docs:* & @editor", "docs:* & @editor"},
+    {"a & b & c | d", "(a & b & c) | d"},
+    {"()", "()"},
+    {"!( )", "!()"},
+    {"edit & ()", "edit & ()"},
+  }
+  for _, tt := range tests {
+    req, err := ParseRequirement(tt.s)
+    if err != nil {
+      t.Errorf("ParseRequirement(%q): unexpected error %v", tt.s, err)
+      continue
+    }
+    if got := req.String(); got != tt.str {
+      t.Errorf("ParseRequirement(%q): got %q, want %q", tt.s, got, tt.str)
+    }
+    // The string form must parse back to the same thing.
+    req2, err := ParseRequirement(req.String())
+    if err != nil || req2.String() != tt.str {
+      t.Errorf("round trip of %q: got %v, %v", tt.str, req2, err)
+    }
+  }
+
+  bad := []string{"", "edit |", "& edit", "(edit", "edit)", "edit root", "!", "docs::x", "(()", "()edit"}
+  for _, s := range bad {
+    if _, err := ParseRequirement(s); err == nil {
+      t.Errorf("ParseRequirement(%q): expected error", s)
+    }
+  }
+
+  req := MustParseRequirement("edit | (root & !readonly)")
+  if got, want := req.Satisfied(FromString("root")), true; got != want {
+    t.Errorf("parsed requirement for root: got %v, want %v", got, want)
+  }
+  if got, want := req.Satisfied(FromString("root readonly")), false; got != want {
+    t.Errorf("parsed requirement for root readonly: got %v, want %v", got, want)
+  }
+  defer func() {
+    if recover() == nil {
+      t.Errorf("expected panic from MustParseRequirement")
+    }
+  }()
+  MustParseRequirement("edit |")
+}
@@ -0,0 +1,125 @@
+package permissions
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+)
+
+// RolePrefix marks a permission that refers to a role rather than being
+// a permission itself. A user with the permission "@editor" has all of
+// the permissions of the editor role. Roles may refer to other roles.
+const RolePrefix = "@"
+
+// Roles holds a set of named roles, each of which bundles a set of
+// permissions and other roles.
+type Roles struct {
+  roles map[string]*Permissions
+}
+
+func NewRoles() *Roles {
+  return &Roles{
+    roles: make(map[string]*Permissions),
+  }
+}
+
+// RolePermission returns the permission that grants the named role.
+func RolePermission(name string) Permission {
+  return Permission(RolePrefix + name)
+}
+
+// RoleName returns the name of the role referred to by perm, and true,
+// or returns false if perm does not refer to a role.
+func RoleName(perm Permission) (string, bool) {
+  s := permToString(perm)
+  if !strings.HasPrefix(s, RolePrefix) {
+    return "", false
+  }
+  return strings.TrimPrefix(s, RolePrefix), true
+}
+
+// SetRole defines or replaces the named role.
+func (r *Roles) SetRole(name string, perms *Permissions) {
+  r.roles[name] = perms
+}
+
+// Role returns the permissions directly granted by the named role,
+// or nil if there is no such role.
+func (r *Roles) Role(name string) *Permissions {
+  return r.roles[name]
+}
+
+// Names returns the sorted names of our roles.
+func (r *Roles) Names() []string {
+  names := make([]string, 0, len(r.roles))
+  for name := range r.roles {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// Check returns an error if any role refers to an undefined role,
+// or if the role references form a cycle.
+func (r *Roles) Check() error {
+  const (
+    unvisited = iota
+    visiting
+    done
+  )
+  state := make(map[string]int)
+  var visit func(name string, path []string) error
+  visit = func(name string, path []string) error {
+    switch state[name] {
+    case visiting:
+      return fmt.Errorf("role cycle: %s", strings.Join(append(path, name), " -> "))
+    case done:
+      return nil
+    }
+    state[name] = visiting
+    for _, perm := range r.roles[name].sorted() {
+      sub, ok := RoleName(perm)
+      if !ok {
+        continue
+      }
+      if r.roles[sub] == nil {
+        return fmt.Errorf("role %q refers to undefined role %q", name, sub)
+      }
+      if err := visit(sub, append(path, name)); err != nil {
+        return err
+      }
+    }
+    state[name] = done
+    return nil
+  }
+  for _, name := range r.Names() {
+    if err := visit(name, nil); err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// hasPermission returns true if the named role grants perm, either
+// directly or through the roles it includes. The visited map protects
+// against cycles that were not caught by Check.
+func (r *Roles) hasPermission(name string, perm Permission, visited map[string]bool) bool {
+  if visited[name] {
+    return false
+  }
+  visited[name] = true
+  p := r.roles[name]
+  if p == nil {
+    return false
+  }
+  active := p.active()
+  if holds(active, perm) {
+    return true
+  }
+  for rp := range active {
+    if sub, ok := RoleName(rp); ok && r.hasPermission(sub, perm, visited) {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,72 @@
+package permissions
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestRoles(t *testing.T) {
+  roles := NewRoles()
+  roles.SetRole("reader", FromString("read"))
+  roles.SetRole("editor", FromString("edit comment @reader"))
+  roles.SetRole("chief", FromString("@editor publish"))
+
+  p := FromString("@chief something")
+  if got, want := p.HasPermission("read"), false; got != want {
+    t.Errorf("role permission before SetRoles: got %v, want %v", got, want)
+  }
+  p.SetRoles(roles)
+  tests := []struct{
+    perm Permission
+    want bool
+  }{
+    {"something", true},
+    {"publish", true},
+    {"edit", true},
+    {"read", true},
+    {"@editor", true},
+    {"@reader", true},
+    {"delete", false},
+    {"@other", false},
+  }
+  for _, tt := range tests {
+    if got := p.HasPermission(tt.perm); got != tt.want {
+      t.Errorf("HasPermission(%q): got %v, want %v", tt.perm, got, tt.want)
+    }
+  }
+  if err := roles.Check(); err != nil {
+    t.Errorf("unexpected error checking roles: %v", err)
+  }
+  if got, want := strings.Join(roles.Names(), " "), "chief editor reader"; got != want {
+    t.Errorf("role names: got %q, want %q", got, want)
+  }
+}
+
+func TestRoleCycle(t *testing.T) {
+  roles := NewRoles()
+  roles.SetRole("a", FromString("x @b"))
+  roles.SetRole("b", FromString("y @c"))
+  roles.SetRole("c", FromString("z @a"))
+  err := roles.Check()
+  if err == nil {
+    t.Fatalf("expected error for role cycle")
+  }
+  if got, want := err.Error(), "role cycle: a -> b -> c -> a"; got != want {
+    t.Errorf("cycle error: got %q, want %q", got, want)
+  }
+  // Resolution must still terminate.
+  p := FromString("@a")
+  p.SetRoles(roles)
+  if got, want := p.HasPermission("z"), true; got != want {
+    t.Errorf("permission through cycle: got %v, want %v", got, want)
+  }
+  if got, want := p.HasPermission("w"), false; got != want {
+    t.Errorf("missing permission through cycle: got %v, want %v", got, want)
+  }
+
+  roles = NewRoles()
+  roles.SetRole("a", FromString("@undefined"))
+  if err := roles.Check(); err == nil {
+    t.Errorf("expected error for undefined role")
+  }
+}
@@ -0,0 +1,129 @@
+package permissions
+
+import (
+  "encoding/json"
+  "fmt"
+  "strings"
+)
+
+// List returns our permissions that have not expired, in sorted order,
+// without their time limits.
+func (p *Permissions) List() []Permission {
+  pp := make([]Permission, 0, len(p.perms))
+  now := timeNow()
+  for _, perm := range p.sorted() {
+    if b := p.bounds[perm]; b != nil && b.expired(now) {
+      continue
+    }
+    pp = append(pp, perm)
+  }
+  return pp
+}
+
+// Equal returns true if both sets contain the same permissions with the
+// same time limits, including permissions that have expired.
+func (p *Permissions) Equal(other *Permissions) bool {
+  if len(p.perms) != len(other.perms) {
+    return false
+  }
+  for perm := range p.perms {
+    if !other.perms[perm] || !p.bounds[perm].equal(other.bounds[perm]) {
+      return false
+    }
+  }
+  return true
+}
+
+// Union returns a new set with the permissions that are in either set.
+// For a permission in both sets, the time limits of p are used.
+// The result uses the roles of p.
+func (p *Permissions) Union(other *Permissions) *Permissions {
+  result := p.copy()
+  for perm := range other.perms {
+    if !result.perms[perm] {
+      result.copyGrant(other, perm)
+    }
+  }
+  return result
+}
+
+// Intersect returns a new set with the permissions that are in both sets,
+// with the time limits of p. The result uses the roles of p.
+func (p *Permissions) Intersect(other *Permissions) *Permissions {
+  result := p.empty()
+  for perm := range p.perms {
+    if other.perms[perm] {
+      result.copyGrant(p, perm)
+    }
+  }
+  return result
+}
+
+// Difference returns a new set with the permissions of p that are not in other.
+// The result uses the roles of p.
+func (p *Permissions) Difference(other *Permissions) *Permissions {
+  result := p.empty()
+  for perm := range p.perms {
+    if !other.perms[perm] {
+      result.copyGrant(p, perm)
+    }
+  }
+  return result
+}
+
+// MarshalJSON encodes our permissions as a sorted array of strings,
+// in the format accepted by FromString.
+func (p *Permissions) MarshalJSON() ([]byte, error) {
+  return json.Marshal(p.grantStrings())
+}
+
+// UnmarshalJSON decodes permissions from an array of strings, or from a
+// single string in the format accepted by FromString.
+func (p *Permissions) UnmarshalJSON(b []byte) error {
+  var ss []string
+  if err := json.Unmarshal(b, &ss); err != nil {
+    var s string
+    if err2 := json.Unmarshal(b, &s); err2 != nil {
+      return fmt.Errorf("permissions must be an array of strings or a string: %v", err)
+    }
+    ss = []string{s}
+  } else {
+    for _, s := range ss {
+      if strings.Contains(s, permSepChar) {
+        return fmt.Errorf("invalid permission %q", s)
+      }
+    }
+  }
+  parsed, err := Parse(strings.Join(ss, permSepChar))
+  if err != nil {
+    return err
+  }
+  p.perms = parsed.perms
+  p.bounds = parsed.bounds
+  return nil
+}
+
+// empty returns a new empty set with our roles.
+func (p *Permissions) empty() *Permissions {
+  return &Permissions{
+    perms: make(map[Permission]bool),
+    roles: p.roles,
+  }
+}
+
+func (p *Permissions) copy() *Permissions {
+  result := p.empty()
+  for perm := range p.perms {
+    result.copyGrant(p, perm)
+  }
+  return result
+}
+
+// copyGrant adds perm with its time limits from the other set.
+func (p *Permissions) copyGrant(other *Permissions, perm Permission) {
+  if b := other.bounds[perm]; b != nil {
+    p.GrantBetween(perm, b.notBefore, b.notAfter)
+  } else {
+    p.perms[perm] = true
+  }
+}
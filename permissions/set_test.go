@@ -0,0 +1,149 @@
+package permissions
+
+import (
+  "encoding/json"
+  "testing"
+  "time"
+)
+
+func TestSortedToString(t *testing.T) {
+  p := FromString("zeta alpha mid docs:read")
+  if got, want := p.ToString(), "alpha docs:read mid zeta"; got != want {
+    t.Errorf("ToString: got %q, want %q", got, want)
+  }
+}
+
+func TestList(t *testing.T) {
+  p := FromString("b a c")
+  got := p.List()
+  want := []Permission{"a", "b", "c"}
+  if len(got) != len(want) {
+    t.Fatalf("List: got %v, want %v", got, want)
+  }
+  for n := range want {
+    if got[n] != want[n] {
+      t.Errorf("List[%d]: got %q, want %q", n, got[n], want[n])
+    }
+  }
+}
+
+func TestSetOperations(t *testing.T) {
+  a := FromString("read write admin")
+  b := FromString("write delete")
+  tests := []struct{
+    name string
+    got *Permissions
+    want string
+  }{
+    { "union", a.Union(b), "admin delete read write" },
+    { "intersect", a.Intersect(b), "write" },
+    { "difference", a.Difference(b), "admin read" },
+    { "difference reversed", b.Difference(a), "delete" },
+  }
+  for _, tc := range tests {
+    if got, want := tc.got.ToString(), tc.want; got != want {
+      t.Errorf("%s: got %q, want %q", tc.name, got, want)
+    }
+  }
+  if got, want := a.ToString(), "admin read write"; got != want {
+    t.Errorf("receiver was modified: got %q, want %q", got, want)
+  }
+}
+
+func TestSetOperationsKeepBounds(t *testing.T) {
+  start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+  end := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+  savedNow := timeNow
+  defer func() { timeNow = savedNow }()
+  timeNow = func() time.Time { return start.Add(time.Hour) }
+
+  a := FromString("read")
+  a.GrantBetween("deploy", start, end)
+  b := FromString("deploy")
+  if got, want := a.Intersect(b).ToString(), "deploy[2020-01-01T00:00:00Z/2020-02-01T00:00:00Z]"; got != want {
+    t.Errorf("Intersect: got %q, want %q", got, want)
+  }
+  if got, want := b.Union(a).ToString(), "deploy read"; got != want {
+    t.Errorf("Union: got %q, want %q", got, want)
+  }
+}
+
+func TestEqual(t *testing.T) {
+  if !FromString("a b").Equal(FromString("b  a")) {
+    t.Errorf("sets with the same permissions should be equal")
+  }
+  if FromString("a b").Equal(FromString("a")) {
+    t.Errorf("sets with different permissions should not be equal")
+  }
+  past := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+  expired := func(notAfter time.Time) *Permissions {
+    p := FromString("a")
+    p.GrantBetween("b", time.Time{}, notAfter)
+    return p
+  }
+  if !expired(past).Equal(expired(past)) {
+    t.Errorf("sets with the same expired permissions should be equal")
+  }
+  if expired(past).Equal(expired(past.Add(time.Hour))) {
+    t.Errorf("sets with different expired time limits should not be equal")
+  }
+  if expired(past).Equal(FromString("a")) || FromString("a").Equal(expired(past)) {
+    t.Errorf("sets with and without an expired permission should not be equal")
+  }
+  if expired(past).Equal(FromString("a b")) {
+    t.Errorf("sets with and without a time limit should not be equal")
+  }
+}
+
+func TestJSON(t *testing.T) {
+  p := FromString("write read")
+  b, err := json.Marshal(p)
+  if err != nil {
+    t.Fatalf("Marshal: %v", err)
+  }
+  if got, want := string(b), `["read","write"]`; got != want {
+    t.Errorf("Marshal: got %s, want %s", got, want)
+  }
+
+  p2 := &Permissions{}
+  if err := json.Unmarshal(b, p2); err != nil {
+    t.Fatalf("Unmarshal: %v", err)
+  }
+  if !p2.Equal(p) {
+    t.Errorf("Unmarshal: got %q, want %q", p2.ToString(), p.ToString())
+  }
+  if !p2.HasPermission("read") {
+    t.Errorf("unmarshalled permissions should have read")
+  }
+
+  p3 := &Permissions{}
+  if err := json.Unmarshal([]byte(`"read write"`), p3); err != nil {
+    t.Fatalf("Unmarshal string: %v", err)
+  }
+  if !p3.Equal(p) {
+    t.Errorf("Unmarshal string: got %q, want %q", p3.ToString(), p.ToString())
+  }
+
+  if err := json.Unmarshal([]byte(`["bad perm"]`), &Permissions{}); err == nil {
+    t.Errorf("Unmarshal of invalid permission should fail")
+  }
+  if err := json.Unmarshal([]byte(`3`), &Permissions{}); err == nil {
+    t.Errorf("Unmarshal of a number should fail")
+  }
+}
+
+func TestWithRoles(t *testing.T) {
+  roles := NewRoles()
+  roles.SetRole("editor", FromString("edit"))
+  p := FromString("@editor read")
+  p2 := p.WithRoles(roles)
+  if got, want := p2.HasPermission("edit"), true; got != want {
+    t.Errorf("copy with roles: got %v, want %v", got, want)
+  }
+  if got, want := p.HasPermission("edit"), false; got != want {
+    t.Errorf("original without roles: got %v, want %v", got, want)
+  }
+  if !p2.Equal(p) {
+    t.Errorf("copy with roles: got %q, want %q", p2.ToString(), p.ToString())
+  }
+}
@@ -0,0 +1,190 @@
+package policy
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "sync"
+  "time"
+
+  "github.com/jimmc/auth/filewatch"
+  "github.com/jimmc/auth/users"
+)
+
+// Engine evaluates requests against a policy loaded from a file.
+// The policy can be reloaded explicitly by calling Load, or
+// automatically when the file changes by calling Watch.
+// If a username policy is set by SetUsernamePolicy, the usernames in
+// the principals of the rules are canonicalized when the policy is loaded.
+type Engine struct {
+  filename string
+  watcher *filewatch.Watcher
+  mu sync.RWMutex
+  policy *Policy
+  usernamePolicy *users.UsernamePolicy
+}
+
+// A Decision is the result of evaluating a Request.
+type Decision struct {
+  Allowed bool
+  Rule string             // Id of the rule that decided, or empty if none did.
+  Reason string
+  Trace []*RuleResult     // Set only by Explain.
+}
+
+// Denied returns true if a deny rule made the decision, rather than the
+// user lacking the permission.
+func (d *Decision) Denied() bool {
+  return !d.Allowed && d.Rule != ""
+}
+
+// RuleResult records how one rule was evaluated by Explain.
+type RuleResult struct {
+  Rule string
+  Effect string
+  Matched bool
+  Reason string           // Why the rule did not match.
+}
+
+func NewEngine(filename string) *Engine {
+  e := &Engine{
+    filename: filename,
+    policy: &Policy{},
+  }
+  e.watcher = filewatch.New("policy file", filename, e.Load)
+  return e
+}
+
+// NewEngineFromPolicy returns an engine using the given policy, with no file.
+// The policy is checked in the same way as by Parse, so one built in code
+// can be used.
+func NewEngineFromPolicy(p *Policy) (*Engine, error) {
+  if err := p.check(); err != nil {
+    return nil, err
+  }
+  e := &Engine{
+    policy: p,
+  }
+  e.watcher = filewatch.New("policy file", "", e.Load)
+  return e, nil
+}
+
+// SetUsernamePolicy sets the policy for the usernames in principals,
+// and applies it to the policy already loaded. It should be the same
+// policy as is set on the user store.
+func (e *Engine) SetUsernamePolicy(p *users.UsernamePolicy) {
+  e.mu.Lock()
+  defer e.mu.Unlock()
+  e.usernamePolicy = p
+  e.policy = e.policy.withCanonicalPrincipals(p)
+}
+
+// Load reads the policy file. If the file can not be read or is not
+// valid, the previous policy stays in effect and the error is returned.
+func (e *Engine) Load() error {
+  info, err := os.Stat(e.filename)
+  if err == nil {
+    err = e.load(info)
+  } else {
+    err = fmt.Errorf("error reading policy file %s: %v", e.filename, err)
+  }
+  e.watcher.SetError(err)
+  return err
+}
+
+func (e *Engine) load(info os.FileInfo) error {
+  b, err := ioutil.ReadFile(e.filename)
+  if err != nil {
+    return fmt.Errorf("error reading policy file %s: %v", e.filename, err)
+  }
+  p, err := Parse(b)
+  if err != nil {
+    return fmt.Errorf("error in policy file %s: %v", e.filename, err)
+  }
+  e.mu.Lock()
+  e.policy = p.withCanonicalPrincipals(e.usernamePolicy)
+  e.mu.Unlock()
+  e.watcher.Loaded(info)
+  return nil
+}
+
+// Watch starts checking the policy file every interval, and reloads
+// it when its modification time or size changes. Call Stop to end
+// the checking.
+func (e *Engine) Watch(interval time.Duration) {
+  e.watcher.Start(interval)
+}
+
+// Stop ends the checking started by Watch.
+func (e *Engine) Stop() {
+  e.watcher.Stop()
+}
+
+// Status returns the reload status of the policy file.
+func (e *Engine) Status() *filewatch.Status {
+  return e.watcher.Status()
+}
+
+// Evaluate decides whether the request is allowed.
+// Any matching deny rule denies the request. Otherwise it is allowed if
+// the subject holds the permission or if a matching allow rule grants it.
+func (e *Engine) Evaluate(req *Request) *Decision {
+  return e.evaluate(req, false)
+}
+
+// Explain is like Evaluate, but does not stop at the first deciding rule,
+// and records the result of every rule in the Trace of the Decision.
+// It can be used as a dry run to see the effect of a policy.
+func (e *Engine) Explain(req *Request) *Decision {
+  return e.evaluate(req, true)
+}
+
+func (e *Engine) evaluate(req *Request, explain bool) *Decision {
+  e.mu.RLock()
+  p := e.policy
+  e.mu.RUnlock()
+  var deny, allow *Rule
+  trace := make([]*RuleResult, 0)
+  for _, rule := range p.Rules {
+    matched, reason := rule.matches(req)
+    if explain {
+      trace = append(trace, &RuleResult{
+        Rule: rule.Id,
+        Effect: rule.Effect,
+        Matched: matched,
+        Reason: reason,
+      })
+    }
+    if !matched {
+      continue
+    }
+    if rule.Effect == Deny && deny == nil {
+      deny = rule
+      if !explain {
+        break
+      }
+    }
+    if rule.Effect == Allow && allow == nil {
+      allow = rule
+    }
+  }
+  d := &Decision{}
+  if explain {
+    d.Trace = trace
+  }
+  switch {
+  case deny != nil:
+    d.Rule = deny.Id
+    d.Reason = fmt.Sprintf("denied by rule %s", deny.Id)
+  case req.Subject.HasPermission(req.Permission):
+    d.Allowed = true
+    d.Reason = fmt.Sprintf("user has permission %s", req.Permission)
+  case allow != nil:
+    d.Allowed = true
+    d.Rule = allow.Id
+    d.Reason = fmt.Sprintf("allowed by rule %s", allow.Id)
+  default:
+    d.Reason = fmt.Sprintf("missing permission %s", req.Permission)
+  }
+  return d
+}
@@ -0,0 +1,214 @@
+package policy
+
+import (
+  "io/ioutil"
+  "net/http"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+func testUser(t *testing.T, name, perms string) *users.User {
+  t.Helper()
+  roles := permissions.NewRoles()
+  roles.SetRole("contractor", permissions.FromString("read"))
+  roles.SetRole("oncall", permissions.FromString("read"))
+  p := permissions.FromString(perms)
+  p.SetRoles(roles)
+  return users.NewUser(name, "", p)
+}
+
+func TestEvaluate(t *testing.T) {
+  e := NewEngine("testdata/policy1.json")
+  if err := e.Load(); err != nil {
+    t.Fatalf("error loading policy: %v", err)
+  }
+  contractor := testUser(t, "alice", "@contractor delete docs:edit write")
+  oncall := testUser(t, "bob", "@oncall write")
+  monday10 := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+  tests := []struct{
+    user *users.User
+    perm permissions.Permission
+    method string
+    addr string
+    t time.Time
+    allowed bool
+    rule string
+  }{
+    {contractor, "delete", "POST", "10.0.0.1:80", monday10, false, "contractors-never-delete"},
+    {contractor, "docs:edit", "POST", "10.0.0.1:80", monday10, false, "contractors-never-delete"},
+    {contractor, "read", "GET", "10.0.0.1:80", monday10, true, ""},
+    {contractor, "deploy", "POST", "10.0.0.1:80", monday10, false, ""},
+    {oncall, "deploy", "POST", "10.0.0.1:80", monday10, true, "oncall-deploy"},
+    {oncall, "deploy", "GET", "10.0.0.1:80", monday10, false, ""},
+    {oncall, "deploy", "POST", "8.8.8.8:80", monday10, false, ""},
+    {oncall, "write", "POST", "10.0.0.1:80", monday10, true, ""},
+    {oncall, "write", "POST", "10.0.0.1:80", monday10.Add(13 * time.Hour), false, "no-night-writes"},
+    {oncall, "delete", "POST", "10.0.0.1:80", monday10, false, ""},
+  }
+  for _, tt := range tests {
+    req := &Request{Subject: tt.user, Permission: tt.perm, Method: tt.method, RemoteAddr: tt.addr, Time: tt.t}
+    d := e.Evaluate(req)
+    if d.Allowed != tt.allowed || d.Rule != tt.rule {
+      t.Errorf("Evaluate %s %s %s %s %v: got allowed=%v rule=%q (%s), want allowed=%v rule=%q",
+          tt.user.Id(), tt.perm, tt.method, tt.addr, tt.t, d.Allowed, d.Rule, d.Reason, tt.allowed, tt.rule)
+    }
+    if d.Trace != nil {
+      t.Errorf("Evaluate should not set a trace")
+    }
+    if got, want := d.Denied(), !tt.allowed && tt.rule != ""; got != want {
+      t.Errorf("Evaluate %s %s: got denied=%v, want %v", tt.user.Id(), tt.perm, got, want)
+    }
+  }
+}
+
+func TestExplain(t *testing.T) {
+  e := NewEngine("testdata/policy1.json")
+  if err := e.Load(); err != nil {
+    t.Fatalf("error loading policy: %v", err)
+  }
+  r, err := http.NewRequest("POST", "/api/deploy", nil)
+  if err != nil {
+    t.Fatalf("error creating request: %v", err)
+  }
+  r.RemoteAddr = "10.0.0.1:1234"
+  timeNow = func() time.Time { return time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC) }
+  defer func() { timeNow = time.Now }()
+  req := NewRequest(r, testUser(t, "alice", "@contractor"), "delete")
+  d := e.Explain(req)
+  if got, want := d.Allowed, false; got != want {
+    t.Errorf("explain allowed: got %v, want %v", got, want)
+  }
+  if got, want := d.Reason, "denied by rule contractors-never-delete"; got != want {
+    t.Errorf("explain reason: got %q, want %q", got, want)
+  }
+  if got, want := len(d.Trace), 3; got != want {
+    t.Fatalf("explain trace length: got %d, want %d", got, want)
+  }
+  if got, want := d.Trace[0].Matched, true; got != want {
+    t.Errorf("trace of first rule matched: got %v, want %v", got, want)
+  }
+  if got, want := d.Trace[1].Reason, "principal does not match"; got != want {
+    t.Errorf("trace of second rule: got %q, want %q", got, want)
+  }
+  if got, want := d.Trace[2].Reason, "permission does not match"; got != want {
+    t.Errorf("trace of third rule: got %q, want %q", got, want)
+  }
+}
+
+func TestWatch(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "policy.json")
+  write := func(s string) {
+    if err := ioutil.WriteFile(filename, []byte(s), 0644); err != nil {
+      t.Fatalf("error writing policy file: %v", err)
+    }
+  }
+  e := NewEngine(filename)
+  // Check twice, so that a change has settled and is reloaded.
+  poll := func() {
+    e.watcher.ReloadIfChanged()
+    e.watcher.ReloadIfChanged()
+  }
+  user := testUser(t, "alice", "")
+  req := &Request{Subject: user, Permission: "read", Time: time.Now()}
+
+  if err := e.Load(); err == nil {
+    t.Errorf("expected error loading missing policy file")
+  }
+  write(`{"rules": [{"id": "r1", "effect": "allow", "principals": ["alice"], "permissions": ["read"]}]}`)
+  if err := e.Load(); err != nil {
+    t.Fatalf("error loading policy: %v", err)
+  }
+  if !e.Evaluate(req).Allowed {
+    t.Errorf("read should be allowed by first policy")
+  }
+  write(`{"rules": [{"id": "r2", "effect": "allow", "principals": ["bob"], "permissions": ["read"]}]}`)
+  poll()
+  if got, want := e.Status().Reloads, 2; got != want {
+    t.Errorf("reloads after change: got %d, want %d", got, want)
+  }
+  if e.Evaluate(req).Allowed {
+    t.Errorf("read should not be allowed after reload")
+  }
+
+  write(`{"rules": [ this is not valid json ]}`)
+  poll()
+  if e.Status().LastError == nil {
+    t.Errorf("expected error after bad file")
+  }
+  if got, want := e.Status().Reloads, 2; got != want {
+    t.Errorf("reloads after bad file: got %d, want %d", got, want)
+  }
+  if e.Evaluate(req).Allowed {
+    t.Errorf("previous policy should still be in effect after bad file")
+  }
+
+  write(`{"rules": [{"id": "r3", "effect": "allow", "principals": ["*"], "permissions": ["read"]}]}`)
+  poll()
+  if got, want := e.Status().Reloads, 3; got != want || e.Status().LastError != nil {
+    t.Errorf("reloads after recovery: got %d (%v), want %d", got, e.Status().LastError, want)
+  }
+  if !e.Evaluate(req).Allowed {
+    t.Errorf("read should be allowed after recovery")
+  }
+}
+
+func TestEngineFromPolicy(t *testing.T) {
+  p := &Policy{
+    Rules: []*Rule{
+      { Effect: Allow, Principals: []string{AnyPrincipal}, Permissions: []permissions.Permission{"deploy"},
+        Conditions: &Conditions{Hours: "09:00-17:00", CIDRs: []string{"10.0.0.0/8"}, Timezone: "UTC"},
+      },
+    },
+  }
+  e, err := NewEngineFromPolicy(p)
+  if err != nil {
+    t.Fatalf("error creating engine from policy: %v", err)
+  }
+  user := testUser(t, "alice", "")
+  monday10 := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+  tests := []struct{
+    addr string
+    t time.Time
+    allowed bool
+  }{
+    {"10.0.0.1:80", monday10, true},
+    {"8.8.8.8:80", monday10, false},
+    {"10.0.0.1:80", monday10.Add(8 * time.Hour), false},
+  }
+  for _, tt := range tests {
+    req := &Request{Subject: user, Permission: "deploy", Method: "POST", RemoteAddr: tt.addr, Time: tt.t}
+    if got, want := e.Evaluate(req).Allowed, tt.allowed; got != want {
+      t.Errorf("deploy from %s at %v: got %v, want %v", tt.addr, tt.t, got, want)
+    }
+  }
+
+  p.Rules[0].Conditions.Hours = "09:00-24:30"
+  if _, err := NewEngineFromPolicy(p); err == nil {
+    t.Errorf("expected error creating engine with invalid hours")
+  }
+}
+
+func TestEngineUsernamePolicy(t *testing.T) {
+  p := &Policy{Rules: []*Rule{
+    {Id: "alice-deploy", Effect: Allow, Principals: []string{"Alice", "@Oncall"}, Permissions: []permissions.Permission{"deploy"}},
+  }}
+  e, err := NewEngineFromPolicy(p)
+  if err != nil {
+    t.Fatalf("error creating engine from policy: %v", err)
+  }
+  req := &Request{Subject: testUser(t, "alice", ""), Permission: "deploy", Time: time.Now()}
+  if e.Evaluate(req).Allowed {
+    t.Errorf("rule for Alice should not apply to alice without a username policy")
+  }
+  e.SetUsernamePolicy(users.NewUsernamePolicy())
+  if !e.Evaluate(req).Allowed {
+    t.Errorf("rule for Alice should apply to alice with a username policy")
+  }
+  if got, want := p.Rules[0].Principals[0], "Alice"; got != want {
+    t.Errorf("principal in the original policy: got %q, want %q", got, want)
+  }
+}
@@ -0,0 +1,320 @@
+// The policy package implements declarative allow and deny rules that
+// are applied on top of the permissions held by a user.
+// A policy is a JSON file containing a list of rules, such as
+//   {
+//     "rules": [
+//       {
+//         "id": "contractors-never-delete",
+//         "effect": "deny",
+//         "principals": ["@contractor"],
+//         "permissions": ["delete", "docs:delete"]
+//       },
+//       {
+//         "id": "office-hours-deploy",
+//         "effect": "allow",
+//         "principals": ["@oncall"],
+//         "permissions": ["deploy"],
+//         "conditions": {
+//           "hours": "09:00-17:00",
+//           "weekdays": ["Mon", "Tue", "Wed", "Thu", "Fri"],
+//           "timezone": "America/Los_Angeles",
+//           "cidrs": ["10.0.0.0/8"],
+//           "methods": ["POST"]
+//         }
+//       }
+//     ]
+//   }
+// Decisions use deny-overrides semantics: a matching deny rule always
+// denies, otherwise the request is allowed if the user holds the
+// permission or a matching allow rule grants it.
+package policy
+
+import (
+  "encoding/json"
+  "fmt"
+  "net"
+  "net/http"
+  "strings"
+  "time"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+var (
+  timeNow = time.Now            // Allow overriding for unit testing.
+)
+
+const (
+  Allow = "allow"
+  Deny = "deny"
+  AnyPrincipal = "*"
+)
+
+// Policy is the contents of a policy file.
+type Policy struct {
+  Rules []*Rule `json:"rules"`
+}
+
+// A Rule allows or denies a set of permissions to a set of principals,
+// optionally subject to conditions. A principal is a username, a role
+// in the form @rolename, or "*" for every user. Permissions may use
+// wildcards, and an empty list matches every permission.
+type Rule struct {
+  Id string `json:"id"`
+  Effect string `json:"effect"`           // "allow" or "deny"
+  Principals []string `json:"principals"`
+  Permissions []permissions.Permission `json:"permissions"`
+  Conditions *Conditions `json:"conditions"`
+}
+
+// Conditions restrict when a rule applies. Every non-empty condition
+// must be met for the rule to apply.
+type Conditions struct {
+  Methods []string `json:"methods"`     // HTTP methods
+  CIDRs []string `json:"cidrs"`         // Client IP ranges
+  Hours string `json:"hours"`           // Time of day range as "HH:MM-HH:MM", may wrap past midnight
+  Weekdays []string `json:"weekdays"`   // Three-letter day names such as "Mon"
+  Timezone string `json:"timezone"`     // Location for Hours and Weekdays, default is local time
+
+  nets []*net.IPNet
+  location *time.Location
+  start, end int                        // Minutes after midnight
+}
+
+// A Subject is the user making a request. It is satisfied by *users.User.
+type Subject interface {
+  Id() string
+  HasPermission(perm permissions.Permission) bool
+}
+
+// A Request is the question to be decided: may Subject use Permission
+// in the context of the other fields.
+type Request struct {
+  Subject Subject
+  Permission permissions.Permission
+  Method string
+  RemoteAddr string      // Client address, as in http.Request
+  Time time.Time
+}
+
+// NewRequest creates a Request for the subject and permission, taking the
+// method and client address from the http request and using the current time.
+func NewRequest(r *http.Request, subject Subject, perm permissions.Permission) *Request {
+  return &Request{
+    Subject: subject,
+    Permission: perm,
+    Method: r.Method,
+    RemoteAddr: r.RemoteAddr,
+    Time: timeNow(),
+  }
+}
+
+// Parse reads a policy from JSON and checks that it is valid.
+func Parse(b []byte) (*Policy, error) {
+  p := &Policy{}
+  if err := json.Unmarshal(b, p); err != nil {
+    return nil, err
+  }
+  if err := p.check(); err != nil {
+    return nil, err
+  }
+  return p, nil
+}
+
+// check validates the policy and prepares its rules for use. It must be
+// called before the policy is evaluated, and can safely be called again.
+func (p *Policy) check() error {
+  ids := make(map[string]bool)
+  for n, rule := range p.Rules {
+    if rule.Id == "" {
+      rule.Id = fmt.Sprintf("rule%d", n+1)
+    }
+    if ids[rule.Id] {
+      return fmt.Errorf("duplicate rule id %q", rule.Id)
+    }
+    ids[rule.Id] = true
+    if err := rule.check(); err != nil {
+      return fmt.Errorf("rule %q: %v", rule.Id, err)
+    }
+  }
+  return nil
+}
+
+// withCanonicalPrincipals returns a copy of the policy in which the
+// usernames in the principals of the rules are in canonical form under
+// up, or the policy itself if up is nil.
+func (p *Policy) withCanonicalPrincipals(up *users.UsernamePolicy) *Policy {
+  if up == nil {
+    return p
+  }
+  cp := &Policy{Rules: make([]*Rule, len(p.Rules))}
+  for n, rule := range p.Rules {
+    cr := *rule
+    cr.Principals = make([]string, len(rule.Principals))
+    for i, principal := range rule.Principals {
+      cr.Principals[i] = up.CanonicalPrincipal(principal)
+    }
+    cp.Rules[n] = &cr
+  }
+  return cp
+}
+
+// check validates the rule and prepares its conditions for use.
+func (rule *Rule) check() error {
+  if rule.Effect != Allow && rule.Effect != Deny {
+    return fmt.Errorf("effect must be %q or %q, not %q", Allow, Deny, rule.Effect)
+  }
+  if len(rule.Principals) == 0 {
+    return fmt.Errorf("no principals")
+  }
+  for _, perm := range rule.Permissions {
+    if _, err := permissions.ParsePermission(string(perm)); err != nil {
+      return err
+    }
+  }
+  if rule.Conditions != nil {
+    return rule.Conditions.check()
+  }
+  return nil
+}
+
+func (c *Conditions) check() error {
+  c.nets = nil
+  for _, cidr := range c.CIDRs {
+    _, ipnet, err := net.ParseCIDR(cidr)
+    if err != nil {
+      return err
+    }
+    c.nets = append(c.nets, ipnet)
+  }
+  c.location = time.Local
+  if c.Timezone != "" {
+    loc, err := time.LoadLocation(c.Timezone)
+    if err != nil {
+      return err
+    }
+    c.location = loc
+  }
+  if c.Hours != "" {
+    var sh, sm, eh, em int
+    if _, err := fmt.Sscanf(c.Hours, "%d:%d-%d:%d", &sh, &sm, &eh, &em); err != nil {
+      return fmt.Errorf("hours must be HH:MM-HH:MM, not %q", c.Hours)
+    }
+    for _, hm := range [][2]int{{sh, sm}, {eh, em}} {
+      if hm[0] < 0 || hm[0] > 23 || hm[1] < 0 || hm[1] > 59 {
+        return fmt.Errorf("hours %q is not a valid time of day range", c.Hours)
+      }
+    }
+    c.start = sh * 60 + sm
+    c.end = eh * 60 + em
+  }
+  for _, day := range c.Weekdays {
+    if weekday(day) < 0 {
+      return fmt.Errorf("unknown weekday %q", day)
+    }
+  }
+  return nil
+}
+
+// weekday returns the time.Weekday for a three-letter day name, or -1.
+func weekday(name string) time.Weekday {
+  for d := time.Sunday; d <= time.Saturday; d++ {
+    if strings.EqualFold(name, d.String()[:3]) {
+      return d
+    }
+  }
+  return -1
+}
+
+// matches returns true if the rule applies to the request, or if it
+// does not, a short description of why not.
+func (rule *Rule) matches(req *Request) (bool, string) {
+  if !rule.matchesPrincipal(req.Subject) {
+    return false, "principal does not match"
+  }
+  if len(rule.Permissions) > 0 {
+    found := false
+    for _, perm := range rule.Permissions {
+      if permissions.Matches(perm, req.Permission) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      return false, "permission does not match"
+    }
+  }
+  if rule.Conditions != nil {
+    return rule.Conditions.met(req)
+  }
+  return true, ""
+}
+
+func (rule *Rule) matchesPrincipal(subject Subject) bool {
+  for _, principal := range rule.Principals {
+    if principal == AnyPrincipal || principal == subject.Id() {
+      return true
+    }
+    if _, isRole := permissions.RoleName(permissions.Permission(principal)); isRole &&
+        subject.HasPermission(permissions.Permission(principal)) {
+      return true
+    }
+  }
+  return false
+}
+
+func (c *Conditions) met(req *Request) (bool, string) {
+  if len(c.Methods) > 0 {
+    found := false
+    for _, m := range c.Methods {
+      if strings.EqualFold(m, req.Method) {
+        found = true
+      }
+    }
+    if !found {
+      return false, fmt.Sprintf("method %s not in %v", req.Method, c.Methods)
+    }
+  }
+  if len(c.nets) > 0 {
+    host := req.RemoteAddr
+    if h, _, err := net.SplitHostPort(host); err == nil {
+      host = h
+    }
+    ip := net.ParseIP(host)
+    found := false
+    for _, ipnet := range c.nets {
+      if ip != nil && ipnet.Contains(ip) {
+        found = true
+      }
+    }
+    if !found {
+      return false, fmt.Sprintf("client address %s not in %v", req.RemoteAddr, c.CIDRs)
+    }
+  }
+  t := req.Time.In(c.location)
+  if c.Hours != "" {
+    minute := t.Hour() * 60 + t.Minute()
+    var in bool
+    if c.start <= c.end {
+      in = minute >= c.start && minute < c.end
+    } else {
+      in = minute >= c.start || minute < c.end      // Wraps past midnight
+    }
+    if !in {
+      return false, fmt.Sprintf("time %s not in hours %s", t.Format("15:04"), c.Hours)
+    }
+  }
+  if len(c.Weekdays) > 0 {
+    found := false
+    for _, day := range c.Weekdays {
+      if weekday(day) == t.Weekday() {
+        found = true
+      }
+    }
+    if !found {
+      return false, fmt.Sprintf("day %s not in %v", t.Weekday().String()[:3], c.Weekdays)
+    }
+  }
+  return true, ""
+}
@@ -0,0 +1,107 @@
+package policy
+
+import (
+  "testing"
+  "time"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+func TestParseErrors(t *testing.T) {
+  bad := []string{
+    `not json`,
+    `{"rules": [{"effect": "maybe", "principals": ["*"]}]}`,
+    `{"rules": [{"effect": "allow"}]}`,
+    `{"rules": [{"effect": "allow", "principals": ["*"], "permissions": ["a::b"]}]}`,
+    `{"rules": [{"effect": "allow", "principals": ["*"], "conditions": {"cidrs": ["10.0.0.0"]}}]}`,
+    `{"rules": [{"effect": "allow", "principals": ["*"], "conditions": {"hours": "9am"}}]}`,
+    `{"rules": [{"effect": "allow", "principals": ["*"], "conditions": {"hours": "09:00-25:00"}}]}`,
+    `{"rules": [{"effect": "allow", "principals": ["*"], "conditions": {"hours": "09:60-17:00"}}]}`,
+    `{"rules": [{"effect": "allow", "principals": ["*"], "conditions": {"weekdays": ["Xyz"]}}]}`,
+    `{"rules": [{"effect": "allow", "principals": ["*"], "conditions": {"timezone": "No/Such_Zone"}}]}`,
+    `{"rules": [{"id": "a", "effect": "allow", "principals": ["*"]}, {"id": "a", "effect": "deny", "principals": ["*"]}]}`,
+  }
+  for _, s := range bad {
+    if _, err := Parse([]byte(s)); err == nil {
+      t.Errorf("Parse(%s): expected error", s)
+    }
+  }
+  p, err := Parse([]byte(`{"rules": [{"effect": "allow", "principals": ["*"]}]}`))
+  if err != nil {
+    t.Fatalf("unexpected error parsing policy: %v", err)
+  }
+  if got, want := p.Rules[0].Id, "rule1"; got != want {
+    t.Errorf("default rule id: got %q, want %q", got, want)
+  }
+}
+
+func TestConditions(t *testing.T) {
+  c := &Conditions{
+    Methods: []string{"POST"},
+    CIDRs: []string{"10.0.0.0/8", "192.168.1.0/24"},
+    Hours: "09:00-17:00",
+    Weekdays: []string{"mon", "Tue"},
+    Timezone: "UTC",
+  }
+  if err := c.check(); err != nil {
+    t.Fatalf("error checking conditions: %v", err)
+  }
+  monday10 := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+  tests := []struct{
+    method string
+    addr string
+    t time.Time
+    met bool
+  }{
+    {"POST", "10.1.2.3:1234", monday10, true},
+    {"post", "192.168.1.7:1234", monday10, true},
+    {"GET", "10.1.2.3:1234", monday10, false},
+    {"POST", "11.1.2.3:1234", monday10, false},
+    {"POST", "garbage", monday10, false},
+    {"POST", "10.1.2.3:1234", monday10.Add(8 * time.Hour), false},
+    {"POST", "10.1.2.3:1234", monday10.Add(-2 * time.Hour), false},
+    {"POST", "10.1.2.3:1234", monday10.Add(24 * time.Hour), true},
+    {"POST", "10.1.2.3:1234", monday10.Add(48 * time.Hour), false},
+  }
+  for _, tt := range tests {
+    req := &Request{Method: tt.method, RemoteAddr: tt.addr, Time: tt.t}
+    if got, reason := c.met(req); got != tt.met {
+      t.Errorf("conditions met for %s %s %v: got %v (%s), want %v", tt.method, tt.addr, tt.t, got, reason, tt.met)
+    }
+  }
+
+  night := &Conditions{Hours: "22:00-06:00", Timezone: "UTC"}
+  if err := night.check(); err != nil {
+    t.Fatalf("error checking conditions: %v", err)
+  }
+  for hour, want := range map[int]bool{21: false, 22: true, 23: true, 0: true, 5: true, 6: false, 12: false} {
+    req := &Request{Time: time.Date(2026, 10, 19, hour, 30, 0, 0, time.UTC)}
+    if got, _ := night.met(req); got != want {
+      t.Errorf("night hours at %02d:30: got %v, want %v", hour, got, want)
+    }
+  }
+}
+
+func TestPrincipals(t *testing.T) {
+  roles := permissions.NewRoles()
+  roles.SetRole("contractor", permissions.FromString("read"))
+  perms := permissions.FromString("@contractor")
+  perms.SetRoles(roles)
+  alice := users.NewUser("alice", "", perms)
+  bob := users.NewUser("bob", "", nil)
+  rule := &Rule{Principals: []string{"@contractor", "carol"}}
+  if !rule.matchesPrincipal(alice) {
+    t.Errorf("alice should match through contractor role")
+  }
+  if rule.matchesPrincipal(bob) {
+    t.Errorf("bob should not match")
+  }
+  if !rule.matchesPrincipal(users.NewUser("carol", "", nil)) {
+    t.Errorf("carol should match by name")
+  }
+  rule = &Rule{Principals: []string{AnyPrincipal}}
+  if !rule.matchesPrincipal(bob) {
+    t.Errorf("bob should match any principal")
+  }
+}
@@ -0,0 +1,334 @@
+package store
+
+import (
+  "container/list"
+  "context"
+  "errors"
+  "fmt"
+  "sync"
+  "time"
+
+  "github.com/golang/glog"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+var (
+  timeNow = time.Now            // Allow overriding for unit testing.
+)
+
+// ErrNotSupported is returned by wrapper stores such as Cached for
+// operations that the store they wrap does not support.
+var ErrNotSupported = errors.New("operation not supported by store")
+
+// Cached wraps a Store to keep the users it has looked up in memory,
+// so that a database is not queried on every request. Entries expire
+// after the TTL, and the least recently used entries are dropped when
+// there are more than the maximum number. Users that don't exist are
+// cached too, for the negative TTL.
+// Changes made through the Cached store remove the changed users from
+// the cache. Changes made directly to the underlying store are not seen
+// until the entries expire, or Invalidate or Load is called.
+// If the underlying store has a username policy, set the same policy
+// with SetUsernamePolicy, so that each user has only one entry.
+type Cached struct {
+    s Store
+    maxEntries int
+    ttl time.Duration
+    negativeTTL time.Duration
+    mu sync.Mutex       // Protects the fields below.
+    usernamePolicy *users.UsernamePolicy  // Canonicalizes our keys.
+    entries map[string]*list.Element
+    lru *list.List      // Of *cacheEntry, most recently used at the front.
+    generation uint64   // Incremented by each invalidation.
+    hits int64
+    misses int64
+}
+
+type cacheEntry struct {
+  username string
+  user *users.User    // nil if there is no such user.
+  expires time.Time
+}
+
+// CacheStats reports the effectiveness of a Cached store.
+type CacheStats struct {
+  Hits int64
+  Misses int64
+  Entries int
+}
+
+// NewCached returns a Cached store that holds up to maxEntries users
+// from s, each for the ttl. The negative TTL is the same as the ttl
+// unless set by SetNegativeTTL.
+func NewCached(s Store, maxEntries int, ttl time.Duration) *Cached {
+  return &Cached{
+    s: s,
+    maxEntries: maxEntries,
+    ttl: ttl,
+    negativeTTL: ttl,
+    entries: make(map[string]*list.Element),
+    lru: list.New(),
+  }
+}
+
+// SetNegativeTTL sets how long we remember that a user does not exist.
+// Zero disables negative caching.
+func (c *Cached) SetNegativeTTL(ttl time.Duration) {
+  c.negativeTTL = ttl
+}
+
+// SetUsernamePolicy sets the policy used to canonicalize the usernames
+// that we use as keys, and empties the cache.
+func (c *Cached) SetUsernamePolicy(p *users.UsernamePolicy) {
+  c.mu.Lock()
+  c.usernamePolicy = p
+  c.mu.Unlock()
+  c.InvalidateAll()
+}
+
+// UsernamePolicy returns the username policy of the underlying store,
+// or nil if it has none.
+func (c *Cached) UsernamePolicy() *users.UsernamePolicy {
+  return usernamePolicyOf(c.s)
+}
+
+// Stats returns the hit and miss counts and the number of cached entries.
+func (c *Cached) Stats() *CacheStats {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return &CacheStats{
+    Hits: c.hits,
+    Misses: c.misses,
+    Entries: c.lru.Len(),
+  }
+}
+
+// Invalidate removes a user from the cache.
+func (c *Cached) Invalidate(username string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.generation++
+  username = c.usernamePolicy.Canonical(username)
+  if e, ok := c.entries[username]; ok {
+    c.lru.Remove(e)
+    delete(c.entries, username)
+  }
+}
+
+// InvalidateAll empties the cache.
+func (c *Cached) InvalidateAll() {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.generation++
+  c.entries = make(map[string]*list.Element)
+  c.lru.Init()
+}
+
+// lookup returns the cached user and true, or false if the user is not
+// in the cache or has expired. It also returns the generation, to be
+// passed to add when the user is looked up in the underlying store.
+func (c *Cached) lookup(username string) (*users.User, bool, uint64) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  username = c.usernamePolicy.Canonical(username)
+  e, ok := c.entries[username]
+  if ok && timeNow().Before(e.Value.(*cacheEntry).expires) {
+    c.lru.MoveToFront(e)
+    c.hits++
+    return e.Value.(*cacheEntry).user, true, c.generation
+  }
+  if ok {
+    c.lru.Remove(e)
+    delete(c.entries, username)
+  }
+  c.misses++
+  return nil, false, c.generation
+}
+
+// currentGeneration returns the generation to pass to add.
+func (c *Cached) currentGeneration() uint64 {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.generation
+}
+
+// add caches the user, unless there has been an invalidation since the
+// generation was read before the user was looked up, in which case the
+// user may have been changed after it was read.
+func (c *Cached) add(username string, user *users.User, generation uint64) {
+  ttl := c.ttl
+  if user == nil {
+    ttl = c.negativeTTL
+  }
+  if ttl <= 0 || c.maxEntries <= 0 {
+    return
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.generation != generation {
+    return
+  }
+  username = c.usernamePolicy.Canonical(username)
+  entry := &cacheEntry{username, user, timeNow().Add(ttl)}
+  if e, ok := c.entries[username]; ok {
+    e.Value = entry
+    c.lru.MoveToFront(e)
+    return
+  }
+  c.entries[username] = c.lru.PushFront(entry)
+  for c.lru.Len() > c.maxEntries {
+    oldest := c.lru.Back()
+    c.lru.Remove(oldest)
+    delete(c.entries, oldest.Value.(*cacheEntry).username)
+  }
+}
+
+// Load loads the underlying store and empties the cache.
+func (c *Cached) Load() error {
+  return c.LoadContext(context.Background())
+}
+
+func (c *Cached) LoadContext(ctx context.Context) error {
+  defer c.InvalidateAll()
+  return WithContext(c.s).LoadContext(ctx)
+}
+
+func (c *Cached) Save() error {
+  return c.s.Save()
+}
+
+func (c *Cached) SaveContext(ctx context.Context) error {
+  return WithContext(c.s).SaveContext(ctx)
+}
+
+func (c *Cached) User(username string) *users.User {
+  user, err := c.UserContext(context.Background(), username)
+  if err != nil {
+    glog.Errorf("%v", err)
+    return nil
+  }
+  return user
+}
+
+// UserContext returns the cached user, or looks it up in the underlying
+// store. Errors are not cached.
+func (c *Cached) UserContext(ctx context.Context, username string) (*users.User, error) {
+  user, ok, generation := c.lookup(username)
+  if ok {
+    return user, nil
+  }
+  user, err := WithContext(c.s).UserContext(ctx, username)
+  if err != nil {
+    return nil, err
+  }
+  c.add(username, user, generation)
+  return user, nil
+}
+
+func (c *Cached) SetSaltword(username, saltword string) {
+  defer c.Invalidate(username)
+  c.s.SetSaltword(username, saltword)
+}
+
+func (c *Cached) SetSaltwordContext(ctx context.Context, username, saltword string) error {
+  defer c.Invalidate(username)
+  return WithContext(c.s).SetSaltwordContext(ctx, username, saltword)
+}
+
+func (c *Cached) UserCount() int {
+  return c.s.UserCount()
+}
+
+func (c *Cached) UserCountContext(ctx context.Context) (int, error) {
+  return WithContext(c.s).UserCountContext(ctx)
+}
+
+// adminStore returns the underlying store as an AdminStore.
+func (c *Cached) adminStore() (AdminStore, error) {
+  as, ok := c.s.(AdminStore)
+  if !ok {
+    return nil, fmt.Errorf("admin operations: %w", ErrNotSupported)
+  }
+  return as, nil
+}
+
+func (c *Cached) ListUsers(offset, limit int) ([]*users.User, error) {
+  as, err := c.adminStore()
+  if err != nil {
+    return nil, err
+  }
+  return as.ListUsers(offset, limit)
+}
+
+func (c *Cached) DeleteUser(username string) error {
+  as, err := c.adminStore()
+  if err != nil {
+    return err
+  }
+  defer c.Invalidate(username)
+  return as.DeleteUser(username)
+}
+
+func (c *Cached) RenameUser(oldname, newname string) error {
+  as, err := c.adminStore()
+  if err != nil {
+    return err
+  }
+  defer c.Invalidate(newname)
+  defer c.Invalidate(oldname)
+  return as.RenameUser(oldname, newname)
+}
+
+func (c *Cached) SetPermissions(username string, perms *permissions.Permissions) error {
+  as, err := c.adminStore()
+  if err != nil {
+    return err
+  }
+  defer c.Invalidate(username)
+  return as.SetPermissions(username, perms)
+}
+
+// SetPassword sets the password in the underlying store if it is a
+// PasswordSetter, and otherwise returns an error wrapping ErrNotSupported.
+func (c *Cached) SetPassword(username, password string) error {
+  ps, ok := c.s.(PasswordSetter)
+  if !ok {
+    return fmt.Errorf("SetPassword: %w", ErrNotSupported)
+  }
+  defer c.Invalidate(username)
+  return ps.SetPassword(username, password)
+}
+
+// Authenticate checks the password with the underlying store if it is an
+// Authenticator, and otherwise returns an error wrapping ErrNotSupported.
+// The result is not cached, but the user is.
+func (c *Cached) Authenticate(ctx context.Context, username, password string) (*users.User, error) {
+  a, ok := c.s.(Authenticator)
+  if !ok {
+    return nil, fmt.Errorf("Authenticate: %w", ErrNotSupported)
+  }
+  generation := c.currentGeneration()
+  user, err := a.Authenticate(ctx, username, password)
+  if user != nil {
+    c.add(username, user, generation)
+  }
+  return user, err
+}
+
+// Lock locks the underlying store if it is a Locker.
+func (c *Cached) Lock() error {
+  if l, ok := c.s.(Locker); ok {
+    return l.Lock()
+  }
+  return nil
+}
+
+// Unlock unlocks the underlying store if it is a Locker.
+func (c *Cached) Unlock() error {
+  if l, ok := c.s.(Locker); ok {
+    return l.Unlock()
+  }
+  return nil
+}
@@ -0,0 +1,200 @@
+package store
+
+import (
+  "context"
+  "errors"
+  "testing"
+  "time"
+
+  "github.com/jimmc/auth/users"
+)
+
+// countingStore counts the lookups in the store it wraps, and fails
+// them when err is set.
+type countingStore struct {
+  *PwFile
+  lookups int
+  err error
+  afterLookup func()    // Called after the user is read, if set.
+}
+
+func (s *countingStore) UserContext(ctx context.Context, username string) (*users.User, error) {
+  s.lookups++
+  if s.err != nil {
+    return nil, s.err
+  }
+  user := s.User(username)
+  if s.afterLookup != nil {
+    s.afterLookup()
+  }
+  return user, nil
+}
+
+func (s *countingStore) LoadContext(ctx context.Context) error { return s.Load() }
+func (s *countingStore) SaveContext(ctx context.Context) error { return s.Save() }
+func (s *countingStore) SetSaltwordContext(ctx context.Context, username, saltword string) error {
+  s.SetSaltword(username, saltword)
+  return nil
+}
+func (s *countingStore) UserCountContext(ctx context.Context) (int, error) { return s.UserCount(), nil }
+
+func newCountingStore(t *testing.T) *countingStore {
+  t.Helper()
+  cs := &countingStore{PwFile: NewPwFile("testdata/pw1.txt")}
+  if err := cs.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+  return cs
+}
+
+func TestCachedHitsAndMisses(t *testing.T) {
+  defer func() { timeNow = time.Now }()
+  now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+  timeNow = func() time.Time { return now }
+
+  cs := newCountingStore(t)
+  c := NewCached(cs, 10, time.Minute)
+  c.SetNegativeTTL(10 * time.Second)
+  for i := 0; i < 3; i++ {
+    if c.User("user1") == nil {
+      t.Fatalf("expected user1, got nil")
+    }
+  }
+  if got, want := cs.lookups, 1; got != want {
+    t.Errorf("lookups of cached user: got %d, want %d", got, want)
+  }
+  stats := c.Stats()
+  if got, want := stats.Hits, int64(2); got != want {
+    t.Errorf("hits: got %d, want %d", got, want)
+  }
+  if got, want := stats.Misses, int64(1); got != want {
+    t.Errorf("misses: got %d, want %d", got, want)
+  }
+
+  // Missing users are cached for the negative TTL.
+  c.User("nobody")
+  c.User("nobody")
+  if got, want := cs.lookups, 2; got != want {
+    t.Errorf("lookups of missing user: got %d, want %d", got, want)
+  }
+  now = now.Add(20 * time.Second)
+  c.User("nobody")
+  c.User("user1")
+  if got, want := cs.lookups, 3; got != want {
+    t.Errorf("lookups after negative TTL: got %d, want %d", got, want)
+  }
+  now = now.Add(time.Minute)
+  c.User("user1")
+  if got, want := cs.lookups, 4; got != want {
+    t.Errorf("lookups after TTL: got %d, want %d", got, want)
+  }
+}
+
+func TestCachedInvalidation(t *testing.T) {
+  cs := newCountingStore(t)
+  c := NewCached(cs, 10, time.Hour)
+  c.User("user1")
+  c.SetSaltword("user1", "newcw")
+  if got, want := c.User("user1").Saltword(), "newcw"; got != want {
+    t.Errorf("saltword after SetSaltword: got %q, want %q", got, want)
+  }
+  // A change made directly in the underlying store is not seen until
+  // the user is invalidated.
+  if err := cs.DeleteUser("user1"); err != nil {
+    t.Fatalf("error deleting user1: %v", err)
+  }
+  if c.User("user1") == nil {
+    t.Errorf("user1 should be cached before invalidation")
+  }
+  c.Invalidate("user1")
+  if c.User("user1") != nil {
+    t.Errorf("user1 should be gone after invalidation")
+  }
+  if err := c.Load(); err != nil {
+    t.Fatalf("error loading: %v", err)
+  }
+  if got, want := c.Stats().Entries, 0; got != want {
+    t.Errorf("entries after Load: got %d, want %d", got, want)
+  }
+}
+
+func TestCachedUsernamePolicy(t *testing.T) {
+  cs := newCountingStore(t)
+  policy := users.NewUsernamePolicy()
+  if err := cs.SetUsernamePolicy(policy); err != nil {
+    t.Fatalf("error setting username policy: %v", err)
+  }
+  c := NewCached(cs, 10, time.Hour)
+  c.SetUsernamePolicy(policy)
+  c.User("User1")
+  c.User("user1")
+  if got, want := cs.lookups, 1; got != want {
+    t.Errorf("lookups of user1 by two names: got %d, want %d", got, want)
+  }
+  c.SetSaltword("user1", "newcw")
+  if got, want := c.User("USER1").Saltword(), "newcw"; got != want {
+    t.Errorf("saltword after SetSaltword: got %q, want %q", got, want)
+  }
+}
+
+// A user that is invalidated while it is being looked up is not cached
+// as it was read before the invalidation.
+func TestCachedInvalidationDuringLookup(t *testing.T) {
+  cs := newCountingStore(t)
+  c := NewCached(cs, 10, time.Hour)
+  cs.afterLookup = func() {
+    cs.afterLookup = nil
+    c.Invalidate("user1")
+  }
+  c.User("user1")
+  c.User("user1")
+  if got, want := cs.lookups, 2; got != want {
+    t.Errorf("lookups after invalidation during lookup: got %d, want %d", got, want)
+  }
+  c.User("user1")
+  if got, want := cs.lookups, 2; got != want {
+    t.Errorf("lookups of cached user: got %d, want %d", got, want)
+  }
+}
+
+func TestCachedEviction(t *testing.T) {
+  cs := newCountingStore(t)
+  c := NewCached(cs, 2, time.Hour)
+  c.User("user1")
+  c.User("user2")
+  c.User("user1")       // user2 is now the least recently used.
+  c.User("nobody")
+  if got, want := c.Stats().Entries, 2; got != want {
+    t.Errorf("entries: got %d, want %d", got, want)
+  }
+  lookups := cs.lookups
+  c.User("user1")
+  if got, want := cs.lookups, lookups; got != want {
+    t.Errorf("user1 should still be cached, lookups got %d, want %d", got, want)
+  }
+  c.User("user2")
+  if got, want := cs.lookups, lookups + 1; got != want {
+    t.Errorf("user2 should have been evicted, lookups got %d, want %d", got, want)
+  }
+}
+
+func TestCachedErrors(t *testing.T) {
+  cs := newCountingStore(t)
+  c := NewCached(cs, 10, time.Hour)
+  cs.err = errors.New("database is down")
+  if _, err := c.UserContext(context.Background(), "user1"); err == nil {
+    t.Errorf("expected error from failing store")
+  }
+  cs.err = nil
+  u, err := c.UserContext(context.Background(), "user1")
+  if err != nil || u == nil {
+    t.Errorf("errors should not be cached: got %v, %v", u, err)
+  }
+  if err := c.SetPassword("user1", "pw"); !errors.Is(err, ErrNotSupported) {
+    t.Errorf("SetPassword on PwFile: got %v, want %v", err, ErrNotSupported)
+  }
+}
+
+func TestCachedAdminStore(t *testing.T) {
+  testAdminStore(t, NewCached(NewPwFile("/no/such/file/foo.txt"), 10, time.Hour))
+}
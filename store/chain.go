@@ -0,0 +1,382 @@
+package store
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "sort"
+
+  "github.com/golang/glog"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+// Precedence says which user a Chain uses when the same username is in
+// more than one of its stores.
+type Precedence int
+
+const (
+  PreferFirst Precedence = iota   // Use the user from the earliest store in the chain.
+  PreferWriter                    // Use the user from the writer, then as PreferFirst.
+  RejectConflicts                 // Treat a username in more than one store as no such user.
+)
+
+// Chain is a Store that combines several stores, such as a local file
+// of break-glass admin accounts and a shared database for everyone else.
+// Users are looked up in each store in order, as set by the Precedence.
+// Changes, including SetSaltword and the AdminStore operations, are made
+// only in the writer, which is the first store unless set by SetWriter.
+// Changes to a user that is in another store but not in the writer fail,
+// since they would add a second copy of the user to the writer, as do
+// changes to a user whose copy in the writer is hidden by the precedence.
+// Deleting or renaming a user fails if the user is in any other store,
+// and renaming fails if the new name is in any store.
+// UserCount and ListUsers merge the users from all of the stores.
+// Passwords are checked by the store in which the user is found, if it
+// is an Authenticator.
+type Chain struct {
+    stores []Store
+    writer int
+    precedence Precedence
+}
+
+// NewChain returns a Chain of the given stores, with the first as the
+// writer. There must be at least one store.
+func NewChain(stores ...Store) (*Chain, error) {
+  if len(stores) == 0 {
+    return nil, fmt.Errorf("chain of stores is empty")
+  }
+  return &Chain{
+    stores: stores,
+  }, nil
+}
+
+// SetWriter sets the index of the store in which changes are made.
+func (c *Chain) SetWriter(n int) error {
+  if n < 0 || n >= len(c.stores) {
+    return fmt.Errorf("writer %d is out of range for a chain of %d stores", n, len(c.stores))
+  }
+  c.writer = n
+  return nil
+}
+
+// SetPrecedence sets how conflicting usernames are handled.
+func (c *Chain) SetPrecedence(p Precedence) {
+  c.precedence = p
+}
+
+// UsernamePolicy returns the username policy of the writer, or nil if
+// it has none.
+func (c *Chain) UsernamePolicy() *users.UsernamePolicy {
+  return usernamePolicyOf(c.stores[c.writer])
+}
+
+// order returns the indexes of our stores in the order they are consulted.
+func (c *Chain) order() []int {
+  order := make([]int, 0, len(c.stores))
+  if c.precedence == PreferWriter {
+    order = append(order, c.writer)
+  }
+  for i := range c.stores {
+    if c.precedence != PreferWriter || i != c.writer {
+      order = append(order, i)
+    }
+  }
+  return order
+}
+
+// Load loads all of the stores.
+func (c *Chain) Load() error {
+  return c.LoadContext(context.Background())
+}
+
+func (c *Chain) LoadContext(ctx context.Context) error {
+  for i, s := range c.stores {
+    if err := WithContext(s).LoadContext(ctx); err != nil {
+      return fmt.Errorf("store %d: %w", i, err)
+    }
+  }
+  return nil
+}
+
+// Save saves the writer, which is the only store we change.
+func (c *Chain) Save() error {
+  return c.stores[c.writer].Save()
+}
+
+func (c *Chain) SaveContext(ctx context.Context) error {
+  return WithContext(c.stores[c.writer]).SaveContext(ctx)
+}
+
+func (c *Chain) User(username string) *users.User {
+  user, err := c.UserContext(context.Background(), username)
+  if err != nil {
+    glog.Errorf("%v", err)
+    return nil
+  }
+  return user
+}
+
+// UserContext returns the user from the first store in which it is found.
+// If a store fails before the user is found, the error is returned, so
+// that a store that is down is not taken to mean there is no such user.
+func (c *Chain) UserContext(ctx context.Context, username string) (*users.User, error) {
+  user, _, err := c.find(ctx, username)
+  return user, err
+}
+
+// find returns the user as for UserContext, and the index of the store
+// in which it was found, or -1 if there is no such user.
+func (c *Chain) find(ctx context.Context, username string) (*users.User, int, error) {
+  var found *users.User
+  foundIn := -1
+  for _, i := range c.order() {
+    user, err := WithContext(c.stores[i]).UserContext(ctx, username)
+    if err != nil {
+      return nil, -1, fmt.Errorf("store %d: %w", i, err)
+    }
+    if user == nil {
+      continue
+    }
+    if c.precedence != RejectConflicts {
+      return user, i, nil
+    }
+    if found != nil {
+      glog.Warningf("User %q is in stores %d and %d, rejecting it", username, foundIn, i)
+      return nil, -1, nil
+    }
+    found, foundIn = user, i
+  }
+  return found, foundIn, nil
+}
+
+// checkWritable returns an error if the user is in another store that
+// is consulted before the writer, or is in another store but not in the
+// writer, or conflicts with another store, where a change made in the
+// writer would not be seen or would conflict with the other store.
+func (c *Chain) checkWritable(ctx context.Context, username string) error {
+  for _, i := range c.order() {
+    user, err := WithContext(c.stores[i]).UserContext(ctx, username)
+    if err != nil {
+      return fmt.Errorf("store %d: %w", i, err)
+    }
+    if user == nil {
+      continue
+    }
+    if i != c.writer {
+      return fmt.Errorf("user %q is in store %d, which is not the writer", username, i)
+    }
+    if c.precedence != RejectConflicts {
+      return nil        // The user in the writer hides any later copies.
+    }
+  }
+  return nil
+}
+
+// checkOnlyInWriter returns an error if the user is in any store other
+// than the writer, where deleting or renaming the user in the writer
+// would leave the other copy in place, or renaming another user to it
+// would make a second copy.
+func (c *Chain) checkOnlyInWriter(ctx context.Context, username string) error {
+  for i, s := range c.stores {
+    if i == c.writer {
+      continue
+    }
+    user, err := WithContext(s).UserContext(ctx, username)
+    if err != nil {
+      return fmt.Errorf("store %d: %w", i, err)
+    }
+    if user != nil {
+      return fmt.Errorf("user %q is in store %d, which is not the writer", username, i)
+    }
+  }
+  return nil
+}
+
+// SetSaltword sets the saltword in the writer, and logs an error if the
+// user is in another store instead.
+func (c *Chain) SetSaltword(username, saltword string) {
+  if err := c.SetSaltwordContext(context.Background(), username, saltword); err != nil {
+    glog.Errorf("%v", err)
+  }
+}
+
+func (c *Chain) SetSaltwordContext(ctx context.Context, username, saltword string) error {
+  if err := c.checkWritable(ctx, username); err != nil {
+    return err
+  }
+  return WithContext(c.stores[c.writer]).SetSaltwordContext(ctx, username, saltword)
+}
+
+// UserCount returns the number of distinct users in all of the stores,
+// or the sum of their counts if any of them can't list its users.
+func (c *Chain) UserCount() int {
+  count, err := c.UserCountContext(context.Background())
+  if err != nil {
+    glog.Errorf("%v", err)
+    return 0
+  }
+  return count
+}
+
+func (c *Chain) UserCountContext(ctx context.Context) (int, error) {
+  uu, err := c.merged()
+  if err == nil {
+    return len(uu), nil
+  }
+  if !errors.Is(err, ErrNotSupported) {
+    return 0, err
+  }
+  count := 0
+  for i, s := range c.stores {
+    n, err := WithContext(s).UserCountContext(ctx)
+    if err != nil {
+      return 0, fmt.Errorf("store %d: %w", i, err)
+    }
+    count += n
+  }
+  return count, nil
+}
+
+// merged returns the users of all of the stores, sorted by id, with
+// conflicts resolved as by User.
+func (c *Chain) merged() ([]*users.User, error) {
+  byId := make(map[string]*users.User)
+  rejected := make(map[string]bool)
+  for _, i := range c.order() {
+    as, ok := c.stores[i].(AdminStore)
+    if !ok {
+      return nil, fmt.Errorf("listing store %d: %w", i, ErrNotSupported)
+    }
+    uu, err := as.ListUsers(0, 0)
+    if err != nil {
+      return nil, fmt.Errorf("store %d: %w", i, err)
+    }
+    for _, u := range uu {
+      if _, ok := byId[u.Id()]; ok {
+        if c.precedence == RejectConflicts {
+          rejected[u.Id()] = true
+        }
+        continue
+      }
+      byId[u.Id()] = u
+    }
+  }
+  result := make([]*users.User, 0, len(byId))
+  for id, u := range byId {
+    if !rejected[id] {
+      result = append(result, u)
+    }
+  }
+  sort.Slice(result, func(i, j int) bool { return result[i].Id() < result[j].Id() })
+  return result, nil
+}
+
+// ListUsers lists the users of all of the stores, which must all be
+// AdminStores.
+func (c *Chain) ListUsers(offset, limit int) ([]*users.User, error) {
+  uu, err := c.merged()
+  if err != nil {
+    return nil, err
+  }
+  if offset < 0 {
+    offset = 0
+  }
+  if offset > len(uu) {
+    offset = len(uu)
+  }
+  uu = uu[offset:]
+  if limit > 0 && limit < len(uu) {
+    uu = uu[:limit]
+  }
+  return uu, nil
+}
+
+// writerAdmin returns the writer as an AdminStore.
+func (c *Chain) writerAdmin() (AdminStore, error) {
+  as, ok := c.stores[c.writer].(AdminStore)
+  if !ok {
+    return nil, fmt.Errorf("admin operations: %w", ErrNotSupported)
+  }
+  return as, nil
+}
+
+func (c *Chain) DeleteUser(username string) error {
+  as, err := c.writerAdmin()
+  if err != nil {
+    return err
+  }
+  if err := c.checkOnlyInWriter(context.Background(), username); err != nil {
+    return err
+  }
+  return as.DeleteUser(username)
+}
+
+func (c *Chain) RenameUser(oldname, newname string) error {
+  as, err := c.writerAdmin()
+  if err != nil {
+    return err
+  }
+  for _, username := range []string{oldname, newname} {
+    if err := c.checkOnlyInWriter(context.Background(), username); err != nil {
+      return err
+    }
+  }
+  return as.RenameUser(oldname, newname)
+}
+
+func (c *Chain) SetPermissions(username string, perms *permissions.Permissions) error {
+  as, err := c.writerAdmin()
+  if err != nil {
+    return err
+  }
+  if err := c.checkWritable(context.Background(), username); err != nil {
+    return err
+  }
+  return as.SetPermissions(username, perms)
+}
+
+// SetPassword sets the password in the writer if it is a PasswordSetter,
+// and otherwise returns an error wrapping ErrNotSupported.
+func (c *Chain) SetPassword(username, password string) error {
+  ps, ok := c.stores[c.writer].(PasswordSetter)
+  if !ok {
+    return fmt.Errorf("SetPassword: %w", ErrNotSupported)
+  }
+  if err := c.checkWritable(context.Background(), username); err != nil {
+    return err
+  }
+  return ps.SetPassword(username, password)
+}
+
+// Authenticate checks the password with the store in which the user is
+// found, if it is an Authenticator, and otherwise returns an error
+// wrapping ErrNotSupported so that the saltword is checked instead.
+func (c *Chain) Authenticate(ctx context.Context, username, password string) (*users.User, error) {
+  user, i, err := c.find(ctx, username)
+  if err != nil || user == nil {
+    return nil, err
+  }
+  a, ok := c.stores[i].(Authenticator)
+  if !ok {
+    return nil, fmt.Errorf("Authenticate: %w", ErrNotSupported)
+  }
+  return a.Authenticate(ctx, username, password)
+}
+
+// Lock locks the writer if it is a Locker.
+func (c *Chain) Lock() error {
+  if l, ok := c.stores[c.writer].(Locker); ok {
+    return l.Lock()
+  }
+  return nil
+}
+
+// Unlock unlocks the writer if it is a Locker.
+func (c *Chain) Unlock() error {
+  if l, ok := c.stores[c.writer].(Locker); ok {
+    return l.Unlock()
+  }
+  return nil
+}
@@ -0,0 +1,258 @@
+package store
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "path/filepath"
+  "testing"
+
+  "github.com/jimmc/auth/users"
+)
+
+func newChainTestStores(t *testing.T) (*PwFile, *countingStore) {
+  t.Helper()
+  filename := filepath.Join(t.TempDir(), "local.txt")
+  if err := ioutil.WriteFile(filename, []byte("admin,cwA,admin\nuser1,cwLocal,\n"), 0600); err != nil {
+    t.Fatalf("error writing local password file: %v", err)
+  }
+  local := NewPwFile(filename)
+  return local, newCountingStore(t)
+}
+
+// newTestChain returns a Chain of the stores with the writer set.
+func newTestChain(t *testing.T, writer int, stores ...Store) *Chain {
+  t.Helper()
+  c, err := NewChain(stores...)
+  if err != nil {
+    t.Fatalf("error creating chain: %v", err)
+  }
+  if err := c.SetWriter(writer); err != nil {
+    t.Fatalf("error setting writer: %v", err)
+  }
+  return c
+}
+
+func TestNewChainErrors(t *testing.T) {
+  if _, err := NewChain(); err == nil {
+    t.Errorf("expected error creating empty chain")
+  }
+  local, shared := newChainTestStores(t)
+  c, err := NewChain(local, shared)
+  if err != nil {
+    t.Fatalf("error creating chain: %v", err)
+  }
+  for _, n := range []int{-1, 2} {
+    if err := c.SetWriter(n); err == nil {
+      t.Errorf("SetWriter(%d): expected error", n)
+    }
+  }
+}
+
+func TestChainPrecedence(t *testing.T) {
+  tests := []struct{
+    precedence Precedence
+    writer int
+    user1 string      // Saltword of user1, or empty if rejected.
+    ids string
+  }{
+    { PreferFirst, 1, "cwLocal", "admin user1 user2" },
+    { PreferWriter, 1, "d761bfe5ffda189a8f1c2212c5fb3fe65274a070d0b1c4f4ec6c2c020db5f22b", "admin user1 user2" },
+    { PreferWriter, 0, "cwLocal", "admin user1 user2" },
+    { RejectConflicts, 1, "", "admin user2" },
+  }
+  for _, tc := range tests {
+    local, shared := newChainTestStores(t)
+    c := newTestChain(t, tc.writer, local, shared)
+    c.SetPrecedence(tc.precedence)
+    if err := c.Load(); err != nil {
+      t.Fatalf("error loading chain: %v", err)
+    }
+    user1 := c.User("user1")
+    if tc.user1 == "" {
+      if user1 != nil {
+        t.Errorf("precedence %d: conflicting user1 should be rejected", tc.precedence)
+      }
+    } else if user1 == nil {
+      t.Errorf("precedence %d: expected user1, got nil", tc.precedence)
+    } else if got, want := user1.Saltword(), tc.user1; got != want {
+      t.Errorf("precedence %d: user1 saltword got %q, want %q", tc.precedence, got, want)
+    }
+    if c.User("admin") == nil || c.User("user2") == nil {
+      t.Errorf("precedence %d: expected admin and user2", tc.precedence)
+    }
+    uu, err := c.ListUsers(0, 0)
+    if err != nil {
+      t.Fatalf("error listing users: %v", err)
+    }
+    if got, want := userIds(uu), tc.ids; got != want {
+      t.Errorf("precedence %d: users got %q, want %q", tc.precedence, got, want)
+    }
+    if got, want := c.UserCount(), len(uu); got != want {
+      t.Errorf("precedence %d: user count got %d, want %d", tc.precedence, got, want)
+    }
+  }
+}
+
+// listFailingStore is a store whose ListUsers fails, as a database
+// does when it is unavailable.
+type listFailingStore struct {
+  *PwFile
+}
+
+func (s *listFailingStore) ListUsers(offset, limit int) ([]*users.User, error) {
+  return nil, errors.New("database unavailable")
+}
+
+func TestChainUserCountErrors(t *testing.T) {
+  local, shared := newChainTestStores(t)
+  c := newTestChain(t, 1, local, &listFailingStore{shared.PwFile})
+  if err := c.Load(); err != nil {
+    t.Fatalf("error loading chain: %v", err)
+  }
+  if _, err := c.UserCountContext(context.Background()); err == nil {
+    t.Errorf("expected error counting users when a store can't list them")
+  }
+}
+
+func TestChainWrites(t *testing.T) {
+  local, shared := newChainTestStores(t)
+  c := newTestChain(t, 1, local, shared)
+  if err := c.Load(); err != nil {
+    t.Fatalf("error loading chain: %v", err)
+  }
+  c.SetSaltword("user3", "cw3")
+  if local.User("user3") != nil {
+    t.Errorf("user3 should not be added to the local store")
+  }
+  if shared.User("user3") == nil {
+    t.Errorf("user3 should be added to the writer")
+  }
+  if err := c.DeleteUser("admin"); err == nil {
+    t.Errorf("expected error deleting user that is not in the writer")
+  }
+  if err := c.SetPassword("user3", "pw"); !errors.Is(err, ErrNotSupported) {
+    t.Errorf("SetPassword on PwFile writer: got %v, want %v", err, ErrNotSupported)
+  }
+  // Changes to a user that is only in the local store are not copied
+  // into the writer.
+  if err := c.SetSaltwordContext(context.Background(), "admin", "cwNew"); err == nil {
+    t.Errorf("expected error setting saltword of user that is not in the writer")
+  }
+  c.SetSaltword("admin", "cwNew")
+  if err := c.SetPermissions("admin", nil); err == nil {
+    t.Errorf("expected error setting permissions of user that is not in the writer")
+  }
+  if shared.User("admin") != nil {
+    t.Errorf("admin should not be added to the writer")
+  }
+  if got, want := c.User("admin").Saltword(), "cwA"; got != want {
+    t.Errorf("admin saltword: got %q, want %q", got, want)
+  }
+  // A user in both stores is not changed in the writer while the copy
+  // in the earlier store hides it, but is once the writer is preferred.
+  if err := c.SetSaltwordContext(context.Background(), "user1", "cwShared"); err == nil {
+    t.Errorf("expected error setting saltword of user1 hidden by the local store")
+  }
+  if err := c.SetPermissions("user1", nil); err == nil {
+    t.Errorf("expected error setting permissions of user1 hidden by the local store")
+  }
+  c.SetPrecedence(PreferWriter)
+  if err := c.SetSaltwordContext(context.Background(), "user1", "cwShared"); err != nil {
+    t.Errorf("error setting saltword of user1: %v", err)
+  }
+  if got, want := shared.User("user1").Saltword(), "cwShared"; got != want {
+    t.Errorf("user1 saltword in writer: got %q, want %q", got, want)
+  }
+  c.SetPrecedence(RejectConflicts)
+  if err := c.SetSaltwordContext(context.Background(), "user1", "cwConflict"); err == nil {
+    t.Errorf("expected error setting saltword of conflicting user1")
+  }
+}
+
+// Deleting or renaming a user in the writer must not leave or make a
+// copy of the user in another store.
+func TestChainDeleteAndRename(t *testing.T) {
+  local, shared := newChainTestStores(t)
+  c := newTestChain(t, 1, local, shared)
+  c.SetPrecedence(PreferWriter)
+  if err := c.Load(); err != nil {
+    t.Fatalf("error loading chain: %v", err)
+  }
+  if err := c.DeleteUser("user1"); err == nil {
+    t.Errorf("expected error deleting user1, which is also in the local store")
+  }
+  if err := c.RenameUser("user1", "user9"); err == nil {
+    t.Errorf("expected error renaming user1, which is also in the local store")
+  }
+  if err := c.RenameUser("user2", "admin"); err == nil {
+    t.Errorf("expected error renaming user2 to admin, which is in the local store")
+  }
+  if shared.User("user1") == nil || shared.User("user2") == nil {
+    t.Fatalf("user1 and user2 should still be in the writer")
+  }
+  if err := c.RenameUser("user2", "user9"); err != nil {
+    t.Errorf("error renaming user2: %v", err)
+  }
+  if err := c.DeleteUser("user9"); err != nil {
+    t.Errorf("error deleting user9: %v", err)
+  }
+  if c.User("user2") != nil || c.User("user9") != nil {
+    t.Errorf("user2 should be gone after rename and delete")
+  }
+}
+
+// passwordStore is a PwFile that checks passwords itself, like LDAP.
+type passwordStore struct {
+  *PwFile
+  password string
+}
+
+func (ps *passwordStore) Authenticate(ctx context.Context, username, password string) (*users.User, error) {
+  user := ps.User(username)
+  if user == nil || password != ps.password {
+    return nil, nil
+  }
+  return user, nil
+}
+
+func TestChainAuthenticate(t *testing.T) {
+  local, shared := newChainTestStores(t)
+  c := newTestChain(t, 0, &passwordStore{local, "localpw"}, shared)
+  if err := c.Load(); err != nil {
+    t.Fatalf("error loading chain: %v", err)
+  }
+  ctx := context.Background()
+  if u, err := c.Authenticate(ctx, "admin", "localpw"); err != nil || u == nil {
+    t.Errorf("authenticating admin in local store: got %v, %v", u, err)
+  }
+  if u, err := c.Authenticate(ctx, "admin", "wrong"); err != nil || u != nil {
+    t.Errorf("authenticating admin with wrong password: got %v, %v", u, err)
+  }
+  if _, err := c.Authenticate(ctx, "user2", "pw"); !errors.Is(err, ErrNotSupported) {
+    t.Errorf("authenticating user2 in shared store: got %v, want %v", err, ErrNotSupported)
+  }
+  if u, err := c.Authenticate(ctx, "nosuchuser", "pw"); err != nil || u != nil {
+    t.Errorf("authenticating unknown user: got %v, %v", u, err)
+  }
+}
+
+func TestChainStoreDown(t *testing.T) {
+  local, shared := newChainTestStores(t)
+  c := newTestChain(t, 0, local, shared)
+  if err := c.Load(); err != nil {
+    t.Fatalf("error loading chain: %v", err)
+  }
+  shared.err = errors.New("database is down")
+  // Break-glass accounts in the local store still work.
+  if u, err := c.UserContext(context.Background(), "admin"); err != nil || u == nil {
+    t.Errorf("local admin with shared store down: got %v, %v", u, err)
+  }
+  if _, err := c.UserContext(context.Background(), "user2"); err == nil {
+    t.Errorf("expected error looking up user2 with shared store down")
+  }
+}
+
+func TestChainAdminStore(t *testing.T) {
+  testAdminStore(t, newTestChain(t, 0, NewPwFile("/no/such/file/foo.txt"), NewPwFile("/no/such/file/bar.txt")))
+}
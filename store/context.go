@@ -0,0 +1,69 @@
+package store
+
+import (
+  "context"
+
+  "github.com/jimmc/auth/users"
+)
+
+// The ContextStore interface is like Store, but its methods take a
+// context and return errors, so that callers can tell a user that does
+// not exist from a failure of the underlying storage, such as a database
+// that is down. Use WithContext to get a ContextStore for any Store.
+type ContextStore interface {
+    LoadContext(ctx context.Context) error
+    SaveContext(ctx context.Context) error
+    UserContext(ctx context.Context, username string) (*users.User, error)  // nil and no error if no such user
+    SetSaltwordContext(ctx context.Context, username, saltword string) error
+    UserCountContext(ctx context.Context) (int, error)
+}
+
+// WithContext returns s as a ContextStore. If s does not implement
+// ContextStore, the returned adapter calls the methods of s after
+// checking that the context has not been canceled.
+func WithContext(s Store) ContextStore {
+  if cs, ok := s.(ContextStore); ok {
+    return cs
+  }
+  return &contextAdapter{s}
+}
+
+type contextAdapter struct {
+    s Store
+}
+
+func (a *contextAdapter) LoadContext(ctx context.Context) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  return a.s.Load()
+}
+
+func (a *contextAdapter) SaveContext(ctx context.Context) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  return a.s.Save()
+}
+
+func (a *contextAdapter) UserContext(ctx context.Context, username string) (*users.User, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  return a.s.User(username), nil
+}
+
+func (a *contextAdapter) SetSaltwordContext(ctx context.Context, username, saltword string) error {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+  a.s.SetSaltword(username, saltword)
+  return nil
+}
+
+func (a *contextAdapter) UserCountContext(ctx context.Context) (int, error) {
+  if err := ctx.Err(); err != nil {
+    return 0, err
+  }
+  return a.s.UserCount(), nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+  "context"
+  "database/sql"
+  "testing"
+
+  _ "github.com/mattn/go-sqlite3"
+)
+
+func TestWithContextAdapter(t *testing.T) {
+  pf := NewPwFile("testdata/pw1.txt")
+  cs := WithContext(pf)
+  ctx := context.Background()
+  if err := cs.LoadContext(ctx); err != nil {
+    t.Fatalf("error loading through adapter: %v", err)
+  }
+  u, err := cs.UserContext(ctx, "user1")
+  if err != nil {
+    t.Fatalf("error getting user1: %v", err)
+  }
+  if u == nil {
+    t.Fatalf("expected user1, got nil")
+  }
+  u, err = cs.UserContext(ctx, "nobody")
+  if err != nil || u != nil {
+    t.Errorf("unknown user: got %v, %v, want nil, nil", u, err)
+  }
+  if got, want := mustCount(t, cs, ctx), pf.UserCount(); got != want {
+    t.Errorf("user count through adapter: got %d, want %d", got, want)
+  }
+
+  canceled, cancel := context.WithCancel(ctx)
+  cancel()
+  if _, err := cs.UserContext(canceled, "user1"); err == nil {
+    t.Errorf("expected error with canceled context")
+  }
+}
+
+func mustCount(t *testing.T, cs ContextStore, ctx context.Context) int {
+  t.Helper()
+  n, err := cs.UserCountContext(ctx)
+  if err != nil {
+    t.Fatalf("error counting users: %v", err)
+  }
+  return n
+}
+
+func TestPwDBContextErrors(t *testing.T) {
+  db, err := sql.Open("sqlite3", t.TempDir() + "/context.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  cs := WithContext(pdb)
+  if cs != ContextStore(pdb) {
+    t.Errorf("WithContext should return a PwDB unchanged")
+  }
+  ctx := context.Background()
+  if err := cs.SetSaltwordContext(ctx, "user1", "cw1"); err != nil {
+    t.Fatalf("error setting saltword: %v", err)
+  }
+  if got, want := mustCount(t, cs, ctx), 1; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+
+  // A database that is down is an error, not a missing user.
+  db.Close()
+  if _, err := cs.UserContext(ctx, "user1"); err == nil {
+    t.Errorf("expected error getting user from closed database")
+  }
+  if _, err := cs.UserCountContext(ctx); err == nil {
+    t.Errorf("expected error counting users in closed database")
+  }
+  if err := cs.SetSaltwordContext(ctx, "user1", "cw2"); err == nil {
+    t.Errorf("expected error setting saltword in closed database")
+  }
+  if u := pdb.User("user1"); u != nil {
+    t.Errorf("legacy User with closed database: got %v, want nil", u)
+  }
+}
@@ -0,0 +1,132 @@
+package store
+
+import (
+  "fmt"
+  "strings"
+)
+
+// A Dialect describes how to write SQL for one kind of database, so that
+// PwDB can work with different database drivers.
+type Dialect interface {
+  Name() string                 // Name of the dialect, such as "postgres"
+  Placeholder(n int) string     // The nth query parameter, counting from 1
+  Quote(name string) string     // Quote a table or column name
+  KeyType() string              // Column type for string primary keys
+  TextType() string             // Column type for other strings
+  // Upsert returns a statement that inserts a row with the columns, or
+  // if a row with the same key exists, updates the update columns.
+  // The statement takes one parameter for each column, in order.
+  // Only the table name is quoted.
+  Upsert(table, key string, columns, update []string) string
+  // LimitOffset returns a clause that skips offset rows and returns
+  // at most limit rows, or all rows if limit<=0.
+  LimitOffset(limit, offset int) string
+}
+
+// The dialects we support.
+var (
+  SQLite Dialect = sqliteDialect{}
+  Postgres Dialect = postgresDialect{}
+  MySQL Dialect = mysqlDialect{}
+)
+
+// DialectFor returns the Dialect to use with the named database/sql driver.
+func DialectFor(driverName string) (Dialect, error) {
+  switch driverName {
+  case "sqlite3", "sqlite":
+    return SQLite, nil
+  case "postgres", "pgx":
+    return Postgres, nil
+  case "mysql":
+    return MySQL, nil
+  }
+  return nil, fmt.Errorf("no SQL dialect for driver %q", driverName)
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite3" }
+func (sqliteDialect) Placeholder(n int) string { return "?" }
+func (sqliteDialect) Quote(name string) string { return quoteWith(name, `"`) }
+func (sqliteDialect) KeyType() string { return "varchar(255)" }
+func (sqliteDialect) TextType() string { return "text" }
+
+func (d sqliteDialect) Upsert(table, key string, columns, update []string) string {
+  return insertInto(d, table, columns) + " ON CONFLICT(" + key + ") DO UPDATE SET " +
+      setEach(update, func(c string) string { return "excluded." + c }) + ";"
+}
+
+func (sqliteDialect) LimitOffset(limit, offset int) string {
+  if limit <= 0 {
+    limit = -1          // No limit in sqlite
+  }
+  return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+func (postgresDialect) Placeholder(n int) string { return fmt.Sprintf("$%d", n) }
+func (postgresDialect) Quote(name string) string { return quoteWith(name, `"`) }
+func (postgresDialect) KeyType() string { return "varchar(255)" }
+func (postgresDialect) TextType() string { return "text" }
+
+func (d postgresDialect) Upsert(table, key string, columns, update []string) string {
+  return insertInto(d, table, columns) + " ON CONFLICT(" + key + ") DO UPDATE SET " +
+      setEach(update, func(c string) string { return "EXCLUDED." + c }) + ";"
+}
+
+func (postgresDialect) LimitOffset(limit, offset int) string {
+  if limit <= 0 {
+    return fmt.Sprintf("OFFSET %d", offset)
+  }
+  return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string { return "mysql" }
+func (mysqlDialect) Placeholder(n int) string { return "?" }
+func (mysqlDialect) Quote(name string) string { return quoteWith(name, "`") }
+func (mysqlDialect) KeyType() string { return "varchar(255)" }
+// MySQL text columns can't have a default value, and indexed or
+// defaulted columns need a length.
+func (mysqlDialect) TextType() string { return "varchar(4096)" }
+
+func (d mysqlDialect) Upsert(table, key string, columns, update []string) string {
+  return insertInto(d, table, columns) + " ON DUPLICATE KEY UPDATE " +
+      setEach(update, func(c string) string { return "VALUES(" + c + ")" }) + ";"
+}
+
+func (mysqlDialect) LimitOffset(limit, offset int) string {
+  if limit <= 0 {
+    // MySQL requires a LIMIT with OFFSET, so use the largest value.
+    return fmt.Sprintf("LIMIT 18446744073709551615 OFFSET %d", offset)
+  }
+  return fmt.Sprintf("LIMIT %d OFFSET %d", limit, offset)
+}
+
+// quoteWith quotes name with q, doubling any q within name.
+func quoteWith(name, q string) string {
+  return q + strings.ReplaceAll(name, q, q+q) + q
+}
+
+// insertInto returns an INSERT statement without a terminating semicolon.
+func insertInto(d Dialect, table string, columns []string) string {
+  params := make([]string, len(columns))
+  for i := range columns {
+    params[i] = d.Placeholder(i+1)
+  }
+  return "INSERT INTO " + d.Quote(table) + "(" + strings.Join(columns, ", ") +
+      ") VALUES(" + strings.Join(params, ", ") + ")"
+}
+
+// setEach returns a list of assignments to the columns of the values
+// returned by value for each column name.
+func setEach(columns []string, value func(string) string) string {
+  sets := make([]string, len(columns))
+  for i, c := range columns {
+    sets[i] = c + " = " + value(c)
+  }
+  return strings.Join(sets, ", ")
+}
@@ -0,0 +1,85 @@
+package store
+
+import (
+  "io/ioutil"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// pwdbStatements returns all of the SQL that PwDB uses with dialect d.
+func pwdbStatements(d Dialect) string {
+  q := pwdbQueries{
+    d: d,
+    table: DefaultUserTable,
+    roleTable: "role",
+  }
+  statements := []string{
+    q.createUserTable(),
+    q.addMetadataColumn(),
+  }
+  statements = append(statements,
+    q.selectUser(),
+    q.upsertSaltword(),
+    q.countUsers(),
+    q.listUsers(0, 0),
+    q.listUsers(10, 20),
+    q.deleteUser(),
+    q.renameUser(),
+    q.setPermissions(),
+    q.setMetadata(),
+    q.setSecrets(),
+    q.createRoleTable(),
+    q.selectRoles(),
+    q.upsertRole(),
+  )
+  return strings.Join(statements, "\n") + "\n"
+}
+
+func TestDialectStatements(t *testing.T) {
+  for _, d := range []Dialect{SQLite, Postgres, MySQL} {
+    got := pwdbStatements(d)
+    wantFile := filepath.Join("testdata", "sql-" + d.Name() + ".txt")
+    want, err := ioutil.ReadFile(wantFile)
+    if err != nil {
+      t.Fatalf("failed to read reference file %s: %v", wantFile, err)
+    }
+    if got != string(want) {
+      t.Errorf("%s statements don't match %s, got:\n%s", d.Name(), wantFile, got)
+    }
+  }
+}
+
+func TestDialectFor(t *testing.T) {
+  tests := []struct{
+    driver string
+    want Dialect
+  }{
+    {"sqlite3", SQLite},
+    {"postgres", Postgres},
+    {"pgx", Postgres},
+    {"mysql", MySQL},
+  }
+  for _, tc := range tests {
+    d, err := DialectFor(tc.driver)
+    if err != nil {
+      t.Errorf("DialectFor(%q): %v", tc.driver, err)
+      continue
+    }
+    if got, want := d.Name(), tc.want.Name(); got != want {
+      t.Errorf("DialectFor(%q): got %s, want %s", tc.driver, got, want)
+    }
+  }
+  if _, err := DialectFor("oracle"); err == nil {
+    t.Errorf("expected error for unknown driver")
+  }
+}
+
+func TestDialectQuote(t *testing.T) {
+  if got, want := Postgres.Quote(`my"table`), `"my""table"`; got != want {
+    t.Errorf("postgres quote: got %s, want %s", got, want)
+  }
+  if got, want := MySQL.Quote("my`table"), "`my``table`"; got != want {
+    t.Errorf("mysql quote: got %s, want %s", got, want)
+  }
+}
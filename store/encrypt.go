@@ -0,0 +1,242 @@
+package store
+
+import (
+  "crypto/aes"
+  "crypto/cipher"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "strings"
+
+  "golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher is an authenticated encryption algorithm used by Encryption.
+type Cipher string
+
+const (
+  XChaCha20Poly1305 Cipher = "xchacha20poly1305"
+  AESGCM Cipher = "aes256gcm"
+)
+
+// KeySize is the size in bytes of the keys used by Encryption.
+const KeySize = 32
+
+// encryptedPrefix starts every value encrypted by Encryption, which has
+// the form enc:cipher:keyid:data, where keyid identifies the key and data
+// is the base64 nonce and sealed value.
+const encryptedPrefix = "enc:"
+
+// ErrWrongKey is returned when an encrypted value was not encrypted with
+// any of our keys, or does not decrypt with the key it names.
+var ErrWrongKey = errors.New("value can not be decrypted with the configured keys")
+
+// Encryption encrypts the secrets kept by a store, such as saltwords,
+// so that they are not readable in backups of the password file or
+// database. New values are encrypted with the current key, and values
+// encrypted with an old key added by AddOldKey can still be read, so
+// that the key can be rotated: load the store with the new key as the
+// current key and the old key as an old key, then re-encrypt it by
+// calling Save for a PwFile or Reencrypt for a PwDB.
+// Values that are not encrypted are read as they are, so that an
+// existing store can be encrypted in the same way.
+type Encryption struct {
+    cipher Cipher
+    key *encryptionKey
+    oldKeys []*encryptionKey
+}
+
+type encryptionKey struct {
+  id string
+  key []byte
+}
+
+// NewEncryption returns an Encryption using XChaCha20-Poly1305 with the
+// given key, which must be KeySize bytes.
+func NewEncryption(key []byte) (*Encryption, error) {
+  k, err := newEncryptionKey(key)
+  if err != nil {
+    return nil, err
+  }
+  return &Encryption{
+    cipher: XChaCha20Poly1305,
+    key: k,
+  }, nil
+}
+
+// ReadKeyFile reads a base64 key, such as from "openssl rand -base64 32",
+// from a file, which should be readable only by its owner.
+func ReadKeyFile(filename string) ([]byte, error) {
+  b, err := ioutil.ReadFile(filename)
+  if err != nil {
+    return nil, fmt.Errorf("error reading key file: %v", err)
+  }
+  key, err := ParseKey(string(b))
+  if err != nil {
+    return nil, fmt.Errorf("key file %s: %v", filename, err)
+  }
+  return key, nil
+}
+
+// KeyFromEnv reads a base64 key from an environment variable.
+func KeyFromEnv(name string) ([]byte, error) {
+  s, ok := os.LookupEnv(name)
+  if !ok {
+    return nil, fmt.Errorf("environment variable %s is not set", name)
+  }
+  key, err := ParseKey(s)
+  if err != nil {
+    return nil, fmt.Errorf("environment variable %s: %v", name, err)
+  }
+  return key, nil
+}
+
+// ParseKey decodes a base64 key and checks its size.
+func ParseKey(s string) ([]byte, error) {
+  key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+  if err != nil {
+    return nil, fmt.Errorf("invalid base64 key: %v", err)
+  }
+  if len(key) != KeySize {
+    return nil, fmt.Errorf("key is %d bytes, want %d", len(key), KeySize)
+  }
+  return key, nil
+}
+
+func newEncryptionKey(key []byte) (*encryptionKey, error) {
+  if len(key) != KeySize {
+    return nil, fmt.Errorf("encryption key is %d bytes, want %d", len(key), KeySize)
+  }
+  sum := sha256.Sum256(key)
+  return &encryptionKey{
+    id: hex.EncodeToString(sum[:4]),
+    key: append([]byte(nil), key...),
+  }, nil
+}
+
+// SetCipher sets the cipher used to encrypt new values. Values encrypted
+// with either cipher can be decrypted.
+func (e *Encryption) SetCipher(c Cipher) error {
+  if c != XChaCha20Poly1305 && c != AESGCM {
+    return fmt.Errorf("unknown cipher %q", c)
+  }
+  e.cipher = c
+  return nil
+}
+
+// AddOldKey adds a key that is used only to decrypt values written
+// before the current key was introduced.
+func (e *Encryption) AddOldKey(key []byte) error {
+  k, err := newEncryptionKey(key)
+  if err != nil {
+    return err
+  }
+  e.oldKeys = append(e.oldKeys, k)
+  return nil
+}
+
+func newAEAD(c Cipher, key []byte) (cipher.AEAD, error) {
+  switch c {
+  case XChaCha20Poly1305:
+    return chacha20poly1305.NewX(key)
+  case AESGCM:
+    block, err := aes.NewCipher(key)
+    if err != nil {
+      return nil, err
+    }
+    return cipher.NewGCM(block)
+  default:
+    return nil, fmt.Errorf("unknown cipher %q", c)
+  }
+}
+
+// Encrypt encrypts a value with the current key. Empty values are
+// left empty.
+func (e *Encryption) Encrypt(value string) (string, error) {
+  if value == "" {
+    return "", nil
+  }
+  aead, err := newAEAD(e.cipher, e.key.key)
+  if err != nil {
+    return "", err
+  }
+  nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(value) + aead.Overhead())
+  if _, err := rand.Read(nonce); err != nil {
+    return "", fmt.Errorf("error generating nonce: %v", err)
+  }
+  sealed := aead.Seal(nonce, nonce, []byte(value), nil)
+  return encryptedPrefix + string(e.cipher) + ":" + e.key.id + ":" +
+      base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value encrypted with any of our keys, or returns
+// the value unchanged if it is not encrypted.
+func (e *Encryption) Decrypt(value string) (string, error) {
+  if !strings.HasPrefix(value, encryptedPrefix) {
+    return value, nil
+  }
+  parts := strings.SplitN(strings.TrimPrefix(value, encryptedPrefix), ":", 3)
+  if len(parts) != 3 {
+    return "", fmt.Errorf("malformed encrypted value")
+  }
+  k := e.findKey(parts[1])
+  if k == nil {
+    return "", fmt.Errorf("key %s: %w", parts[1], ErrWrongKey)
+  }
+  aead, err := newAEAD(Cipher(parts[0]), k.key)
+  if err != nil {
+    return "", err
+  }
+  sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+  if err != nil || len(sealed) < aead.NonceSize() {
+    return "", fmt.Errorf("malformed encrypted value")
+  }
+  plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+  if err != nil {
+    return "", fmt.Errorf("key %s: %w", parts[1], ErrWrongKey)
+  }
+  return string(plain), nil
+}
+
+// IsCurrent returns true if the value is empty or is encrypted with the
+// current key and cipher, so it does not need to be re-encrypted.
+func (e *Encryption) IsCurrent(value string) bool {
+  return value == "" || strings.HasPrefix(value, encryptedPrefix + string(e.cipher) + ":" + e.key.id + ":")
+}
+
+func (e *Encryption) findKey(id string) *encryptionKey {
+  if id == e.key.id {
+    return e.key
+  }
+  for _, k := range e.oldKeys {
+    if id == k.id {
+      return k
+    }
+  }
+  return nil
+}
+
+// encryptValue encrypts value if e is not nil.
+func encryptValue(e *Encryption, value string) (string, error) {
+  if e == nil {
+    return value, nil
+  }
+  return e.Encrypt(value)
+}
+
+// decryptValue decrypts value if e is not nil, and otherwise returns an
+// error if value is encrypted.
+func decryptValue(e *Encryption, value string) (string, error) {
+  if e == nil {
+    if strings.HasPrefix(value, encryptedPrefix) {
+      return "", fmt.Errorf("value is encrypted but no key is configured: %w", ErrWrongKey)
+    }
+    return value, nil
+  }
+  return e.Decrypt(value)
+}
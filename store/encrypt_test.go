@@ -0,0 +1,220 @@
+package store
+
+import (
+  "bytes"
+  "context"
+  "encoding/base64"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func testKey(b byte) []byte {
+  return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func newTestEncryption(t *testing.T, b byte) *Encryption {
+  t.Helper()
+  e, err := NewEncryption(testKey(b))
+  if err != nil {
+    t.Fatalf("error creating encryption: %v", err)
+  }
+  return e
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+  for _, c := range []Cipher{XChaCha20Poly1305, AESGCM} {
+    e := newTestEncryption(t, 1)
+    if err := e.SetCipher(c); err != nil {
+      t.Fatalf("error setting cipher %s: %v", c, err)
+    }
+    v1, err := e.Encrypt("secret")
+    if err != nil {
+      t.Fatalf("error encrypting with %s: %v", c, err)
+    }
+    v2, _ := e.Encrypt("secret")
+    if v1 == v2 || strings.Contains(v1, "secret") {
+      t.Errorf("%s: encrypted values should differ and hide the plaintext, got %q and %q", c, v1, v2)
+    }
+    if !e.IsCurrent(v1) || e.IsCurrent("secret") {
+      t.Errorf("%s: IsCurrent is wrong", c)
+    }
+    for _, v := range []string{v1, "secret"} {
+      if got, err := e.Decrypt(v); err != nil || got != "secret" {
+        t.Errorf("%s: decrypt %q: got %q, %v, want %q", c, v, got, err, "secret")
+      }
+    }
+  }
+  e := newTestEncryption(t, 1)
+  if err := e.SetCipher("rot13"); err == nil {
+    t.Errorf("expected error setting unknown cipher")
+  }
+  if got, _ := e.Encrypt(""); got != "" {
+    t.Errorf("empty value should stay empty, got %q", got)
+  }
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+  v, err := newTestEncryption(t, 1).Encrypt("secret")
+  if err != nil {
+    t.Fatalf("error encrypting: %v", err)
+  }
+  if _, err := newTestEncryption(t, 2).Decrypt(v); !errors.Is(err, ErrWrongKey) {
+    t.Errorf("decrypt with wrong key: got %v, want %v", err, ErrWrongKey)
+  }
+  if _, err := decryptValue(nil, v); !errors.Is(err, ErrWrongKey) {
+    t.Errorf("decrypt with no key: got %v, want %v", err, ErrWrongKey)
+  }
+  // A tampered value does not decrypt.
+  tampered := v[:len(v)-2] + "AA"
+  if tampered == v {
+    tampered = v[:len(v)-2] + "BB"
+  }
+  if _, err := newTestEncryption(t, 1).Decrypt(tampered); err == nil {
+    t.Errorf("expected error decrypting tampered value")
+  }
+
+  rotated := newTestEncryption(t, 2)
+  if err := rotated.AddOldKey(testKey(1)); err != nil {
+    t.Fatalf("error adding old key: %v", err)
+  }
+  if got, err := rotated.Decrypt(v); err != nil || got != "secret" {
+    t.Errorf("decrypt with old key: got %q, %v", got, err)
+  }
+  if rotated.IsCurrent(v) {
+    t.Errorf("value encrypted with old key should not be current")
+  }
+}
+
+func TestParseKey(t *testing.T) {
+  encoded := base64.StdEncoding.EncodeToString(testKey(3))
+  filename := filepath.Join(t.TempDir(), "key")
+  if err := ioutil.WriteFile(filename, []byte(encoded + "\n"), 0600); err != nil {
+    t.Fatalf("error writing key file: %v", err)
+  }
+  if key, err := ReadKeyFile(filename); err != nil || !bytes.Equal(key, testKey(3)) {
+    t.Errorf("ReadKeyFile: got %v, %v", key, err)
+  }
+  os.Setenv("STORE_TEST_KEY", encoded)
+  defer os.Unsetenv("STORE_TEST_KEY")
+  if key, err := KeyFromEnv("STORE_TEST_KEY"); err != nil || !bytes.Equal(key, testKey(3)) {
+    t.Errorf("KeyFromEnv: got %v, %v", key, err)
+  }
+  if _, err := KeyFromEnv("STORE_TEST_NO_SUCH_KEY"); err == nil {
+    t.Errorf("expected error for unset environment variable")
+  }
+  for _, s := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+    if _, err := ParseKey(s); err == nil {
+      t.Errorf("expected error parsing key %q", s)
+    }
+  }
+}
+
+func TestPwFileEncryption(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "pw.txt")
+  if err := ioutil.WriteFile(filename, []byte("user1,cw1,\nuser2,,\n"), 0600); err != nil {
+    t.Fatalf("error writing password file: %v", err)
+  }
+  // Encrypt a plain file.
+  pf := NewPwFile(filename)
+  pf.SetEncryption(newTestEncryption(t, 1))
+  if err := pf.Load(); err != nil {
+    t.Fatalf("error loading plain file with encryption: %v", err)
+  }
+  if err := pf.Save(); err != nil {
+    t.Fatalf("error saving encrypted file: %v", err)
+  }
+  b, err := ioutil.ReadFile(filename)
+  if err != nil {
+    t.Fatalf("error reading encrypted file: %v", err)
+  }
+  if strings.Contains(string(b), "cw1") || !strings.Contains(string(b), "user2,,") {
+    t.Errorf("saltwords not encrypted as expected:\n%s", b)
+  }
+
+  // Refuse to load with a wrong key or no key.
+  pf = NewPwFile(filename)
+  pf.SetEncryption(newTestEncryption(t, 2))
+  if err := pf.Load(); !errors.Is(err, ErrWrongKey) {
+    t.Errorf("load with wrong key: got %v, want %v", err, ErrWrongKey)
+  }
+  if err := NewPwFile(filename).Load(); !errors.Is(err, ErrWrongKey) {
+    t.Errorf("load with no key: got %v, want %v", err, ErrWrongKey)
+  }
+
+  // Rotate to a new key.
+  e := newTestEncryption(t, 2)
+  e.AddOldKey(testKey(1))
+  pf.SetEncryption(e)
+  if err := pf.Load(); err != nil {
+    t.Fatalf("error loading with old key: %v", err)
+  }
+  if err := pf.Save(); err != nil {
+    t.Fatalf("error saving with new key: %v", err)
+  }
+  pf = NewPwFile(filename)
+  pf.SetEncryption(newTestEncryption(t, 2))
+  if err := pf.Load(); err != nil {
+    t.Fatalf("error loading with new key after rotation: %v", err)
+  }
+  if got, want := pf.User("user1").Saltword(), "cw1"; got != want {
+    t.Errorf("user1 saltword after rotation: got %q, want %q", got, want)
+  }
+}
+
+func TestPwDBEncryption(t *testing.T) {
+  dbloc := "/tmp/pwdb-encryption.db"
+  db := openTestDB(t, dbloc)
+  defer os.Remove(dbloc)
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  pdb.SetSaltword("plain", "cwPlain")
+  pdb.SetEncryption(newTestEncryption(t, 1))
+  pdb.SetSaltword("user1", "cw1")
+  if err := pdb.SetMetadata("user1", "totp", "seed"); err != nil {
+    t.Fatalf("error setting metadata: %v", err)
+  }
+  var cryptword, metadata string
+  if err := db.QueryRow(`SELECT cryptword, metadata FROM "user" WHERE id = 'user1'`).Scan(&cryptword, &metadata); err != nil {
+    t.Fatalf("error reading user1 row: %v", err)
+  }
+  if strings.Contains(cryptword, "cw1") || strings.Contains(metadata, "seed") {
+    t.Errorf("user1 row is not encrypted: %q, %q", cryptword, metadata)
+  }
+  u := pdb.User("user1")
+  if u == nil || u.Saltword() != "cw1" || u.Metadata("totp") != "seed" {
+    t.Errorf("user1 not decrypted: %v", u)
+  }
+
+  // Rotate to a new key, which re-encrypts both users.
+  e := newTestEncryption(t, 2)
+  e.AddOldKey(testKey(1))
+  pdb.SetEncryption(e)
+  if err := pdb.Load(); err != nil {
+    t.Fatalf("error loading with old key: %v", err)
+  }
+  if n, err := pdb.Reencrypt(); err != nil || n != 2 {
+    t.Errorf("re-encrypt: got %d, %v, want 2 users", n, err)
+  }
+  if n, err := pdb.Reencrypt(); err != nil || n != 0 {
+    t.Errorf("second re-encrypt: got %d, %v, want 0 users", n, err)
+  }
+
+  pdb.SetEncryption(newTestEncryption(t, 1))
+  if err := pdb.Load(); !errors.Is(err, ErrWrongKey) {
+    t.Errorf("load with old key only: got %v, want %v", err, ErrWrongKey)
+  }
+  if _, err := pdb.UserContext(context.Background(), "user1"); !errors.Is(err, ErrWrongKey) {
+    t.Errorf("user1 with old key only: got %v, want %v", err, ErrWrongKey)
+  }
+  pdb.SetEncryption(newTestEncryption(t, 2))
+  if u := pdb.User("plain"); u == nil || u.Saltword() != "cwPlain" {
+    t.Errorf("plain user after re-encryption: got %v", u)
+  }
+}
@@ -0,0 +1,322 @@
+package store
+
+import (
+  "bufio"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "sort"
+  "strings"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+// ExportVersion is the version of the export format written by Export.
+const ExportVersion = 1
+
+// The export format is JSON lines. The first line is a header
+//   {"version":1}
+// and each following line is one user, sorted by username, in the same
+// form as the users in a JSONFile:
+//   {"username":"alice","saltword":"2432...","permissions":["edit"],"metadata":{"email":"alice@example.com"}}
+// Saltwords are exported as stored by the auth package, not encrypted,
+// so an export should be protected as well as the password file.
+type exportHeader struct {
+  Version int `json:"version"`
+}
+
+// A MetadataSetter is a Store that can hold per-user metadata.
+type MetadataSetter interface {
+    SetMetadata(username, key, value string) error  // Set a value, or remove it if value is empty
+}
+
+// ImportMode says how Import treats the users already in a store.
+type ImportMode int
+
+const (
+  ImportMerge ImportMode = 0      // Add and update the imported users, and keep the others.
+  ImportReplace ImportMode = 1    // As ImportMerge, and delete users that were not imported.
+  ImportDryRun ImportMode = 2     // Add to either mode to report the changes without making them.
+)
+
+// A UserChange is a change to one user made by Import.
+type UserChange struct {
+  Username string
+  Action string         // add, update or delete
+  Fields []string       // For an update, the fields that changed.
+}
+
+// An ImportReport lists the changes made by Import, or that would be
+// made in a dry run.
+type ImportReport struct {
+  Changes []*UserChange
+  Unchanged int
+}
+
+// String returns the changes one per line, such as
+//   add alice
+//   update bob: permissions, saltword
+//   delete carol
+func (r *ImportReport) String() string {
+  var b strings.Builder
+  for _, c := range r.Changes {
+    b.WriteString(c.Action + " " + c.Username)
+    if len(c.Fields) > 0 {
+      b.WriteString(": " + strings.Join(c.Fields, ", "))
+    }
+    b.WriteString("\n")
+  }
+  return b.String()
+}
+
+// Export writes all of the users in src, which must be an AdminStore,
+// to w in the export format.
+func Export(src Store, w io.Writer) error {
+  as, ok := src.(AdminStore)
+  if !ok {
+    return fmt.Errorf("export: listing users: %w", ErrNotSupported)
+  }
+  uu, err := as.ListUsers(0, 0)
+  if err != nil {
+    return fmt.Errorf("export: %v", err)
+  }
+  enc := json.NewEncoder(w)
+  if err := enc.Encode(&exportHeader{ExportVersion}); err != nil {
+    return fmt.Errorf("export: %v", err)
+  }
+  for _, u := range uu {
+    if err := enc.Encode(exportUser(u)); err != nil {
+      return fmt.Errorf("export: user %q: %v", u.Id(), err)
+    }
+  }
+  return nil
+}
+
+func exportUser(u *users.User) *jsonUser {
+  perms := u.Permissions()
+  if perms == nil {
+    perms = permissions.FromString("")
+  }
+  ju := &jsonUser{
+    Username: u.Id(),
+    Saltword: u.Saltword(),
+    Permissions: perms,
+  }
+  for _, key := range u.MetadataKeys() {
+    if ju.Metadata == nil {
+      ju.Metadata = make(map[string]string)
+    }
+    ju.Metadata[key] = u.Metadata(key)
+  }
+  return ju
+}
+
+// Import reads users in the export format from r into dst, which must
+// be an AdminStore, and returns a report of the changes. The whole input
+// is read and checked before any changes are made, but an error from dst
+// can leave some of the changes made, so use ImportDryRun first.
+// If dst has a username policy, the imported usernames are put into
+// canonical form first, and it is an error if any of them fails the
+// policy's Check or if two of them have the same canonical form.
+// As with the AdminStore operations, call Save to persist the changes
+// to a file-based store.
+func Import(dst Store, r io.Reader, mode ImportMode) (*ImportReport, error) {
+  as, ok := dst.(AdminStore)
+  if !ok {
+    return nil, fmt.Errorf("import: admin operations: %w", ErrNotSupported)
+  }
+  imported, err := readExport(r)
+  if err != nil {
+    return nil, fmt.Errorf("import: %v", err)
+  }
+  if err := canonicalizeImport(imported, usernamePolicyOf(dst)); err != nil {
+    return nil, fmt.Errorf("import: %w", err)
+  }
+  ms, canSetMetadata := dst.(MetadataSetter)
+  for _, ju := range imported {
+    if len(ju.Metadata) > 0 && !canSetMetadata {
+      return nil, fmt.Errorf("import: metadata for user %q: %w", ju.Username, ErrNotSupported)
+    }
+  }
+  existing, err := as.ListUsers(0, 0)
+  if err != nil {
+    return nil, fmt.Errorf("import: %v", err)
+  }
+  report := diffImport(existing, imported, mode & ImportReplace != 0)
+  if mode & ImportDryRun != 0 {
+    return report, nil
+  }
+
+  byName := make(map[string]*jsonUser)
+  for _, ju := range imported {
+    byName[ju.Username] = ju
+  }
+  for _, c := range report.Changes {
+    if c.Action == "delete" {
+      if err := as.DeleteUser(c.Username); err != nil {
+        return report, fmt.Errorf("import: %v", err)
+      }
+      continue
+    }
+    ju := byName[c.Username]
+    old := dst.User(c.Username)
+    if old == nil || old.Saltword() != ju.Saltword {
+      if err := WithContext(dst).SetSaltwordContext(context.Background(), ju.Username, ju.Saltword); err != nil {
+        return report, fmt.Errorf("import: %v", err)
+      }
+    }
+    if err := as.SetPermissions(ju.Username, ju.Permissions); err != nil {
+      return report, fmt.Errorf("import: %v", err)
+    }
+    if !canSetMetadata {
+      continue
+    }
+    if old != nil {
+      for _, key := range old.MetadataKeys() {
+        if _, ok := ju.Metadata[key]; !ok {
+          if err := ms.SetMetadata(ju.Username, key, ""); err != nil {
+            return report, fmt.Errorf("import: %v", err)
+          }
+        }
+      }
+    }
+    for key, value := range ju.Metadata {
+      if old == nil || old.Metadata(key) != value {
+        if err := ms.SetMetadata(ju.Username, key, value); err != nil {
+          return report, fmt.Errorf("import: %v", err)
+        }
+      }
+    }
+  }
+  return report, nil
+}
+
+// readExport reads and checks all of the users in the export format.
+func readExport(r io.Reader) ([]*jsonUser, error) {
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(nil, 1024 * 1024)
+  lineno := 0
+  var header *exportHeader
+  imported := make([]*jsonUser, 0)
+  seen := make(map[string]bool)
+  for scanner.Scan() {
+    lineno++
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" {
+      continue
+    }
+    if header == nil {
+      header = &exportHeader{}
+      if err := json.Unmarshal([]byte(line), header); err != nil {
+        return nil, fmt.Errorf("line %d: invalid header: %v", lineno, err)
+      }
+      if header.Version <= 0 || header.Version > ExportVersion {
+        return nil, fmt.Errorf("line %d: unsupported version %d", lineno, header.Version)
+      }
+      continue
+    }
+    ju := &jsonUser{}
+    if err := json.Unmarshal([]byte(line), ju); err != nil {
+      return nil, fmt.Errorf("line %d: %v", lineno, err)
+    }
+    if ju.Username == "" {
+      return nil, fmt.Errorf("line %d: no username", lineno)
+    }
+    if seen[ju.Username] {
+      return nil, fmt.Errorf("line %d: duplicate user %q", lineno, ju.Username)
+    }
+    seen[ju.Username] = true
+    if ju.Permissions == nil {
+      ju.Permissions = permissions.FromString("")
+    }
+    imported = append(imported, ju)
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, fmt.Errorf("line %d: %v", lineno + 1, err)
+  }
+  if header == nil {
+    return nil, fmt.Errorf("missing header")
+  }
+  return imported, nil
+}
+
+// canonicalizeImport changes the imported usernames to their canonical
+// form under the policy, so that they match the users in the store.
+func canonicalizeImport(imported []*jsonUser, p *users.UsernamePolicy) error {
+  if p == nil {
+    return nil
+  }
+  byCanonical := make(map[string]string)
+  for _, ju := range imported {
+    id := p.Canonical(ju.Username)
+    if err := p.Check(id); err != nil {
+      return fmt.Errorf("user %q: %w", ju.Username, err)
+    }
+    if other, ok := byCanonical[id]; ok {
+      return fmt.Errorf("users %q and %q are both %q", other, ju.Username, id)
+    }
+    byCanonical[id] = ju.Username
+    ju.Username = id
+  }
+  return nil
+}
+
+// diffImport returns the changes needed to make existing match imported,
+// sorted by username.
+func diffImport(existing []*users.User, imported []*jsonUser, replace bool) *ImportReport {
+  report := &ImportReport{}
+  byName := make(map[string]*users.User)
+  for _, u := range existing {
+    byName[u.Id()] = u
+  }
+  importedNames := make(map[string]bool)
+  for _, ju := range imported {
+    importedNames[ju.Username] = true
+    old := byName[ju.Username]
+    if old == nil {
+      report.Changes = append(report.Changes, &UserChange{Username: ju.Username, Action: "add"})
+      continue
+    }
+    fields := changedFields(old, ju)
+    if len(fields) == 0 {
+      report.Unchanged++
+      continue
+    }
+    report.Changes = append(report.Changes, &UserChange{Username: ju.Username, Action: "update", Fields: fields})
+  }
+  if replace {
+    for _, u := range existing {
+      if !importedNames[u.Id()] {
+        report.Changes = append(report.Changes, &UserChange{Username: u.Id(), Action: "delete"})
+      }
+    }
+  }
+  sort.Slice(report.Changes, func(i, j int) bool {
+    return report.Changes[i].Username < report.Changes[j].Username
+  })
+  return report
+}
+
+func changedFields(old *users.User, ju *jsonUser) []string {
+  var fields []string
+  if old.Saltword() != ju.Saltword {
+    fields = append(fields, "saltword")
+  }
+  if old.PermissionsString() != ju.Permissions.ToString() {
+    fields = append(fields, "permissions")
+  }
+  keys := old.MetadataKeys()
+  metadataChanged := len(keys) != len(ju.Metadata)
+  for _, key := range keys {
+    if v, ok := ju.Metadata[key]; !ok || v != old.Metadata(key) {
+      metadataChanged = true
+    }
+  }
+  if metadataChanged {
+    fields = append(fields, "metadata")
+  }
+  sort.Strings(fields)
+  return fields
+}
@@ -0,0 +1,235 @@
+package store
+
+import (
+  "bytes"
+  "context"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "github.com/jimmc/auth/users"
+)
+
+const exportTestPwFile = "alice,cw-alice,edit read\nbob,!cw-bob,deploy[/2099-01-01T00:00:00Z] read\ncarol,,\n"
+
+func newExportTestPwFile(t *testing.T, content string) *PwFile {
+  t.Helper()
+  filename := filepath.Join(t.TempDir(), "pw.txt")
+  if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+    t.Fatalf("error writing password file: %v", err)
+  }
+  pf := NewPwFile(filename)
+  if err := pf.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+  return pf
+}
+
+func exportString(t *testing.T, s Store) string {
+  t.Helper()
+  var b bytes.Buffer
+  if err := Export(s, &b); err != nil {
+    t.Fatalf("error exporting: %v", err)
+  }
+  return b.String()
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+  pf := newExportTestPwFile(t, exportTestPwFile)
+  exported := exportString(t, pf)
+  want, err := ioutil.ReadFile("testdata/export1.jsonl")
+  if err != nil {
+    t.Fatalf("error reading reference file: %v", err)
+  }
+  if got := exported; got != string(want) {
+    t.Errorf("export of PwFile doesn't match testdata/export1.jsonl, got:\n%s", got)
+  }
+
+  dbloc := "/tmp/export-roundtrip.db"
+  db := openTestDB(t, dbloc)
+  defer os.Remove(dbloc)
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  report, err := Import(pdb, strings.NewReader(exported), ImportMerge)
+  if err != nil {
+    t.Fatalf("error importing into PwDB: %v", err)
+  }
+  if got, want := report.String(), "add alice\nadd bob\nadd carol\n"; got != want {
+    t.Errorf("import report: got %q, want %q", got, want)
+  }
+  if got := exportString(t, pdb); got != exported {
+    t.Errorf("export of PwDB doesn't match export of PwFile, got:\n%s", got)
+  }
+  if pdb.User("bob").Disabled() != true {
+    t.Errorf("bob should still be disabled after import")
+  }
+
+  // And back to an empty PwFile, which must be saved.
+  pf2 := newExportTestPwFile(t, "")
+  if _, err := Import(pf2, strings.NewReader(exportString(t, pdb)), ImportMerge); err != nil {
+    t.Fatalf("error importing into PwFile: %v", err)
+  }
+  if err := pf2.Save(); err != nil {
+    t.Fatalf("error saving password file: %v", err)
+  }
+  b, err := ioutil.ReadFile(pf2.filename)
+  if err != nil {
+    t.Fatalf("error reading password file: %v", err)
+  }
+  if got, want := string(b), exportTestPwFile; got != want {
+    t.Errorf("password file after round trip: got %q, want %q", got, want)
+  }
+}
+
+func TestImportModes(t *testing.T) {
+  src := newExportTestPwFile(t, "alice,cw-alice,edit read\nbob,cw-bob2,read\n")
+  exported := exportString(t, src)
+  tests := []struct{
+    mode ImportMode
+    report string
+    users string      // Users in the destination after the import.
+  }{
+    { ImportMerge, "update bob: permissions, saltword\n", "alice bob dave" },
+    { ImportReplace, "update bob: permissions, saltword\ndelete dave\n", "alice bob" },
+    { ImportMerge | ImportDryRun, "update bob: permissions, saltword\n", "alice bob dave" },
+    { ImportReplace | ImportDryRun, "update bob: permissions, saltword\ndelete dave\n", "alice bob dave" },
+  }
+  for _, tc := range tests {
+    dst := newExportTestPwFile(t, "alice,cw-alice,edit read\nbob,cw-bob,edit\ndave,cw-dave,\n")
+    report, err := Import(dst, strings.NewReader(exported), tc.mode)
+    if err != nil {
+      t.Fatalf("mode %d: error importing: %v", tc.mode, err)
+    }
+    if got, want := report.String(), tc.report; got != want {
+      t.Errorf("mode %d: report got %q, want %q", tc.mode, got, want)
+    }
+    if got, want := report.Unchanged, 1; got != want {
+      t.Errorf("mode %d: unchanged got %d, want %d", tc.mode, got, want)
+    }
+    uu, _ := dst.ListUsers(0, 0)
+    if got, want := userIds(uu), tc.users; got != want {
+      t.Errorf("mode %d: users got %q, want %q", tc.mode, got, want)
+    }
+    wantBob := "cw-bob2"
+    if tc.mode & ImportDryRun != 0 {
+      wantBob = "cw-bob"
+    }
+    if got := dst.User("bob").Saltword(); got != wantBob {
+      t.Errorf("mode %d: bob saltword got %q, want %q", tc.mode, got, wantBob)
+    }
+  }
+}
+
+func TestImportMetadata(t *testing.T) {
+  jf := NewJSONFile("testdata/users1.json")
+  if err := jf.Load(); err != nil {
+    t.Fatalf("error loading json file: %v", err)
+  }
+  exported := exportString(t, jf)
+  jf2 := NewJSONFile(filepath.Join(t.TempDir(), "users.json"))
+  if _, err := Import(jf2, strings.NewReader(exported), ImportMerge); err != nil {
+    t.Fatalf("error importing into JSONFile: %v", err)
+  }
+  if got, want := jf2.User("alice").Metadata("email"), "alice@example.com"; got != want {
+    t.Errorf("alice email: got %q, want %q", got, want)
+  }
+  // A PwFile can't hold metadata, so nothing is imported.
+  pf := newExportTestPwFile(t, "")
+  if _, err := Import(pf, strings.NewReader(exported), ImportMerge); !errors.Is(err, ErrNotSupported) {
+    t.Errorf("import metadata into PwFile: got %v, want %v", err, ErrNotSupported)
+  }
+  if got, want := pf.UserCount(), 0; got != want {
+    t.Errorf("users after failed import: got %d, want %d", got, want)
+  }
+}
+
+// fixedSaltwords is a PwFile whose saltwords can't be changed, such as
+// a directory.
+type fixedSaltwords struct {
+  *PwFile
+}
+
+func (s fixedSaltwords) LoadContext(ctx context.Context) error {
+  return s.Load()
+}
+
+func (s fixedSaltwords) SaveContext(ctx context.Context) error {
+  return s.Save()
+}
+
+func (s fixedSaltwords) UserContext(ctx context.Context, username string) (*users.User, error) {
+  return s.User(username), nil
+}
+
+func (s fixedSaltwords) SetSaltwordContext(ctx context.Context, username, saltword string) error {
+  return errors.New("saltwords can't be changed")
+}
+
+func (s fixedSaltwords) UserCountContext(ctx context.Context) (int, error) {
+  return s.UserCount(), nil
+}
+
+func TestImportSaltwordError(t *testing.T) {
+  src := newExportTestPwFile(t, "alice,cw-alice2,edit read\n")
+  dst := fixedSaltwords{newExportTestPwFile(t, exportTestPwFile)}
+  if _, err := Import(dst, strings.NewReader(exportString(t, src)), ImportMerge); err == nil {
+    t.Errorf("expected error importing saltword that can't be set")
+  }
+  if got, want := dst.User("alice").Saltword(), "cw-alice"; got != want {
+    t.Errorf("alice saltword: got %q, want %q", got, want)
+  }
+}
+
+// Imported usernames are matched to the users in a store with a
+// username policy by their canonical form.
+func TestImportUsernamePolicy(t *testing.T) {
+  dst := newExportTestPwFile(t, exportTestPwFile)
+  if err := dst.SetUsernamePolicy(users.NewUsernamePolicy()); err != nil {
+    t.Fatalf("error setting username policy: %v", err)
+  }
+  src := newExportTestPwFile(t, "Alice,cw-alice,edit read\nBOB,cw-bob2,read\n")
+  report, err := Import(dst, strings.NewReader(exportString(t, src)), ImportReplace)
+  if err != nil {
+    t.Fatalf("error importing: %v", err)
+  }
+  if got, want := report.String(), "update bob: permissions, saltword\ndelete carol\n"; got != want {
+    t.Errorf("report got %q, want %q", got, want)
+  }
+  uu, _ := dst.ListUsers(0, 0)
+  if got, want := userIds(uu), "alice bob"; got != want {
+    t.Errorf("users got %q, want %q", got, want)
+  }
+
+  for _, content := range []string{
+    "Alice,cw-alice,\nALICE,cw-alice,\n",
+    "bad name,cw,\n",
+  } {
+    src := newExportTestPwFile(t, content)
+    if _, err := Import(dst, strings.NewReader(exportString(t, src)), ImportMerge); err == nil {
+      t.Errorf("expected error importing %q", content)
+    }
+  }
+}
+
+func TestImportErrors(t *testing.T) {
+  tests := []string{
+    "",
+    `{"username":"alice"}`,
+    `{"version":99}`,
+    "{\"version\":1}\n{\"username\":\"\"}",
+    "{\"version\":1}\n{\"username\":\"alice\"}\n{\"username\":\"alice\"}",
+    "{\"version\":1}\nnot json",
+  }
+  for _, input := range tests {
+    pf := newExportTestPwFile(t, "")
+    if _, err := Import(pf, strings.NewReader(input), ImportMerge); err == nil {
+      t.Errorf("expected error importing %q", input)
+    }
+  }
+}
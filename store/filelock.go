@@ -0,0 +1,47 @@
+package store
+
+import (
+  "fmt"
+  "os"
+  "sync"
+)
+
+// fileLock is an exclusive advisory lock for a file. It is held on a
+// separate file named with a .lock suffix, since our stores replace their
+// files when saving. It is also held against other goroutines.
+type fileLock struct {
+  mu sync.Mutex         // Held along with f, between lock and unlock.
+  f *os.File
+}
+
+// lock waits for and takes the lock for filename.
+func (l *fileLock) lock(filename string) error {
+  l.mu.Lock()
+  f, err := os.OpenFile(filename + ".lock", os.O_RDWR|os.O_CREATE, 0600)
+  if err != nil {
+    l.mu.Unlock()
+    return fmt.Errorf("error opening lock file: %v", err)
+  }
+  if err := lockFile(f); err != nil {
+    f.Close()
+    l.mu.Unlock()
+    return fmt.Errorf("error locking %s: %v", f.Name(), err)
+  }
+  l.f = f
+  return nil
+}
+
+// unlock releases the lock taken by lock.
+func (l *fileLock) unlock(filename string) error {
+  f := l.f
+  if f == nil {
+    return fmt.Errorf("file %s is not locked", filename)
+  }
+  l.f = nil
+  defer l.mu.Unlock()
+  err := unlockFile(f)
+  if cerr := f.Close(); err == nil {
+    err = cerr
+  }
+  return err
+}
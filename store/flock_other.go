@@ -0,0 +1,26 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package store
+
+import (
+  "os"
+)
+
+// On other systems we have no advisory locking, so Lock only
+// protects against other goroutines in the same process.
+func lockFile(f *os.File) error {
+  return nil
+}
+
+func unlockFile(f *os.File) error {
+  return nil
+}
+
+func chownLike(f *os.File, info os.FileInfo) error {
+  return nil
+}
+
+func syncDir(dir string) error {
+  return nil
+}
@@ -0,0 +1,42 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package store
+
+import (
+  "os"
+  "syscall"
+)
+
+// lockFile blocks until it gets an exclusive advisory lock on f.
+func lockFile(f *os.File) error {
+  for {
+    err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+    if err != syscall.EINTR {
+      return err
+    }
+  }
+}
+
+func unlockFile(f *os.File) error {
+  return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// chownLike gives f the same owner and group as the file described by info.
+func chownLike(f *os.File, info os.FileInfo) error {
+  st, ok := info.Sys().(*syscall.Stat_t)
+  if !ok {
+    return nil
+  }
+  return f.Chown(int(st.Uid), int(st.Gid))
+}
+
+// syncDir flushes the directory entries of dir to disk.
+func syncDir(dir string) error {
+  d, err := os.Open(dir)
+  if err != nil {
+    return err
+  }
+  defer d.Close()
+  return d.Sync()
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+  "bufio"
+  "encoding/csv"
+  "fmt"
+  "io"
+  "os"
+  "strings"
+  "sync"
+
+  "github.com/golang/glog"
+  "golang.org/x/crypto/bcrypt"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+// DefaultPermissionSuffix is appended to the name of an htpasswd file
+// to get the name of its permissions file, unless SetPermissionFile is called.
+const DefaultPermissionSuffix = ".perms"
+
+const htpasswdBcryptCost = 10   // The default used by "htpasswd -B".
+
+// Htpasswd implements the Store interface using an Apache htpasswd file,
+// so that the same users can log in to our server and to Apache or nginx.
+// Each line of the file has the format
+//   username:hash
+// Comment lines starting with # and blank lines are ignored, and are not
+// kept when the file is saved.
+// Since htpasswd files have no place for permissions, they are kept in a
+// separate permissions file, by default the htpasswd filename with .perms
+// appended. Each line of that file has the format
+//   username,permissions
+// as in our own password file. The permissions file need not exist.
+// Passwords set with SetPassword are hashed with bcrypt in the $2y$ format
+// used by htpasswd. Use auth.CheckPassword to check passwords against the
+// hashes, which may also be in the {SHA} or $apr1$ formats.
+type Htpasswd struct {
+    filename string
+    permFilename string
+    backups int
+    flock fileLock
+    mu sync.RWMutex     // Protects the fields below.
+    users *users.Users
+}
+
+func NewHtpasswd(filename string) *Htpasswd {
+  return &Htpasswd{
+    filename: filename,
+    permFilename: filename + DefaultPermissionSuffix,
+    backups: 1,
+    users: users.Empty(),
+  }
+}
+
+// SetBackups sets the number of backups of each file kept by Save,
+// as for PwFile.
+func (hp *Htpasswd) SetBackups(n int) {
+  hp.backups = n
+}
+
+// SetPermissionFile sets the name of the file holding user permissions.
+func (hp *Htpasswd) SetPermissionFile(filename string) {
+  hp.permFilename = filename
+}
+
+// Load reads the htpasswd file and the permissions file.
+func (hp *Htpasswd) Load() error {
+  uu, err := readHtpasswd(hp.filename)
+  if err != nil {
+    return err
+  }
+  perms, err := readHtpasswdPerms(hp.permFilename)
+  if err != nil {
+    return err
+  }
+  for username, p := range perms {
+    u := uu[username]
+    if u == nil {
+      glog.Warningf("User %q in permission file %s is not in %s", username, hp.permFilename, hp.filename)
+      continue
+    }
+    u.SetPermissions(p)
+  }
+  newUsers := users.NewUsers(uu)
+  hp.mu.Lock()
+  hp.users = newUsers
+  hp.mu.Unlock()
+  return nil
+}
+
+func readHtpasswd(filename string) (map[string]*users.User, error) {
+  f, err := os.Open(filename)
+  if err != nil {
+    return nil, fmt.Errorf("error opening htpasswd file %s: %v", filename, err)
+  }
+  defer f.Close()
+  uu := make(map[string]*users.User)
+  scanner := bufio.NewScanner(f)
+  lineno := 0
+  for scanner.Scan() {
+    lineno++
+    line := strings.TrimSpace(scanner.Text())
+    if line == "" || strings.HasPrefix(line, CommentPrefix) {
+      continue
+    }
+    n := strings.Index(line, ":")
+    if n <= 0 {
+      return nil, fmt.Errorf("error in htpasswd file %s: line %d: missing colon", filename, lineno)
+    }
+    username, hash := line[:n], line[n+1:]
+    uu[username] = users.NewUser(username, hash, permissions.FromString(""))
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, fmt.Errorf("error reading htpasswd file %s: %v", filename, err)
+  }
+  return uu, nil
+}
+
+// readHtpasswdPerms reads the permissions file, which need not exist.
+func readHtpasswdPerms(filename string) (map[string]*permissions.Permissions, error) {
+  perms := make(map[string]*permissions.Permissions)
+  f, err := os.Open(filename)
+  if os.IsNotExist(err) {
+    return perms, nil
+  }
+  if err != nil {
+    return nil, fmt.Errorf("error opening permission file %s: %v", filename, err)
+  }
+  defer f.Close()
+  r := csv.NewReader(bufio.NewReader(f))
+  r.FieldsPerRecord = 2         // username, permissions
+  r.Comment = '#'
+  records, err := r.ReadAll()
+  if err != nil {
+    return nil, fmt.Errorf("error loading permission file %s: %v", filename, err)
+  }
+  for _, record := range records {
+    perms[record[0]] = permissions.FromString(record[1])
+  }
+  return perms, nil
+}
+
+// Save writes the htpasswd file and the permissions file. The permissions
+// file only lists users who have permissions.
+func (hp *Htpasswd) Save() error {
+  hp.mu.RLock()
+  ua := hp.users.ToArray()
+  hp.mu.RUnlock()
+  err := writeFileSafely(hp.filename, hp.backups, func(w io.Writer) error {
+    for _, u := range ua {
+      if _, err := fmt.Fprintf(w, "%s:%s\n", u.Id(), u.Saltword()); err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return fmt.Errorf("error saving htpasswd file: %v", err)
+  }
+  err = writeFileSafely(hp.permFilename, hp.backups, func(w io.Writer) error {
+    cw := csv.NewWriter(w)
+    for _, u := range ua {
+      if perms := u.PermissionsString(); perms != "" {
+        cw.Write([]string{u.Id(), perms})
+      }
+    }
+    cw.Flush()
+    return cw.Error()
+  })
+  if err != nil {
+    return fmt.Errorf("error saving permission file: %v", err)
+  }
+  return nil
+}
+
+// Lock gets an exclusive lock on the htpasswd file, as for PwFile.
+// It also covers the permissions file.
+func (hp *Htpasswd) Lock() error {
+  return hp.flock.lock(hp.filename)
+}
+
+// Unlock releases the lock obtained by Lock.
+func (hp *Htpasswd) Unlock() error {
+  return hp.flock.unlock(hp.filename)
+}
+
+func (hp *Htpasswd) User(username string) *users.User {
+  hp.mu.RLock()
+  defer hp.mu.RUnlock()
+  return hp.users.User(username)
+}
+
+// SetSaltword sets the hash for a user. To keep the file usable by other
+// servers, use SetPassword instead, which hashes the password in a
+// format that they understand.
+func (hp *Htpasswd) SetSaltword(username, saltword string) {
+  if strings.Contains(username, ":") {
+    glog.Errorf("Can't set saltword for %q: username may not contain a colon", username)
+    return
+  }
+  hp.mu.Lock()
+  defer hp.mu.Unlock()
+  hp.users.SetSaltword(username, saltword)
+}
+
+// SetPassword hashes password with bcrypt and sets it for the user,
+// adding the user if not already present.
+func (hp *Htpasswd) SetPassword(username, password string) error {
+  if strings.Contains(username, ":") {
+    return fmt.Errorf("username %q may not contain a colon", username)
+  }
+  hash, err := bcrypt.GenerateFromPassword([]byte(password), htpasswdBcryptCost)
+  if err != nil {
+    return fmt.Errorf("error hashing password for %q: %v", username, err)
+  }
+  // Go produces $2a$, which is the same algorithm as $2y$ from htpasswd.
+  hp.mu.Lock()
+  defer hp.mu.Unlock()
+  hp.users.SetSaltword(username, "$2y$" + strings.TrimPrefix(string(hash), "$2a$"))
+  return nil
+}
+
+func (hp *Htpasswd) UserCount() int {
+  hp.mu.RLock()
+  defer hp.mu.RUnlock()
+  return hp.users.UserCount()
+}
+
+func (hp *Htpasswd) ListUsers(offset, limit int) ([]*users.User, error) {
+  hp.mu.RLock()
+  defer hp.mu.RUnlock()
+  return hp.users.Page(offset, limit), nil
+}
+
+func (hp *Htpasswd) DeleteUser(username string) error {
+  hp.mu.Lock()
+  defer hp.mu.Unlock()
+  return hp.users.DeleteUser(username)
+}
+
+func (hp *Htpasswd) RenameUser(oldname, newname string) error {
+  if strings.Contains(newname, ":") {
+    return fmt.Errorf("username %q may not contain a colon", newname)
+  }
+  hp.mu.Lock()
+  defer hp.mu.Unlock()
+  return hp.users.RenameUser(oldname, newname)
+}
+
+func (hp *Htpasswd) SetPermissions(username string, perms *permissions.Permissions) error {
+  hp.mu.Lock()
+  defer hp.mu.Unlock()
+  return hp.users.SetPermissions(username, perms)
+}
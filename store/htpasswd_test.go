@@ -0,0 +1,133 @@
+package store
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "golang.org/x/crypto/bcrypt"
+
+  "github.com/jimmc/auth/permissions"
+)
+
+func TestHtpasswdLoad(t *testing.T) {
+  hp := NewHtpasswd("testdata/htpasswd1")
+  if err := hp.Load(); err != nil {
+    t.Fatalf("error loading htpasswd file: %v", err)
+  }
+  if got, want := hp.UserCount(), 3; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+  if got, want := hp.User("bob").Saltword(), "{SHA}KXV5lfOmXj1HOy0eE1tRGdIyUHw="; got != want {
+    t.Errorf("hash for bob: got %q, want %q", got, want)
+  }
+  tests := []struct{
+    username string
+    perms string
+  }{
+    { "alice", "edit read" },
+    { "bob", "" },
+    { "carol", "read" },
+  }
+  for _, tc := range tests {
+    if got := hp.User(tc.username).PermissionsString(); got != tc.perms {
+      t.Errorf("permissions for %s: got %q, want %q", tc.username, got, tc.perms)
+    }
+  }
+
+  if err := NewHtpasswd("testdata/htpasswd-bad").Load(); err == nil {
+    t.Errorf("expected error loading bad htpasswd file")
+  } else if got, want := err.Error(), "error in htpasswd file testdata/htpasswd-bad: line 2: missing colon"; got != want {
+    t.Errorf("load error: got %q, want %q", got, want)
+  }
+  if err := NewHtpasswd("/no/such/file/htpasswd").Load(); err == nil {
+    t.Errorf("expected error loading missing htpasswd file")
+  }
+}
+
+func TestHtpasswdSave(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "htpasswd")
+  hp := NewHtpasswd(filename)
+  if err := hp.SetPassword("dave", "davepw"); err != nil {
+    t.Fatalf("error setting password: %v", err)
+  }
+  if err := hp.SetPassword("bad:name", "pw"); err == nil {
+    t.Errorf("expected error setting password for username with a colon")
+  }
+  hash := hp.User("dave").Saltword()
+  if !strings.HasPrefix(hash, "$2y$") {
+    t.Errorf("hash should use the htpasswd bcrypt format, got %q", hash)
+  }
+  if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte("davepw")); err != nil {
+    t.Errorf("hash does not match password: %v", err)
+  }
+  hp.SetSaltword("erin", "{SHA}KXV5lfOmXj1HOy0eE1tRGdIyUHw=")
+  if err := hp.SetPermissions("erin", permissions.FromString("read edit")); err != nil {
+    t.Fatalf("error setting permissions: %v", err)
+  }
+  if err := hp.Save(); err != nil {
+    t.Fatalf("error saving htpasswd file: %v", err)
+  }
+
+  b, err := ioutil.ReadFile(filename)
+  if err != nil {
+    t.Fatalf("error reading saved htpasswd file: %v", err)
+  }
+  if got, want := string(b), "dave:" + hash + "\nerin:{SHA}KXV5lfOmXj1HOy0eE1tRGdIyUHw=\n"; got != want {
+    t.Errorf("saved htpasswd file: got %q, want %q", got, want)
+  }
+  b, err = ioutil.ReadFile(filename + DefaultPermissionSuffix)
+  if err != nil {
+    t.Fatalf("error reading saved permission file: %v", err)
+  }
+  if got, want := string(b), "erin,edit read\n"; got != want {
+    t.Errorf("saved permission file: got %q, want %q", got, want)
+  }
+
+  hp2 := NewHtpasswd(filename)
+  if err := hp2.Load(); err != nil {
+    t.Fatalf("error loading saved htpasswd file: %v", err)
+  }
+  if got, want := hp2.User("erin").HasPermission("edit"), true; got != want {
+    t.Errorf("erin edit permission after reload: got %v, want %v", got, want)
+  }
+}
+
+func TestHtpasswdAdminStore(t *testing.T) {
+  testAdminStore(t, NewHtpasswd("/no/such/file/htpasswd"))
+}
+
+func TestHtpasswdBackupsAndLock(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "htpasswd")
+  hp := NewHtpasswd(filename)
+  var _ Locker = hp
+  if err := hp.Lock(); err != nil {
+    t.Fatalf("error locking htpasswd file: %v", err)
+  }
+  hp.SetBackups(2)
+  for _, saltword := range []string{"cw1", "cw2", "cw3"} {
+    hp.SetSaltword("alice", saltword)
+    if err := hp.Save(); err != nil {
+      t.Fatalf("error saving htpasswd file: %v", err)
+    }
+  }
+  if err := hp.Unlock(); err != nil {
+    t.Fatalf("error unlocking htpasswd file: %v", err)
+  }
+  for _, suffix := range []string{"~", "~2"} {
+    for _, f := range []string{filename, filename + DefaultPermissionSuffix} {
+      if _, err := os.Stat(f + suffix); err != nil {
+        t.Errorf("backup file %s should exist: %v", f + suffix, err)
+      }
+    }
+  }
+  b, err := ioutil.ReadFile(filename + "~2")
+  if err != nil {
+    t.Fatalf("error reading backup file: %v", err)
+  }
+  if got, want := string(b), "alice:cw1\n"; got != want {
+    t.Errorf("oldest backup: got %q, want %q", got, want)
+  }
+}
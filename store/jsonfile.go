@@ -0,0 +1,356 @@
+package store
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "sync"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+// JSONVersion is the version of the JSON file format written by JSONFile.
+const JSONVersion = 1
+
+// JSONFile implements the Store interface using a JSON file, which
+// unlike PwFile can hold roles and per-user metadata. The format is
+//   {
+//     "version": 1,
+//     "users": [
+//       {
+//         "username": "alice",
+//         "saltword": "2432...",
+//         "permissions": ["@editor", "deploy[2024-01-01T00:00:00Z/]"],
+//         "metadata": {"email": "alice@example.com"}
+//       }
+//     ],
+//     "roles": {
+//       "editor": ["edit", "read"]
+//     }
+//   }
+// Files written by older versions are upgraded when loaded, and written
+// in the current version when saved. Saves are atomic in the same way
+// as for PwFile. Use ConvertPwFile to create a JSON file from a PwFile.
+type JSONFile struct {
+    filename string
+    validation Validation
+    usernamePolicy *users.UsernamePolicy
+    backups int
+    flock fileLock
+    mu sync.RWMutex     // Protects the fields below.
+    users *users.Users
+    roles *permissions.Roles
+}
+
+type jsonDoc struct {
+  Version int `json:"version"`
+  Users []*jsonUser `json:"users"`
+  Roles map[string]*permissions.Permissions `json:"roles,omitempty"`
+}
+
+type jsonUser struct {
+  Username string `json:"username"`
+  Saltword string `json:"saltword"`
+  Permissions *permissions.Permissions `json:"permissions"`
+  Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func NewJSONFile(filename string) *JSONFile {
+  return &JSONFile{
+    filename: filename,
+    backups: 1,
+    users: users.Empty(),
+  }
+}
+
+// SetValidation sets how Load and SetPermissions treat permissions
+// that are not in the permissions catalog.
+func (jf *JSONFile) SetValidation(mode Validation) {
+  jf.validation = mode
+}
+
+// SetUsernamePolicy sets the policy for usernames, as for PwFile.
+func (jf *JSONFile) SetUsernamePolicy(p *users.UsernamePolicy) error {
+  jf.mu.Lock()
+  defer jf.mu.Unlock()
+  if err := jf.users.SetUsernamePolicy(p); err != nil {
+    return err
+  }
+  jf.usernamePolicy = p
+  return nil
+}
+
+// UsernamePolicy returns the policy set by SetUsernamePolicy, or nil.
+func (jf *JSONFile) UsernamePolicy() *users.UsernamePolicy {
+  jf.mu.RLock()
+  defer jf.mu.RUnlock()
+  return jf.usernamePolicy
+}
+
+// SetBackups sets the number of backups kept by Save, as for PwFile.
+func (jf *JSONFile) SetBackups(n int) {
+  jf.backups = n
+}
+
+// Load reads the JSON file. If it can not be read or is not valid,
+// the previously loaded data stays in effect and the error is returned.
+func (jf *JSONFile) Load() error {
+  b, err := ioutil.ReadFile(jf.filename)
+  if err != nil {
+    return fmt.Errorf("error reading user file %s: %v", jf.filename, err)
+  }
+  doc, err := parseJSONDoc(b)
+  if err != nil {
+    return fmt.Errorf("error in user file %s: %v", jf.filename, err)
+  }
+  jf.mu.RLock()
+  policy := jf.usernamePolicy
+  jf.mu.RUnlock()
+  uu, roles, err := jf.docToUsers(doc, policy)
+  if err != nil {
+    return fmt.Errorf("error in user file %s: %v", jf.filename, err)
+  }
+  jf.mu.Lock()
+  jf.users = uu
+  jf.roles = roles
+  jf.mu.Unlock()
+  return nil
+}
+
+// parseJSONDoc decodes a JSON file of any supported version,
+// and upgrades it to the current version.
+func parseJSONDoc(b []byte) (*jsonDoc, error) {
+  var header struct {
+    Version int `json:"version"`
+  }
+  if err := json.Unmarshal(b, &header); err != nil {
+    return nil, err
+  }
+  switch {
+  case header.Version <= 0:
+    return nil, fmt.Errorf("missing or invalid version")
+  case header.Version > JSONVersion:
+    return nil, fmt.Errorf("version %d is newer than the supported version %d", header.Version, JSONVersion)
+  }
+  // When there are older versions, decode them into their own types
+  // here and convert them to the current version.
+  doc := &jsonDoc{}
+  if err := json.Unmarshal(b, doc); err != nil {
+    return nil, err
+  }
+  return doc, nil
+}
+
+func (jf *JSONFile) docToUsers(doc *jsonDoc, policy *users.UsernamePolicy) (*users.Users, *permissions.Roles, error) {
+  var roles *permissions.Roles
+  if len(doc.Roles) > 0 {
+    roles = permissions.NewRoles()
+    for name, perms := range doc.Roles {
+      roles.SetRole(name, perms)
+    }
+    if err := roles.Check(); err != nil {
+      return nil, nil, err
+    }
+    if err := validateRoles(jf.validation, roles); err != nil {
+      return nil, nil, err
+    }
+  }
+  uu := make(map[string]*users.User)
+  for n, ju := range doc.Users {
+    if ju.Username == "" {
+      return nil, nil, fmt.Errorf("user %d has no username", n + 1)
+    }
+    if uu[ju.Username] != nil {
+      return nil, nil, fmt.Errorf("duplicate user %q", ju.Username)
+    }
+    perms := ju.Permissions
+    if perms == nil {
+      perms = permissions.FromString("")
+    }
+    if err := validatePermissions(jf.validation, fmt.Sprintf("user %q", ju.Username), perms); err != nil {
+      return nil, nil, err
+    }
+    u := users.NewUser(ju.Username, ju.Saltword, perms)
+    for key, value := range ju.Metadata {
+      u.SetMetadata(key, value)
+    }
+    uu[ju.Username] = u
+  }
+  result := users.NewUsers(uu)
+  if err := result.SetUsernamePolicy(policy); err != nil {
+    return nil, nil, err
+  }
+  result.SetRoles(roles)
+  return result, roles, nil
+}
+
+// Save writes the JSON file in the current version.
+func (jf *JSONFile) Save() error {
+  jf.mu.RLock()
+  b, err := json.MarshalIndent(jf.toDoc(), "", "  ")
+  jf.mu.RUnlock()
+  if err != nil {
+    return fmt.Errorf("error encoding user file: %v", err)
+  }
+  err = writeFileSafely(jf.filename, jf.backups, func(w io.Writer) error {
+    _, err := w.Write(append(b, '\n'))
+    return err
+  })
+  if err != nil {
+    return fmt.Errorf("error saving user file: %v", err)
+  }
+  return nil
+}
+
+func (jf *JSONFile) toDoc() *jsonDoc {
+  doc := &jsonDoc{
+    Version: JSONVersion,
+    Users: make([]*jsonUser, 0),
+  }
+  for _, u := range jf.users.ToArray() {
+    perms := u.Permissions()
+    if perms == nil {
+      perms = permissions.FromString("")
+    }
+    ju := &jsonUser{
+      Username: u.Id(),
+      Saltword: u.Saltword(),
+      Permissions: perms,
+    }
+    for _, key := range u.MetadataKeys() {
+      if ju.Metadata == nil {
+        ju.Metadata = make(map[string]string)
+      }
+      ju.Metadata[key] = u.Metadata(key)
+    }
+    doc.Users = append(doc.Users, ju)
+  }
+  if jf.roles != nil {
+    doc.Roles = make(map[string]*permissions.Permissions)
+    for _, name := range jf.roles.Names() {
+      doc.Roles[name] = jf.roles.Role(name)
+    }
+  }
+  return doc
+}
+
+// Lock gets an exclusive lock on the JSON file, as for PwFile.
+func (jf *JSONFile) Lock() error {
+  return jf.flock.lock(jf.filename)
+}
+
+// Unlock releases the lock obtained by Lock.
+func (jf *JSONFile) Unlock() error {
+  return jf.flock.unlock(jf.filename)
+}
+
+func (jf *JSONFile) User(username string) *users.User {
+  jf.mu.RLock()
+  defer jf.mu.RUnlock()
+  return jf.users.User(username)
+}
+
+func (jf *JSONFile) SetSaltword(username, saltword string) {
+  jf.mu.Lock()
+  defer jf.mu.Unlock()
+  jf.users.SetSaltword(username, saltword)
+}
+
+func (jf *JSONFile) UserCount() int {
+  jf.mu.RLock()
+  defer jf.mu.RUnlock()
+  return jf.users.UserCount()
+}
+
+func (jf *JSONFile) ListUsers(offset, limit int) ([]*users.User, error) {
+  jf.mu.RLock()
+  defer jf.mu.RUnlock()
+  return jf.users.Page(offset, limit), nil
+}
+
+func (jf *JSONFile) DeleteUser(username string) error {
+  jf.mu.Lock()
+  defer jf.mu.Unlock()
+  return jf.users.DeleteUser(username)
+}
+
+func (jf *JSONFile) RenameUser(oldname, newname string) error {
+  jf.mu.Lock()
+  defer jf.mu.Unlock()
+  return jf.users.RenameUser(oldname, newname)
+}
+
+func (jf *JSONFile) SetPermissions(username string, perms *permissions.Permissions) error {
+  if err := validatePermissions(jf.validation, fmt.Sprintf("user %q", username), perms); err != nil {
+    return err
+  }
+  jf.mu.Lock()
+  defer jf.mu.Unlock()
+  return jf.users.SetPermissions(username, perms.WithRoles(jf.roles))
+}
+
+// SetMetadata sets a metadata value for a user, or removes it if
+// value is empty.
+func (jf *JSONFile) SetMetadata(username, key, value string) error {
+  jf.mu.Lock()
+  defer jf.mu.Unlock()
+  u := jf.users.User(username)
+  if u == nil {
+    return fmt.Errorf("user %q: %w", username, users.ErrNoSuchUser)
+  }
+  u.SetMetadata(key, value)
+  return nil
+}
+
+// SetRole adds or replaces a role. Roles are saved in the JSON file.
+func (jf *JSONFile) SetRole(name string, perms *permissions.Permissions) error {
+  jf.mu.Lock()
+  defer jf.mu.Unlock()
+  roles := permissions.NewRoles()
+  if jf.roles != nil {
+    for _, n := range jf.roles.Names() {
+      roles.SetRole(n, jf.roles.Role(n))
+    }
+  }
+  roles.SetRole(name, perms)
+  if err := roles.Check(); err != nil {
+    return err
+  }
+  jf.roles = roles
+  jf.users.SetRoles(roles)
+  return nil
+}
+
+// ConvertPwFile copies the users and roles of pf, which must already be
+// loaded, into jf, replacing any data in jf, and saves jf.
+// Saltwords, permissions including time limits, and roles are kept.
+// A JSONFile does not encrypt saltwords, so ConvertPwFile fails if pf
+// has an Encryption, rather than writing its saltwords in plain form.
+// The username policy of jf is applied to the users, and ConvertPwFile
+// fails without changing jf if two of them have the same canonical name.
+func ConvertPwFile(pf *PwFile, jf *JSONFile) error {
+  pf.mu.RLock()
+  if pf.encryption != nil {
+    pf.mu.RUnlock()
+    return fmt.Errorf("can't convert password file %s: it has encrypted saltwords", pf.filename)
+  }
+  uu := make(map[string]*users.User)
+  for _, u := range pf.users.ToArray() {
+    uu[u.Id()] = users.NewUser(u.Id(), u.Saltword(), permissions.FromString(u.PermissionsString()))
+  }
+  roles := pf.roles
+  pf.mu.RUnlock()
+  jf.mu.Lock()
+  newUsers := users.NewUsers(uu)
+  if err := newUsers.SetUsernamePolicy(jf.usernamePolicy); err != nil {
+    jf.mu.Unlock()
+    return fmt.Errorf("error converting password file: %w", err)
+  }
+  newUsers.SetRoles(roles)
+  jf.users = newUsers
+  jf.roles = roles
+  jf.mu.Unlock()
+  return jf.Save()
+}
@@ -0,0 +1,185 @@
+package store
+
+import (
+  "bytes"
+  "io/ioutil"
+  "path/filepath"
+  "sync"
+  "testing"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+func TestJSONFileLoad(t *testing.T) {
+  jf := NewJSONFile("testdata/users1.json")
+  if err := jf.Load(); err != nil {
+    t.Fatalf("error loading json file: %v", err)
+  }
+  if got, want := jf.UserCount(), 2; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+  alice := jf.User("alice")
+  if got, want := alice.Saltword(), "cw-alice"; got != want {
+    t.Errorf("saltword for alice: got %q, want %q", got, want)
+  }
+  if got, want := alice.HasPermission("read"), true; got != want {
+    t.Errorf("alice read permission through role: got %v, want %v", got, want)
+  }
+  if got, want := alice.Metadata("email"), "alice@example.com"; got != want {
+    t.Errorf("alice email: got %q, want %q", got, want)
+  }
+  if got, want := jf.User("bob").PermissionsString(), "read"; got != want {
+    t.Errorf("permissions for bob: got %q, want %q", got, want)
+  }
+
+  // Saving what we loaded should give the same file.
+  outfile := filepath.Join(t.TempDir(), "users.json")
+  jf.filename = outfile
+  if err := jf.Save(); err != nil {
+    t.Fatalf("error saving json file: %v", err)
+  }
+  compareFiles(t, outfile, "testdata/users1.json")
+}
+
+func TestJSONFileErrors(t *testing.T) {
+  tests := []struct{
+    name string
+    contents string
+    want string
+  }{
+    { "no version", `{"users": []}`, "missing or invalid version" },
+    { "newer version", `{"version": 99, "users": []}`, "version 99 is newer than the supported version 1" },
+    { "duplicate", `{"version": 1, "users": [{"username": "a"}, {"username": "a"}]}`, `duplicate user "a"` },
+    { "no username", `{"version": 1, "users": [{"saltword": "x"}]}`, "user 1 has no username" },
+    { "bad permission", `{"version": 1, "users": [{"username": "a", "permissions": ["bad:"]}]}`, `permission "bad:" has an empty segment` },
+    { "role cycle", `{"version": 1, "users": [], "roles": {"a": ["@a"]}}`, "role cycle: a -> a" },
+  }
+  dir := t.TempDir()
+  for _, tc := range tests {
+    filename := filepath.Join(dir, "users.json")
+    if err := ioutil.WriteFile(filename, []byte(tc.contents), 0600); err != nil {
+      t.Fatalf("error writing json file: %v", err)
+    }
+    jf := NewJSONFile(filename)
+    err := jf.Load()
+    if err == nil {
+      t.Errorf("%s: expected error", tc.name)
+      continue
+    }
+    if got, want := err.Error(), "error in user file " + filename + ": " + tc.want; got != want {
+      t.Errorf("%s: got %q, want %q", tc.name, got, want)
+    }
+  }
+}
+
+func TestConvertPwFile(t *testing.T) {
+  pf := NewPwFile("testdata/pw-roles.txt")
+  pf.SetRoleFile("testdata/roles1.txt")
+  if err := pf.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+  outfile := filepath.Join(t.TempDir(), "users.json")
+  jf := NewJSONFile(outfile)
+  if err := ConvertPwFile(pf, jf); err != nil {
+    t.Fatalf("error converting password file: %v", err)
+  }
+  compareFiles(t, outfile, "testdata/pw-roles-golden.json")
+
+  jf2 := NewJSONFile(outfile)
+  if err := jf2.Load(); err != nil {
+    t.Fatalf("error loading converted file: %v", err)
+  }
+  if got, want := jf2.User("alice").HasPermission("comment"), true; got != want {
+    t.Errorf("alice permission through converted role: got %v, want %v", got, want)
+  }
+  if got, want := jf2.User("bob").Saltword(), "cw2"; got != want {
+    t.Errorf("saltword for bob after conversion: got %q, want %q", got, want)
+  }
+
+  // The converted store keeps its username policy.
+  jf3 := NewJSONFile(filepath.Join(t.TempDir(), "users.json"))
+  if err := jf3.SetUsernamePolicy(users.NewUsernamePolicy()); err != nil {
+    t.Fatalf("error setting username policy: %v", err)
+  }
+  if err := ConvertPwFile(pf, jf3); err != nil {
+    t.Fatalf("error converting password file: %v", err)
+  }
+  if jf3.User("ALICE") == nil {
+    t.Errorf("alice should be found by ALICE after conversion")
+  }
+
+  // Encrypted saltwords are not written in plain form.
+  pf.SetEncryption(newTestEncryption(t, 1))
+  jf4 := NewJSONFile(filepath.Join(t.TempDir(), "users.json"))
+  if err := ConvertPwFile(pf, jf4); err == nil {
+    t.Errorf("expected error converting password file with encryption")
+  }
+  if got, want := jf4.UserCount(), 0; got != want {
+    t.Errorf("users after failed conversion: got %d, want %d", got, want)
+  }
+}
+
+func TestJSONFileSetRole(t *testing.T) {
+  jf := NewJSONFile(filepath.Join(t.TempDir(), "users.json"))
+  jf.SetSaltword("alice", "cw1")
+  perms := permissions.FromString("@reader")
+  if err := jf.SetPermissions("alice", perms); err != nil {
+    t.Fatalf("error setting permissions: %v", err)
+  }
+  if err := jf.SetRole("reader", permissions.FromString("read")); err != nil {
+    t.Fatalf("error setting role: %v", err)
+  }
+  if got, want := jf.User("alice").HasPermission("read"), true; got != want {
+    t.Errorf("permission through new role: got %v, want %v", got, want)
+  }
+  if got, want := perms.HasPermission("read"), false; got != want {
+    t.Errorf("caller's permissions should not get our roles: got %v, want %v", got, want)
+  }
+  if err := jf.SetRole("loop", permissions.FromString("@loop")); err == nil {
+    t.Errorf("expected error setting role with a cycle")
+  }
+}
+
+func TestJSONFileAdminStore(t *testing.T) {
+  testAdminStore(t, NewJSONFile("/no/such/file/users.json"))
+}
+
+func compareFiles(t *testing.T, gotFile, wantFile string) {
+  t.Helper()
+  got, err := ioutil.ReadFile(gotFile)
+  if err != nil {
+    t.Fatalf("failed to read %s: %v", gotFile, err)
+  }
+  want, err := ioutil.ReadFile(wantFile)
+  if err != nil {
+    t.Fatalf("failed to read reference file %s: %v", wantFile, err)
+  }
+  if !bytes.Equal(got, want) {
+    t.Errorf("file contents don't match %s, got '%s', want '%s'", wantFile, got, want)
+  }
+}
+
+func TestJSONFileConcurrent(t *testing.T) {
+  jf := NewJSONFile("testdata/users1.json")
+  if err := jf.Load(); err != nil {
+    t.Fatalf("error loading json file: %v", err)
+  }
+  var wg sync.WaitGroup
+  wg.Add(1)
+  go func() {
+    defer wg.Done()
+    for i := 0; i < 50; i++ {
+      if err := jf.Load(); err != nil {
+        t.Errorf("error reloading json file: %v", err)
+      }
+    }
+  }()
+  for i := 0; i < 50; i++ {
+    jf.SetSaltword("carol", "cw-carol")
+    jf.User("alice")
+    jf.SetMetadata("alice", "email", "alice@example.org")
+    jf.ListUsers(0, 0)
+  }
+  wg.Wait()
+}
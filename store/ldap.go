@@ -0,0 +1,254 @@
+package store
+
+import (
+  "context"
+  "fmt"
+  "net"
+  "time"
+
+  "github.com/go-ldap/ldap/v3"
+  "github.com/golang/glog"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+// LDAPConfig says how to find users and their groups in an LDAP directory.
+type LDAPConfig struct {
+  URL string                    // Such as ldaps://ldap.example.com
+  BindDN string                 // Account used to search for users, or empty to search anonymously.
+  BindPassword string
+  BaseDN string                 // Where to search for users.
+  UserFilter string             // Filter with %s for the escaped username, such as (uid=%s).
+  GroupAttribute string         // User attribute with the DNs of the user's groups, default memberOf.
+  Groups map[string]string      // Permissions granted to the members of each group, by group DN.
+  Permissions string            // Permissions granted to every user in the directory.
+  Timeout time.Duration         // Timeout for each request, default 10 seconds.
+}
+
+const (
+  defaultLDAPGroupAttribute = "memberOf"
+  defaultLDAPTimeout = 10 * time.Second
+  ldapPageSize = 500            // Entries per page when counting users.
+)
+
+// LDAP implements Store and Authenticator using an LDAP directory.
+// Passwords are checked by binding to the directory as the user, so
+// the client must send the plain password rather than a hashword, and
+// should do so only over https. Users are found by searching under the
+// base DN, and their permissions come from their group memberships as
+// mapped by LDAPConfig.Groups. The directory is read on each request,
+// so LDAP is usually wrapped in a Cached store.
+// The directory can not be changed through this Store.
+type LDAP struct {
+    config *LDAPConfig
+    groups []*ldapGroup
+}
+
+type ldapGroup struct {
+  dn *ldap.DN
+  perms string
+}
+
+// NewLDAP returns an LDAP store using the configuration, which it
+// checks for errors.
+func NewLDAP(config *LDAPConfig) (*LDAP, error) {
+  if config.URL == "" || config.BaseDN == "" || config.UserFilter == "" {
+    return nil, fmt.Errorf("LDAP configuration requires URL, BaseDN and UserFilter")
+  }
+  groups := make([]*ldapGroup, 0, len(config.Groups))
+  for dn, perms := range config.Groups {
+    parsed, err := ldap.ParseDN(dn)
+    if err != nil {
+      return nil, fmt.Errorf("invalid LDAP group DN %q: %v", dn, err)
+    }
+    groups = append(groups, &ldapGroup{parsed, perms})
+  }
+  return &LDAP{
+    config: config,
+    groups: groups,
+  }, nil
+}
+
+// Load does nothing, since we read the directory as needed.
+func (l *LDAP) Load() error {
+  return nil
+}
+
+func (l *LDAP) LoadContext(ctx context.Context) error {
+  return nil
+}
+
+// Save does nothing, since we don't change the directory.
+func (l *LDAP) Save() error {
+  return nil
+}
+
+func (l *LDAP) SaveContext(ctx context.Context) error {
+  return nil
+}
+
+func (l *LDAP) User(username string) *users.User {
+  user, err := l.UserContext(context.Background(), username)
+  if err != nil {
+    glog.Errorf("%v", err)
+    return nil
+  }
+  return user
+}
+
+// UserContext looks up the user in the directory, and returns it with
+// no saltword, so it can only be authenticated by Authenticate.
+func (l *LDAP) UserContext(ctx context.Context, username string) (*users.User, error) {
+  conn, err := l.connect(ctx)
+  if err != nil {
+    return nil, err
+  }
+  defer conn.Close()
+  entry, err := l.findUser(conn, username)
+  if err != nil || entry == nil {
+    return nil, err
+  }
+  return l.newUser(username, entry), nil
+}
+
+// SetSaltword is not supported, since we don't change the directory.
+func (l *LDAP) SetSaltword(username, saltword string) {
+  glog.Errorf("Can't set the password for %q in the LDAP directory", username)
+}
+
+func (l *LDAP) SetSaltwordContext(ctx context.Context, username, saltword string) error {
+  return fmt.Errorf("setting password in LDAP directory: %w", ErrNotSupported)
+}
+
+func (l *LDAP) UserCount() int {
+  count, err := l.UserCountContext(context.Background())
+  if err != nil {
+    glog.Errorf("%v", err)
+    return 0
+  }
+  return count
+}
+
+// UserCountContext returns the number of entries that match the
+// user filter with any username.
+func (l *LDAP) UserCountContext(ctx context.Context) (int, error) {
+  conn, err := l.connect(ctx)
+  if err != nil {
+    return 0, err
+  }
+  defer conn.Close()
+  req := ldap.NewSearchRequest(l.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+      0, 0, false, fmt.Sprintf(l.config.UserFilter, "*"), []string{"dn"}, nil)
+  // Page the results, since servers limit the size of a single search.
+  result, err := conn.SearchWithPaging(req, ldapPageSize)
+  if err != nil {
+    return 0, fmt.Errorf("error counting LDAP users: %v", err)
+  }
+  return len(result.Entries), nil
+}
+
+// Authenticate checks the password by binding to the directory as the
+// user. It returns nil and no error if the username or password is wrong.
+func (l *LDAP) Authenticate(ctx context.Context, username, password string) (*users.User, error) {
+  if password == "" {
+    return nil, nil     // An empty password would be an unauthenticated bind.
+  }
+  conn, err := l.connect(ctx)
+  if err != nil {
+    return nil, err
+  }
+  defer conn.Close()
+  entry, err := l.findUser(conn, username)
+  if err != nil || entry == nil {
+    return nil, err
+  }
+  if err := conn.Bind(entry.DN, password); err != nil {
+    if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+      glog.V(2).Infof("Invalid LDAP credentials for %q", username)
+      return nil, nil
+    }
+    return nil, fmt.Errorf("error binding to LDAP as %q: %v", entry.DN, err)
+  }
+  return l.newUser(username, entry), nil
+}
+
+// connect opens a connection to the directory, bound as the search account.
+func (l *LDAP) connect(ctx context.Context) (*ldap.Conn, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
+  timeout := l.config.Timeout
+  if timeout == 0 {
+    timeout = defaultLDAPTimeout
+  }
+  if deadline, ok := ctx.Deadline(); ok {
+    remaining := time.Until(deadline)
+    if remaining <= 0 {
+      // The context may not have noticed its deadline yet.
+      if err := ctx.Err(); err != nil {
+        return nil, err
+      }
+      return nil, context.DeadlineExceeded
+    }
+    if remaining < timeout {
+      timeout = remaining
+    }
+  }
+  conn, err := ldap.DialURL(l.config.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}))
+  if err != nil {
+    return nil, fmt.Errorf("error connecting to LDAP server: %v", err)
+  }
+  conn.SetTimeout(timeout)
+  if l.config.BindDN != "" {
+    if err := conn.Bind(l.config.BindDN, l.config.BindPassword); err != nil {
+      conn.Close()
+      return nil, fmt.Errorf("error binding to LDAP as %q: %v", l.config.BindDN, err)
+    }
+  }
+  return conn, nil
+}
+
+// findUser returns the directory entry for the user, or nil if there is
+// not exactly one.
+func (l *LDAP) findUser(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+  req := ldap.NewSearchRequest(l.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+      2, 0, false, fmt.Sprintf(l.config.UserFilter, ldap.EscapeFilter(username)),
+      []string{l.groupAttribute()}, nil)
+  result, err := conn.Search(req)
+  if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+    return nil, fmt.Errorf("error searching LDAP for %q: %v", username, err)
+  }
+  if len(result.Entries) != 1 {
+    if len(result.Entries) > 1 {
+      glog.Warningf("More than one LDAP entry for %q, rejecting it", username)
+    }
+    return nil, nil
+  }
+  return result.Entries[0], nil
+}
+
+func (l *LDAP) groupAttribute() string {
+  if l.config.GroupAttribute == "" {
+    return defaultLDAPGroupAttribute
+  }
+  return l.config.GroupAttribute
+}
+
+// newUser creates a user with the permissions of the groups in entry.
+func (l *LDAP) newUser(username string, entry *ldap.Entry) *users.User {
+  perms := permissions.FromString(l.config.Permissions)
+  for _, dn := range entry.GetEqualFoldAttributeValues(l.groupAttribute()) {
+    parsed, err := ldap.ParseDN(dn)
+    if err != nil {
+      glog.Warningf("Invalid group DN %q for LDAP user %q: %v", dn, username, err)
+      continue
+    }
+    for _, g := range l.groups {
+      if g.dn.EqualFold(parsed) {
+        perms = perms.Union(permissions.FromString(g.perms))
+      }
+    }
+  }
+  return users.NewUser(username, "", perms)
+}
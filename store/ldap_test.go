@@ -0,0 +1,303 @@
+package store
+
+import (
+  "context"
+  "errors"
+  "net"
+  "regexp"
+  "strings"
+  "testing"
+  "time"
+
+  ber "github.com/go-asn1-ber/asn1-ber"
+  "github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAP is an in-process stand-in for an LDAP server. It supports
+// simple bind, and searches with a single equality or presence filter.
+type fakeLDAP struct {
+  listener net.Listener
+  entries []*ldap.Entry
+  passwords map[string]string   // By DN.
+}
+
+const (
+  ldapBindRequest = 0
+  ldapBindResponse = 1
+  ldapSearchRequest = 3
+  ldapSearchResultEntry = 4
+  ldapSearchResultDone = 5
+)
+
+var fakeFilterRE = regexp.MustCompile(`^\(([^=()]+)=([^()]*)\)$`)
+
+func newFakeLDAP(t *testing.T) *fakeLDAP {
+  t.Helper()
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatalf("error listening for fake LDAP server: %v", err)
+  }
+  f := &fakeLDAP{
+    listener: listener,
+    passwords: map[string]string{
+      "cn=search,dc=example,dc=com": "searchpw",
+      "uid=alice,ou=people,dc=example,dc=com": "alicepw",
+      "uid=bob,ou=people,dc=example,dc=com": "bobpw",
+    },
+  }
+  f.entries = []*ldap.Entry{
+    ldap.NewEntry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{
+      "uid": {"alice"},
+      "memberOf": {"cn=editors,ou=groups,dc=example,dc=com", "cn=other,ou=groups,dc=example,dc=com"},
+    }),
+    ldap.NewEntry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{
+      "uid": {"bob"},
+      "memberOf": {"CN=Readers,OU=Groups,DC=example,DC=com"},
+    }),
+    ldap.NewEntry("uid=dup,ou=people,dc=example,dc=com", map[string][]string{"uid": {"dup"}}),
+    ldap.NewEntry("uid=dup,ou=staff,dc=example,dc=com", map[string][]string{"uid": {"dup"}}),
+  }
+  go f.serve()
+  return f
+}
+
+func (f *fakeLDAP) url() string {
+  return "ldap://" + f.listener.Addr().String()
+}
+
+func (f *fakeLDAP) close() {
+  f.listener.Close()
+}
+
+func (f *fakeLDAP) serve() {
+  for {
+    conn, err := f.listener.Accept()
+    if err != nil {
+      return
+    }
+    go f.serveConn(conn)
+  }
+}
+
+func (f *fakeLDAP) serveConn(conn net.Conn) {
+  defer conn.Close()
+  for {
+    p, err := ber.ReadPacket(conn)
+    if err != nil || len(p.Children) < 2 {
+      return
+    }
+    id := p.Children[0].Value.(int64)
+    op := p.Children[1]
+    switch op.Tag {
+    case ldapBindRequest:
+      dn := op.Children[1].Value.(string)
+      password := op.Children[2].Data.String()
+      code := uint16(ldap.LDAPResultSuccess)
+      if want, ok := f.passwords[dn]; dn != "" && (!ok || password != want) {
+        code = ldap.LDAPResultInvalidCredentials
+      }
+      conn.Write(ldapMessage(id, ldapResult(ldapBindResponse, code)).Bytes())
+    case ldapSearchRequest:
+      f.search(conn, id, op)
+    default:
+      return
+    }
+  }
+}
+
+func (f *fakeLDAP) search(conn net.Conn, id int64, op *ber.Packet) {
+  base := strings.ToLower(op.Children[0].Value.(string))
+  sizeLimit := int(op.Children[3].Value.(int64))
+  filter, err := ldap.DecompileFilter(op.Children[6])
+  m := fakeFilterRE.FindStringSubmatch(filter)
+  if err != nil || m == nil {
+    conn.Write(ldapMessage(id, ldapResult(ldapSearchResultDone, ldap.LDAPResultUnwillingToPerform)).Bytes())
+    return
+  }
+  var wanted []string
+  for _, a := range op.Children[7].Children {
+    wanted = append(wanted, a.Value.(string))
+  }
+  count := 0
+  for _, e := range f.entries {
+    if !strings.HasSuffix(strings.ToLower(e.DN), base) {
+      continue
+    }
+    if m[2] != "*" && e.GetAttributeValue(m[1]) != m[2] {
+      continue
+    }
+    if m[2] == "*" && len(e.GetAttributeValues(m[1])) == 0 {
+      continue
+    }
+    if sizeLimit > 0 && count == sizeLimit {
+      conn.Write(ldapMessage(id, ldapResult(ldapSearchResultDone, ldap.LDAPResultSizeLimitExceeded)).Bytes())
+      return
+    }
+    count++
+    conn.Write(ldapMessage(id, ldapEntry(e, wanted)).Bytes())
+  }
+  conn.Write(ldapMessage(id, ldapResult(ldapSearchResultDone, ldap.LDAPResultSuccess)).Bytes())
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+  p := ber.NewSequence("LDAP Message")
+  p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+  p.AppendChild(op)
+  return p
+}
+
+func ldapResult(tag ber.Tag, code uint16) *ber.Packet {
+  op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+  op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+  op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+  op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+  return op
+}
+
+func ldapEntry(e *ldap.Entry, wanted []string) *ber.Packet {
+  op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldapSearchResultEntry, nil, "Entry")
+  op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "DN"))
+  attrs := ber.NewSequence("Attributes")
+  for _, name := range wanted {
+    values := e.GetAttributeValues(name)
+    if len(values) == 0 {
+      continue
+    }
+    attr := ber.NewSequence("Attribute")
+    attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+    set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+    for _, v := range values {
+      set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+    }
+    attr.AppendChild(set)
+    attrs.AppendChild(attr)
+  }
+  op.AppendChild(attrs)
+  return op
+}
+
+func newTestLDAP(t *testing.T, f *fakeLDAP) *LDAP {
+  t.Helper()
+  l, err := NewLDAP(&LDAPConfig{
+    URL: f.url(),
+    BindDN: "cn=search,dc=example,dc=com",
+    BindPassword: "searchpw",
+    BaseDN: "dc=example,dc=com",
+    UserFilter: "(uid=%s)",
+    Groups: map[string]string{
+      "cn=editors,ou=groups,dc=example,dc=com": "edit read",
+      "cn=readers,ou=groups,dc=example,dc=com": "read",
+    },
+    Permissions: "login",
+  })
+  if err != nil {
+    t.Fatalf("error creating LDAP store: %v", err)
+  }
+  return l
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+  f := newFakeLDAP(t)
+  defer f.close()
+  l := newTestLDAP(t, f)
+  tests := []struct{
+    username string
+    password string
+    perms string       // Or empty if the credentials are wrong.
+  }{
+    { "alice", "alicepw", "edit login read" },
+    { "bob", "bobpw", "login read" },
+    { "alice", "bobpw", "" },
+    { "alice", "", "" },
+    { "nobody", "pw", "" },
+    { "dup", "pw", "" },
+    { "*", "alicepw", "" },
+  }
+  for _, tc := range tests {
+    user, err := l.Authenticate(context.Background(), tc.username, tc.password)
+    if err != nil {
+      t.Errorf("error authenticating %q: %v", tc.username, err)
+      continue
+    }
+    if tc.perms == "" {
+      if user != nil {
+        t.Errorf("authenticate %q with %q: got user, want nil", tc.username, tc.password)
+      }
+      continue
+    }
+    if user == nil {
+      t.Errorf("authenticate %q: got nil, want user", tc.username)
+      continue
+    }
+    if got, want := user.Id(), tc.username; got != want {
+      t.Errorf("username: got %q, want %q", got, want)
+    }
+    if got, want := user.Permissions().ToString(), tc.perms; got != want {
+      t.Errorf("permissions for %q: got %q, want %q", tc.username, got, want)
+    }
+  }
+}
+
+func TestLDAPUser(t *testing.T) {
+  f := newFakeLDAP(t)
+  defer f.close()
+  l := newTestLDAP(t, f)
+  alice := l.User("alice")
+  if alice == nil {
+    t.Fatalf("expected alice, got nil")
+  }
+  if got, want := alice.PermissionsString(), "edit login read"; got != want {
+    t.Errorf("alice permissions: got %q, want %q", got, want)
+  }
+  if got, want := alice.Saltword(), ""; got != want {
+    t.Errorf("alice saltword: got %q, want %q", got, want)
+  }
+  if l.User("nobody") != nil {
+    t.Errorf("expected nil for unknown user")
+  }
+  if got, want := l.UserCount(), 4; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+  if err := l.SetSaltwordContext(context.Background(), "alice", "cw"); err == nil {
+    t.Errorf("expected error setting saltword in LDAP")
+  }
+}
+
+func TestLDAPErrors(t *testing.T) {
+  f := newFakeLDAP(t)
+  l := newTestLDAP(t, f)
+  l.config.BindPassword = "wrong"
+  if _, err := l.UserContext(context.Background(), "alice"); err == nil {
+    t.Errorf("expected error with wrong search password")
+  }
+
+  // A request whose deadline has passed is not sent.
+  ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+  defer cancel()
+  if _, err := newTestLDAP(t, f).UserCountContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+    t.Errorf("UserCountContext after deadline: got %v, want %v", err, context.DeadlineExceeded)
+  }
+
+  // A server that is down is an error, not a missing user.
+  f.close()
+  l = newTestLDAP(t, f)
+  if _, err := l.UserContext(context.Background(), "alice"); err == nil {
+    t.Errorf("expected error from UserContext with server down")
+  }
+  if _, err := l.Authenticate(context.Background(), "alice", "alicepw"); err == nil {
+    t.Errorf("expected error from Authenticate with server down")
+  }
+
+  if _, err := NewLDAP(&LDAPConfig{URL: f.url()}); err == nil {
+    t.Errorf("expected error for incomplete configuration")
+  }
+  _, err := NewLDAP(&LDAPConfig{
+    URL: f.url(),
+    BaseDN: "dc=example,dc=com",
+    UserFilter: "(uid=%s)",
+    Groups: map[string]string{"not a dn": "read"},
+  })
+  if err == nil {
+    t.Errorf("expected error for invalid group DN")
+  }
+}
@@ -0,0 +1,140 @@
+package store
+
+import (
+  "database/sql"
+  "fmt"
+  "time"
+
+  "github.com/golang/glog"
+)
+
+// SchemaVersionTable is the table in which Migrate records the
+// migrations that have been applied to a database. Use MigrateTable to
+// keep the versions of several sets of tables in one database apart.
+const SchemaVersionTable = "schema_version"
+
+// A Migration is one step in the evolution of a database schema.
+// Migrations are applied in order of Version, each in its own
+// transaction, and each is applied only once. MySQL commits each
+// statement that changes the schema, so there a migration is not undone
+// when it fails; see Migrate.
+type Migration struct {
+  Version int
+  Description string
+  Up func(tx *sql.Tx) error
+}
+
+// execMigration returns a Migration function that executes the statements.
+func execMigration(statements ...string) func(tx *sql.Tx) error {
+  return func(tx *sql.Tx) error {
+    for _, stmt := range statements {
+      if _, err := tx.Exec(stmt); err != nil {
+        return err
+      }
+    }
+    return nil
+  }
+}
+
+// SchemaVersion returns the version of the most recent migration applied
+// to db, or 0 if none has been applied.
+func SchemaVersion(db *sql.DB) (int, error) {
+  return schemaVersion(db, SchemaVersionTable)
+}
+
+// TableSchemaVersion is like SchemaVersion, for the migrations recorded
+// in versionTable by MigrateTable.
+func TableSchemaVersion(db *sql.DB, d Dialect, versionTable string) (int, error) {
+  return schemaVersion(db, d.Quote(versionTable))
+}
+
+// schemaVersion returns the version recorded in the table, whose name
+// is already quoted.
+func schemaVersion(db *sql.DB, table string) (int, error) {
+  if err := createSchemaVersionTable(db, table); err != nil {
+    return 0, err
+  }
+  var version int
+  query := "SELECT COALESCE(MAX(version), 0) FROM " + table + ";"
+  if err := db.QueryRow(query).Scan(&version); err != nil {
+    return 0, fmt.Errorf("error reading schema version: %v", err)
+  }
+  return version, nil
+}
+
+func createSchemaVersionTable(db *sql.DB, table string) error {
+  query := "CREATE TABLE IF NOT EXISTS " + table +
+      "(version integer, description varchar(255), applied varchar(64), primary key(version));"
+  if _, err := db.Exec(query); err != nil {
+    return fmt.Errorf("error creating schema version table: %v", err)
+  }
+  return nil
+}
+
+// Migrate applies to db, using dialect d, in order, each of the migrations with a version
+// greater than the current schema version, and records it in the schema
+// version table. It is safe to call every time the program starts.
+// It returns the number of migrations applied.
+// On MySQL, statements such as CREATE TABLE and ALTER TABLE commit
+// implicitly, so a migration that fails part way can leave a partial
+// schema that is not recorded as migrated. It must be repaired by hand
+// before Migrate is run again.
+func Migrate(db *sql.DB, d Dialect, migrations []*Migration) (int, error) {
+  return migrate(db, d, SchemaVersionTable, migrations)
+}
+
+// MigrateTable is like Migrate, but records the migrations in
+// versionTable rather than SchemaVersionTable, so that several sets of
+// tables, such as user tables with different names, can be migrated
+// separately in one database.
+func MigrateTable(db *sql.DB, d Dialect, versionTable string, migrations []*Migration) (int, error) {
+  return migrate(db, d, d.Quote(versionTable), migrations)
+}
+
+// migrate applies the migrations, recording them in the table, whose
+// name is already quoted.
+func migrate(db *sql.DB, d Dialect, table string, migrations []*Migration) (int, error) {
+  previous := 0
+  for _, m := range migrations {
+    if m.Version <= previous {
+      return 0, fmt.Errorf("migration versions must be positive and increasing, got %d after %d", m.Version, previous)
+    }
+    previous = m.Version
+  }
+  current, err := schemaVersion(db, table)
+  if err != nil {
+    return 0, err
+  }
+  applied := 0
+  for _, m := range migrations {
+    if m.Version <= current {
+      continue
+    }
+    if err := applyMigration(db, d, table, m); err != nil {
+      return applied, fmt.Errorf("error applying migration %d (%s): %v", m.Version, m.Description, err)
+    }
+    glog.Infof("Applied schema migration %d: %s", m.Version, m.Description)
+    applied++
+  }
+  return applied, nil
+}
+
+func applyMigration(db *sql.DB, d Dialect, table string, m *Migration) error {
+  tx, err := db.Begin()
+  if err != nil {
+    return err
+  }
+  if err := m.Up(tx); err != nil {
+    tx.Rollback()
+    return err
+  }
+  // If another process applied this migration at the same time, this
+  // insert fails on the primary key and our changes are rolled back.
+  query := "INSERT INTO " + table + "(version, description, applied) VALUES(" +
+      d.Placeholder(1) + ", " + d.Placeholder(2) + ", " + d.Placeholder(3) + ");"
+  if _, err := tx.Exec(query, m.Version, m.Description, time.Now().UTC().Format(time.RFC3339)); err != nil {
+    tx.Rollback()
+    return err
+  }
+  return tx.Commit()
+}
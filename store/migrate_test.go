@@ -0,0 +1,202 @@
+package store
+
+import (
+  "database/sql"
+  "errors"
+  "os"
+  "strings"
+  "testing"
+
+  _ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T, dbloc string) *sql.DB {
+  t.Helper()
+  os.Remove(dbloc)
+  db, err := sql.Open("sqlite3", dbloc)
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  return db
+}
+
+func TestMigrateEmpty(t *testing.T) {
+  dbloc := "/tmp/migrate-empty.db"
+  db := openTestDB(t, dbloc)
+  defer os.Remove(dbloc)
+  defer db.Close()
+
+  pdb := NewPwDB(db)
+  migrations := pdb.queries().migrations()
+  n, err := pdb.Migrate()
+  if err != nil {
+    t.Fatalf("error migrating empty database: %v", err)
+  }
+  if got, want := n, len(migrations); got != want {
+    t.Errorf("migrations applied to empty database: got %d, want %d", got, want)
+  }
+  version, err := SchemaVersion(db)
+  if err != nil {
+    t.Fatalf("error reading schema version: %v", err)
+  }
+  if got, want := version, migrations[len(migrations)-1].Version; got != want {
+    t.Errorf("schema version: got %d, want %d", got, want)
+  }
+
+  n, err = pdb.Migrate()
+  if err != nil {
+    t.Fatalf("error migrating up-to-date database: %v", err)
+  }
+  if got, want := n, 0; got != want {
+    t.Errorf("migrations applied to up-to-date database: got %d, want %d", got, want)
+  }
+}
+
+func TestMigrateExistingTable(t *testing.T) {
+  dbloc := "/tmp/migrate-existing.db"
+  db := openTestDB(t, dbloc)
+  defer os.Remove(dbloc)
+  defer db.Close()
+
+  // The table as created before we had migrations.
+  if _, err := db.Exec("CREATE TABLE user(id string, cryptword string, permissions string, primary key(id));"); err != nil {
+    t.Fatalf("error creating old user table: %v", err)
+  }
+  if _, err := db.Exec(`INSERT INTO user(id, cryptword, permissions) VALUES("user1", "cw1", "edit");`); err != nil {
+    t.Fatalf("error inserting user: %v", err)
+  }
+
+  pdb := NewPwDB(db)
+  pdb.SetAutoMigrate(false)
+  if err := pdb.Load(); err == nil || !strings.Contains(err.Error(), "run Migrate") {
+    t.Errorf("loading old schema without auto-migrate: got %v, want error to run Migrate", err)
+  }
+  pdb.SetAutoMigrate(true)
+  if err := pdb.Load(); err != nil {
+    t.Fatalf("error loading with auto-migrate: %v", err)
+  }
+  u := pdb.User("user1")
+  if u == nil {
+    t.Fatalf("user1 not found after migration")
+  }
+  if got, want := u.Saltword(), "cw1"; got != want {
+    t.Errorf("user1 saltword after migration: got %q, want %q", got, want)
+  }
+  if got, want := u.Permissions().ToString(), "edit"; got != want {
+    t.Errorf("user1 permissions after migration: got %q, want %q", got, want)
+  }
+
+  if err := pdb.SetMetadata("user1", "email", "user1@example.com"); err != nil {
+    t.Fatalf("error setting metadata: %v", err)
+  }
+  if got, want := pdb.User("user1").Metadata("email"), "user1@example.com"; got != want {
+    t.Errorf("user1 email: got %q, want %q", got, want)
+  }
+  uu, err := pdb.ListUsers(0, 0)
+  if err != nil {
+    t.Fatalf("error listing users: %v", err)
+  }
+  if got, want := uu[0].Metadata("email"), "user1@example.com"; got != want {
+    t.Errorf("listed user1 email: got %q, want %q", got, want)
+  }
+  if err := pdb.SetMetadata("user1", "email", ""); err != nil {
+    t.Fatalf("error clearing metadata: %v", err)
+  }
+  if got, want := len(pdb.User("user1").MetadataKeys()), 0; got != want {
+    t.Errorf("user1 metadata count after clearing: got %d, want %d", got, want)
+  }
+  if err := pdb.SetMetadata("nobody", "email", "x"); err == nil {
+    t.Errorf("expected error setting metadata for unknown user")
+  }
+}
+
+func TestMigrateOrder(t *testing.T) {
+  dbloc := "/tmp/migrate-order.db"
+  db := openTestDB(t, dbloc)
+  defer os.Remove(dbloc)
+  defer db.Close()
+
+  migrations := []*Migration{
+    {Version: 2, Description: "two", Up: execMigration()},
+    {Version: 1, Description: "one", Up: execMigration()},
+  }
+  _, err := Migrate(db, SQLite, migrations)
+  if err == nil {
+    t.Fatalf("expected error for out-of-order migrations")
+  }
+  if got, want := err.Error(), "increasing"; !strings.Contains(got, want) {
+    t.Errorf("out-of-order error: got %q, want it to contain %q", got, want)
+  }
+}
+
+func TestMigrateRollback(t *testing.T) {
+  dbloc := "/tmp/migrate-rollback.db"
+  db := openTestDB(t, dbloc)
+  defer os.Remove(dbloc)
+  defer db.Close()
+
+  migrations := []*Migration{
+    {Version: 1, Description: "create", Up: execMigration("CREATE TABLE thing(id string);")},
+    {Version: 2, Description: "fail", Up: func(tx *sql.Tx) error {
+      if _, err := tx.Exec("INSERT INTO thing(id) VALUES('a');"); err != nil {
+        return err
+      }
+      return errors.New("failed on purpose")
+    }},
+  }
+  n, err := Migrate(db, SQLite, migrations)
+  if err == nil {
+    t.Fatalf("expected error from failing migration")
+  }
+  if got, want := n, 1; got != want {
+    t.Errorf("migrations applied before failure: got %d, want %d", got, want)
+  }
+  version, err := SchemaVersion(db)
+  if err != nil {
+    t.Fatalf("error reading schema version: %v", err)
+  }
+  if got, want := version, 1; got != want {
+    t.Errorf("schema version after failure: got %d, want %d", got, want)
+  }
+  var count int
+  if err := db.QueryRow("SELECT count(*) FROM thing;").Scan(&count); err != nil {
+    t.Fatalf("error counting rows: %v", err)
+  }
+  if got, want := count, 0; got != want {
+    t.Errorf("rows left by failed migration: got %d, want %d", got, want)
+  }
+}
+
+// Each user table in a database has its own schema version.
+func TestMigrateTwoTables(t *testing.T) {
+  dbloc := "/tmp/migrate-two-tables.db"
+  db := openTestDB(t, dbloc)
+  defer os.Remove(dbloc)
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.Load(); err != nil {
+    t.Fatalf("error loading default table: %v", err)
+  }
+  customers := NewPwDB(db)
+  customers.SetTable("customers")
+  if err := customers.Load(); err != nil {
+    t.Fatalf("error loading customers table: %v", err)
+  }
+  pdb.SetSaltword("user1", "cw1")
+  customers.SetSaltword("customer1", "cw2")
+  if got, want := pdb.UserCount(), 1; got != want {
+    t.Errorf("users in default table: got %d, want %d", got, want)
+  }
+  if got, want := customers.UserCount(), 1; got != want {
+    t.Errorf("users in customers table: got %d, want %d", got, want)
+  }
+  for _, table := range []string{SchemaVersionTable, SchemaVersionTable + "_customers"} {
+    version, err := TableSchemaVersion(db, SQLite, table)
+    if err != nil {
+      t.Fatalf("error reading schema version from %s: %v", table, err)
+    }
+    if got, want := version, 2; got != want {
+      t.Errorf("schema version in %s: got %d, want %d", table, got, want)
+    }
+  }
+}
@@ -1,7 +1,11 @@
 package store
 
 import (
+  "context"
   "database/sql"
+  "encoding/json"
+  "fmt"
+  "sync"
 
   "github.com/golang/glog"
 
@@ -10,78 +14,581 @@ import (
 )
 
 // PwDB implements the Store interface to load and store data in an SQL database.
-// Data is stored in a table called "user" with three string columns,
-// id, cryptword, and permissions,
-// where the permissions value is a comma-separated list of permission names.
+// Data is stored in a table called "user", or as set by SetTable, with string columns
+// id, cryptword, permissions and metadata,
+// where the permissions value is a comma-separated list of permission names
+// and metadata is a JSON object of string values.
+// The schema is created and updated by Migrate, which Load calls
+// unless SetAutoMigrate(false) is called.
+// PwDB implements ContextStore, which reports database errors that
+// the Store methods can only log.
+// SQL is written for SQLite unless another dialect is set by SetDialect.
+// If a role table is set, roles are loaded from that table, which has
+// two string columns, id and permissions, and users may be granted a role
+// with a permission of the form @rolename.
+// If encryption is set by SetEncryption, the cryptword and metadata
+// values are encrypted in the database.
+// If a username policy is set by SetUsernamePolicy, usernames are
+// canonicalized before they are used in queries.
 type PwDB struct {
     db *sql.DB
+    dialect Dialect
+    table string        // The name of our user table.
+    roleTable string    // The name of our role table, or empty if not using roles.
+    roles *permissions.Roles
+    validation Validation
+    encryption *Encryption  // Encrypts cryptwords and metadata, or nil.
+    autoMigrate bool    // True to run Migrate in Load.
+    mu sync.Mutex       // Protects the fields below.
+    usernamePolicy *users.UsernamePolicy
+    migrated bool       // True once Load has run Migrate.
+    usernamesChecked bool   // True once Load has checked the ids against usernamePolicy.
 }
 
 func NewPwDB(db *sql.DB) *PwDB {
   return &PwDB{
     db: db,
+    dialect: SQLite,
+    table: DefaultUserTable,
+    autoMigrate: true,
   }
 }
 
+// SetDialect sets the dialect of SQL to use for our database.
+func (pdb *PwDB) SetDialect(d Dialect) {
+  pdb.dialect = d
+}
+
+// SetTable sets the name of our user table.
+func (pdb *PwDB) SetTable(table string) {
+  pdb.table = table
+}
+
+func (pdb *PwDB) queries() pwdbQueries {
+  return pwdbQueries{
+    d: pdb.dialect,
+    table: pdb.table,
+    roleTable: pdb.roleTable,
+  }
+}
+
+// CreatePasswordTable creates the user table, or brings an existing
+// one up to date, by calling Migrate.
 func (pdb *PwDB) CreatePasswordTable() error {
-  query := "CREATE TABLE user(id string, cryptword string, permissions string, primary key(id));"
-  _, err := pdb.db.Exec(query)
+  _, err := pdb.Migrate()
+  return err
+}
+
+// Migrate applies any of our schema migrations that have not yet been
+// applied to the database, and returns the number applied.
+func (pdb *PwDB) Migrate() (int, error) {
+  q := pdb.queries()
+  return MigrateTable(pdb.db, q.d, q.versionTable(), q.migrations())
+}
+
+// SetAutoMigrate sets whether the first successful Load calls Migrate,
+// so that the schema is updated when the program starts. It is on by
+// default. When it is off, Load returns an error if the schema is not up
+// to date, rather than letting every query fail.
+func (pdb *PwDB) SetAutoMigrate(auto bool) {
+  pdb.autoMigrate = auto
+}
+
+// checkSchemaVersion returns an error if any of our migrations has not
+// been applied to the database.
+func (pdb *PwDB) checkSchemaVersion() error {
+  q := pdb.queries()
+  migrations := q.migrations()
+  want := migrations[len(migrations)-1].Version
+  version, err := TableSchemaVersion(pdb.db, q.d, q.versionTable())
+  if err != nil {
+    return err
+  }
+  if version < want {
+    return fmt.Errorf("user table schema is version %d, not %d: run Migrate to update it", version, want)
+  }
+  return nil
+}
+
+// SetEncryption sets the encryption for the cryptword and metadata
+// values. Load fails if any of them can't be decrypted, such as when the
+// key is wrong. Call Reencrypt after changing the key.
+func (pdb *PwDB) SetEncryption(e *Encryption) {
+  pdb.encryption = e
+}
+
+// SetUsernamePolicy sets the policy for usernames. Since the ids in
+// the user table are not changed, the next Load checks them, and fails
+// if any of them is not in canonical form; use CanonicalizeUsernames
+// before setting the policy to fix them. Once the check has passed,
+// later Loads don't repeat it, since that reads the whole table; call
+// CheckUsernames to check again after changing the table directly.
+func (pdb *PwDB) SetUsernamePolicy(p *users.UsernamePolicy) {
+  pdb.mu.Lock()
+  defer pdb.mu.Unlock()
+  pdb.usernamePolicy = p
+  pdb.usernamesChecked = false
+}
+
+// UsernamePolicy returns the policy set by SetUsernamePolicy, or nil.
+func (pdb *PwDB) UsernamePolicy() *users.UsernamePolicy {
+  pdb.mu.Lock()
+  defer pdb.mu.Unlock()
+  return pdb.usernamePolicy
+}
+
+// SetRoleTable sets the name of the table from which Load reads roles.
+func (pdb *PwDB) SetRoleTable(table string) {
+  pdb.roleTable = table
+}
+
+// CreateRoleTable creates the role table set by SetRoleTable.
+func (pdb *PwDB) CreateRoleTable() error {
+  if pdb.roleTable == "" {
+    return fmt.Errorf("no role table has been set")
+  }
+  _, err := pdb.db.Exec(pdb.queries().createRoleTable())
   return err
 }
 
-// Load does nothing when we are using a database.
-func (pdb *PwDB) Load() (*users.Users, error) {
-  return nil, nil
+// SetRole adds or replaces a role in the role table. Call Load to
+// use the updated roles.
+func (pdb *PwDB) SetRole(name string, perms *permissions.Permissions) error {
+  if pdb.roleTable == "" {
+    return fmt.Errorf("no role table has been set")
+  }
+  _, err := pdb.db.Exec(pdb.queries().upsertRole(), name, perms.ToString())
+  if err != nil {
+    return fmt.Errorf("error setting role %q: %v", name, err)
+  }
+  return nil
+}
+
+// SetValidation sets how Load and SetPermissions treat permissions
+// that are not in the permissions catalog.
+func (pdb *PwDB) SetValidation(mode Validation) {
+  pdb.validation = mode
+}
+
+// Load updates the schema the first time it is called if SetAutoMigrate
+// is on, or checks that it is up to date if not, and reads our
+// roles if we have a role table. User data is read from
+// the database as needed, so Load only reads it to check permissions
+// when validation is enabled, to check that it can be decrypted
+// when encryption is set, and to check the usernames the first time
+// after a username policy is set.
+func (pdb *PwDB) Load() error {
+  return pdb.LoadContext(context.Background())
+}
+
+// LoadContext is like Load, using ctx for the queries.
+func (pdb *PwDB) LoadContext(ctx context.Context) error {
+  if err := pdb.loadSchema(); err != nil {
+    return err
+  }
+  if pdb.roleTable != "" {
+    if err := pdb.loadRoles(ctx); err != nil {
+      return err
+    }
+  }
+  if err := pdb.loadUsernameCheck(); err != nil {
+    return err
+  }
+  if pdb.validation == ValidateNone && pdb.encryption == nil {
+    return nil
+  }
+  uu, err := pdb.ListUsers(0, 0)
+  if err != nil {
+    return err
+  }
+  for _, u := range uu {
+    if err := validatePermissions(pdb.validation, fmt.Sprintf("user %q", u.Id()), u.Permissions()); err != nil {
+      return fmt.Errorf("error in user table: %v", err)
+    }
+  }
+  return nil
+}
+
+// loadSchema runs Migrate if it has not yet run and SetAutoMigrate is
+// on, or checks the schema version if it is off.
+func (pdb *PwDB) loadSchema() error {
+  if !pdb.autoMigrate {
+    return pdb.checkSchemaVersion()
+  }
+  pdb.mu.Lock()
+  defer pdb.mu.Unlock()
+  if pdb.migrated {
+    return nil
+  }
+  if _, err := pdb.Migrate(); err != nil {
+    return err
+  }
+  pdb.migrated = true
+  return nil
+}
+
+// loadUsernameCheck checks that the ids in the user table fit the
+// username policy, if it has not been checked since it was set.
+func (pdb *PwDB) loadUsernameCheck() error {
+  pdb.mu.Lock()
+  p, checked := pdb.usernamePolicy, pdb.usernamesChecked
+  pdb.mu.Unlock()
+  if p == nil || checked {
+    return nil
+  }
+  report, err := CheckUsernames(pdb, p)
+  if err != nil {
+    return err
+  }
+  if err := report.Err(); err != nil {
+    return fmt.Errorf("error in user table: %w", err)
+  }
+  pdb.mu.Lock()
+  if pdb.usernamePolicy == p {
+    pdb.usernamesChecked = true
+  }
+  pdb.mu.Unlock()
+  return nil
+}
+
+// canonical returns the canonical form of username under our policy.
+func (pdb *PwDB) canonical(username string) string {
+  return pdb.UsernamePolicy().Canonical(username)
+}
+
+func (pdb *PwDB) loadRoles(ctx context.Context) error {
+  rows, err := pdb.db.QueryContext(ctx, pdb.queries().selectRoles())
+  if err != nil {
+    return fmt.Errorf("error loading roles: %v", err)
+  }
+  defer rows.Close()
+  roles := permissions.NewRoles()
+  for rows.Next() {
+    var id, perms string
+    if err := rows.Scan(&id, &perms); err != nil {
+      return fmt.Errorf("error scanning role row: %v", err)
+    }
+    roles.SetRole(id, permissions.FromString(perms))
+  }
+  if err := rows.Err(); err != nil {
+    return fmt.Errorf("error loading roles: %v", err)
+  }
+  if err := roles.Check(); err != nil {
+    return fmt.Errorf("error in role table: %v", err)
+  }
+  if err := validateRoles(pdb.validation, roles); err != nil {
+    return fmt.Errorf("error in role table: %v", err)
+  }
+  pdb.roles = roles
+  return nil
 }
 
 // Save does nothing when we are using a database.
-func (pdb *PwDB) Save(_ *users.Users) error {
+func (pdb *PwDB) Save() error {
+  return nil
+}
+
+// SaveContext does nothing when we are using a database.
+func (pdb *PwDB) SaveContext(ctx context.Context) error {
   return nil
 }
 
 func (pdb *PwDB) User(username string) *users.User {
-  query := "SELECT cryptword, permissions FROM user WHERE id = :id"
+  user, err := pdb.UserContext(context.Background(), username)
+  if err != nil {
+    glog.Errorf("%v\n", err)
+    return nil
+  }
+  return user
+}
+
+// UserContext returns the user, or nil if there is no such user.
+func (pdb *PwDB) UserContext(ctx context.Context, username string) (*users.User, error) {
+  username = pdb.canonical(username)
   var cryptword string
   var perms string
-  err := pdb.db.QueryRow(query,sql.Named("id", username)).Scan(&cryptword, &perms)
+  var metadata string
+  err := pdb.db.QueryRowContext(ctx, pdb.queries().selectUser(), username).Scan(&cryptword, &perms, &metadata)
   if err == sql.ErrNoRows {
-    return nil          // No matching username found
+    return nil, nil          // No matching username found
   }
   if err != nil {
-    glog.Errorf("Error scanning for user %q: %v\n", username, err)
-    return nil
+    return nil, fmt.Errorf("error scanning for user %q: %v", username, err)
   }
-  user := users.NewUser(username, cryptword, permissions.FromString(perms))
-  return user
+  return pdb.newUser(username, cryptword, perms, metadata)
 }
 
 func (pdb *PwDB) SetSaltword(username, cryptword string) {
+  if err := pdb.SetSaltwordContext(context.Background(), username, cryptword); err != nil {
+    glog.Errorf("%v\n", err)
+  }
+}
+
+// SetSaltwordContext sets the cryptword for a user, adding the user
+// with no permissions if needed.
+func (pdb *PwDB) SetSaltwordContext(ctx context.Context, username, cryptword string) error {
+  username = pdb.canonical(username)
   if username == "" {
-    glog.Errorf("Can't SetSaltword with no username\n")
-    return
+    return fmt.Errorf("can't SetSaltword with no username")
   }
-  // Assume row does not exist, try to insert it.
-  iQuery := `INSERT into user(id,cryptword,permissions) values(:id, :cw, "");`
-  _, err := pdb.db.Exec(iQuery,sql.Named("cw", cryptword),sql.Named("id", username))
-  if err == nil {
-    return      // Succeeded
+  cryptword, err := encryptValue(pdb.encryption, cryptword)
+  if err != nil {
+    return fmt.Errorf("error encrypting cryptword for user %q: %v", username, err)
   }
-  glog.Infof("INSERT returned err=%v\n", err)   // Expected if the user already exists.
-  // If the INSERT failed, assume it was because the row already exists, so try updating it.
-  query := "UPDATE user SET cryptword = :cw WHERE id = :id;"
-  _, err = pdb.db.Exec(query,sql.Named("cw", cryptword),sql.Named("id", username))
+  _, err = pdb.db.ExecContext(ctx, pdb.queries().upsertSaltword(), username, cryptword, "")
   if err != nil {
-    glog.Errorf("Error setting cryptword for user %q: %v\n", username, err)
+    return fmt.Errorf("error setting cryptword for user %q: %v", username, err)
   }
+  return nil
 }
 
 func (pdb *PwDB) UserCount() int {
-  var count int
-  sql := "SELECT count(*) from user;"
-  err := pdb.db.QueryRow(sql).Scan(&count)
+  count, err := pdb.UserCountContext(context.Background())
   if err != nil {
-    glog.Errorf("Error counting user in database: %v\n", err)
+    glog.Errorf("%v\n", err)
     return 0
   }
   return count
 }
+
+func (pdb *PwDB) UserCountContext(ctx context.Context) (int, error) {
+  var count int
+  err := pdb.db.QueryRowContext(ctx, pdb.queries().countUsers()).Scan(&count)
+  if err != nil {
+    return 0, fmt.Errorf("error counting users in database: %v", err)
+  }
+  return count, nil
+}
+
+func (pdb *PwDB) ListUsers(offset, limit int) ([]*users.User, error) {
+  if offset < 0 {
+    offset = 0
+  }
+  rows, err := pdb.db.Query(pdb.queries().listUsers(limit, offset))
+  if err != nil {
+    return nil, fmt.Errorf("error listing users: %v", err)
+  }
+  defer rows.Close()
+  uu := make([]*users.User, 0)
+  for rows.Next() {
+    var id, cryptword, perms, metadata string
+    if err := rows.Scan(&id, &cryptword, &perms, &metadata); err != nil {
+      return nil, fmt.Errorf("error scanning user row: %v", err)
+    }
+    u, err := pdb.newUser(id, cryptword, perms, metadata)
+    if err != nil {
+      return nil, err
+    }
+    uu = append(uu, u)
+  }
+  if err := rows.Err(); err != nil {
+    return nil, fmt.Errorf("error listing users: %v", err)
+  }
+  return uu, nil
+}
+
+func (pdb *PwDB) DeleteUser(username string) error {
+  username = pdb.canonical(username)
+  result, err := pdb.db.Exec(pdb.queries().deleteUser(), username)
+  if err != nil {
+    return fmt.Errorf("error deleting user %q: %v", username, err)
+  }
+  return pdb.requireOneRow(result, username)
+}
+
+func (pdb *PwDB) RenameUser(oldname, newname string) error {
+  oldname, newname = pdb.canonical(oldname), pdb.canonical(newname)
+  ctx := context.Background()
+  if oldname == newname {
+    u, err := pdb.UserContext(ctx, oldname)
+    if err != nil {
+      return err
+    }
+    if u == nil {
+      return fmt.Errorf("can't rename %q: %w", oldname, users.ErrNoSuchUser)
+    }
+    return nil
+  }
+  u, err := pdb.UserContext(ctx, newname)
+  if err != nil {
+    return err
+  }
+  if u != nil {
+    return fmt.Errorf("can't rename %q to %q: %w", oldname, newname, users.ErrUserExists)
+  }
+  result, err := pdb.db.Exec(pdb.queries().renameUser(), newname, oldname)
+  if err != nil {
+    return fmt.Errorf("error renaming user %q to %q: %v", oldname, newname, err)
+  }
+  return pdb.requireOneRow(result, oldname)
+}
+
+func (pdb *PwDB) SetPermissions(username string, perms *permissions.Permissions) error {
+  username = pdb.canonical(username)
+  if err := validatePermissions(pdb.validation, fmt.Sprintf("user %q", username), perms); err != nil {
+    return err
+  }
+  result, err := pdb.db.Exec(pdb.queries().setPermissions(), perms.ToString(), username)
+  if err != nil {
+    return fmt.Errorf("error setting permissions for user %q: %v", username, err)
+  }
+  return pdb.requireOneRow(result, username)
+}
+
+// SetMetadata sets a metadata value for a user, or removes it if
+// value is empty.
+func (pdb *PwDB) SetMetadata(username, key, value string) error {
+  username = pdb.canonical(username)
+  u, err := pdb.UserContext(context.Background(), username)
+  if err != nil {
+    return err
+  }
+  if u == nil {
+    return fmt.Errorf("user %q: %w", username, users.ErrNoSuchUser)
+  }
+  u.SetMetadata(key, value)
+  metadata, err := encodeMetadata(u)
+  if err != nil {
+    return fmt.Errorf("error encoding metadata for user %q: %v", username, err)
+  }
+  metadata, err = encryptValue(pdb.encryption, metadata)
+  if err != nil {
+    return fmt.Errorf("error encrypting metadata for user %q: %v", username, err)
+  }
+  result, err := pdb.db.Exec(pdb.queries().setMetadata(), metadata, username)
+  if err != nil {
+    return fmt.Errorf("error setting metadata for user %q: %v", username, err)
+  }
+  return pdb.requireOneRow(result, username)
+}
+
+// Reencrypt encrypts all of the cryptword and metadata values that are
+// not encrypted with the current key, and returns the number of users
+// that were updated. It is done in one transaction, so that an error
+// leaves the database unchanged.
+func (pdb *PwDB) Reencrypt() (int, error) {
+  if pdb.encryption == nil {
+    return 0, fmt.Errorf("no encryption has been set")
+  }
+  tx, err := pdb.db.Begin()
+  if err != nil {
+    return 0, fmt.Errorf("error starting re-encryption: %v", err)
+  }
+  defer tx.Rollback()
+  q := pdb.queries()
+  rows, err := tx.Query(q.listUsers(0, 0))
+  if err != nil {
+    return 0, fmt.Errorf("error listing users: %v", err)
+  }
+  type row struct {
+    id, cryptword, metadata string
+  }
+  var stale []*row
+  for rows.Next() {
+    var id, cryptword, perms, metadata string
+    if err := rows.Scan(&id, &cryptword, &perms, &metadata); err != nil {
+      rows.Close()
+      return 0, fmt.Errorf("error scanning user row: %v", err)
+    }
+    if !pdb.encryption.IsCurrent(cryptword) || !pdb.encryption.IsCurrent(metadata) {
+      stale = append(stale, &row{id, cryptword, metadata})
+    }
+  }
+  rows.Close()
+  if err := rows.Err(); err != nil {
+    return 0, fmt.Errorf("error listing users: %v", err)
+  }
+  for _, r := range stale {
+    cryptword, err := pdb.reencryptValue(r.cryptword)
+    if err != nil {
+      return 0, fmt.Errorf("cryptword for user %q: %v", r.id, err)
+    }
+    metadata, err := pdb.reencryptValue(r.metadata)
+    if err != nil {
+      return 0, fmt.Errorf("metadata for user %q: %v", r.id, err)
+    }
+    if _, err := tx.Exec(q.setSecrets(), cryptword, metadata, r.id); err != nil {
+      return 0, fmt.Errorf("error re-encrypting user %q: %v", r.id, err)
+    }
+  }
+  if err := tx.Commit(); err != nil {
+    return 0, fmt.Errorf("error committing re-encryption: %v", err)
+  }
+  return len(stale), nil
+}
+
+func (pdb *PwDB) reencryptValue(value string) (string, error) {
+  if pdb.encryption.IsCurrent(value) {
+    return value, nil
+  }
+  plain, err := pdb.encryption.Decrypt(value)
+  if err != nil {
+    return "", err
+  }
+  return pdb.encryption.Encrypt(plain)
+}
+
+// newUser creates a user from the values in a row of our user table.
+func (pdb *PwDB) newUser(username, cryptword, perms, metadata string) (*users.User, error) {
+  cryptword, err := decryptValue(pdb.encryption, cryptword)
+  if err != nil {
+    return nil, fmt.Errorf("cryptword for user %q: %w", username, err)
+  }
+  metadata, err = decryptValue(pdb.encryption, metadata)
+  if err != nil {
+    return nil, fmt.Errorf("metadata for user %q: %w", username, err)
+  }
+  p := permissions.FromString(perms)
+  p.SetRoles(pdb.roles)
+  u := users.NewUser(username, cryptword, p)
+  if metadata != "" {
+    var m map[string]string
+    if err := json.Unmarshal([]byte(metadata), &m); err != nil {
+      return nil, fmt.Errorf("error decoding metadata for user %q: %v", username, err)
+    }
+    for k, v := range m {
+      u.SetMetadata(k, v)
+    }
+  }
+  return u, nil
+}
+
+// encodeMetadata returns the metadata of u as stored in our user table.
+func encodeMetadata(u *users.User) (string, error) {
+  keys := u.MetadataKeys()
+  if len(keys) == 0 {
+    return "", nil
+  }
+  m := make(map[string]string)
+  for _, k := range keys {
+    m[k] = u.Metadata(k)
+  }
+  b, err := json.Marshal(m)
+  if err != nil {
+    return "", err
+  }
+  return string(b), nil
+}
+
+// requireOneRow returns an ErrNoSuchUser error if the statement that
+// produced result did not touch any rows and the user does not exist.
+// MySQL counts only the rows that an UPDATE changed, so setting a value
+// to what it already was affects no rows.
+func (pdb *PwDB) requireOneRow(result sql.Result, username string) error {
+  n, err := result.RowsAffected()
+  if err != nil {
+    return fmt.Errorf("error checking rows affected for user %q: %v", username, err)
+  }
+  if n > 0 {
+    return nil
+  }
+  var cryptword, perms, metadata string
+  err = pdb.db.QueryRow(pdb.queries().selectUser(), username).Scan(&cryptword, &perms, &metadata)
+  if err == sql.ErrNoRows {
+    return fmt.Errorf("user %q: %w", username, users.ErrNoSuchUser)
+  }
+  if err != nil {
+    return fmt.Errorf("error checking for user %q: %v", username, err)
+  }
+  return nil
+}
@@ -1,13 +1,15 @@
 package store
 
 import (
+  "context"
   "database/sql"
+  "errors"
   "os"
   "testing"
 
   _ "github.com/mattn/go-sqlite3"
 
-  //"github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/permissions"
   "github.com/jimmc/auth/users"
 )
 
@@ -23,12 +25,12 @@ func TestCreatePasswordTable(t *testing.T) {
     t.Fatalf("error opening sql database: %v", err)
   }
   pdb := NewPwDB(db)
-  uu, _ := pdb.Load()    // No-op, just for coverage.
+  pdb.Load()    // No-op, just for coverage.
   err = pdb.CreatePasswordTable()
   if err != nil {
     t.Fatalf("error creating password table: %v", err)
   }
-  pdb.Save(uu)    // No-op, just for coverage.
+  pdb.Save()    // No-op, just for coverage.
 }
 
 func TestDbUpdateUser(t *testing.T) {
@@ -74,3 +76,202 @@ func TestDbUpdateUser(t *testing.T) {
     t.Errorf("user1 Saltword after being updated: got %v, want %v", got, want)
   }
 }
+
+func TestPwDBAdminStore(t *testing.T) {
+  db, err := sql.Open("sqlite3", t.TempDir() + "/admin.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  testAdminStore(t, pdb)
+}
+
+// unchangedResult is the result of a MySQL UPDATE that set values to
+// what they already were.
+type unchangedResult struct{}
+
+func (unchangedResult) LastInsertId() (int64, error) { return 0, nil }
+func (unchangedResult) RowsAffected() (int64, error) { return 0, nil }
+
+func TestPwDBUnchangedRows(t *testing.T) {
+  db, err := sql.Open("sqlite3", t.TempDir() + "/unchanged.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  pdb.SetSaltword("user1", "cw1")
+  if err := pdb.requireOneRow(unchangedResult{}, "user1"); err != nil {
+    t.Errorf("unchanged row for existing user: %v", err)
+  }
+  if err := pdb.requireOneRow(unchangedResult{}, "user2"); !errors.Is(err, users.ErrNoSuchUser) {
+    t.Errorf("no row for missing user: got %v, want %v", err, users.ErrNoSuchUser)
+  }
+}
+
+func TestPwDBErrors(t *testing.T) {
+  db, err := sql.Open("sqlite3", t.TempDir() + "/errors.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  pdb.SetSaltword("user1", "cw1")
+  if _, err := db.Exec(pdb.queries().setMetadata(), "{bad", "user1"); err != nil {
+    t.Fatalf("error setting bad metadata: %v", err)
+  }
+  if _, err := pdb.UserContext(context.Background(), "user1"); err == nil {
+    t.Errorf("expected error for user with bad metadata")
+  }
+
+  // A database failure is not reported as a missing user.
+  db.Close()
+  if err := pdb.RenameUser("user1", "user2"); err == nil || errors.Is(err, users.ErrNoSuchUser) {
+    t.Errorf("RenameUser with closed database: got %v, want a database error", err)
+  }
+  if err := pdb.RenameUser("user1", "user1"); err == nil || errors.Is(err, users.ErrNoSuchUser) {
+    t.Errorf("RenameUser to same name with closed database: got %v, want a database error", err)
+  }
+  if err := pdb.SetMetadata("user1", "k", "v"); err == nil || errors.Is(err, users.ErrNoSuchUser) {
+    t.Errorf("SetMetadata with closed database: got %v, want a database error", err)
+  }
+}
+
+func TestPwDBTableName(t *testing.T) {
+  db, err := sql.Open("sqlite3", t.TempDir() + "/table.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  defer db.Close()
+  pdb := NewPwDB(db)
+  pdb.SetDialect(SQLite)
+  pdb.SetTable("app users")
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  testAdminStore(t, pdb)
+  var count int
+  if err := db.QueryRow(`SELECT count(*) FROM "app users";`).Scan(&count); err != nil {
+    t.Fatalf("error counting users in renamed table: %v", err)
+  }
+  if got, want := count, pdb.UserCount(); got != want {
+    t.Errorf("users in renamed table: got %d, want %d", got, want)
+  }
+}
+
+func TestDbRoles(t *testing.T) {
+  db, err := sql.Open("sqlite3", t.TempDir() + "/roles.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.SetRole("reader", permissions.FromString("read")); err == nil {
+    t.Errorf("expected error setting role with no role table")
+  }
+  pdb.SetRoleTable("role")
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  if err := pdb.CreateRoleTable(); err != nil {
+    t.Fatalf("error creating role table: %v", err)
+  }
+  if err := pdb.SetRole("reader", permissions.FromString("read")); err != nil {
+    t.Fatalf("error setting reader role: %v", err)
+  }
+  if err := pdb.SetRole("editor", permissions.FromString("edit @reader")); err != nil {
+    t.Fatalf("error setting editor role: %v", err)
+  }
+  if err := pdb.Load(); err != nil {
+    t.Fatalf("error loading roles: %v", err)
+  }
+  pdb.SetSaltword("alice", "cw1")
+  if err := pdb.SetPermissions("alice", permissions.FromString("@editor")); err != nil {
+    t.Fatalf("error setting permissions for alice: %v", err)
+  }
+  alice := pdb.User("alice")
+  if got, want := alice.HasPermission("read"), true; got != want {
+    t.Errorf("alice read permission through roles: got %v, want %v", got, want)
+  }
+  if got, want := alice.HasPermission("delete"), false; got != want {
+    t.Errorf("alice delete permission: got %v, want %v", got, want)
+  }
+
+  if err := pdb.SetRole("reader", permissions.FromString("@editor")); err != nil {
+    t.Fatalf("error updating reader role: %v", err)
+  }
+  if err := pdb.Load(); err == nil {
+    t.Errorf("expected error loading roles with a cycle")
+  }
+}
+
+func TestDbValidation(t *testing.T) {
+  defer permissions.ClearCatalog()
+  permissions.Register("read", "Read documents")
+  db, err := sql.Open("sqlite3", t.TempDir() + "/validate.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  pdb.SetSaltword("alice", "cw1")
+  if err := pdb.SetPermissions("alice", permissions.FromString("read edti")); err != nil {
+    t.Fatalf("error setting permissions without validation: %v", err)
+  }
+  pdb.SetValidation(ValidateWarn)
+  if err := pdb.Load(); err != nil {
+    t.Errorf("load with warnings should succeed: %v", err)
+  }
+  pdb.SetValidation(ValidateFail)
+  if err := pdb.Load(); err == nil {
+    t.Errorf("load with unregistered permission should fail")
+  }
+  if err := pdb.SetPermissions("alice", permissions.FromString("raed")); err == nil {
+    t.Errorf("setting unregistered permission should fail")
+  }
+  if err := pdb.SetPermissions("alice", permissions.FromString("read")); err != nil {
+    t.Fatalf("error setting registered permission: %v", err)
+  }
+  if err := pdb.Load(); err != nil {
+    t.Errorf("load with registered permissions failed: %v", err)
+  }
+}
+
+func TestDbTimeLimitedPermissions(t *testing.T) {
+  db, err := sql.Open("sqlite3", t.TempDir() + "/bounds.db")
+  if err != nil {
+    t.Fatalf("error opening sql database: %v", err)
+  }
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  pdb.SetSaltword("user1", "cw1")
+  perms := permissions.FromString("deploy[/2099-01-01T00:00:00Z] old[/2000-01-01T00:00:00Z]")
+  if err := pdb.SetPermissions("user1", perms); err != nil {
+    t.Fatalf("error setting permissions: %v", err)
+  }
+  u := pdb.User("user1")
+  if !u.HasPermission("deploy") {
+    t.Errorf("time-limited permission should be held")
+  }
+  if u.HasPermission("old") {
+    t.Errorf("expired permission should not be held")
+  }
+  if got, want := u.PermissionsString(), "deploy[/2099-01-01T00:00:00Z]"; got != want {
+    t.Errorf("permissions string: got %q, want %q", got, want)
+  }
+}
@@ -0,0 +1,112 @@
+package store
+
+// DefaultUserTable is the name of the table in which PwDB stores users
+// unless SetTable is called.
+const DefaultUserTable = "user"
+
+// pwdbQueries generates the SQL statements used by PwDB.
+type pwdbQueries struct {
+  d Dialect
+  table string        // The user table.
+  roleTable string
+}
+
+func (q pwdbQueries) p(n int) string {
+  return q.d.Placeholder(n)
+}
+
+// migrations returns the schema changes for the user table, in order.
+// Add new migrations to the end; never change one that has been released.
+func (q pwdbQueries) migrations() []*Migration {
+  return []*Migration{
+    {
+      Version: 1,
+      Description: "create user table",
+      Up: execMigration(q.createUserTable()),
+    },
+    {
+      Version: 2,
+      Description: "add user metadata",
+      Up: execMigration(q.addMetadataColumn()),
+    },
+  }
+}
+
+// versionTable returns the table in which the migrations of our user
+// table are recorded. The default table uses SchemaVersionTable, and
+// other tables get their own.
+func (q pwdbQueries) versionTable() string {
+  if q.table == DefaultUserTable {
+    return SchemaVersionTable
+  }
+  return SchemaVersionTable + "_" + q.table
+}
+
+func (q pwdbQueries) createUserTable() string {
+  return "CREATE TABLE IF NOT EXISTS " + q.d.Quote(q.table) + "(id " + q.d.KeyType() + " NOT NULL, cryptword " +
+      q.d.TextType() + ", permissions " + q.d.TextType() + ", primary key(id));"
+}
+
+func (q pwdbQueries) addMetadataColumn() string {
+  return "ALTER TABLE " + q.d.Quote(q.table) + " ADD COLUMN metadata " + q.d.TextType() + " NOT NULL DEFAULT '';"
+}
+
+func (q pwdbQueries) selectUser() string {
+  return "SELECT cryptword, permissions, metadata FROM " + q.d.Quote(q.table) + " WHERE id = " + q.p(1) + ";"
+}
+
+// upsertSaltword takes id, cryptword and permissions, and leaves the
+// permissions unchanged for an existing user.
+func (q pwdbQueries) upsertSaltword() string {
+  return q.d.Upsert(q.table, "id", []string{"id", "cryptword", "permissions"}, []string{"cryptword"})
+}
+
+func (q pwdbQueries) countUsers() string {
+  return "SELECT count(*) FROM " + q.d.Quote(q.table) + ";"
+}
+
+func (q pwdbQueries) listUsers(limit, offset int) string {
+  return "SELECT id, cryptword, permissions, metadata FROM " + q.d.Quote(q.table) +
+      " ORDER BY id " + q.d.LimitOffset(limit, offset) + ";"
+}
+
+func (q pwdbQueries) deleteUser() string {
+  return "DELETE FROM " + q.d.Quote(q.table) + " WHERE id = " + q.p(1) + ";"
+}
+
+// The update statements take the new value, then the id.
+
+func (q pwdbQueries) renameUser() string {
+  return q.update("id")
+}
+
+func (q pwdbQueries) setPermissions() string {
+  return q.update("permissions")
+}
+
+func (q pwdbQueries) setMetadata() string {
+  return q.update("metadata")
+}
+
+// setSecrets takes the cryptword, metadata and id.
+func (q pwdbQueries) setSecrets() string {
+  return "UPDATE " + q.d.Quote(q.table) + " SET cryptword = " + q.p(1) + ", metadata = " + q.p(2) +
+      " WHERE id = " + q.p(3) + ";"
+}
+
+func (q pwdbQueries) update(column string) string {
+  return "UPDATE " + q.d.Quote(q.table) + " SET " + column + " = " + q.p(1) + " WHERE id = " + q.p(2) + ";"
+}
+
+func (q pwdbQueries) createRoleTable() string {
+  return "CREATE TABLE " + q.d.Quote(q.roleTable) + "(id " + q.d.KeyType() + " NOT NULL, permissions " +
+      q.d.TextType() + ", primary key(id));"
+}
+
+func (q pwdbQueries) selectRoles() string {
+  return "SELECT id, permissions FROM " + q.d.Quote(q.roleTable) + ";"
+}
+
+func (q pwdbQueries) upsertRole() string {
+  return q.d.Upsert(q.roleTable, "id", []string{"id", "permissions"}, []string{"permissions"})
+}
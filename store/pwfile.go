@@ -1,30 +1,105 @@
 package store
 
 import (
-  "bufio"
-  "encoding/csv"
   "fmt"
+  "io"
   "os"
+  "sync"
+  "time"
 
+  "github.com/jimmc/auth/filewatch"
   "github.com/jimmc/auth/permissions"
   "github.com/jimmc/auth/users"
 )
 
 // PwFile implements the Store interface to load and store data in a file
 // similar to a Unix /etc/passwd file.
-// Each line has data for one user in colon-separated fields with the format
-//   username:password:permissions
-// where the permissions field is a comma-separated list of permission names.
+// Each line has data for one user in comma-separated fields with the format
+//   username,password,permissions
+// where the permissions field is a space-separated list of permission names.
+// Fields are quoted as for encoding/csv, and a quoted field may contain
+// newlines, so one user's record may span several lines.
+// Lines starting with # and blank lines are ignored, and are kept in
+// place when the file is saved.
+// If a role file is set, roles are loaded from that file, and users may
+// be granted a role with a permission of the form @rolename.
+// Call Watch to reload the file automatically when it changes on disk.
+// If encryption is set by SetEncryption, saltwords are encrypted in the file.
+// If a username policy is set by SetUsernamePolicy, usernames are
+// canonicalized when loaded, and written in canonical form by Save.
 type PwFile struct {
     filename string     // The CSV file with our data.
+    roleFilename string // The CSV file with our role definitions, optional.
+    validation Validation
+    encryption *Encryption  // Encrypts saltwords, or nil.
+    usernamePolicy *users.UsernamePolicy
+    backups int         // Number of backup files to keep.
+    flock fileLock      // Held between Lock and Unlock.
+    mu sync.RWMutex     // Protects the fields below.
     users *users.Users
+    lines []*pwLine     // Layout of the file, including comments.
+    roles *permissions.Roles
+    watcher *filewatch.Watcher
 }
 
 func NewPwFile(filename string) *PwFile {
-  return &PwFile{
+  pf := &PwFile{
     filename: filename,
+    backups: 1,
     users: users.Empty(),
   }
+  pf.watcher = filewatch.New("password file", filename, pf.reload)
+  return pf
+}
+
+// SetBackups sets the number of backups kept by Save. The most recent is
+// named with a ~ suffix, and older ones with ~2, ~3 and so on. The
+// default is 1, and 0 disables backups.
+func (pf *PwFile) SetBackups(n int) {
+  pf.backups = n
+}
+
+// SetRoleFile sets the name of the file from which Load reads roles.
+func (pf *PwFile) SetRoleFile(filename string) {
+  pf.roleFilename = filename
+}
+
+// SetValidation sets how Load and SetPermissions treat permissions
+// that are not in the permissions catalog.
+func (pf *PwFile) SetValidation(mode Validation) {
+  pf.validation = mode
+}
+
+// SetEncryption sets the encryption for saltwords in the file. Load
+// fails if the file has saltwords that can't be decrypted, such as when
+// the key is wrong, and Save encrypts all saltwords with the current key.
+func (pf *PwFile) SetEncryption(e *Encryption) {
+  pf.mu.Lock()
+  defer pf.mu.Unlock()
+  pf.encryption = e
+}
+
+// SetUsernamePolicy sets the policy for usernames, and applies it to
+// the users already loaded. It and Load fail if two users have the
+// same canonical username.
+func (pf *PwFile) SetUsernamePolicy(p *users.UsernamePolicy) error {
+  pf.mu.Lock()
+  defer pf.mu.Unlock()
+  if err := pf.users.SetUsernamePolicy(p); err != nil {
+    return err
+  }
+  for _, line := range pf.lines {
+    line.username = p.Canonical(line.username)
+  }
+  pf.usernamePolicy = p
+  return nil
+}
+
+// UsernamePolicy returns the policy set by SetUsernamePolicy, or nil.
+func (pf *PwFile) UsernamePolicy() *users.UsernamePolicy {
+  pf.mu.RLock()
+  defer pf.mu.RUnlock()
+  return pf.usernamePolicy
 }
 
 func (pf *PwFile) CreatePasswordFile() error {
@@ -40,81 +115,207 @@ func (pf *PwFile) CreatePasswordFile() error {
   return nil
 }
 
+// Load reads the password file and the role file, if set. If either
+// can not be read or is not valid, the previously loaded data stays in
+// effect and the error is returned.
 func (pf *PwFile) Load() error {
+  err := pf.load()
+  pf.watcher.SetError(err)
+  return err
+}
+
+func (pf *PwFile) load() error {
   f, err := os.Open(pf.filename)
   if err != nil {
     return fmt.Errorf("error opening password file %s: %v", pf.filename, err)
   }
-  r := csv.NewReader(bufio.NewReader(f))
-  r.FieldsPerRecord = 3         // username, password, permissions
-
-  records, err := r.ReadAll()
+  defer f.Close()
+  info, err := f.Stat()
+  if err != nil {
+    return fmt.Errorf("error checking password file %s: %v", pf.filename, err)
+  }
+  lines, err := readPwLines(f)
   if err != nil {
     return fmt.Errorf("error loading password file %s: %v", pf.filename, err)
   }
 
-  uu := pf.recordsToUsers(records)
-  pf.users = users.NewUsers(uu)
+  var roles *permissions.Roles
+  if pf.roleFilename != "" {
+    roles, err = loadRoleFile(pf.roleFilename)
+    if err != nil {
+      return err
+    }
+    if err := validateRoles(pf.validation, roles); err != nil {
+      return fmt.Errorf("error in role file %s: %v", pf.roleFilename, err)
+    }
+  }
+
+  pf.mu.RLock()
+  encryption, policy := pf.encryption, pf.usernamePolicy
+  pf.mu.RUnlock()
+  uu, err := pf.linesToUsers(lines, encryption)
+  if err != nil {
+    return fmt.Errorf("error in password file %s: %w", pf.filename, err)
+  }
+  newUsers := users.NewUsers(uu)
+  if err := newUsers.SetUsernamePolicy(policy); err != nil {
+    return fmt.Errorf("error in password file %s: %w", pf.filename, err)
+  }
+  for _, line := range lines {
+    line.username = policy.Canonical(line.username)
+  }
+  newUsers.SetRoles(roles)
+
+  pf.mu.Lock()
+  pf.users = newUsers
+  pf.lines = lines
+  pf.roles = roles
+  pf.mu.Unlock()
+  pf.watcher.Loaded(info)
   return nil
 }
 
-func (pf *PwFile) Save() error {
-  newFilePath := pf.filename + ".new"
-  f, err := os.Create(newFilePath)
-  if err != nil {
-    return fmt.Errorf("error creating new password file %s: %v", newFilePath, err)
+// reload is called by the watcher to load the file when it changes. It
+// holds the lock, so that it waits for a caller that has locked the file
+// to make changes and save them, rather than replacing those changes
+// with the copy on disk.
+func (pf *PwFile) reload() error {
+  if err := pf.Lock(); err != nil {
+    pf.watcher.SetError(err)
+    return err
   }
-  w := csv.NewWriter(bufio.NewWriter(f))
-  err = w.WriteAll(pf.usersToRecords(pf.users))
-  if err != nil {
-    return fmt.Errorf("error writing new password file %s: %v", newFilePath, err)
+  err := pf.Load()
+  if uerr := pf.Unlock(); err == nil {
+    err = uerr
   }
-  w.Flush()
-  f.Close()
+  return err
+}
+
+// Watch starts checking the password file every interval, and reloads
+// it when its modification time or size changes. A reload waits for the
+// lock taken by Lock, so changes made while holding the lock are not
+// lost, but other changes that have not been saved are lost when the
+// file is reloaded. Call Stop to end the checking.
+func (pf *PwFile) Watch(interval time.Duration) {
+  pf.watcher.Start(interval)
+}
+
+// Stop ends the checking started by Watch.
+func (pf *PwFile) Stop() {
+  pf.watcher.Stop()
+}
+
+// Status returns the reload status of the password file.
+func (pf *PwFile) Status() *filewatch.Status {
+  return pf.watcher.Status()
+}
 
-  backupFilePath := pf.filename + "~"
-  err = os.Rename(pf.filename, backupFilePath)
+// Save writes our users to a new file, syncs it to disk, keeps a backup
+// of the old file as set by SetBackups, and renames the new file into
+// place, so a crash leaves either the old or the new file intact.
+// To avoid losing changes made by another process, hold the lock
+// from before Load until after Save.
+func (pf *PwFile) Save() error {
+  pf.mu.RLock()
+  err := writeFileSafely(pf.filename, pf.backups, func(w io.Writer) error {
+    return writePwLines(w, pf.lines, pf.users, pf.encryption)
+  })
+  pf.mu.RUnlock()
   if err != nil {
-    return fmt.Errorf("error moving old file to backup path %s: %v", backupFilePath, err)
+    return fmt.Errorf("error saving password file: %v", err)
   }
-  err = os.Rename(newFilePath, pf.filename)
-  if err != nil {
-    return fmt.Errorf("error moving new file %s to become active file: %v", newFilePath, err)
+  // Don't let Watch reload the file we just wrote.
+  if info, err := os.Stat(pf.filename); err == nil {
+    pf.watcher.Seen(info)
   }
-
   return nil
 }
 
-func (pf *PwFile) recordsToUsers(records [][]string) map[string]*users.User {
+// Lock gets an exclusive lock on the password file, waiting if another
+// process or goroutine holds it. The lock is advisory, and is held on a
+// separate file named with a .lock suffix, since Save replaces the
+// password file. Call Unlock to release it.
+func (pf *PwFile) Lock() error {
+  return pf.flock.lock(pf.filename)
+}
+
+// Unlock releases the lock obtained by Lock.
+func (pf *PwFile) Unlock() error {
+  return pf.flock.unlock(pf.filename)
+}
+
+func (pf *PwFile) linesToUsers(lines []*pwLine, encryption *Encryption) (map[string]*users.User, error) {
   uu := make(map[string]*users.User)
-  for _, record := range records {
-    username := record[0]
-    saltword := record[1]
-    perms := permissions.FromString(record[2])
+  for _, line := range lines {
+    if line.fields == nil {
+      continue
+    }
+    username := line.fields[0]
+    saltword, err := decryptValue(encryption, line.fields[1])
+    if err != nil {
+      return nil, fmt.Errorf("line %d: saltword for user %q: %w", line.lineno, username, err)
+    }
+    perms := permissions.FromString(line.fields[2])
+    if err := validatePermissions(pf.validation, fmt.Sprintf("user %q", username), perms); err != nil {
+      return nil, fmt.Errorf("line %d: %v", line.lineno, err)
+    }
     user := users.NewUser(username, saltword, perms)
     uu[username] = user
   }
-  return uu
-}
-
-func (pf *PwFile) usersToRecords(uu *users.Users) [][]string {
-  count := uu.UserCount()
-  records := make([][]string, count, count)
-  ua := uu.ToArray()
-  for n, u := range ua {
-    records[n] = []string{ u.Id(), u.Saltword(), u.PermissionsString() }
-  }
-  return records
+  return uu, nil
 }
 
 func (pf *PwFile) User(username string) *users.User {
+  pf.mu.RLock()
+  defer pf.mu.RUnlock()
   return pf.users.User(username)
 }
 
 func (pf *PwFile) SetSaltword(username, saltword string) {
+  pf.mu.Lock()
+  defer pf.mu.Unlock()
   pf.users.SetSaltword(username, saltword)
 }
 
 func (pf *PwFile) UserCount() int {
+  pf.mu.RLock()
+  defer pf.mu.RUnlock()
   return pf.users.UserCount()
 }
+
+func (pf *PwFile) ListUsers(offset, limit int) ([]*users.User, error) {
+  pf.mu.RLock()
+  defer pf.mu.RUnlock()
+  return pf.users.Page(offset, limit), nil
+}
+
+func (pf *PwFile) DeleteUser(username string) error {
+  pf.mu.Lock()
+  defer pf.mu.Unlock()
+  return pf.users.DeleteUser(username)
+}
+
+func (pf *PwFile) RenameUser(oldname, newname string) error {
+  pf.mu.Lock()
+  defer pf.mu.Unlock()
+  if err := pf.users.RenameUser(oldname, newname); err != nil {
+    return err
+  }
+  // Keep the renamed user in the same place in the file.
+  oldname, newname = pf.usernamePolicy.Canonical(oldname), pf.usernamePolicy.Canonical(newname)
+  for _, line := range pf.lines {
+    if line.fields != nil && line.username == oldname {
+      line.username = newname
+    }
+  }
+  return nil
+}
+
+func (pf *PwFile) SetPermissions(username string, perms *permissions.Permissions) error {
+  if err := validatePermissions(pf.validation, fmt.Sprintf("user %q", username), perms); err != nil {
+    return err
+  }
+  pf.mu.Lock()
+  defer pf.mu.Unlock()
+  return pf.users.SetPermissions(username, perms.WithRoles(pf.roles))
+}
@@ -4,7 +4,9 @@ import (
   "bytes"
   "io/ioutil"
   "os"
+  "path/filepath"
   "testing"
+  "time"
 
   "github.com/jimmc/auth/permissions"
   "github.com/jimmc/auth/users"
@@ -100,18 +102,13 @@ func TestSaveError(t *testing.T) {
 
   // Saving the password file after a change is done by creating a new temp
   // file and moving it onto the old file. To make this fail, we create a
-  // file of that new name and make it read-only.
-  // Now make the password file protected so a write on save fails
+  // directory of that new name, which can't be replaced by a file even
+  // when running as root.
   tfName := pf.Name()+".new"
-  tf, err := os.Create(tfName)
-  if err != nil {
-    t.Fatalf("failed to create temp password file")
-  }
-  defer os.Remove(tf.Name())    // clean up
-  err = os.Chmod(tf.Name(), 0400)       // read-only
-  if err!=nil {
-    t.Fatalf("error setting temp password file (~) to read-only: %v", err)
+  if err := os.Mkdir(tfName, 0700); err != nil {
+    t.Fatalf("failed to create directory in place of temp password file: %v", err)
   }
+  defer os.Remove(tfName)    // clean up
   err = pw.Save()
   if err == nil {
     t.Errorf("expected error updating password, did not get error")
@@ -186,3 +183,329 @@ func TestLoadSaveFile(t *testing.T) {
     t.Errorf("password file contents don't match, got '%s', want '%s'", pwgot, pwwant)
   }
 }
+
+func TestPwFileAdminStore(t *testing.T) {
+  testAdminStore(t, NewPwFile("/no/such/file/foo.txt"))
+}
+
+func TestRoleFile(t *testing.T) {
+  pw := NewPwFile("testdata/pw-roles.txt")
+  pw.SetRoleFile("testdata/roles1.txt")
+  if err := pw.Load(); err != nil {
+    t.Fatalf("failed to load password file with roles: %v", err)
+  }
+  tests := []struct{
+    username string
+    perm permissions.Permission
+    want bool
+  }{
+    {"alice", "edit", true},
+    {"alice", "read", true},
+    {"alice", "delete", false},
+    {"bob", "read", true},
+    {"bob", "edit", false},
+  }
+  for _, tt := range tests {
+    if got := pw.User(tt.username).HasPermission(tt.perm); got != tt.want {
+      t.Errorf("%s HasPermission(%q): got %v, want %v", tt.username, tt.perm, got, tt.want)
+    }
+  }
+  perms := permissions.FromString("@editor")
+  if err := pw.SetPermissions("bob", perms); err != nil {
+    t.Fatalf("error setting permissions for bob: %v", err)
+  }
+  if got, want := pw.User("bob").HasPermission("comment"), true; got != want {
+    t.Errorf("bob permission from new role: got %v, want %v", got, want)
+  }
+  if got, want := perms.HasPermission("comment"), false; got != want {
+    t.Errorf("caller's permissions should not get our roles: got %v, want %v", got, want)
+  }
+
+  pw.SetRoleFile("testdata/roles-cycle.txt")
+  if err := pw.Load(); err == nil {
+    t.Errorf("expected error loading role file with a cycle")
+  }
+  pw.SetRoleFile("/no/such/file/roles.txt")
+  if err := pw.Load(); err == nil {
+    t.Errorf("expected error loading missing role file")
+  }
+}
+
+func TestTimeLimitedPermissionsFile(t *testing.T) {
+  pwfile := filepath.Join(t.TempDir(), "pw.txt")
+  pw := NewPwFile(pwfile)
+  if err := pw.CreatePasswordFile(); err != nil {
+    t.Fatalf("error creating password file: %v", err)
+  }
+  pw.SetSaltword("user1", "cw1")
+  perms := permissions.FromString("read deploy[/2099-01-01T00:00:00Z] old[/2000-01-01T00:00:00Z]")
+  if err := pw.SetPermissions("user1", perms); err != nil {
+    t.Fatalf("error setting permissions: %v", err)
+  }
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving password file: %v", err)
+  }
+  pw2 := NewPwFile(pwfile)
+  if err := pw2.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+  u := pw2.User("user1")
+  if !u.HasPermission("deploy") {
+    t.Errorf("time-limited permission should be held after reload")
+  }
+  if u.HasPermission("old") {
+    t.Errorf("expired permission should not be held after reload")
+  }
+  if got, want := len(u.Permissions().Grants()), 2; got != want {
+    t.Errorf("grants after reload: got %d, want %d", got, want)
+  }
+}
+
+func TestPwFileValidation(t *testing.T) {
+  defer permissions.ClearCatalog()
+  permissions.Register("edit", "Edit documents")
+  permissions.Register("read", "Read documents")
+
+  pw := NewPwFile("testdata/pw-typo.txt")
+  if err := pw.Load(); err != nil {
+    t.Errorf("load without validation should succeed: %v", err)
+  }
+  pw.SetValidation(ValidateWarn)
+  if err := pw.Load(); err != nil {
+    t.Errorf("load with warnings should succeed: %v", err)
+  }
+  pw.SetValidation(ValidateFail)
+  err := pw.Load()
+  if err == nil {
+    t.Fatalf("load with unregistered permission should fail")
+  }
+  if got, want := err.Error(), `error in password file testdata/pw-typo.txt: line 2: user "bob" has unregistered permissions: edti`; got != want {
+    t.Errorf("load error: got %q, want %q", got, want)
+  }
+
+  pw = NewPwFile("testdata/pw-roles.txt")
+  pw.SetRoleFile("testdata/roles1.txt")
+  pw.SetValidation(ValidateFail)
+  if err := pw.Load(); err == nil {
+    t.Errorf("load with unregistered role permission should fail")
+  }
+  permissions.Register("comment", "Comment on documents")
+  if err := pw.Load(); err != nil {
+    t.Fatalf("load with registered role permissions failed: %v", err)
+  }
+  if err := pw.SetPermissions("bob", permissions.FromString("raed")); err == nil {
+    t.Errorf("setting unregistered permission should fail")
+  }
+}
+
+func TestPwFileWatch(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "pw.txt")
+  write := func(s string) {
+    if err := ioutil.WriteFile(filename, []byte(s), 0600); err != nil {
+      t.Fatalf("error writing password file: %v", err)
+    }
+  }
+  pw := NewPwFile(filename)
+  // Check twice, so that a change has settled and is reloaded.
+  poll := func() {
+    pw.watcher.ReloadIfChanged()
+    pw.watcher.ReloadIfChanged()
+  }
+
+  write("alice,cw1,read\n")
+  if err := pw.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+
+  write("alice,cw1,read\nbob,cw2,edit\n")
+  poll()
+  if got, want := pw.Status().Reloads, 2; got != want {
+    t.Errorf("reloads after change: got %d, want %d", got, want)
+  }
+  if pw.User("bob") == nil {
+    t.Errorf("bob should exist after reload")
+  }
+
+  // A file seen empty while it is rewritten is not loaded.
+  write("")
+  pw.watcher.ReloadIfChanged()
+  write("alice,cw1,read\nbob,cw2,edit\nbill,cw8,\n")
+  pw.watcher.ReloadIfChanged()
+  if got, want := pw.UserCount(), 2; got != want {
+    t.Errorf("users while the file is changing: got %d, want %d", got, want)
+  }
+  pw.watcher.ReloadIfChanged()
+  if got, want := pw.UserCount(), 3; got != want {
+    t.Errorf("users after the file has settled: got %d, want %d", got, want)
+  }
+
+  write("alice,cw1\n")
+  poll()
+  if pw.Status().LastError == nil {
+    t.Errorf("expected error after bad file")
+  }
+  if got, want := pw.Status().Reloads, 3; got != want {
+    t.Errorf("reloads after bad file: got %d, want %d", got, want)
+  }
+  if got, want := pw.UserCount(), 3; got != want {
+    t.Errorf("previous users should still be in effect: got %d users, want %d", got, want)
+  }
+
+  write("carol,cw3,\n")
+  poll()
+  if got, want := pw.Status().Reloads, 4; got != want || pw.Status().LastError != nil {
+    t.Errorf("reloads after recovery: got %d (%v), want %d", got, pw.Status().LastError, want)
+  }
+  if pw.User("carol") == nil || pw.User("bob") != nil {
+    t.Errorf("users not updated after recovery")
+  }
+
+  // Our own Save should not cause a reload.
+  pw.SetSaltword("carol", "cw4")
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving password file: %v", err)
+  }
+  poll()
+  if got, want := pw.Status().Reloads, 4; got != want {
+    t.Errorf("reloads after save: got %d, want %d", got, want)
+  }
+
+  // A change on disk is not reloaded over changes made under the lock.
+  if err := pw.Lock(); err != nil {
+    t.Fatalf("error locking password file: %v", err)
+  }
+  pw.SetSaltword("carol", "cw5")
+  write("carol,cw6,\ndave,cw7,\n")
+  done := make(chan bool)
+  go func() {
+    poll()
+    close(done)
+  }()
+  time.Sleep(20 * time.Millisecond)
+  if got, want := pw.User("carol").Saltword(), "cw5"; got != want {
+    t.Errorf("saltword while locked: got %q, want %q", got, want)
+  }
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving password file: %v", err)
+  }
+  if err := pw.Unlock(); err != nil {
+    t.Fatalf("error unlocking password file: %v", err)
+  }
+  <-done
+  if got, want := pw.User("carol").Saltword(), "cw5"; got != want {
+    t.Errorf("saltword after save: got %q, want %q", got, want)
+  }
+}
+
+func TestCommentsPreserved(t *testing.T) {
+  pw := NewPwFile("testdata/pw-comments.txt")
+  if err := pw.Load(); err != nil {
+    t.Fatalf("error loading password file with comments: %v", err)
+  }
+  if got, want := pw.UserCount(), 4; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+  if got, want := pw.User("bob").PermissionsString(), "edit read"; got != want {
+    t.Errorf("permissions for bob: got %q, want %q", got, want)
+  }
+
+  pw.SetSaltword("alice", "cw-alice2")
+  pw.SetSaltword("dave", "cw-dave")
+  if err := pw.SetPermissions("dave", permissions.FromString("read")); err != nil {
+    t.Fatalf("error setting permissions for dave: %v", err)
+  }
+  if err := pw.DeleteUser("bob"); err != nil {
+    t.Fatalf("error deleting bob: %v", err)
+  }
+  if err := pw.RenameUser("carol", "carl"); err != nil {
+    t.Fatalf("error renaming carol: %v", err)
+  }
+
+  // Save to a copy by pointing our PwFile at a new file name.
+  pw.filename = filepath.Join(t.TempDir(), "pw.txt")
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving password file with comments: %v", err)
+  }
+  pwgolden := "testdata/pw-comments-golden.txt"
+  pwgot, err := ioutil.ReadFile(pw.filename)
+  if err != nil {
+    t.Fatalf("failed to read saved password file: %v", err)
+  }
+  pwwant, err := ioutil.ReadFile(pwgolden)
+  if err != nil {
+    t.Fatalf("failed to read reference password file %s: %v", pwgolden, err)
+  }
+  if !bytes.Equal(pwgot, pwwant) {
+    t.Errorf("password file contents don't match, got '%s', want '%s'", pwgot, pwwant)
+  }
+}
+
+func TestMultiLineRecord(t *testing.T) {
+  pwfile := filepath.Join(t.TempDir(), "pw.txt")
+  text := "# users\nalice,cw1,read\n\"bob\nsmith\",\"cw2\",edit\n# end\ncarol,cw3,\n"
+  if err := ioutil.WriteFile(pwfile, []byte(text), 0600); err != nil {
+    t.Fatalf("error writing password file: %v", err)
+  }
+  pw := NewPwFile(pwfile)
+  if err := pw.Load(); err != nil {
+    t.Fatalf("error loading password file with a multi-line record: %v", err)
+  }
+  if got, want := pw.UserCount(), 3; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+  if u := pw.User("bob\nsmith"); u == nil || u.Saltword() != "cw2" {
+    t.Errorf("user with a newline in the name: got %v", u)
+  }
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving password file: %v", err)
+  }
+  b, err := ioutil.ReadFile(pwfile)
+  if err != nil {
+    t.Fatalf("failed to read saved password file: %v", err)
+  }
+  if got, want := string(b), "# users\nalice,cw1,read\n\"bob\nsmith\",cw2,edit\n# end\ncarol,cw3,\n"; got != want {
+    t.Errorf("saved password file: got %q, want %q", got, want)
+  }
+
+  for _, bad := range []string{"alice,cw1,read\n\"bob,cw2,edit\n", "alice,\"cw1\"x,read\n"} {
+    if err := ioutil.WriteFile(pwfile, []byte(bad), 0600); err != nil {
+      t.Fatalf("error writing password file: %v", err)
+    }
+    if err := pw.Load(); err == nil {
+      t.Errorf("expected error loading %q", bad)
+    }
+  }
+}
+
+func TestCommentPrefixUsername(t *testing.T) {
+  pw := NewPwFile(filepath.Join(t.TempDir(), "pw.txt"))
+  pw.SetSaltword("#ops", "cw1")
+  pw.SetSaltword("#a\"b", "cw2")
+  pw.SetSaltword("user1", "cw3")
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving password file: %v", err)
+  }
+  pw2 := NewPwFile(pw.filename)
+  if err := pw2.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+  for _, id := range []string{"#ops", "#a\"b", "user1"} {
+    if pw2.User(id) == nil {
+      t.Errorf("user %q was not loaded", id)
+    }
+  }
+  if got, want := pw2.UserCount(), 3; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+}
+
+func TestLoadErrorLineNumber(t *testing.T) {
+  pw := NewPwFile("testdata/pw-bad-line.txt")
+  err := pw.Load()
+  if err == nil {
+    t.Fatalf("expected error loading password file with a bad line")
+  }
+  if got, want := err.Error(), "error loading password file testdata/pw-bad-line.txt: line 3: wrong number of fields"; got != want {
+    t.Errorf("load error: got %q, want %q", got, want)
+  }
+}
@@ -0,0 +1,145 @@
+package store
+
+import (
+  "bufio"
+  "encoding/csv"
+  "errors"
+  "fmt"
+  "io"
+  "strings"
+
+  "github.com/jimmc/auth/users"
+)
+
+// CommentPrefix starts a comment line in a password file.
+const CommentPrefix = "#"
+
+// A pwLine is one line of a password file. Comment and blank lines are
+// kept as text so that Save can write them back in the same place.
+type pwLine struct {
+  lineno int
+  text string          // The text of a comment or blank line.
+  username string      // The user on this line, if not a comment.
+  fields []string      // username, saltword, permissions
+}
+
+// readPwLines reads the lines of a password file. A record may span
+// several lines when it has a quoted field containing a newline, as
+// written by csv.Writer; its pwLine has the number of its first line.
+// Errors include the line number at which they occurred.
+func readPwLines(r io.Reader) ([]*pwLine, error) {
+  lines := make([]*pwLine, 0)
+  scanner := bufio.NewScanner(r)
+  lineno := 0
+  var record []string   // The lines of a record that is not yet complete.
+  start := 0            // The line number of the first line of record.
+  quotes := 0           // The number of quote characters in record.
+  for scanner.Scan() {
+    lineno++
+    text := scanner.Text()
+    if record == nil {
+      trimmed := strings.TrimSpace(text)
+      if trimmed == "" || strings.HasPrefix(trimmed, CommentPrefix) {
+        lines = append(lines, &pwLine{lineno: lineno, text: text})
+        continue
+      }
+      start = lineno
+    }
+    record = append(record, text)
+    // A newline ends the record unless it is within a quoted field,
+    // which is the case when we have seen an odd number of quotes.
+    quotes += strings.Count(text, `"`)
+    if quotes % 2 != 0 {
+      continue
+    }
+    line, err := parsePwRecord(start, record)
+    if err != nil {
+      return nil, err
+    }
+    lines = append(lines, line)
+    record, quotes = nil, 0
+  }
+  if err := scanner.Err(); err != nil {
+    return nil, fmt.Errorf("line %d: %v", lineno + 1, err)
+  }
+  if record != nil {
+    _, err := parsePwRecord(start, record)
+    if err == nil {
+      err = fmt.Errorf("line %d: unterminated quoted field", start)
+    }
+    return nil, err
+  }
+  return lines, nil
+}
+
+// parsePwRecord parses the text of one record that starts at line lineno.
+func parsePwRecord(lineno int, text []string) (*pwLine, error) {
+  cr := csv.NewReader(strings.NewReader(strings.Join(text, "\n") + "\n"))
+  cr.FieldsPerRecord = 3      // username, password, permissions
+  fields, err := cr.Read()
+  if err != nil {
+    var pe *csv.ParseError
+    if errors.As(err, &pe) {
+      err = pe.Err
+    }
+    return nil, fmt.Errorf("line %d: %v", lineno, err)
+  }
+  if _, err := cr.Read(); err != io.EOF {
+    return nil, fmt.Errorf("line %d: extra text after record", lineno)
+  }
+  return &pwLine{lineno: lineno, username: fields[0], fields: fields}, nil
+}
+
+// writePwLines writes uu in the layout given by lines. Each user is
+// written in place of the line it was read from, comment and blank lines
+// are written unchanged, and users that were not in lines are written
+// at the end, sorted by username. Saltwords are encrypted if enc is
+// not nil.
+func writePwLines(w io.Writer, lines []*pwLine, uu *users.Users, enc *Encryption) error {
+  cw := csv.NewWriter(w)
+  written := make(map[string]bool)
+  writeUser := func(u *users.User) error {
+    saltword, err := encryptValue(enc, u.Saltword())
+    if err != nil {
+      return fmt.Errorf("error encrypting saltword for %q: %v", u.Id(), err)
+    }
+    written[u.Id()] = true
+    if !strings.HasPrefix(u.Id(), CommentPrefix) {
+      return cw.Write([]string{ u.Id(), saltword, u.PermissionsString() })
+    }
+    // The csv package does not quote a username that starts with
+    // CommentPrefix, and the line would be read back as a comment.
+    cw.Flush()
+    if _, err := io.WriteString(w, `"` + strings.ReplaceAll(u.Id(), `"`, `""`) + `",`); err != nil {
+      return err
+    }
+    if err := cw.Write([]string{ saltword, u.PermissionsString() }); err != nil {
+      return err
+    }
+    cw.Flush()
+    return cw.Error()
+  }
+  for _, line := range lines {
+    if line.fields == nil {
+      cw.Flush()
+      if _, err := io.WriteString(w, line.text + "\n"); err != nil {
+        return err
+      }
+      continue
+    }
+    if u := uu.User(line.username); u != nil && !written[u.Id()] {
+      if err := writeUser(u); err != nil {
+        return err
+      }
+    }
+  }
+  for _, u := range uu.ToArray() {
+    if !written[u.Id()] {
+      if err := writeUser(u); err != nil {
+        return err
+      }
+    }
+  }
+  cw.Flush()
+  return cw.Error()
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+  "bufio"
+  "encoding/csv"
+  "fmt"
+  "os"
+
+  "github.com/jimmc/auth/permissions"
+)
+
+// loadRoleFile reads role definitions from a file in the same style as
+// our password file. Each line defines one role with the format
+//   rolename,permissions
+// where the permissions field is a space-separated list of permission
+// names, and may include other roles as @rolename.
+func loadRoleFile(filename string) (*permissions.Roles, error) {
+  f, err := os.Open(filename)
+  if err != nil {
+    return nil, fmt.Errorf("error opening role file %s: %v", filename, err)
+  }
+  defer f.Close()
+  r := csv.NewReader(bufio.NewReader(f))
+  r.FieldsPerRecord = 2         // rolename, permissions
+
+  records, err := r.ReadAll()
+  if err != nil {
+    return nil, fmt.Errorf("error loading role file %s: %v", filename, err)
+  }
+  roles := permissions.NewRoles()
+  for _, record := range records {
+    roles.SetRole(record[0], permissions.FromString(record[1]))
+  }
+  if err := roles.Check(); err != nil {
+    return nil, fmt.Errorf("error in role file %s: %v", filename, err)
+  }
+  return roles, nil
+}
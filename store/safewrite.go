@@ -0,0 +1,138 @@
+package store
+
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "os"
+  "path/filepath"
+  "strconv"
+
+  "github.com/golang/glog"
+)
+
+var (
+  syncFile = func(f *os.File) error { return f.Sync() }  // Allow overriding for unit testing.
+)
+
+// writeFileSafely replaces filename with the data written by write, such
+// that a crash at any point leaves either the old or the new file in place.
+// The data is written to filename.new, which is synced to disk and then
+// renamed onto filename. The new file gets the mode and, if possible, the
+// owner of the old file. If backups is greater than zero and filename
+// exists, the old file is kept as filename~, and older backups are kept
+// as filename~2 up to filename~<backups>.
+func writeFileSafely(filename string, backups int, write func(io.Writer) error) error {
+  mode := os.FileMode(0600)
+  info, err := os.Stat(filename)
+  exists := err == nil
+  if err != nil && !os.IsNotExist(err) {
+    return fmt.Errorf("error checking file %s: %v", filename, err)
+  }
+  if exists {
+    mode = info.Mode().Perm()
+  }
+
+  newFilePath := filename + ".new"
+  f, err := os.OpenFile(newFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+  if err != nil {
+    return fmt.Errorf("error creating new file %s: %v", newFilePath, err)
+  }
+  if err := writeAndSync(f, mode, info, write); err != nil {
+    f.Close()
+    os.Remove(newFilePath)
+    return fmt.Errorf("error writing new file %s: %v", newFilePath, err)
+  }
+  if err := f.Close(); err != nil {
+    os.Remove(newFilePath)
+    return fmt.Errorf("error closing new file %s: %v", newFilePath, err)
+  }
+
+  if exists && backups > 0 {
+    if err := makeBackup(filename, backups); err != nil {
+      os.Remove(newFilePath)
+      return err
+    }
+  }
+  if err := os.Rename(newFilePath, filename); err != nil {
+    return fmt.Errorf("error moving new file %s to become active file: %v", newFilePath, err)
+  }
+  if err := syncDir(filepath.Dir(filename)); err != nil {
+    return fmt.Errorf("error syncing directory of %s: %v", filename, err)
+  }
+  return nil
+}
+
+// writeAndSync writes the data to f, which replaces the file described
+// by info if that is not nil, and syncs it to disk.
+func writeAndSync(f *os.File, mode os.FileMode, info os.FileInfo, write func(io.Writer) error) error {
+  // The mode passed to OpenFile is reduced by the umask, and is ignored
+  // if a stale new file was left behind by an earlier failure.
+  if err := f.Chmod(mode); err != nil {
+    return err
+  }
+  if info != nil {
+    if err := chownLike(f, info); err != nil {
+      glog.Warningf("Can't preserve owner of %s: %v", info.Name(), err)
+    }
+  }
+  bw := bufio.NewWriter(f)
+  if err := write(bw); err != nil {
+    return err
+  }
+  if err := bw.Flush(); err != nil {
+    return err
+  }
+  return syncFile(f)
+}
+
+// backupName returns the name of backup number n of filename.
+func backupName(filename string, n int) string {
+  if n == 1 {
+    return filename + "~"
+  }
+  return filename + "~" + strconv.Itoa(n)
+}
+
+// makeBackup shifts the existing backups of filename up by one, dropping
+// the oldest, and makes a copy of filename as its first backup.
+// filename itself stays in place until it is replaced.
+func makeBackup(filename string, backups int) error {
+  for n := backups - 1; n >= 1; n-- {
+    err := os.Rename(backupName(filename, n), backupName(filename, n + 1))
+    if err != nil && !os.IsNotExist(err) {
+      return fmt.Errorf("error rotating backups of %s: %v", filename, err)
+    }
+  }
+  backupFilePath := backupName(filename, 1)
+  if err := os.Remove(backupFilePath); err != nil && !os.IsNotExist(err) {
+    return fmt.Errorf("error removing old backup %s: %v", backupFilePath, err)
+  }
+  if err := os.Link(filename, backupFilePath); err != nil {
+    if err := copyFile(filename, backupFilePath); err != nil {
+      return fmt.Errorf("error copying old file to backup path %s: %v", backupFilePath, err)
+    }
+  }
+  return nil
+}
+
+func copyFile(from, to string) error {
+  in, err := os.Open(from)
+  if err != nil {
+    return err
+  }
+  defer in.Close()
+  info, err := in.Stat()
+  if err != nil {
+    return err
+  }
+  out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+  if err != nil {
+    return err
+  }
+  if _, err := io.Copy(out, in); err != nil {
+    out.Close()
+    return err
+  }
+  return out.Close()
+}
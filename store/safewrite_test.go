@@ -0,0 +1,182 @@
+package store
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+)
+
+func readFile(t *testing.T, filename string) string {
+  t.Helper()
+  b, err := ioutil.ReadFile(filename)
+  if err != nil {
+    t.Fatalf("error reading %s: %v", filename, err)
+  }
+  return string(b)
+}
+
+func TestSaveWithoutOriginal(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "pw.txt")
+  pw := NewPwFile(filename)
+  pw.SetSaltword("alice", "cw1")
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving new password file: %v", err)
+  }
+  if got, want := readFile(t, filename), "alice,cw1,\n"; got != want {
+    t.Errorf("saved file: got %q, want %q", got, want)
+  }
+  if _, err := os.Stat(filename + "~"); !os.IsNotExist(err) {
+    t.Errorf("there should be no backup of a file that did not exist")
+  }
+  info, err := os.Stat(filename)
+  if err != nil {
+    t.Fatalf("error checking saved file: %v", err)
+  }
+  if got, want := info.Mode().Perm(), os.FileMode(0600); got != want {
+    t.Errorf("mode of new password file: got %v, want %v", got, want)
+  }
+}
+
+func TestSaveKeepsMode(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "pw.txt")
+  if err := ioutil.WriteFile(filename, []byte("alice,cw1,\n"), 0600); err != nil {
+    t.Fatalf("error writing password file: %v", err)
+  }
+  if err := os.Chmod(filename, 0640); err != nil {
+    t.Fatalf("error setting mode of password file: %v", err)
+  }
+  pw := NewPwFile(filename)
+  if err := pw.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving password file: %v", err)
+  }
+  info, err := os.Stat(filename)
+  if err != nil {
+    t.Fatalf("error checking saved file: %v", err)
+  }
+  if got, want := info.Mode().Perm(), os.FileMode(0640); got != want {
+    t.Errorf("mode of saved password file: got %v, want %v", got, want)
+  }
+}
+
+func TestSaveBackups(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "pw.txt")
+  pw := NewPwFile(filename)
+  pw.SetBackups(3)
+  for n := 1; n <= 5; n++ {
+    pw.SetSaltword("alice", fmt.Sprintf("cw%d", n))
+    if err := pw.Save(); err != nil {
+      t.Fatalf("error saving password file version %d: %v", n, err)
+    }
+  }
+  tests := []struct{
+    filename string
+    want string
+  }{
+    { filename, "alice,cw5,\n" },
+    { filename + "~", "alice,cw4,\n" },
+    { filename + "~2", "alice,cw3,\n" },
+    { filename + "~3", "alice,cw2,\n" },
+  }
+  for _, tc := range tests {
+    if got := readFile(t, tc.filename); got != tc.want {
+      t.Errorf("%s: got %q, want %q", filepath.Base(tc.filename), got, tc.want)
+    }
+  }
+  if _, err := os.Stat(filename + "~4"); !os.IsNotExist(err) {
+    t.Errorf("only 3 backups should be kept")
+  }
+
+  pw.SetBackups(0)
+  pw.SetSaltword("alice", "cw6")
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving password file without backup: %v", err)
+  }
+  if got, want := readFile(t, filename + "~"), "alice,cw4,\n"; got != want {
+    t.Errorf("backup should not change with backups disabled: got %q, want %q", got, want)
+  }
+}
+
+func TestSaveInterrupted(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "pw.txt")
+  if err := ioutil.WriteFile(filename, []byte("alice,cw1,\n"), 0600); err != nil {
+    t.Fatalf("error writing password file: %v", err)
+  }
+  pw := NewPwFile(filename)
+  if err := pw.Load(); err != nil {
+    t.Fatalf("error loading password file: %v", err)
+  }
+  pw.SetSaltword("alice", "cw2")
+
+  // Fail as if the disk filled up while writing the new file.
+  savedSync := syncFile
+  syncFile = func(f *os.File) error { return fmt.Errorf("no space left on device") }
+  err := pw.Save()
+  syncFile = savedSync
+  if err == nil {
+    t.Fatalf("expected error from interrupted save")
+  }
+  if got, want := readFile(t, filename), "alice,cw1,\n"; got != want {
+    t.Errorf("original file after interrupted save: got %q, want %q", got, want)
+  }
+  if _, err := os.Stat(filename + ".new"); !os.IsNotExist(err) {
+    t.Errorf("partial new file should be removed after interrupted save")
+  }
+  if _, err := os.Stat(filename + "~"); !os.IsNotExist(err) {
+    t.Errorf("no backup should be made by an interrupted save")
+  }
+
+  // A stale new file left by a crash should not prevent saving.
+  if err := ioutil.WriteFile(filename + ".new", []byte("partial"), 0644); err != nil {
+    t.Fatalf("error writing stale new file: %v", err)
+  }
+  if err := pw.Save(); err != nil {
+    t.Fatalf("error saving over stale new file: %v", err)
+  }
+  if got, want := readFile(t, filename), "alice,cw2,\n"; got != want {
+    t.Errorf("saved file: got %q, want %q", got, want)
+  }
+  if got, want := readFile(t, filename + "~"), "alice,cw1,\n"; got != want {
+    t.Errorf("backup file: got %q, want %q", got, want)
+  }
+}
+
+func TestLock(t *testing.T) {
+  filename := filepath.Join(t.TempDir(), "pw.txt")
+  pw1 := NewPwFile(filename)
+  pw2 := NewPwFile(filename)
+  if err := pw1.Unlock(); err == nil {
+    t.Errorf("expected error unlocking a file that is not locked")
+  }
+  if err := pw1.Lock(); err != nil {
+    t.Fatalf("error locking password file: %v", err)
+  }
+  locked := make(chan error)
+  go func() {
+    locked <- pw2.Lock()
+  }()
+  select {
+  case <-locked:
+    t.Fatalf("second lock should wait for the first to be released")
+  case <-time.After(50 * time.Millisecond):
+  }
+  if err := pw1.Unlock(); err != nil {
+    t.Fatalf("error unlocking password file: %v", err)
+  }
+  select {
+  case err := <-locked:
+    if err != nil {
+      t.Fatalf("error getting second lock: %v", err)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("timed out waiting for second lock")
+  }
+  if err := pw2.Unlock(); err != nil {
+    t.Errorf("error unlocking second lock: %v", err)
+  }
+}
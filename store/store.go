@@ -1,11 +1,15 @@
 package store
 
 import (
+    "context"
+
+    "github.com/jimmc/auth/permissions"
     "github.com/jimmc/auth/users"
 )
 
 // The Store interface is used by our classes that need to load
 // and save the user/password/premissions data.
+// Its methods can't report errors reading the data; see ContextStore.
 type Store interface {
     Load() error           // Load our data before other operations
     Save() error           // Save our data after other operations
@@ -13,3 +17,38 @@ type Store interface {
     SetSaltword(username, saltword string)  // Set the saltword for a user
     UserCount() int             // Get the number of users in our records
 }
+
+// The AdminStore interface extends Store with the operations needed
+// by tools that manage users. As with SetSaltword, changes made to a
+// file-based store are not persisted until Save is called.
+// Operations on a user that does not exist return an error wrapping
+// users.ErrNoSuchUser.
+type AdminStore interface {
+    Store
+    ListUsers(offset, limit int) ([]*users.User, error)  // Users sorted by id; limit<=0 means all
+    DeleteUser(username string) error         // Remove a user
+    RenameUser(oldname, newname string) error // Change a user's id
+    SetPermissions(username string, perms *permissions.Permissions) error  // Replace a user's permissions
+}
+
+// A Locker is a Store that can be locked against changes by other
+// processes, to make a sequence of Load, changes, and Save atomic.
+type Locker interface {
+    Lock() error        // Wait for and take an exclusive lock
+    Unlock() error      // Release the lock
+}
+
+// A PasswordSetter is a Store that hashes passwords itself, in its own
+// format, rather than storing the saltword calculated by the auth package.
+// A wrapper store may return an error wrapping ErrNotSupported if the
+// store it wraps is not a PasswordSetter.
+type PasswordSetter interface {
+    SetPassword(username, password string) error  // Hash and set the password for a user, adding the user if needed
+}
+
+// An Authenticator is a Store that checks passwords itself, such as by
+// asking a directory server, rather than giving out saltwords to check.
+// The client must send the plain password rather than a hashword.
+type Authenticator interface {
+    Authenticate(ctx context.Context, username, password string) (*users.User, error)  // nil and no error if the credentials are wrong
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+  "errors"
+  "testing"
+
+  "github.com/jimmc/auth/permissions"
+  "github.com/jimmc/auth/users"
+)
+
+// testAdminStore runs the AdminStore operations against an empty store.
+// It is shared by the tests for each of our Store implementations.
+func testAdminStore(t *testing.T, s AdminStore) {
+  t.Helper()
+  for _, id := range []string{"user3", "user1", "user2"} {
+    s.SetSaltword(id, "cw-"+id)
+  }
+  if got, want := s.UserCount(), 3; got != want {
+    t.Fatalf("user count after adding users: got %d, want %d", got, want)
+  }
+
+  uu, err := s.ListUsers(0, 0)
+  if err != nil {
+    t.Fatalf("error listing all users: %v", err)
+  }
+  if got, want := userIds(uu), "user1 user2 user3"; got != want {
+    t.Errorf("list of all users: got %q, want %q", got, want)
+  }
+  uu, err = s.ListUsers(1, 1)
+  if err != nil {
+    t.Fatalf("error listing page of users: %v", err)
+  }
+  if got, want := userIds(uu), "user2"; got != want {
+    t.Errorf("page of users: got %q, want %q", got, want)
+  }
+  uu, err = s.ListUsers(5, 2)
+  if err != nil {
+    t.Fatalf("error listing page past end of users: %v", err)
+  }
+  if got, want := len(uu), 0; got != want {
+    t.Errorf("users past end: got %d, want %d", got, want)
+  }
+
+  if err := s.SetPermissions("user2", permissions.FromString("something")); err != nil {
+    t.Errorf("error setting permissions for user2: %v", err)
+  }
+  if got, want := s.User("user2").HasPermission(CanDoSomething), true; got != want {
+    t.Errorf("user2 permission after SetPermissions: got %v, want %v", got, want)
+  }
+  err = s.SetPermissions("nobody", permissions.FromString("something"))
+  if !errors.Is(err, users.ErrNoSuchUser) {
+    t.Errorf("SetPermissions for missing user: got %v, want %v", err, users.ErrNoSuchUser)
+  }
+
+  if err := s.RenameUser("user2", "user4"); err != nil {
+    t.Errorf("error renaming user2: %v", err)
+  }
+  if s.User("user2") != nil {
+    t.Errorf("user2 should not exist after rename")
+  }
+  u4 := s.User("user4")
+  if u4 == nil {
+    t.Fatalf("user4 should exist after rename")
+  }
+  if got, want := u4.Saltword(), "cw-user2"; got != want {
+    t.Errorf("saltword after rename: got %q, want %q", got, want)
+  }
+  if got, want := u4.HasPermission(CanDoSomething), true; got != want {
+    t.Errorf("permission after rename: got %v, want %v", got, want)
+  }
+  err = s.RenameUser("user1", "user3")
+  if !errors.Is(err, users.ErrUserExists) {
+    t.Errorf("rename onto existing user: got %v, want %v", err, users.ErrUserExists)
+  }
+  err = s.RenameUser("nobody", "user5")
+  if !errors.Is(err, users.ErrNoSuchUser) {
+    t.Errorf("rename of missing user: got %v, want %v", err, users.ErrNoSuchUser)
+  }
+
+  if err := s.DeleteUser("user1"); err != nil {
+    t.Errorf("error deleting user1: %v", err)
+  }
+  if s.User("user1") != nil {
+    t.Errorf("user1 should not exist after delete")
+  }
+  err = s.DeleteUser("user1")
+  if !errors.Is(err, users.ErrNoSuchUser) {
+    t.Errorf("second delete of user1: got %v, want %v", err, users.ErrNoSuchUser)
+  }
+  if got, want := s.UserCount(), 2; got != want {
+    t.Errorf("user count after delete: got %d, want %d", got, want)
+  }
+}
+
+func userIds(uu []*users.User) string {
+  s := ""
+  sep := ""
+  for _, u := range uu {
+    s = s + sep + u.Id()
+    sep = " "
+  }
+  return s
+}
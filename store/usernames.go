@@ -0,0 +1,117 @@
+package store
+
+import (
+  "fmt"
+  "sort"
+  "strings"
+
+  "github.com/jimmc/auth/users"
+)
+
+// A UsernameReport describes how the usernames in a store fit a
+// UsernamePolicy, as a check before the policy is put into use.
+// Renamed users whose saltwords were calculated by the auth package
+// must have their passwords reset, since the username is part of the
+// hashword, so those with saltwords are listed in NeedReset.
+type UsernameReport struct {
+  Renames map[string]string       // Users whose id is not canonical, to their canonical id.
+  Collisions map[string][]string  // Canonical ids shared by more than one user, to those users.
+  Invalid []string                // Users whose canonical id fails the policy's Check.
+  NeedReset []string              // Users in Renames that have a saltword, sorted.
+}
+
+// Err returns an error describing the collisions and renames, or nil
+// if the usernames are all canonical. Invalid usernames are allowed
+// for existing users.
+func (r *UsernameReport) Err() error {
+  var problems []string
+  for id, names := range r.Collisions {
+    problems = append(problems, fmt.Sprintf("%q are all %q", names, id))
+  }
+  for name, id := range r.Renames {
+    problems = append(problems, fmt.Sprintf("%q is not canonical, should be %q", name, id))
+  }
+  sort.Strings(problems)
+  if len(problems) == 0 {
+    return nil
+  }
+  return fmt.Errorf("usernames do not fit policy: %s", strings.Join(problems, "; "))
+}
+
+// usernamePolicyOf returns the username policy of s, or nil if it has
+// none or doesn't say.
+func usernamePolicyOf(s Store) *users.UsernamePolicy {
+  if ps, ok := s.(interface{ UsernamePolicy() *users.UsernamePolicy }); ok {
+    return ps.UsernamePolicy()
+  }
+  return nil
+}
+
+// CheckUsernames reports which users in s do not fit the policy.
+// Since it needs the ids as stored, call it before setting the policy
+// on a PwFile or JSONFile.
+func CheckUsernames(s AdminStore, p *users.UsernamePolicy) (*UsernameReport, error) {
+  uu, err := s.ListUsers(0, 0)
+  if err != nil {
+    return nil, err
+  }
+  report := &UsernameReport{
+    Renames: make(map[string]string),
+    Collisions: make(map[string][]string),
+  }
+  byCanonical := make(map[string][]string)
+  hasSaltword := make(map[string]bool)
+  for _, u := range uu {
+    hasSaltword[u.Id()] = u.Saltword() != ""
+    id := p.Canonical(u.Id())
+    byCanonical[id] = append(byCanonical[id], u.Id())
+    if err := p.Check(id); err != nil {
+      report.Invalid = append(report.Invalid, u.Id())
+    }
+  }
+  for id, names := range byCanonical {
+    if len(names) > 1 {
+      report.Collisions[id] = names
+      continue
+    }
+    if names[0] != id {
+      report.Renames[names[0]] = id
+      if hasSaltword[names[0]] {
+        report.NeedReset = append(report.NeedReset, names[0])
+      }
+    }
+  }
+  sort.Strings(report.NeedReset)
+  return report, nil
+}
+
+// CanonicalizeUsernames renames the users in s to their canonical ids,
+// and returns the report of what was done. If there are collisions, it
+// returns an error without renaming anyone, so that they can be resolved
+// by hand first. Renaming users with saltwords would lock them out until
+// their passwords are reset, so unless allowReset is true it also returns
+// an error without renaming anyone if any are in the report's NeedReset.
+// Call it before setting the policy on s, then Save s.
+func CanonicalizeUsernames(s AdminStore, p *users.UsernamePolicy, allowReset bool) (*UsernameReport, error) {
+  report, err := CheckUsernames(s, p)
+  if err != nil {
+    return nil, err
+  }
+  if len(report.Collisions) > 0 {
+    return report, report.Err()
+  }
+  if len(report.NeedReset) > 0 && !allowReset {
+    return report, fmt.Errorf("renaming %q would require resetting their passwords", report.NeedReset)
+  }
+  names := make([]string, 0, len(report.Renames))
+  for name := range report.Renames {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    if err := s.RenameUser(name, report.Renames[name]); err != nil {
+      return report, err
+    }
+  }
+  return report, nil
+}
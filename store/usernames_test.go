@@ -0,0 +1,140 @@
+package store
+
+import (
+  "errors"
+  "io/ioutil"
+  "os"
+  "strings"
+  "testing"
+
+  "github.com/jimmc/auth/users"
+)
+
+func TestCheckUsernames(t *testing.T) {
+  pf := newExportTestPwFile(t, "Alice,cw1,\nALICE,cw2,\nBob,cw3,\ncarol,cw4,\nbad name,cw5,\n")
+  report, err := CheckUsernames(pf, users.NewUsernamePolicy())
+  if err != nil {
+    t.Fatalf("error checking usernames: %v", err)
+  }
+  if got, want := len(report.Collisions["alice"]), 2; got != want {
+    t.Errorf("collisions for alice: got %v, want %d users", report.Collisions, want)
+  }
+  if got, want := report.Renames["Bob"], "bob"; got != want {
+    t.Errorf("rename for Bob: got %q, want %q", got, want)
+  }
+  if got, want := len(report.Renames), 1; got != want {
+    t.Errorf("renames: got %v, want %d", report.Renames, want)
+  }
+  if got, want := len(report.NeedReset), 1; got != want || report.NeedReset[0] != "Bob" {
+    t.Errorf("need reset: got %v, want [Bob]", report.NeedReset)
+  }
+  if got, want := len(report.Invalid), 1; got != want || report.Invalid[0] != "bad name" {
+    t.Errorf("invalid: got %v, want [bad name]", report.Invalid)
+  }
+  if report.Err() == nil {
+    t.Errorf("expected error from report with collisions")
+  }
+  if _, err := CanonicalizeUsernames(pf, users.NewUsernamePolicy(), true); err == nil {
+    t.Errorf("expected error canonicalizing usernames with collisions")
+  }
+  if pf.User("Bob") == nil {
+    t.Errorf("no users should be renamed when there are collisions")
+  }
+  if err := pf.SetUsernamePolicy(users.NewUsernamePolicy()); !errors.Is(err, users.ErrUserExists) {
+    t.Errorf("set policy with collisions: got %v, want %v", err, users.ErrUserExists)
+  }
+}
+
+func TestPwFileUsernamePolicy(t *testing.T) {
+  pf := newExportTestPwFile(t, "# Users\nAlice,cw1,edit\nbob,cw2,\n")
+  if err := pf.SetUsernamePolicy(users.NewUsernamePolicy()); err != nil {
+    t.Fatalf("error setting username policy: %v", err)
+  }
+  if u := pf.User(" ALICE"); u == nil || u.Id() != "alice" {
+    t.Errorf("alice by canonical lookup: got %v", u)
+  }
+  pf.SetSaltword("Bob", "cw3")
+  if err := pf.RenameUser("ALICE", "Carl"); err != nil {
+    t.Fatalf("error renaming alice: %v", err)
+  }
+  if err := pf.Save(); err != nil {
+    t.Fatalf("error saving password file: %v", err)
+  }
+  b, err := ioutil.ReadFile(pf.filename)
+  if err != nil {
+    t.Fatalf("error reading password file: %v", err)
+  }
+  if got, want := string(b), "# Users\ncarl,cw1,edit\nbob,cw3,\n"; got != want {
+    t.Errorf("saved password file: got %q, want %q", got, want)
+  }
+}
+
+func TestPwDBUsernamePolicy(t *testing.T) {
+  dbloc := "/tmp/pwdb-usernames.db"
+  db := openTestDB(t, dbloc)
+  defer os.Remove(dbloc)
+  defer db.Close()
+  pdb := NewPwDB(db)
+  if err := pdb.CreatePasswordTable(); err != nil {
+    t.Fatalf("error creating password table: %v", err)
+  }
+  pdb.SetSaltword("Alice", "cw1")
+  pdb.SetSaltword("bob", "cw2")
+
+  pdb.SetUsernamePolicy(users.NewUsernamePolicy())
+  if err := pdb.Load(); err == nil {
+    t.Errorf("expected error loading with non-canonical username")
+  }
+  pdb.SetUsernamePolicy(nil)
+  // Alice's saltword was calculated from "Alice", so she would be locked out.
+  if _, err := CanonicalizeUsernames(pdb, users.NewUsernamePolicy(), false); err == nil {
+    t.Errorf("expected error renaming user with saltword")
+  }
+  if pdb.User("Alice") == nil {
+    t.Errorf("Alice should not be renamed without allowReset")
+  }
+  report, err := CanonicalizeUsernames(pdb, users.NewUsernamePolicy(), true)
+  if err != nil {
+    t.Fatalf("error canonicalizing usernames: %v", err)
+  }
+  if got, want := report.Renames["Alice"], "alice"; got != want {
+    t.Errorf("rename for Alice: got %q, want %q", got, want)
+  }
+  if got, want := strings.Join(report.NeedReset, " "), "Alice"; got != want {
+    t.Errorf("users needing reset: got %q, want %q", got, want)
+  }
+
+  pdb.SetUsernamePolicy(users.NewUsernamePolicy())
+  if err := pdb.Load(); err != nil {
+    t.Fatalf("error loading with canonical usernames: %v", err)
+  }
+  if u := pdb.User("ALICE"); u == nil || u.Saltword() != "cw1" {
+    t.Errorf("alice by canonical lookup: got %v", u)
+  }
+  pdb.SetSaltword("BOB", "cw3")
+  if got, want := pdb.UserCount(), 2; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+  if got, want := pdb.User("bob").Saltword(), "cw3"; got != want {
+    t.Errorf("bob saltword: got %q, want %q", got, want)
+  }
+
+  // The ids are checked once after the policy is set, not on every Load.
+  if _, err := db.Exec(pdb.queries().upsertSaltword(), "Carol", "cw4", ""); err != nil {
+    t.Fatalf("error adding non-canonical user: %v", err)
+  }
+  if err := pdb.Load(); err != nil {
+    t.Errorf("error reloading after the check passed: %v", err)
+  }
+  report, err = CheckUsernames(pdb, pdb.UsernamePolicy())
+  if err != nil {
+    t.Fatalf("error checking usernames: %v", err)
+  }
+  if got, want := report.Renames["Carol"], "carol"; got != want {
+    t.Errorf("rename for Carol: got %q, want %q", got, want)
+  }
+  pdb.SetUsernamePolicy(users.NewUsernamePolicy())
+  if err := pdb.Load(); err == nil {
+    t.Errorf("expected error loading after setting the policy again")
+  }
+}
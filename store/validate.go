@@ -0,0 +1,50 @@
+package store
+
+import (
+  "fmt"
+
+  "github.com/golang/glog"
+
+  "github.com/jimmc/auth/permissions"
+)
+
+// Validation controls what a store does when it loads permissions
+// that are not in the permissions catalog.
+type Validation int
+
+const (
+  ValidateNone Validation = iota        // Accept all permissions
+  ValidateWarn                          // Log a warning for unregistered permissions
+  ValidateFail                          // Fail the load for unregistered permissions
+)
+
+// validatePermissions checks perms against the permissions catalog
+// according to mode. The where string identifies the permissions in
+// messages, such as `user "joe"`.
+func validatePermissions(mode Validation, where string, perms *permissions.Permissions) error {
+  if mode == ValidateNone {
+    return nil
+  }
+  err := permissions.CheckRegistered(perms)
+  if err == nil {
+    return nil
+  }
+  if mode == ValidateWarn {
+    glog.Warningf("%s has %v", where, err)
+    return nil
+  }
+  return fmt.Errorf("%s has %v", where, err)
+}
+
+// validateRoles checks the permissions of each role.
+func validateRoles(mode Validation, roles *permissions.Roles) error {
+  if roles == nil {
+    return nil
+  }
+  for _, name := range roles.Names() {
+    if err := validatePermissions(mode, fmt.Sprintf("role %q", name), roles.Role(name)); err != nil {
+      return err
+    }
+  }
+  return nil
+}
@@ -1,13 +1,22 @@
 package users
 
 import (
+  "sort"
+  "strings"
+
   "github.com/jimmc/auth/permissions"
 )
 
+// DisabledPrefix is prepended to the saltword of a disabled account,
+// in the same way as a Unix shadow password file, so that no hashword
+// can match it. Removing the prefix restores the original password.
+const DisabledPrefix = "!"
+
 type User struct {
   username string
   saltword string
   perms *permissions.Permissions
+  metadata map[string]string    // Optional data such as a display name, may be nil.
 }
 
 func NewUser(username, saltword string, perms *permissions.Permissions) *User {
@@ -26,6 +35,11 @@ func (u *User) SetSaltword(saltword string) {
   u.saltword = saltword
 }
 
+// Disabled returns true if the account has been disabled.
+func (u *User) Disabled() bool {
+  return strings.HasPrefix(u.saltword, DisabledPrefix)
+}
+
 func (u *User) Id() string {
   return u.username
 }
@@ -48,3 +62,34 @@ func (u *User) Permissions() *permissions.Permissions {
   return u.perms
 }
 
+func (u *User) SetPermissions(perms *permissions.Permissions) {
+  u.perms = perms
+}
+
+
+// Metadata returns the value stored for key, or the empty string.
+func (u *User) Metadata(key string) string {
+  return u.metadata[key]
+}
+
+// SetMetadata stores value for key. An empty value removes the key.
+func (u *User) SetMetadata(key, value string) {
+  if value == "" {
+    delete(u.metadata, key)
+    return
+  }
+  if u.metadata == nil {
+    u.metadata = make(map[string]string)
+  }
+  u.metadata[key] = value
+}
+
+// MetadataKeys returns the keys that have metadata, in sorted order.
+func (u *User) MetadataKeys() []string {
+  keys := make([]string, 0, len(u.metadata))
+  for key := range u.metadata {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
@@ -0,0 +1,111 @@
+package users
+
+import (
+  "errors"
+  "fmt"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+
+  "golang.org/x/text/cases"
+  "golang.org/x/text/unicode/norm"
+
+  "github.com/jimmc/auth/permissions"
+)
+
+// ErrInvalidUsername is returned for a username that is not allowed by
+// a UsernamePolicy.
+var ErrInvalidUsername = errors.New("invalid username")
+
+// A UsernamePolicy says how usernames are put into canonical form, so
+// that names that look the same, such as "Alice" and "alice", refer to
+// the same account. A nil *UsernamePolicy leaves usernames unchanged.
+// The canonical form is used as the user's id, and in the hashword, so
+// clients must send the canonical username, or canonicalize it in the
+// same way before calculating the hashword.
+type UsernamePolicy struct {
+  TrimSpace bool                // Remove leading and trailing white space.
+  Normalize bool                // Apply Unicode NFKC normalization.
+  FoldCase bool                 // Apply Unicode case folding.
+  Allowed func(r rune) bool     // Characters allowed in new usernames, or nil for any.
+  MaxLength int                 // Maximum length in characters of new usernames, or 0 for no limit.
+}
+
+// NewUsernamePolicy returns the recommended policy, which trims,
+// normalizes and case-folds usernames, and allows the characters
+// accepted by IsUsernameChar, up to 64 of them.
+func NewUsernamePolicy() *UsernamePolicy {
+  return &UsernamePolicy{
+    TrimSpace: true,
+    Normalize: true,
+    FoldCase: true,
+    Allowed: IsUsernameChar,
+    MaxLength: 64,
+  }
+}
+
+// IsUsernameChar returns true for letters, digits, and the punctuation
+// commonly found in usernames and email addresses: . _ - + @
+func IsUsernameChar(r rune) bool {
+  return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-+@", r)
+}
+
+// Canonical returns the canonical form of a username. It is idempotent,
+// so canonical names can be passed through it again.
+func (p *UsernamePolicy) Canonical(username string) string {
+  if p == nil {
+    return username
+  }
+  if p.TrimSpace {
+    username = strings.TrimSpace(username)
+  }
+  if p.Normalize {
+    username = norm.NFKC.String(username)
+  }
+  if p.FoldCase {
+    // Folding can denormalize, so normalize again.
+    username = cases.Fold().String(username)
+    if p.Normalize {
+      username = norm.NFKC.String(username)
+    }
+  }
+  return username
+}
+
+// CanonicalPrincipal returns the canonical form of a principal in an
+// access rule, such as an acl grant or a policy rule, so that a rule for
+// "Alice" applies to the user "alice". Roles in the form @rolename and
+// "*" for every user are returned unchanged.
+func (p *UsernamePolicy) CanonicalPrincipal(principal string) string {
+  if principal == "*" {
+    return principal
+  }
+  if _, isRole := permissions.RoleName(permissions.Permission(principal)); isRole {
+    return principal
+  }
+  return p.Canonical(principal)
+}
+
+// Check returns an error wrapping ErrInvalidUsername if the canonical
+// form of username is empty or is not allowed by the policy. It is used
+// when creating users; existing users are found by Canonical alone.
+func (p *UsernamePolicy) Check(username string) error {
+  canonical := p.Canonical(username)
+  if canonical == "" {
+    return fmt.Errorf("empty username: %w", ErrInvalidUsername)
+  }
+  if p == nil {
+    return nil
+  }
+  if p.MaxLength > 0 && utf8.RuneCountInString(canonical) > p.MaxLength {
+    return fmt.Errorf("username %q is longer than %d characters: %w", canonical, p.MaxLength, ErrInvalidUsername)
+  }
+  if p.Allowed != nil {
+    for _, r := range canonical {
+      if !p.Allowed(r) {
+        return fmt.Errorf("username %q has disallowed character %q: %w", canonical, r, ErrInvalidUsername)
+      }
+    }
+  }
+  return nil
+}
@@ -1,13 +1,21 @@
 package users
 
 import (
+  "errors"
+  "fmt"
   "sort"
 
   "github.com/jimmc/auth/permissions"
 )
 
+var (
+  ErrNoSuchUser = errors.New("no such user")
+  ErrUserExists = errors.New("user already exists")
+)
+
 type Users struct {
-  users map[string]*User
+  users map[string]*User      // By canonical username.
+  policy *UsernamePolicy
 }
 
 func NewUsers(users map[string]*User) *Users {
@@ -20,6 +28,27 @@ func Empty() *Users {
   return NewUsers(make(map[string]*User))
 }
 
+// SetUsernamePolicy sets the policy used to canonicalize usernames, and
+// changes the ids of our users to their canonical form. If two users
+// have the same canonical form, it returns an error wrapping
+// ErrUserExists and leaves the users unchanged.
+func (m *Users) SetUsernamePolicy(p *UsernamePolicy) error {
+  canonical := make(map[string]*User)
+  for _, user := range m.ToArray() {
+    id := p.Canonical(user.username)
+    if other := canonical[id]; other != nil {
+      return fmt.Errorf("usernames %q and %q are both %q: %w", other.username, user.username, id, ErrUserExists)
+    }
+    canonical[id] = user
+  }
+  for id, user := range canonical {
+    user.username = id
+  }
+  m.users = canonical
+  m.policy = p
+  return nil
+}
+
 func (m *Users) UserCount() int {
   return len(m.users)
 }
@@ -37,7 +66,25 @@ func (m *Users) ToArray() []*User {
   return ua
 }
 
+// Page returns up to limit users sorted by username, starting at offset.
+// A limit of zero or less means no limit.
+func (m *Users) Page(offset, limit int) []*User {
+  ua := m.ToArray()
+  if offset < 0 {
+    offset = 0
+  }
+  if offset >= len(ua) {
+    return []*User{}
+  }
+  ua = ua[offset:]
+  if limit > 0 && limit < len(ua) {
+    ua = ua[:limit]
+  }
+  return ua
+}
+
 func (m *Users) AddUser(username, saltword string, perms *permissions.Permissions) {
+  username = m.policy.Canonical(username)
   user := &User{
     username: username,
     saltword: saltword,
@@ -47,7 +94,7 @@ func (m *Users) AddUser(username, saltword string, perms *permissions.Permission
 }
 
 func (m *Users) User(username string) *User {
-  return m.users[username]
+  return m.users[m.policy.Canonical(username)]
 }
 
 func (m *Users) SetSaltword(username, saltword string) {
@@ -59,6 +106,54 @@ func (m *Users) SetSaltword(username, saltword string) {
   }
 }
 
+// SetRoles sets the roles used to resolve role permissions for all of our users.
+func (m *Users) SetRoles(roles *permissions.Roles) {
+  for _, user := range m.users {
+    if user.perms != nil {
+      user.perms.SetRoles(roles)
+    }
+  }
+}
+
+// DeleteUser removes a user, returning ErrNoSuchUser if there is no such user.
+func (m *Users) DeleteUser(username string) error {
+  if m.User(username) == nil {
+    return fmt.Errorf("can't delete %q: %w", username, ErrNoSuchUser)
+  }
+  delete(m.users, m.policy.Canonical(username))
+  return nil
+}
+
+// RenameUser changes the id of a user, keeping the saltword and permissions.
+// The new username must not already be in use.
+func (m *Users) RenameUser(oldname, newname string) error {
+  user := m.User(oldname)
+  if user == nil {
+    return fmt.Errorf("can't rename %q: %w", oldname, ErrNoSuchUser)
+  }
+  oldname, newname = m.policy.Canonical(oldname), m.policy.Canonical(newname)
+  if oldname == newname {
+    return nil
+  }
+  if m.User(newname) != nil {
+    return fmt.Errorf("can't rename %q to %q: %w", oldname, newname, ErrUserExists)
+  }
+  delete(m.users, oldname)
+  user.username = newname
+  m.users[newname] = user
+  return nil
+}
+
+// SetPermissions replaces the permissions of an existing user.
+func (m *Users) SetPermissions(username string, perms *permissions.Permissions) error {
+  user := m.User(username)
+  if user == nil {
+    return fmt.Errorf("can't set permissions for %q: %w", username, ErrNoSuchUser)
+  }
+  user.SetPermissions(perms)
+  return nil
+}
+
 func (m *Users) Saltword(username string) string {
   user := m.User(username)
   if user == nil {
@@ -1,6 +1,8 @@
 package users
 
 import (
+  "errors"
+  "strings"
   "testing"
 
   "github.com/jimmc/auth/permissions"
@@ -74,3 +76,158 @@ func TestUserData(t *testing.T) {
     t.Errorf("wrong updated saltword for user3: got %q, want %q", got, want)
   }
 }
+
+func TestUserMutations(t *testing.T) {
+  uu := Empty()
+  uu.SetSaltword("user1", "foo")
+  uu.SetSaltword("user2", "bar")
+  if got, want := len(uu.Page(1, 0)), 1; got != want {
+    t.Errorf("page length: got %d, want %d", got, want)
+  }
+  if err := uu.RenameUser("user1", "user3"); err != nil {
+    t.Errorf("error renaming user1: %v", err)
+  }
+  if got, want := uu.Saltword("user3"), "foo"; got != want {
+    t.Errorf("saltword for renamed user: got %q, want %q", got, want)
+  }
+  if err := uu.RenameUser("user3", "user2"); !errors.Is(err, ErrUserExists) {
+    t.Errorf("rename onto existing user: got %v, want %v", err, ErrUserExists)
+  }
+  if err := uu.SetPermissions("user2", permissions.FromString("something")); err != nil {
+    t.Errorf("error setting permissions: %v", err)
+  }
+  if got, want := uu.HasPermission("user2", CanDoSomething), true; got != want {
+    t.Errorf("permission after SetPermissions: got %v, want %v", got, want)
+  }
+  if err := uu.DeleteUser("user2"); err != nil {
+    t.Errorf("error deleting user2: %v", err)
+  }
+  if err := uu.DeleteUser("user2"); !errors.Is(err, ErrNoSuchUser) {
+    t.Errorf("delete of missing user: got %v, want %v", err, ErrNoSuchUser)
+  }
+  if got, want := uu.UserCount(), 1; got != want {
+    t.Errorf("user count after delete: got %d, want %d", got, want)
+  }
+}
+
+func TestDisabled(t *testing.T) {
+  u := NewUser("user1", "abc", nil)
+  if got, want := u.Disabled(), false; got != want {
+    t.Errorf("disabled for normal user: got %v, want %v", got, want)
+  }
+  u.SetSaltword(DisabledPrefix + "abc")
+  if got, want := u.Disabled(), true; got != want {
+    t.Errorf("disabled for disabled user: got %v, want %v", got, want)
+  }
+}
+
+func TestMetadata(t *testing.T) {
+  u := NewUser("user1", "abc", nil)
+  if got, want := u.Metadata("email"), ""; got != want {
+    t.Errorf("metadata before set: got %q, want %q", got, want)
+  }
+  u.SetMetadata("name", "User One")
+  u.SetMetadata("email", "user1@example.com")
+  if got, want := u.Metadata("email"), "user1@example.com"; got != want {
+    t.Errorf("metadata after set: got %q, want %q", got, want)
+  }
+  if got, want := strings.Join(u.MetadataKeys(), " "), "email name"; got != want {
+    t.Errorf("metadata keys: got %q, want %q", got, want)
+  }
+  u.SetMetadata("email", "")
+  if got, want := strings.Join(u.MetadataKeys(), " "), "name"; got != want {
+    t.Errorf("metadata keys after removing email: got %q, want %q", got, want)
+  }
+}
+
+func TestUsernamePolicy(t *testing.T) {
+  p := NewUsernamePolicy()
+  tests := []struct{
+    username string
+    canonical string
+    valid bool
+  }{
+    { "alice", "alice", true },
+    { " Alice ", "alice", true },
+    { "ＡＬＩＣＥ", "alice", true },       // Fullwidth letters
+    { "Straße", "strasse", true },
+    { "bob.smith+test@example.com", "bob.smith+test@example.com", true },
+    { "bob smith", "bob smith", false },
+    { "bob/smith", "bob/smith", false },
+    { "  ", "", false },
+    { strings.Repeat("x", 65), strings.Repeat("x", 65), false },
+  }
+  for _, tc := range tests {
+    if got, want := p.Canonical(tc.username), tc.canonical; got != want {
+      t.Errorf("canonical %q: got %q, want %q", tc.username, got, want)
+    }
+    if got, want := p.Canonical(p.Canonical(tc.username)), tc.canonical; got != want {
+      t.Errorf("canonical of canonical %q: got %q, want %q", tc.username, got, want)
+    }
+    err := p.Check(tc.username)
+    if got, want := err == nil, tc.valid; got != want {
+      t.Errorf("check %q: got %v, want valid=%v", tc.username, err, want)
+    }
+    if err != nil && !errors.Is(err, ErrInvalidUsername) {
+      t.Errorf("check %q: got %v, want %v", tc.username, err, ErrInvalidUsername)
+    }
+  }
+  var exact *UsernamePolicy
+  if got, want := exact.Canonical(" Alice "), " Alice "; got != want {
+    t.Errorf("nil policy canonical: got %q, want %q", got, want)
+  }
+  if err := exact.Check(" Alice "); err != nil {
+    t.Errorf("nil policy check: %v", err)
+  }
+  for principal, want := range map[string]string{
+    "Alice": "alice",
+    "@Admins": "@Admins",
+    "*": "*",
+  } {
+    if got := p.CanonicalPrincipal(principal); got != want {
+      t.Errorf("canonical principal %q: got %q, want %q", principal, got, want)
+    }
+  }
+}
+
+func TestUsersUsernamePolicy(t *testing.T) {
+  m := Empty()
+  m.AddUser("Alice", "cw1", permissions.FromString(""))
+  m.AddUser("bob", "cw2", permissions.FromString(""))
+  if m.User("alice") != nil {
+    t.Errorf("lookup should be exact before setting a policy")
+  }
+  if err := m.SetUsernamePolicy(NewUsernamePolicy()); err != nil {
+    t.Fatalf("error setting username policy: %v", err)
+  }
+  alice := m.User("ALICE")
+  if alice == nil {
+    t.Fatalf("expected to find alice by ALICE")
+  }
+  if got, want := alice.Id(), "alice"; got != want {
+    t.Errorf("alice id: got %q, want %q", got, want)
+  }
+  m.SetSaltword("Bob", "cw3")
+  if got, want := m.Saltword("bob"), "cw3"; got != want {
+    t.Errorf("bob saltword: got %q, want %q", got, want)
+  }
+  if got, want := m.UserCount(), 2; got != want {
+    t.Errorf("user count: got %d, want %d", got, want)
+  }
+  if err := m.RenameUser("BOB", "Carol"); err != nil {
+    t.Fatalf("error renaming bob: %v", err)
+  }
+  if m.User("carol") == nil || m.User("bob") != nil {
+    t.Errorf("rename should use canonical names")
+  }
+
+  m2 := Empty()
+  m2.AddUser("Alice", "cw1", nil)
+  m2.AddUser("alice", "cw2", nil)
+  if err := m2.SetUsernamePolicy(NewUsernamePolicy()); !errors.Is(err, ErrUserExists) {
+    t.Errorf("colliding usernames: got %v, want %v", err, ErrUserExists)
+  }
+  if m2.User("Alice") == nil || m2.User("alice") == nil {
+    t.Errorf("users should be unchanged after a collision")
+  }
+}